@@ -0,0 +1,201 @@
+package resolve
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+)
+
+// sortAddrs sorts addrs so that the best one to connect to comes first, by
+// the destination address selection rules of RFC 6724, section 6. The
+// source address for each destination is the one the system would use to
+// reach it.
+func sortAddrs(addrs []netip.Addr) {
+	sortAddrsFrom(addrs, sourceAddrs(addrs))
+}
+
+// sourceAddrs returns the source address the system would use for each of
+// dsts, or the zero Addr if it has no route to one. No packets are sent.
+func sourceAddrs(dsts []netip.Addr) []netip.Addr {
+	srcs := make([]netip.Addr, len(dsts))
+	for i, dst := range dsts {
+		conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(dst, 9)))
+		if err != nil {
+			continue
+		}
+		srcs[i] = conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr()
+		conn.Close()
+	}
+	return srcs
+}
+
+// sortAddrsFrom is like sortAddrs, but takes the source address for each
+// destination: srcs[i] is the one for dsts[i].
+//
+// Rules 3, 4 and 7, which need to know about deprecated addresses, home
+// addresses and encapsulation, are skipped. As in most implementations,
+// rule 9 only applies to IPv6 addresses, since longest matching prefix
+// makes little sense for IPv4 (RFC 6724 erratum 4069 discusses this).
+func sortAddrsFrom(dsts, srcs []netip.Addr) {
+	type candidate struct {
+		dst, src     netip.Addr
+		dstAttr      addrAttr
+		srcAttr      addrAttr
+		usable       bool
+		commonPrefix int
+	}
+	cands := make([]candidate, len(dsts))
+	for i, dst := range dsts {
+		dst = dst.Unmap()
+		src := srcs[i].Unmap()
+		c := candidate{dst: dst, src: src, dstAttr: attrOf(dst), usable: src.IsValid()}
+		if c.usable {
+			c.srcAttr = attrOf(src)
+			if dst.Is6() && src.Is6() {
+				c.commonPrefix = commonPrefixLen(dst, src)
+			}
+		}
+		cands[i] = c
+	}
+
+	sort.SliceStable(cands, func(i, j int) bool {
+		a, b := &cands[i], &cands[j]
+
+		// Rule 1: Avoid unusable destinations.
+		if a.usable != b.usable {
+			return a.usable
+		}
+		if !a.usable {
+			return false
+		}
+
+		// Rule 2: Prefer matching scope.
+		aMatch, bMatch := a.dstAttr.scope == a.srcAttr.scope, b.dstAttr.scope == b.srcAttr.scope
+		if aMatch != bMatch {
+			return aMatch
+		}
+
+		// Rule 5: Prefer matching label.
+		aMatch, bMatch = a.dstAttr.label == a.srcAttr.label, b.dstAttr.label == b.srcAttr.label
+		if aMatch != bMatch {
+			return aMatch
+		}
+
+		// Rule 6: Prefer higher precedence.
+		if a.dstAttr.precedence != b.dstAttr.precedence {
+			return a.dstAttr.precedence > b.dstAttr.precedence
+		}
+
+		// Rule 8: Prefer smaller scope.
+		if a.dstAttr.scope != b.dstAttr.scope {
+			return a.dstAttr.scope < b.dstAttr.scope
+		}
+
+		// Rule 9: Use longest matching prefix.
+		if a.dst.Is6() && b.dst.Is6() && a.commonPrefix != b.commonPrefix {
+			return a.commonPrefix > b.commonPrefix
+		}
+
+		// Rule 10: Otherwise, leave the order unchanged.
+		return false
+	})
+
+	for i, c := range cands {
+		dsts[i] = c.dst
+	}
+}
+
+// An addrAttr holds the properties of an address that RFC 6724 sorts by.
+type addrAttr struct {
+	scope      addrScope
+	precedence uint8
+	label      uint8
+}
+
+func attrOf(addr netip.Addr) addrAttr {
+	policy := policyOf(addr)
+	return addrAttr{scope: scopeOf(addr), precedence: policy.precedence, label: policy.label}
+}
+
+// An addrScope is the scope of an address (RFC 4291, section 2.7).
+type addrScope uint8
+
+const (
+	scopeLinkLocal addrScope = 0x2
+	scopeSiteLocal addrScope = 0x5
+	scopeGlobal    addrScope = 0xe
+)
+
+// scopeOf returns the scope of addr. IPv4 loopback and link-local addresses
+// have link-local scope, and other IPv4 addresses, even private ones, have
+// global scope (RFC 6724, section 3.2).
+func scopeOf(addr netip.Addr) addrScope {
+	if addr.Is4() {
+		if addr.IsLoopback() || addr.IsLinkLocalUnicast() {
+			return scopeLinkLocal
+		}
+		return scopeGlobal
+	}
+	b := addr.As16()
+	switch {
+	case addr.IsMulticast():
+		return addrScope(b[1] & 0xf)
+	case addr.IsLoopback(), addr.IsLinkLocalUnicast():
+		return scopeLinkLocal
+	case b[0] == 0xfe && b[1]&0xc0 == 0xc0: // fec0::/10, deprecated site-local.
+		return scopeSiteLocal
+	default:
+		return scopeGlobal
+	}
+}
+
+// A policy is an entry in the policy table of RFC 6724, section 2.1.
+type policy struct {
+	prefix     netip.Prefix
+	precedence uint8
+	label      uint8
+}
+
+// policyTable is the default policy table, longest prefixes first.
+var policyTable = []policy{
+	{netip.MustParsePrefix("::1/128"), 50, 0},
+	{netip.MustParsePrefix("::ffff:0:0/96"), 35, 4},
+	{netip.MustParsePrefix("::/96"), 1, 3},
+	{netip.MustParsePrefix("2001::/32"), 5, 5},
+	{netip.MustParsePrefix("2002::/16"), 30, 2},
+	{netip.MustParsePrefix("3ffe::/16"), 1, 12},
+	{netip.MustParsePrefix("fec0::/10"), 1, 11},
+	{netip.MustParsePrefix("fc00::/7"), 3, 13},
+	{netip.MustParsePrefix("::/0"), 40, 1},
+}
+
+// policyOf returns the entry in policyTable for addr. IPv4 addresses are
+// looked up as IPv4-mapped IPv6 addresses.
+func policyOf(addr netip.Addr) policy {
+	addr = netip.AddrFrom16(addr.As16())
+	for _, p := range policyTable {
+		if p.prefix.Contains(addr) {
+			return p
+		}
+	}
+	return policyTable[len(policyTable)-1]
+}
+
+// commonPrefixLen returns the length of the longest prefix that a and b,
+// both IPv6 addresses, have in common, up to the 64 bits of the usual
+// network prefix.
+func commonPrefixLen(a, b netip.Addr) int {
+	x, y := a.As16(), b.As16()
+	n := 0
+	for i := 0; i < 8; i++ {
+		if x[i] == y[i] {
+			n += 8
+			continue
+		}
+		for d := x[i] ^ y[i]; d&0x80 == 0; d <<= 1 {
+			n++
+		}
+		break
+	}
+	return n
+}
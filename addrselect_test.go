@@ -0,0 +1,97 @@
+package resolve
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSortAddrsFrom(t *testing.T) {
+	addrs := func(ss ...string) []netip.Addr {
+		var out []netip.Addr
+		for _, s := range ss {
+			if s == "" {
+				out = append(out, netip.Addr{})
+			} else {
+				out = append(out, netip.MustParseAddr(s))
+			}
+		}
+		return out
+	}
+
+	tests := []struct {
+		name       string
+		dsts, srcs []netip.Addr
+		want       []netip.Addr
+	}{
+		{
+			name: "unusable last",
+			dsts: addrs("2001:db8::1", "198.51.100.121"),
+			srcs: addrs("", "169.254.13.78"),
+			want: addrs("198.51.100.121", "2001:db8::1"),
+		},
+		// The examples of RFC 6724, section 10.2.
+		{
+			name: "prefer matching scope",
+			dsts: addrs("2001:db8:1::1", "198.51.100.121"),
+			srcs: addrs("fe80::1", "198.51.100.117"),
+			want: addrs("198.51.100.121", "2001:db8:1::1"),
+		},
+		{
+			name: "prefer higher precedence",
+			dsts: addrs("198.51.100.121", "2001:db8:1::1"),
+			srcs: addrs("198.51.100.117", "2001:db8:1::2"),
+			want: addrs("2001:db8:1::1", "198.51.100.121"),
+		},
+		{
+			name: "prefer smaller scope",
+			dsts: addrs("2001:db8:1::1", "fe80::1"),
+			srcs: addrs("2001:db8:1::2", "fe80::2"),
+			want: addrs("fe80::1", "2001:db8:1::1"),
+		},
+		{
+			name: "prefer matching label",
+			dsts: addrs("2001:db8:1::1", "10.1.2.3"),
+			srcs: addrs("2002:c633:6401::2", "10.1.2.4"),
+			want: addrs("10.1.2.3", "2001:db8:1::1"),
+		},
+		{
+			name: "use longest matching prefix",
+			dsts: addrs("2001:db8:3ffe::1", "2001:db8:1::1"),
+			srcs: addrs("2001:db8:3f44::2", "2001:db8:1::2"),
+			want: addrs("2001:db8:1::1", "2001:db8:3ffe::1"),
+		},
+		{
+			name: "IPv4 order unchanged",
+			dsts: addrs("198.51.100.1", "203.0.113.1"),
+			srcs: addrs("203.0.113.2", "203.0.113.2"),
+			want: addrs("198.51.100.1", "203.0.113.1"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := append([]netip.Addr(nil), tt.dsts...)
+			sortAddrsFrom(got, tt.srcs)
+			if diff := cmp.Diff(tt.want, got, cmpAddr); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCommonPrefixLen(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"2001:db8::1", "2001:db8::1", 64},
+		{"2001:db8:1::1", "2001:db8:3ffe::1", 34},
+		{"2001:db8::1", "fe80::1", 0},
+	}
+	for _, tt := range tests {
+		if got := commonPrefixLen(netip.MustParseAddr(tt.a), netip.MustParseAddr(tt.b)); got != tt.want {
+			t.Errorf("commonPrefixLen(%s, %s) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
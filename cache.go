@@ -0,0 +1,575 @@
+package resolve
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A CacheKey identifies the records a cache entry answers: those of a
+// type and class for a name.
+type CacheKey struct {
+	Name  string // In lower case, without a trailing dot.
+	Type  Type
+	Class Class
+}
+
+// newCacheKey returns the key for a question about domain, t and class.
+func newCacheKey(domain string, t Type, class Class) CacheKey {
+	return CacheKey{Name: strings.ToLower(strings.TrimSuffix(domain, ".")), Type: t, Class: class}
+}
+
+// A CacheEntry is a cached response.
+type CacheEntry struct {
+	Response *Packet
+	Stored   time.Time // When Response was received.
+	Expires  time.Time // When Response must no longer be used.
+
+	// Hits is how many times the entry has been looked up before it
+	// expired.
+	Hits int
+
+	// StaleUntil, if later than Expires, is when Response must no longer
+	// be served stale; see Resolver.MaxStale. Caches should keep the
+	// entry until then.
+	StaleUntil time.Time
+}
+
+// expired reports whether e can no longer be used at all at now, even
+// stale.
+func (e CacheEntry) expired(now time.Time) bool {
+	return !now.Before(e.Expires) && !now.Before(e.StaleUntil)
+}
+
+// A Cache stores responses, so that repeated queries can be answered
+// without asking the server. Implementations must be safe for concurrent
+// use.
+type Cache interface {
+	// Get returns the entry for key, if there is one, and counts a hit on
+	// it. It may have expired.
+	Get(key CacheKey) (CacheEntry, bool)
+
+	// Put stores entry for key, replacing any entry there was. It may
+	// drop the entry once it expires, and StaleUntil has passed.
+	Put(key CacheKey, entry CacheEntry)
+}
+
+// MemoryCache is a Cache held in memory. The zero value is an empty,
+// unbounded cache ready to use.
+//
+// If MaxEntries or MaxBytes is set, the least recently used entries are
+// evicted to keep the cache within them.
+type MemoryCache struct {
+	// MaxEntries is the most entries the cache holds. If 0, there is no
+	// limit.
+	MaxEntries int
+
+	// MaxBytes bounds the memory the entries take up, as estimated from
+	// the size of their responses. If 0, there is no limit.
+	MaxBytes int
+
+	mu      sync.Mutex
+	entries map[CacheKey]*list.Element // Of *memoryEntry, in lru.
+	lru     list.List                  // Most recently used first.
+	bytes   int                        // Estimated size of the entries.
+	swept   int                        // The number of entries after the last sweep.
+	stats   CacheStats                 // Entries and Bytes are left 0.
+	now     func() time.Time           // If nil, time.Now.
+}
+
+type memoryEntry struct {
+	key   CacheKey
+	entry CacheEntry
+	size  int
+}
+
+// recordOverhead estimates the memory a decoded record takes up beyond its
+// name and data.
+const recordOverhead = 128
+
+// entrySize estimates the memory that an entry for key takes up, from the
+// sizes of the parts of its response rather than by encoding it, which
+// would be costly on every Put.
+func entrySize(key CacheKey, e CacheEntry) int {
+	size := len(key.Name) + 128
+	p := e.Response
+	if p == nil {
+		return size
+	}
+	for _, q := range p.Questions {
+		size += len(q.Name) + 4
+	}
+	for _, section := range [][]Record{p.Answers, p.Authorities, p.Additionals} {
+		for _, rec := range section {
+			size += len(rec.Name) + len(rec.Data) + recordOverhead
+		}
+	}
+	if p.EDNS != nil {
+		size += recordOverhead
+		for _, o := range p.EDNS.Options {
+			size += len(o.Data) + 4
+		}
+	}
+	return size
+}
+
+// CacheStats are counters of a MemoryCache's activity.
+type CacheStats struct {
+	Entries   int    // Entries held, including expired ones not yet dropped.
+	Bytes     int    // Estimated memory taken up by the entries.
+	Hits      uint64 // Lookups that found an unexpired entry.
+	Misses    uint64 // Lookups that found no entry, or an expired one.
+	Evictions uint64 // Entries dropped to make room for others.
+	Expired   uint64 // Entries dropped because they expired.
+}
+
+func (c *MemoryCache) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// Get implements Cache.
+func (c *MemoryCache) Get(key CacheKey) (CacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return CacheEntry{}, false
+	}
+	me := el.Value.(*memoryEntry)
+	if c.clock().Before(me.entry.Expires) {
+		c.stats.Hits++
+		me.entry.Hits++
+	} else {
+		// A stale entry may still be served, but it isn't popular enough
+		// to prefetch for it.
+		c.stats.Misses++
+	}
+	c.lru.MoveToFront(el)
+	return me.entry, true
+}
+
+// Put implements Cache. Entries that can't be used any more are dropped
+// from time to time, when the cache has doubled in size since they were
+// last dropped. An entry too large for MaxBytes on its own is not stored.
+func (c *MemoryCache) Put(key CacheKey, entry CacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[CacheKey]*list.Element)
+	}
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	size := entrySize(key, entry)
+	if c.MaxBytes > 0 && size > c.MaxBytes {
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&memoryEntry{key: key, entry: entry, size: size})
+	c.bytes += size
+
+	if len(c.entries) >= 2*c.swept+64 {
+		c.sweep()
+	}
+	for c.MaxEntries > 0 && len(c.entries) > c.MaxEntries || c.MaxBytes > 0 && c.bytes > c.MaxBytes {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// remove drops the entry in el.
+func (c *MemoryCache) remove(el *list.Element) {
+	me := c.lru.Remove(el).(*memoryEntry)
+	delete(c.entries, me.key)
+	c.bytes -= me.size
+}
+
+// sweep drops entries that have expired and can't be served stale.
+func (c *MemoryCache) sweep() {
+	now := c.clock()
+	for _, el := range c.entries {
+		if el.Value.(*memoryEntry).entry.expired(now) {
+			c.remove(el)
+			c.stats.Expired++
+		}
+	}
+	c.swept = len(c.entries)
+}
+
+// Len returns the number of entries in c, including any that have expired
+// but not yet been dropped.
+func (c *MemoryCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Stats returns c's counters.
+func (c *MemoryCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	stats.Bytes = c.bytes
+	return stats
+}
+
+// A CacheItem is an entry in a dump of a MemoryCache.
+type CacheItem struct {
+	Key   CacheKey
+	Entry CacheEntry
+
+	// TTL is how long the entry has left before it expires. It is
+	// negative for expired entries kept to be served stale.
+	TTL time.Duration
+}
+
+// Dump returns c's entries, sorted by name, type and class. Their responses
+// are shared with c and must not be modified.
+func (c *MemoryCache) Dump() []CacheItem {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock()
+	items := make([]CacheItem, 0, len(c.entries))
+	for key, el := range c.entries {
+		e := el.Value.(*memoryEntry).entry
+		items = append(items, CacheItem{Key: key, Entry: e, TTL: e.Expires.Sub(now)})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		a, b := items[i].Key, items[j].Key
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.Class < b.Class
+	})
+	return items
+}
+
+// now returns the current time, from r's clock if it has one.
+func (r *Resolver) now() time.Time {
+	if r.clock != nil {
+		return r.clock()
+	}
+	return time.Now()
+}
+
+// store caches response to a query for key until its TTL runs out; see
+// cacheTTL.
+func (r *Resolver) store(key CacheKey, response *Packet) {
+	ttl, ok := cacheTTL(key, response)
+	if !ok || ttl == 0 {
+		return
+	}
+	now := r.now()
+	e := CacheEntry{
+		Response: agePacket(response, 0), // A copy, which callers can't modify.
+		Stored:   now,
+		Expires:  now.Add(time.Duration(ttl) * time.Second),
+	}
+	if r.MaxStale > 0 {
+		e.StaleUntil = e.Expires.Add(r.MaxStale)
+	}
+	r.Cache.Put(key, e)
+}
+
+// staleTTL is the TTL of records in stale responses, as RFC 8767, section 4
+// recommends.
+const staleTTL = 30
+
+// stalePacket returns a copy of p to serve stale, marked with a Stale
+// Answer or Stale NXDOMAIN Answer extended error (RFC 8914) and with TTLs of
+// 30 seconds.
+func stalePacket(response *Packet) *Packet {
+	p := agePacket(response, 0)
+	for _, section := range [][]Record{p.Answers, p.Authorities, p.Additionals} {
+		for i := range section {
+			section[i].TTL = staleTTL
+		}
+	}
+
+	ee := ExtendedError{InfoCode: EDEStaleAnswer}
+	if p.RCode() == RCodeNameError {
+		ee.InfoCode = EDEStaleNXDOMAINAnswer
+	}
+	var edns EDNS
+	if p.EDNS != nil {
+		edns = *p.EDNS
+	}
+	edns.Options = append(edns.Options[:len(edns.Options):len(edns.Options)], ee.Option())
+	edns.ExtendedErrors = append(edns.ExtendedErrors[:len(edns.ExtendedErrors):len(edns.ExtendedErrors)], ee)
+	p.EDNS = &edns
+	return p
+}
+
+// Stale reports whether p is a stale response: one served from a cache
+// after its TTL ran out, by a server or by a Resolver with MaxStale set. It
+// is marked with a Stale Answer or Stale NXDOMAIN Answer extended error.
+func (p *Packet) Stale() bool {
+	if p.EDNS == nil {
+		return false
+	}
+	for _, ee := range p.EDNS.ExtendedErrors {
+		if ee.InfoCode == EDEStaleAnswer || ee.InfoCode == EDEStaleNXDOMAINAnswer {
+			return true
+		}
+	}
+	return false
+}
+
+// maxNegativeTTL caps how long negative responses are cached, in seconds,
+// as RFC 2308, section 5 recommends.
+const maxNegativeTTL = 3 * 60 * 60
+
+// cacheTTL returns how long response to a query for key may be cached: the
+// first of the TTLs of its answers to run out. Negative responses, which
+// are NXDOMAIN or have no records of the type asked for, can be cached if
+// they carry the zone's SOA record, for the lesser of its TTL and MINIMUM
+// field (RFC 2308, section 5). ok is false if response can't be cached.
+func cacheTTL(key CacheKey, response *Packet) (ttl uint32, ok bool) {
+	rc := response.RCode()
+	if response.Header.Flags.TC() || rc != RCodeSuccess && rc != RCodeNameError {
+		return 0, false
+	}
+	_, _, records := followCNAMEs(response.Answers, key.Name, key.Type)
+	if rc == RCodeSuccess && len(records) > 0 {
+		return ChainTTL(response.Answers), true
+	}
+
+	ttl, ok = negativeTTL(response.Authorities)
+	if !ok {
+		return 0, false
+	}
+	if len(response.Answers) > 0 {
+		// The CNAME records leading to the missing name or data.
+		if chain := ChainTTL(response.Answers); chain < ttl {
+			ttl = chain
+		}
+	}
+	return ttl, true
+}
+
+// negativeTTL returns the TTL for a negative response from the SOA record
+// in authorities, its Authority section.
+func negativeTTL(authorities []Record) (uint32, bool) {
+	for _, rec := range authorities {
+		soa, ok := rec.RData.(SOA)
+		if !ok {
+			continue
+		}
+		ttl := rec.TTL
+		if soa.Minimum < ttl {
+			ttl = soa.Minimum
+		}
+		if ttl > maxNegativeTTL {
+			ttl = maxNegativeTTL
+		}
+		return ttl, true
+	}
+	return 0, false
+}
+
+// agePacket returns a copy of p with the TTLs of its records reduced by
+// age, but not below 0.
+func agePacket(p *Packet, age time.Duration) *Packet {
+	out := *p
+	secs := uint32(age / time.Second)
+	for _, section := range []*[]Record{&out.Answers, &out.Authorities, &out.Additionals} {
+		records := make([]Record, len(*section))
+		for i, rec := range *section {
+			if rec.TTL > secs {
+				rec.TTL -= secs
+			} else {
+				rec.TTL = 0
+			}
+			records[i] = rec
+		}
+		if *section != nil {
+			*section = records
+		}
+	}
+	return &out
+}
+
+// prefetchMinHits is how many times an entry must have been used to be
+// prefetched.
+const prefetchMinHits = 2
+
+// A prefetchRun is a prefetch in progress, which Close cancels and waits
+// for.
+type prefetchRun struct {
+	cancel context.CancelFunc
+	done   chan struct{} // Closed when the prefetch is done.
+}
+
+// prefetch refreshes the cache entry for key in the background, unless
+// that is already underway.
+func (r *Resolver) prefetch(key CacheKey) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.fetches[key] != nil {
+		return
+	}
+	if r.fetches == nil {
+		r.fetches = make(map[CacheKey]*prefetchRun)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout())
+	run := &prefetchRun{cancel: cancel, done: make(chan struct{})}
+	r.fetches[key] = run
+
+	go func() {
+		defer close(run.done)
+		defer func() {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			delete(r.fetches, key)
+		}()
+		defer cancel()
+
+		if response, err := r.sharedQuery(ctx, key.Name, key.Type, key.Class); err == nil {
+			r.store(key, response)
+		}
+	}()
+}
+
+// stopPrefetches cancels the prefetches in progress and waits for them to
+// finish.
+func (r *Resolver) stopPrefetches() {
+	r.mu.Lock()
+	runs := make([]*prefetchRun, 0, len(r.fetches))
+	for _, run := range r.fetches {
+		run.cancel()
+		runs = append(runs, run)
+	}
+	r.mu.Unlock()
+
+	for _, run := range runs {
+		<-run.done
+	}
+}
+
+// cacheMagic starts a MemoryCache snapshot, and identifies its version.
+const cacheMagic = "resolve cache 1\n"
+
+// Save writes a snapshot of c's entries to w, for Load to read back later.
+// Each entry holds its response in wire format, and its times as absolute
+// times, so entries expire on schedule even after a restart.
+func (c *MemoryCache) Save(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(cacheMagic); err != nil {
+		return err
+	}
+	var b []byte
+	for key, el := range c.entries {
+		e := el.Value.(*memoryEntry).entry
+		if len(key.Name) > math.MaxUint8 {
+			continue
+		}
+		msg, err := e.Response.MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("cache entry for %s %s: %w", key.Name, key.Type, err)
+		}
+
+		b = append(b[:0], byte(len(key.Name)))
+		b = append(b, key.Name...)
+		b = binary.BigEndian.AppendUint16(b, uint16(key.Type))
+		b = binary.BigEndian.AppendUint16(b, uint16(key.Class))
+		for _, t := range []time.Time{e.Stored, e.Expires, e.StaleUntil} {
+			var nanos int64 // 0 for the zero time.
+			if !t.IsZero() {
+				nanos = t.UnixNano()
+			}
+			b = binary.BigEndian.AppendUint64(b, uint64(nanos))
+		}
+		b = binary.BigEndian.AppendUint32(b, uint32(len(msg)))
+		b = append(b, msg...)
+		if _, err := bw.Write(b); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// Load reads a snapshot written by Save from r, and adds its entries to c.
+// Entries that can no longer be used, even stale, are skipped.
+func (c *MemoryCache) Load(r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(cacheMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != cacheMagic {
+		return fmt.Errorf("not a cache snapshot")
+	}
+
+	now := c.clock()
+	for {
+		key, e, err := readCacheEntry(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("cache snapshot: %w", err)
+		}
+		if !e.expired(now) {
+			c.Put(key, e)
+		}
+	}
+}
+
+// readCacheEntry reads an entry of a cache snapshot. It returns io.EOF only
+// if there are no more entries.
+func readCacheEntry(r *bufio.Reader) (CacheKey, CacheEntry, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return CacheKey{}, CacheEntry{}, err
+	}
+	b := make([]byte, int(n)+2+2+3*8+4)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return CacheKey{}, CacheEntry{}, io.ErrUnexpectedEOF
+	}
+
+	key := CacheKey{
+		Name:  string(b[:n]),
+		Type:  Type(binary.BigEndian.Uint16(b[n:])),
+		Class: Class(binary.BigEndian.Uint16(b[n+2:])),
+	}
+	b = b[n+4:]
+	var times [3]time.Time
+	for i := range times {
+		if nanos := int64(binary.BigEndian.Uint64(b[8*i:])); nanos != 0 {
+			times[i] = time.Unix(0, nanos)
+		}
+	}
+	size := binary.BigEndian.Uint32(b[24:])
+	if size > math.MaxUint16 {
+		return CacheKey{}, CacheEntry{}, fmt.Errorf("message too large: %d bytes", size)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return CacheKey{}, CacheEntry{}, io.ErrUnexpectedEOF
+	}
+	p, err := ParsePacket(msg)
+	if err != nil {
+		return CacheKey{}, CacheEntry{}, err
+	}
+	return key, CacheEntry{Response: p, Stored: times[0], Expires: times[1], StaleUntil: times[2]}, nil
+}
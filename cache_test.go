@@ -0,0 +1,506 @@
+package resolve
+
+import (
+	"bytes"
+	"net/netip"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// fakeClock is a clock for tests that only moves when told to.
+type fakeClock struct {
+	t atomic.Int64 // Unix nanoseconds.
+}
+
+func newFakeClock() *fakeClock {
+	c := &fakeClock{}
+	c.t.Store(time.Date(2023, 5, 14, 0, 0, 0, 0, time.UTC).UnixNano())
+	return c
+}
+
+func (c *fakeClock) Now() time.Time { return time.Unix(0, c.t.Load()) }
+
+func (c *fakeClock) Advance(d time.Duration) { c.t.Add(int64(d)) }
+
+func TestResolver_Cache(t *testing.T) {
+	var queries atomic.Int32
+	r := serveUDP(t, handle(func(q *Packet) *Packet {
+		queries.Add(1)
+		name := q.Questions[0].Name
+		return &Packet{Answers: []Record{
+			{Name: name, Type: TypeCNAME, Class: ClassIN, TTL: 60, RData: CNAME{Target: "b.example"}},
+			{Name: []byte("b.example"), Type: TypeA, Class: ClassIN, TTL: 300, RData: A{Addr: netip.MustParseAddr("192.0.2.1")}},
+		}}
+	}))
+	clock := newFakeClock()
+	r.clock = clock.Now
+	r.Cache = &MemoryCache{}
+
+	ttls := func(p *Packet) []uint32 {
+		var out []uint32
+		for _, rec := range p.Answers {
+			out = append(out, rec.TTL)
+		}
+		return out
+	}
+
+	p, err := r.Query("a.example", TypeA)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	p.Answers[0].TTL = 1 // Doesn't change the cached response.
+
+	clock.Advance(20 * time.Second)
+	p, err = r.Query("A.example.", TypeA)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("%d queries upstream, want 1", n)
+	}
+	if diff := cmp.Diff([]uint32{40, 280}, ttls(p)); diff != "" {
+		t.Errorf("TTLs (-want, +got):\n%s", diff)
+	}
+
+	// The CNAME record expires first, and with it the entry.
+	clock.Advance(40 * time.Second)
+	if _, err := r.Query("a.example", TypeA); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("%d queries upstream, want 2", n)
+	}
+}
+
+func TestResolver_CacheSkipsErrors(t *testing.T) {
+	var queries atomic.Int32
+	r := serveUDP(t, handle(func(q *Packet) *Packet {
+		queries.Add(1)
+		p := &Packet{}
+		p.Header.Flags.SetRCode(RCodeServerFailure)
+		return p
+	}))
+	r.Cache = &MemoryCache{}
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.Query("a.example", TypeA); err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("%d queries upstream, want 2", n)
+	}
+}
+
+func TestResolver_NegativeCache(t *testing.T) {
+	var queries atomic.Int32
+	r := serveUDP(t, handle(func(q *Packet) *Packet {
+		queries.Add(1)
+		p := &Packet{Authorities: []Record{soa(3600, 300)}}
+		p.Header.Flags.SetRCode(RCodeNameError)
+		return p
+	}))
+	clock := newFakeClock()
+	r.clock = clock.Now
+	r.Cache = &MemoryCache{}
+
+	for _, d := range []time.Duration{0, 299 * time.Second, time.Second} {
+		clock.Advance(d)
+		p, err := r.Query("nx.example", TypeA)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		if p.RCode() != RCodeNameError {
+			t.Errorf("rcode %v, want %v", p.RCode(), RCodeNameError)
+		}
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("%d queries upstream, want 2", n)
+	}
+}
+
+func TestResolver_ServeStale(t *testing.T) {
+	var down atomic.Bool
+	r := serveUDP(t, handle(func(q *Packet) *Packet {
+		if down.Load() {
+			return nil
+		}
+		return &Packet{Answers: []Record{a("www.example", "192.0.2.1")}}
+	}))
+	clock := newFakeClock()
+	r.clock = clock.Now
+	r.Cache = &MemoryCache{}
+	r.Timeout = 100 * time.Millisecond
+	r.MaxStale = time.Hour
+
+	p, err := r.Query("www.example", TypeA)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if p.Stale() {
+		t.Error("fresh response marked stale")
+	}
+
+	down.Store(true)
+	clock.Advance(301 * time.Second)
+	p, err = r.Query("www.example", TypeA)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if !p.Stale() {
+		t.Error("stale response not marked stale")
+	}
+	if p.Answers[0].TTL != staleTTL {
+		t.Errorf("TTL %d, want %d", p.Answers[0].TTL, staleTTL)
+	}
+
+	clock.Advance(time.Hour)
+	if _, err := r.Query("www.example", TypeA); err == nil {
+		t.Error("got a response older than MaxStale")
+	}
+}
+
+func TestResolver_Prefetch(t *testing.T) {
+	var queries atomic.Int32
+	r := serveUDP(t, handle(func(q *Packet) *Packet {
+		queries.Add(1)
+		rec := a("www.example", "192.0.2.1")
+		rec.TTL = 100
+		return &Packet{Answers: []Record{rec}}
+	}))
+	clock := newFakeClock()
+	r.clock = clock.Now
+	r.Cache = &MemoryCache{now: clock.Now}
+	r.Prefetch = true
+
+	for _, d := range []time.Duration{0, 50 * time.Second, 45 * time.Second} {
+		clock.Advance(d)
+		if _, err := r.Query("www.example", TypeA); err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	}
+	for deadline := time.Now().Add(time.Second); queries.Load() < 2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := queries.Load(); n != 2 {
+		t.Fatalf("%d queries upstream, want 2", n)
+	}
+
+	// Past the original expiry, the refreshed entry answers.
+	clock.Advance(10 * time.Second)
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		r.mu.Lock()
+		done := len(r.fetches) == 0
+		r.mu.Unlock()
+		if done || time.Now().After(deadline) {
+			break
+		}
+	}
+	if _, err := r.Query("www.example", TypeA); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("%d queries upstream, want 2", n)
+	}
+}
+
+func TestResolver_Close_StopsPrefetch(t *testing.T) {
+	// The first query is answered, and the prefetch for it never is.
+	var queries atomic.Int32
+	r := serveUDP(t, func(query []byte) []byte {
+		if queries.Add(1) > 1 {
+			return nil
+		}
+		return handle(func(q *Packet) *Packet {
+			rec := a("www.example", "192.0.2.1")
+			rec.TTL = 100
+			return &Packet{Answers: []Record{rec}}
+		})(query)
+	})
+	clock := newFakeClock()
+	r.clock = clock.Now
+	r.Cache = &MemoryCache{now: clock.Now}
+	r.Prefetch = true
+	r.Timeout = time.Minute
+	before := runtime.NumGoroutine()
+
+	for _, d := range []time.Duration{0, 50 * time.Second, 45 * time.Second} {
+		clock.Advance(d)
+		if _, err := r.Query("www.example", TypeA); err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	}
+	for deadline := time.Now().Add(time.Second); queries.Load() < 2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := queries.Load(); n != 2 {
+		t.Fatalf("%d queries upstream, want 2", n)
+	}
+
+	done := make(chan error)
+	go func() { done <- r.Close() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close didn't stop the prefetch")
+	}
+	r.mu.Lock()
+	n := len(r.fetches)
+	r.mu.Unlock()
+	if n != 0 {
+		t.Errorf("%d prefetches left after Close", n)
+	}
+
+	// The prefetch's goroutines exit soon after it is done.
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > before && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines after Close, want at most %d", n, before)
+	}
+}
+
+func soa(ttl, minimum uint32) Record {
+	return Record{Name: []byte("example"), Type: TypeSOA, Class: ClassIN, TTL: ttl, RData: SOA{MName: "ns.example", RName: "hostmaster.example", Minimum: minimum}}
+}
+
+func TestCacheTTL(t *testing.T) {
+	key := newCacheKey("www.example", TypeA, ClassIN)
+	cname := Record{Name: []byte("www.example"), Type: TypeCNAME, Class: ClassIN, TTL: 30, RData: CNAME{Target: "b.example"}}
+	tests := []struct {
+		name   string
+		rcode  RCode
+		tc     bool
+		answer []Record
+		auth   []Record
+		want   uint32
+		ok     bool
+	}{
+		{"answer", RCodeSuccess, false, []Record{a("www.example", "192.0.2.1")}, nil, 300, true},
+		{"chain", RCodeSuccess, false, []Record{cname, a("b.example", "192.0.2.1")}, nil, 30, true},
+		{"nodata", RCodeSuccess, false, nil, []Record{soa(3600, 60)}, 60, true},
+		{"nodata, soa ttl", RCodeSuccess, false, nil, []Record{soa(45, 60)}, 45, true},
+		{"nxdomain after cname", RCodeNameError, false, []Record{cname}, []Record{soa(3600, 60)}, 30, true},
+		{"nxdomain capped", RCodeNameError, false, nil, []Record{soa(86400, 86400)}, maxNegativeTTL, true},
+		{"nxdomain without soa", RCodeNameError, false, nil, nil, 0, false},
+		{"servfail", RCodeServerFailure, false, nil, []Record{soa(3600, 60)}, 0, false},
+		{"truncated", RCodeSuccess, true, []Record{a("www.example", "192.0.2.1")}, nil, 0, false},
+	}
+	for _, tt := range tests {
+		p := &Packet{Answers: tt.answer, Authorities: tt.auth}
+		p.Header.Flags.SetRCode(tt.rcode)
+		p.Header.Flags.SetTC(tt.tc)
+		got, ok := cacheTTL(key, p)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: got %d, %t; want %d, %t", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestMemoryCache_Sweep(t *testing.T) {
+	clock := newFakeClock()
+	c := &MemoryCache{now: clock.Now}
+	for i := 0; i < 100; i++ {
+		c.Put(CacheKey{Name: "a.example", Type: Type(i)}, CacheEntry{Expires: clock.Now().Add(time.Second)})
+	}
+	clock.Advance(time.Second)
+	c.Put(CacheKey{Name: "b.example", Type: TypeA}, CacheEntry{Expires: clock.Now().Add(time.Second)})
+	for i := 0; i < 100; i++ {
+		c.Put(CacheKey{Name: "c.example", Type: Type(i)}, CacheEntry{Expires: clock.Now().Add(time.Second)})
+	}
+	if got := c.Len(); got >= 201 {
+		t.Errorf("Len() = %d: expired entries not dropped", got)
+	}
+}
+
+func TestMemoryCache_SaveLoad(t *testing.T) {
+	clock := newFakeClock()
+	now := clock.Now()
+	c := &MemoryCache{now: clock.Now}
+
+	nx := &Packet{Authorities: []Record{soa(3600, 60)}}
+	nx.Header.Flags.SetRCode(RCodeNameError)
+	entries := map[CacheKey]CacheEntry{
+		newCacheKey("www.example", TypeA, ClassIN): {
+			Response: &Packet{Answers: []Record{a("www.example", "192.0.2.1")}},
+			Stored:   now,
+			Expires:  now.Add(300 * time.Second),
+		},
+		newCacheKey("nx.example", TypeA, ClassIN): {
+			Response:   nx,
+			Stored:     now,
+			Expires:    now.Add(60 * time.Second),
+			StaleUntil: now.Add(time.Hour),
+		},
+		newCacheKey("old.example", TypeA, ClassIN): {
+			Response: &Packet{Answers: []Record{a("old.example", "192.0.2.2")}},
+			Stored:   now.Add(-time.Hour),
+			Expires:  now.Add(-time.Minute),
+		},
+	}
+	for key, e := range entries {
+		c.Put(key, e)
+	}
+
+	var buf bytes.Buffer
+	if err := c.Save(&buf); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	loaded := &MemoryCache{now: clock.Now}
+	if err := loaded.Load(&buf); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	delete(entries, newCacheKey("old.example", TypeA, ClassIN)) // Expired.
+	if got := loaded.Len(); got != len(entries) {
+		t.Errorf("loaded %d entries, want %d", got, len(entries))
+	}
+	for key, want := range entries {
+		got, ok := loaded.Get(key)
+		if !ok {
+			t.Errorf("%v: not loaded", key)
+			continue
+		}
+		want.Hits = 1
+		opts := []cmp.Option{
+			cmp.Comparer(func(a, b netip.Addr) bool { return a == b }),
+			cmp.Comparer(func(a, b time.Time) bool { return a.Equal(b) }),
+			cmpopts.IgnoreFields(Record{}, "Data"),
+			cmpopts.IgnoreFields(Header{}, "NumAnswers", "NumAuthorities"),
+			cmpopts.EquateEmpty(),
+		}
+		if diff := cmp.Diff(want, got, opts...); diff != "" {
+			t.Errorf("%v: (-want, +got):\n%s", key, diff)
+		}
+	}
+
+	if err := loaded.Load(strings.NewReader("not a snapshot")); err == nil {
+		t.Error("Load of garbage: no error")
+	}
+}
+
+func TestMemoryCache_StatsDump(t *testing.T) {
+	clock := newFakeClock()
+	now := clock.Now()
+	c := &MemoryCache{now: clock.Now}
+
+	www := newCacheKey("www.example", TypeA, ClassIN)
+	mail := newCacheKey("mail.example", TypeA, ClassIN)
+	c.Put(www, CacheEntry{Response: &Packet{}, Stored: now, Expires: now.Add(300 * time.Second)})
+	c.Put(mail, CacheEntry{Response: &Packet{}, Stored: now, Expires: now.Add(60 * time.Second)})
+
+	c.Get(www)
+	c.Get(newCacheKey("nx.example", TypeA, ClassIN))
+	clock.Advance(100 * time.Second)
+	c.Get(mail) // Expired.
+
+	var ttls []time.Duration
+	for _, item := range c.Dump() {
+		ttls = append(ttls, item.TTL)
+	}
+	if diff := cmp.Diff([]time.Duration{-40 * time.Second, 200 * time.Second}, ttls); diff != "" {
+		t.Errorf("Dump TTLs (-want, +got):\n%s", diff)
+	}
+
+	c.mu.Lock()
+	c.sweep()
+	c.mu.Unlock()
+	want := CacheStats{Entries: 1, Hits: 1, Misses: 2, Expired: 1}
+	if diff := cmp.Diff(want, c.Stats(), cmpopts.IgnoreFields(CacheStats{}, "Bytes")); diff != "" {
+		t.Errorf("Stats (-want, +got):\n%s", diff)
+	}
+}
+
+func TestMemoryCache_StaleNotHit(t *testing.T) {
+	clock := newFakeClock()
+	now := clock.Now()
+	c := &MemoryCache{now: clock.Now}
+	key := newCacheKey("www.example", TypeA, ClassIN)
+	c.Put(key, CacheEntry{Response: &Packet{}, Stored: now, Expires: now.Add(time.Minute), StaleUntil: now.Add(time.Hour)})
+
+	c.Get(key)
+	clock.Advance(2 * time.Minute)
+	e, ok := c.Get(key)
+	if !ok {
+		t.Fatal("stale entry dropped")
+	}
+	if e.Hits != 1 {
+		t.Errorf("Hits = %d, want 1", e.Hits)
+	}
+}
+
+func TestEntrySize(t *testing.T) {
+	p, err := ParsePacket(examplePacket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := newCacheKey("example.com", TypeA, ClassIN)
+	size := entrySize(key, CacheEntry{Response: p})
+
+	// The estimate is at least the size on the wire, and not much more
+	// than that plus the overhead of each record.
+	records := len(p.Answers) + len(p.Authorities) + len(p.Additionals)
+	if min, max := len(examplePacket), len(examplePacket)+recordOverhead*(records+1)+256; size < min || size > max {
+		t.Errorf("entrySize = %d, want within [%d, %d]", size, min, max)
+	}
+
+	p.Answers = append(p.Answers, p.Answers...)
+	if bigger := entrySize(key, CacheEntry{Response: p}); bigger <= size {
+		t.Errorf("entrySize with another answer = %d, want more than %d", bigger, size)
+	}
+}
+
+func TestMemoryCache_LRU(t *testing.T) {
+	clock := newFakeClock()
+	now := clock.Now()
+	entry := func(name string) CacheEntry {
+		return CacheEntry{Response: &Packet{Answers: []Record{a(name, "192.0.2.1")}}, Stored: now, Expires: now.Add(time.Hour)}
+	}
+	key := func(name string) CacheKey { return newCacheKey(name, TypeA, ClassIN) }
+	names := func(c *MemoryCache) []string {
+		var out []string
+		for _, item := range c.Dump() {
+			out = append(out, item.Key.Name)
+		}
+		return out
+	}
+
+	c := &MemoryCache{MaxEntries: 2, now: clock.Now}
+	c.Put(key("a.example"), entry("a.example"))
+	c.Put(key("b.example"), entry("b.example"))
+	c.Get(key("a.example"))
+	c.Put(key("c.example"), entry("c.example")) // Evicts b, the least recently used.
+	if diff := cmp.Diff([]string{"a.example", "c.example"}, names(c)); diff != "" {
+		t.Errorf("MaxEntries: (-want, +got):\n%s", diff)
+	}
+	if got := c.Stats().Evictions; got != 1 {
+		t.Errorf("%d evictions, want 1", got)
+	}
+
+	size := entrySize(key("a.example"), entry("a.example"))
+	c = &MemoryCache{MaxBytes: 2*size + size/2, now: clock.Now}
+	for _, name := range []string{"a.example", "b.example", "c.example"} {
+		c.Put(key(name), entry(name))
+	}
+	if diff := cmp.Diff([]string{"b.example", "c.example"}, names(c)); diff != "" {
+		t.Errorf("MaxBytes: (-want, +got):\n%s", diff)
+	}
+	if got := c.Stats().Bytes; got > c.MaxBytes {
+		t.Errorf("%d bytes, over the limit of %d", got, c.MaxBytes)
+	}
+
+	c = &MemoryCache{MaxBytes: size - 1}
+	c.Put(key("a.example"), entry("a.example"))
+	if got := c.Len(); got != 0 {
+		t.Errorf("stored an entry larger than MaxBytes")
+	}
+}
@@ -0,0 +1,51 @@
+package resolve
+
+import (
+	"bytes"
+	"crypto/rand"
+)
+
+// randomizeCase returns name with the case of each letter chosen at random,
+// for CaseRandomization. A server echoes the name as it was sent, which an
+// attacker who spoofs a response would have to guess.
+func randomizeCase(name string) (string, error) {
+	bits := make([]byte, (len(name)+7)/8)
+	if _, err := rand.Read(bits); err != nil {
+		return "", err
+	}
+	b := []byte(name)
+	for i, c := range b {
+		if ('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') && bits[i/8]&(1<<(i%8)) != 0 {
+			b[i] ^= 0x20
+		}
+	}
+	return string(b), nil
+}
+
+// sameCase reports whether response echoes the names of query's questions
+// with the same case. A response without questions has nothing to compare.
+func sameCase(query, response *Packet) bool {
+	for i, q := range query.Questions {
+		if i < len(response.Questions) && !bytes.Equal(q.Name, response.Questions[i].Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// restoreCase sets the names in response that are domain, other than in
+// case, back to domain, undoing randomizeCase for the caller.
+func restoreCase(response *Packet, domain string) {
+	for i := range response.Questions {
+		if equalNames(string(response.Questions[i].Name), domain) {
+			response.Questions[i].Name = []byte(domain)
+		}
+	}
+	for _, records := range [][]Record{response.Answers, response.Authorities, response.Additionals} {
+		for i := range records {
+			if equalNames(string(records[i].Name), domain) {
+				records[i].Name = []byte(domain)
+			}
+		}
+	}
+}
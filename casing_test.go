@@ -0,0 +1,131 @@
+package resolve
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRandomizeCase(t *testing.T) {
+	const name = "www-1.example.com"
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		got, err := randomizeCase(name)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		if !strings.EqualFold(got, name) {
+			t.Fatalf("randomizeCase(%q) = %q, not the same name", name, got)
+		}
+		seen[got] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("got the same case every time: %v", seen)
+	}
+}
+
+func TestResolver_CaseRandomization(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		sent []string
+	)
+	r := serveUDP(t, handle(func(q *Packet) *Packet {
+		mu.Lock()
+		sent = append(sent, string(q.Questions[0].Name))
+		mu.Unlock()
+		return &Packet{Answers: []Record{a(string(q.Questions[0].Name), "192.0.2.1")}}
+	}))
+	r.CaseRandomization = true
+
+	const name = "www.example.com"
+	for i := 0; i < 5; i++ {
+		p, err := r.Query(name, TypeA)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		if got := string(p.Questions[0].Name); got != name {
+			t.Errorf("question name %q, want %q", got, name)
+		}
+		if got := string(p.Answers[0].Name); got != name {
+			t.Errorf("answer name %q, want %q", got, name)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Count(strings.Join(sent, ""), name) == len(sent) {
+		t.Errorf("names sent as given every time: %q", sent)
+	}
+}
+
+func TestResolver_CaseRandomization_Mismatch(t *testing.T) {
+	// The server lowercases the question, so the case can't be checked.
+	// Over UDP, such responses are ignored like spoofed ones; other
+	// transports report them.
+	r := &Resolver{Attempts: 1, CaseRandomization: true, Exchanger: ExchangerFunc(func(ctx context.Context, query *Packet) (*Packet, error) {
+		p := &Packet{Header: query.Header, Questions: append([]Question(nil), query.Questions...)}
+		p.Header.Flags.SetQR(true)
+		p.Questions[0].Name = []byte(strings.ToLower(string(p.Questions[0].Name)))
+		return p, nil
+	})}
+
+	// A name with many letters is all but sure to get some uppercase.
+	if _, err := r.Query("abcdefghijklmnopqrstuvwxyz.example.com", TypeA); !errors.Is(err, ErrResponseMismatch) {
+		t.Errorf("got %v, want %v", err, ErrResponseMismatch)
+	}
+}
+
+func TestResolver_CaseRandomization_WrongCaseIgnored(t *testing.T) {
+	// Before the real response, the server sends one that echoes the name
+	// with the case of every letter flipped, as an attacker who guessed the
+	// ID and port but not the case might.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query, err := ParsePacket(buf[:n])
+			if err != nil {
+				continue
+			}
+			send := func(name, answer string) {
+				p := &Packet{Header: Header{ID: query.Header.ID}, Questions: []Question{{Name: []byte(name), Type: TypeA, Class: ClassIN}}}
+				p.Header.Flags.SetQR(true)
+				p.Answers = []Record{a(name, answer)}
+				b, _ := p.MarshalBinary()
+				_, _ = conn.WriteTo(b, addr)
+			}
+			name := string(query.Questions[0].Name)
+			flipped := strings.Map(func(c rune) rune {
+				if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' {
+					return c ^ 0x20
+				}
+				return c
+			}, name)
+			send(flipped, "203.0.113.1")
+			send(name, "192.0.2.1")
+		}
+	}()
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	r := &Resolver{Server: addr.IP.String(), Port: addr.Port, Timeout: time.Second, Attempts: 1, CaseRandomization: true}
+
+	got, err := r.Lookup("www.example", TypeA)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if want := netip.MustParseAddr("192.0.2.1"); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"log"
+	"net/netip"
 
 	"github.com/clfs/resolve"
 )
@@ -10,6 +11,8 @@ import (
 func main() {
 	domainFlag := flag.String("domain", "", "domain to lookup")
 	typeFlag := flag.String("record-type", "A", "record type to lookup")
+	stampFlag := flag.String("stamp", "", "DNS stamp (sdns://...) of a server to query instead of resolving from the root")
+	cdFlag := flag.Bool("cd", false, "set the checking-disabled bit, so a validating -stamp server returns data that fails DNSSEC validation; for debugging only")
 	flag.Parse()
 
 	var t resolve.Type
@@ -17,6 +20,8 @@ func main() {
 	switch *typeFlag {
 	case "A":
 		t = resolve.TypeA
+	case "AAAA":
+		t = resolve.TypeAAAA
 	default:
 		log.Fatalf("bad type %s", *typeFlag)
 	}
@@ -25,11 +30,38 @@ func main() {
 		flag.Usage()
 		return
 	}
+	if *cdFlag && *stampFlag == "" {
+		// Resolving from the root asks authoritative servers, which don't
+		// validate.
+		log.Fatal("-cd needs -stamp")
+	}
 
-	ip, err := resolve.Resolve(*domainFlag, t)
+	var (
+		ip  netip.Addr
+		err error
+	)
+	if *stampFlag != "" {
+		ip, err = lookupWithStamp(*stampFlag, *domainFlag, t, *cdFlag)
+	} else {
+		ip, err = resolve.Resolve(*domainFlag, t)
+	}
 	if err != nil {
 		log.Fatalf("failed lookup: %v", err)
 	}
 
 	log.Print(ip)
 }
+
+func lookupWithStamp(stamp, domain string, t resolve.Type, cd bool) (netip.Addr, error) {
+	st, err := resolve.ParseStamp(stamp)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	r, err := st.Resolver()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer r.Close()
+	r.CheckingDisabled = cd
+	return r.Lookup(domain, t)
+}
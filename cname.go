@@ -0,0 +1,94 @@
+package resolve
+
+import (
+	"errors"
+	"strings"
+)
+
+// MaxCNAMEChain is the most CNAME records a lookup follows before giving
+// up.
+const MaxCNAMEChain = 8
+
+// ErrCNAMEChainTooLong is returned when a lookup would follow more than
+// MaxCNAMEChain CNAME records, which usually means the chain loops.
+var ErrCNAMEChainTooLong = errors.New("cname chain too long")
+
+// equalNames reports whether two domain names are equal, ignoring case and
+// a trailing dot.
+func equalNames(a, b string) bool {
+	return strings.EqualFold(strings.TrimSuffix(a, "."), strings.TrimSuffix(b, "."))
+}
+
+// followCNAMEs follows the CNAME records in answers, starting from name.
+// Where a name has no CNAME record, a DNAME record for one of its ancestors
+// is applied instead. It returns the name at the end of the chain, the
+// number of aliases followed, and the records of type t owned by that name. Following stops
+// after MaxCNAMEChain+1 records, so a caller can tell a loop from a long
+// chain.
+func followCNAMEs(answers []Record, name string, t Type) (target string, hops int, records []Record) {
+	for {
+		for _, r := range answers {
+			if r.Type == t && equalNames(string(r.Name), name) {
+				records = append(records, r)
+			}
+		}
+		if len(records) > 0 || t == TypeCNAME || hops > MaxCNAMEChain {
+			return name, hops, records
+		}
+
+		next, ok := cnameTarget(answers, name)
+		if !ok {
+			next, ok = dnameTarget(answers, name)
+		}
+		if !ok {
+			return name, hops, nil
+		}
+		name = next
+		hops++
+	}
+}
+
+// cnameTarget returns the target of the CNAME record for name in answers.
+func cnameTarget(answers []Record, name string) (string, bool) {
+	for _, r := range answers {
+		if cname, ok := r.RData.(CNAME); ok && equalNames(string(r.Name), name) {
+			return cname.Target, true
+		}
+	}
+	return "", false
+}
+
+// dnameTarget returns name with its suffix replaced according to a DNAME
+// record in answers owned by one of its ancestors (RFC 6672, section 2.2).
+func dnameTarget(answers []Record, name string) (string, bool) {
+	name = strings.TrimSuffix(name, ".")
+	for _, r := range answers {
+		dname, ok := r.RData.(DNAME)
+		if !ok {
+			continue
+		}
+		owner := strings.TrimSuffix(string(r.Name), ".")
+
+		// The owner itself is not redirected, only names below it.
+		var prefix string
+		switch {
+		case owner == "":
+			prefix = name
+		case len(name) > len(owner) && name[len(name)-len(owner)-1] == '.' && strings.EqualFold(name[len(name)-len(owner):], owner):
+			prefix = name[:len(name)-len(owner)-1]
+		}
+		if prefix == "" {
+			continue
+		}
+
+		target := prefix
+		if dname.Target != "" {
+			target += "." + dname.Target
+		}
+		if len(target) > 253 {
+			continue // Too long to be a name, so the DNAME doesn't apply.
+		}
+		return target, true
+	}
+	return "", false
+}
@@ -0,0 +1,117 @@
+package resolve
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func cnameRecord(name, target string) Record {
+	return Record{Name: []byte(name), Type: TypeCNAME, Class: ClassIN, TTL: 300, RData: CNAME{Target: target}}
+}
+
+func TestFollowCNAMEs(t *testing.T) {
+	a := Record{Name: []byte("c.example.com"), Type: TypeA, Class: ClassIN, TTL: 60, Data: []byte{192, 0, 2, 1}}
+
+	tests := []struct {
+		name        string
+		answers     []Record
+		start       string
+		wantTarget  string
+		wantHops    int
+		wantRecords []Record
+	}{
+		{
+			name:        "no alias",
+			answers:     []Record{a},
+			start:       "C.Example.com.",
+			wantTarget:  "C.Example.com.",
+			wantRecords: []Record{a},
+		},
+		{
+			name: "chain",
+			answers: []Record{
+				a,
+				cnameRecord("b.example.com", "c.example.com"),
+				cnameRecord("a.example.com", "b.example.com"),
+			},
+			start:       "a.example.com",
+			wantTarget:  "c.example.com",
+			wantHops:    2,
+			wantRecords: []Record{a},
+		},
+		{
+			name:       "dangling",
+			answers:    []Record{cnameRecord("a.example.com", "elsewhere.example.net")},
+			start:      "a.example.com",
+			wantTarget: "elsewhere.example.net",
+			wantHops:   1,
+		},
+		{
+			name: "dname",
+			answers: []Record{
+				{Name: []byte("example.org"), Type: TypeDNAME, Class: ClassIN, TTL: 300, RData: DNAME{Target: "example.com"}},
+				a,
+			},
+			start:       "c.Example.ORG.",
+			wantTarget:  "c.example.com",
+			wantHops:    1,
+			wantRecords: []Record{a},
+		},
+		{
+			name: "cname before dname",
+			answers: []Record{
+				{Name: []byte("example.org"), Type: TypeDNAME, Class: ClassIN, TTL: 300, RData: DNAME{Target: "example.net"}},
+				cnameRecord("c.example.org", "c.example.com"),
+				a,
+			},
+			start:       "c.example.org",
+			wantTarget:  "c.example.com",
+			wantHops:    1,
+			wantRecords: []Record{a},
+		},
+		{
+			name: "loop",
+			answers: []Record{
+				cnameRecord("a.example.com", "b.example.com"),
+				cnameRecord("b.example.com", "a.example.com"),
+			},
+			start:      "a.example.com",
+			wantTarget: "b.example.com",
+			wantHops:   MaxCNAMEChain + 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, hops, records := followCNAMEs(tt.answers, tt.start, TypeA)
+			if target != tt.wantTarget || hops != tt.wantHops {
+				t.Errorf("got (%q, %d), want (%q, %d)", target, hops, tt.wantTarget, tt.wantHops)
+			}
+			if diff := cmp.Diff(tt.wantRecords, records); diff != "" {
+				t.Errorf("records mismatch (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDNAMETarget(t *testing.T) {
+	answers := []Record{{Name: []byte("example.org"), Type: TypeDNAME, Class: ClassIN, TTL: 300, RData: DNAME{Target: "example.com"}}}
+
+	tests := []struct {
+		name   string
+		want   string
+		wantOK bool
+	}{
+		{"www.example.org", "www.example.com", true},
+		{"a.b.example.org.", "a.b.example.com", true},
+		{"example.org", "", false},    // The owner itself isn't redirected.
+		{"badexample.org", "", false}, // Not a subdomain.
+		{"example.com", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := dnameTarget(answers, tt.name)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("%s: got (%q, %t), want (%q, %t)", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package resolve
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// maxPointer is the largest offset a compression pointer can hold.
+const maxPointer = 0x3fff
+
+// A compressor remembers where names were written in a message, so later
+// occurrences of the same name or suffix can be replaced by compression
+// pointers (RFC 1035, section 4.1.4).
+type compressor struct {
+	offsets map[string]int // Name suffix to its offset in the message.
+}
+
+func newCompressor() *compressor {
+	return &compressor{offsets: make(map[string]int)}
+}
+
+// appendName appends the wire form of name to b. If c is non-nil, b must
+// hold the message from its first byte, and name is compressed against the
+// names already written.
+func appendName(b []byte, name string, c *compressor) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	for name != "" {
+		if c != nil {
+			if off, ok := c.offsets[name]; ok {
+				return binary.BigEndian.AppendUint16(b, 0b1100_0000<<8|uint16(off)), nil
+			}
+			if len(b) <= maxPointer {
+				c.offsets[name] = len(b)
+			}
+		}
+
+		label, rest, _ := strings.Cut(name, ".")
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+		name = rest
+	}
+	return append(b, 0), nil
+}
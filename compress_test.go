@@ -0,0 +1,82 @@
+package resolve
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestPacket_MarshalBinary_Compression(t *testing.T) {
+	// examplePacket's answer name is a pointer to the question name, which is
+	// exactly what the encoder should produce.
+	p, err := DecodePacket(bytes.NewReader(examplePacket))
+	if err != nil {
+		t.Fatalf("DecodePacket: %v", err)
+	}
+
+	got, err := p.MarshalBinary()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if !bytes.Equal(got, examplePacket) {
+		t.Errorf("got %q, want %q", got, examplePacket)
+	}
+}
+
+func TestPacket_MarshalBinary_CompressionRoundTrip(t *testing.T) {
+	want, err := DecodePacket(bytes.NewReader(mixedPacket))
+	if err != nil {
+		t.Fatalf("DecodePacket: %v", err)
+	}
+	want.Additionals = []Record{{
+		Name:  []byte("mail.example.com"),
+		Type:  TypeA,
+		Class: ClassIN,
+		TTL:   3600,
+		RData: A{Addr: netip.MustParseAddr("192.0.2.25")},
+	}}
+
+	b, err := want.MarshalBinary()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	// The MX host should be compressed against the question name, and the
+	// additional record's name should point at the MX host.
+	mx := bytes.Index(b, []byte("\x04mail\xc0\x0c"))
+	if mx < 0 {
+		t.Fatalf("MX host not compressed against the question name: %q", b)
+	}
+	if want := []byte{0xc0, byte(mx)}; !bytes.Contains(b, want) {
+		t.Errorf("additional name not compressed against the MX host: %q", b)
+	}
+
+	got, err := DecodePacket(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("DecodePacket: %v", err)
+	}
+	want.Header.NumAdditionals = 1
+	if diff := cmp.Diff(want, got, cmpAddr, cmpopts.IgnoreFields(Record{}, "Data")); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+}
+
+func TestRecord_MarshalBinary_NoCompression(t *testing.T) {
+	r := Record{
+		Name:  []byte("example.com"),
+		Type:  TypeMX,
+		Class: ClassIN,
+		RData: MX{Preference: 10, Host: "example.com"},
+	}
+
+	b, err := r.MarshalBinary()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if bytes.Contains(b, []byte{0xc0}) {
+		t.Errorf("standalone record contains a pointer: %q", b)
+	}
+}
@@ -0,0 +1,103 @@
+package resolve
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// ErrCookieMismatch is returned when a response carries a different client
+// cookie from the one sent with the query, which suggests it was forged.
+var ErrCookieMismatch = errors.New("response client cookie does not match query")
+
+// Cookie is the data of a DNS Cookie option (RFC 7873).
+type Cookie struct {
+	Client [8]byte
+	Server []byte // 8 to 32 bytes, or empty if the server's cookie is unknown.
+}
+
+// ParseCookie parses the data of a Cookie option.
+func ParseCookie(data []byte) (Cookie, error) {
+	if len(data) != 8 && (len(data) < 16 || len(data) > 40) {
+		return Cookie{}, fmt.Errorf("cookie is %d bytes, want 8 or 16 to 40", len(data))
+	}
+	var c Cookie
+	copy(c.Client[:], data)
+	if len(data) > 8 {
+		c.Server = data[8:]
+	}
+	return c, nil
+}
+
+// Option returns the EDNS option that carries c.
+func (c Cookie) Option() EDNSOption {
+	return EDNSOption{Code: OptionCodeCookie, Data: append(c.Client[:], c.Server...)}
+}
+
+// cookie returns the cookie to send to the server at address, creating a
+// random client cookie on first use.
+func (r *Resolver) cookie(address string) (Cookie, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if c, ok := r.cookies[address]; ok {
+		return c, nil
+	}
+	var c Cookie
+	if _, err := rand.Read(c.Client[:]); err != nil {
+		return Cookie{}, err
+	}
+	if r.cookies == nil {
+		r.cookies = make(map[string]Cookie)
+	}
+	r.cookies[address] = c
+	return c, nil
+}
+
+// setServerCookie remembers the server cookie from the server at address.
+func (r *Resolver) setServerCookie(address string, server []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c := r.cookies[address]
+	c.Server = append([]byte(nil), server...)
+	r.cookies[address] = c
+}
+
+// exchangeWithCookie sends a query with a DNS Cookie to the upstream
+// server, and checks and remembers the cookie in the response. If the
+// server rejects a stale server cookie with BADCOOKIE, the query is retried
+// once with the fresh one.
+func (r *Resolver) exchangeWithCookie(ctx context.Context, domain string, t Type, class Class) (*Packet, error) {
+	address := r.address()
+	for retried := false; ; retried = true {
+		sent, err := r.cookie(address)
+		if err != nil {
+			return nil, err
+		}
+		query, err := r.newQuery(domain, t, class, sent.Option())
+		if err != nil {
+			return nil, err
+		}
+		response, err := r.exchange(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+
+		if response.EDNS == nil || response.EDNS.Cookie == nil {
+			return response, nil // The server doesn't support cookies.
+		}
+		got := response.EDNS.Cookie
+		if got.Client != sent.Client {
+			return nil, ErrCookieMismatch
+		}
+		if len(got.Server) > 0 {
+			r.setServerCookie(address, got.Server)
+		}
+
+		if response.RCode() != RCodeBadCookie || retried {
+			return response, nil
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package resolve
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestParseCookie(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Cookie
+	}{
+		{"\x01\x02\x03\x04\x05\x06\x07\x08", Cookie{Client: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}}},
+		{"\x01\x02\x03\x04\x05\x06\x07\x08serverck", Cookie{Client: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}, Server: []byte("serverck")}},
+	}
+	for _, tt := range tests {
+		got, err := ParseCookie([]byte(tt.in))
+		if err != nil {
+			t.Errorf("%q: error: %v", tt.in, err)
+			continue
+		}
+		if diff := cmp.Diff(tt.want, got, cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("%q: mismatch (-want, +got):\n%s", tt.in, diff)
+		}
+		if o := got.Option(); !bytes.Equal(o.Data, []byte(tt.in)) {
+			t.Errorf("%q: Option: got %q", tt.in, o.Data)
+		}
+	}
+
+	for _, n := range []int{0, 7, 9, 15, 41} {
+		if _, err := ParseCookie(make([]byte, n)); err == nil {
+			t.Errorf("%d bytes: want error", n)
+		}
+	}
+}
+
+// cookieServer returns a handler that echoes the client cookie with
+// serverCookie, and records the cookies it receives.
+func cookieServer(serverCookie string, received chan<- *Cookie) func([]byte) []byte {
+	return handle(func(query *Packet) *Packet {
+		received <- query.EDNS.Cookie
+		c := *query.EDNS.Cookie
+		c.Server = []byte(serverCookie)
+		return &Packet{EDNS: &EDNS{UDPSize: 1232, Options: []EDNSOption{c.Option()}}}
+	})
+}
+
+func TestResolver_Cookies(t *testing.T) {
+	received := make(chan *Cookie, 2)
+	r := serveUDP(t, cookieServer("srvcookie", received))
+	r.Cookies = true
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.Query("example.com", TypeA); err != nil {
+			t.Fatalf("query %d: error: %v", i, err)
+		}
+	}
+
+	first, second := <-received, <-received
+	if len(first.Server) != 0 {
+		t.Errorf("first query: got server cookie %q, want none", first.Server)
+	}
+	if first.Client != second.Client {
+		t.Errorf("client cookie changed: %x, then %x", first.Client, second.Client)
+	}
+	if string(second.Server) != "srvcookie" {
+		t.Errorf("second query: got server cookie %q, want %q", second.Server, "srvcookie")
+	}
+}
+
+func TestResolver_Cookies_Mismatch(t *testing.T) {
+	r := serveUDP(t, handle(func(*Packet) *Packet {
+		c := Cookie{Client: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}, Server: []byte("srvcookie")}
+		return &Packet{EDNS: &EDNS{UDPSize: 1232, Options: []EDNSOption{c.Option()}}}
+	}))
+	r.Cookies = true
+
+	if _, err := r.Query("example.com", TypeA); !errors.Is(err, ErrCookieMismatch) {
+		t.Errorf("got %v, want %v", err, ErrCookieMismatch)
+	}
+}
+
+func TestResolver_Cookies_BadCookie(t *testing.T) {
+	received := make(chan *Cookie, 2)
+	r := serveUDP(t, handle(func(query *Packet) *Packet {
+		received <- query.EDNS.Cookie
+		c := *query.EDNS.Cookie
+		p := &Packet{EDNS: &EDNS{UDPSize: 1232}}
+		if string(c.Server) != "freshcookie" {
+			// BADCOOKIE is 23, which needs the extended RCODE bits.
+			p.Header.Flags.SetRCode(RCodeBadCookie & 0xf)
+			p.EDNS.ExtendedRCode = uint8(RCodeBadCookie >> 4)
+		}
+		c.Server = []byte("freshcookie")
+		p.EDNS.Options = []EDNSOption{c.Option()}
+		return p
+	}))
+	r.Cookies = true
+
+	response, err := r.Query("example.com", TypeA)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if rc := response.RCode(); rc != RCodeSuccess {
+		t.Errorf("got %s, want %s", rc, RCodeSuccess)
+	}
+	if len(received) != 2 {
+		t.Errorf("got %d queries, want 2", len(received))
+	}
+}
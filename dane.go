@@ -0,0 +1,96 @@
+package resolve
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+)
+
+// TLSA certificate usages (RFC 7218).
+const (
+	TLSAUsagePKIXTA uint8 = 0
+	TLSAUsagePKIXEE uint8 = 1
+	TLSAUsageDANETA uint8 = 2
+	TLSAUsageDANEEE uint8 = 3
+)
+
+// TLSA selectors (RFC 7218).
+const (
+	TLSASelectorCert uint8 = 0
+	TLSASelectorSPKI uint8 = 1
+)
+
+// TLSA matching types (RFC 7218).
+const (
+	TLSAMatchingFull   uint8 = 0
+	TLSAMatchingSHA256 uint8 = 1
+	TLSAMatchingSHA512 uint8 = 2
+)
+
+// Match reports whether cert matches t's certificate association data,
+// using t's selector and matching type. It ignores t's usage.
+func (t TLSA) Match(cert *x509.Certificate) bool {
+	var selected []byte
+	switch t.Selector {
+	case TLSASelectorCert:
+		selected = cert.Raw
+	case TLSASelectorSPKI:
+		selected = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+
+	switch t.MatchingType {
+	case TLSAMatchingFull:
+		return bytes.Equal(selected, t.Data)
+	case TLSAMatchingSHA256:
+		sum := sha256.Sum256(selected)
+		return bytes.Equal(sum[:], t.Data)
+	case TLSAMatchingSHA512:
+		sum := sha512.Sum512(selected)
+		return bytes.Equal(sum[:], t.Data)
+	default:
+		return false
+	}
+}
+
+// MatchTLSA reports whether the certificate chain in cert matches any of
+// the records in rrset (RFC 6698, section 2.1.1). Records with an end
+// entity usage are matched against the leaf certificate, and records with
+// a trust anchor usage against the rest of the chain. Records with unknown
+// parameters are ignored.
+//
+// For the PKIX usages, callers must also validate the chain against their
+// trusted roots, which MatchTLSA does not do.
+func MatchTLSA(rrset []TLSA, cert tls.Certificate) (bool, error) {
+	if len(cert.Certificate) == 0 {
+		return false, fmt.Errorf("no certificates")
+	}
+	chain := make([]*x509.Certificate, len(cert.Certificate))
+	for i, der := range cert.Certificate {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return false, err
+		}
+		chain[i] = c
+	}
+
+	for _, t := range rrset {
+		var candidates []*x509.Certificate
+		switch t.Usage {
+		case TLSAUsagePKIXEE, TLSAUsageDANEEE:
+			candidates = chain[:1]
+		case TLSAUsagePKIXTA, TLSAUsageDANETA:
+			candidates = chain[1:]
+		}
+		for _, c := range candidates {
+			if t.Match(c) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,126 @@
+package resolve
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testChain returns a chain of a leaf certificate for www.example.com signed
+// by a CA, and the chain with the leaf's private key.
+func testChain(t *testing.T) (leaf, ca *x509.Certificate, cert tls.Certificate) {
+	t.Helper()
+
+	newCert := func(tmpl, parent *x509.Certificate, pub, priv any) *x509.Certificate {
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pub, priv)
+		if err != nil {
+			t.Fatalf("CreateCertificate: %v", err)
+		}
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatalf("ParseCertificate: %v", err)
+		}
+		return c
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             now,
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	ca = newCert(caTmpl, caTmpl, &caKey.PublicKey, caKey)
+
+	leafTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "www.example.com"},
+		DNSNames:     []string{"www.example.com"},
+		NotBefore:    now,
+		NotAfter:     now.Add(time.Hour),
+	}
+	leaf = newCert(leafTmpl, ca, &leafKey.PublicKey, caKey)
+
+	return leaf, ca, tls.Certificate{Certificate: [][]byte{leaf.Raw, ca.Raw}, PrivateKey: leafKey}
+}
+
+func TestTLSA_Match(t *testing.T) {
+	leaf, _, _ := testChain(t)
+
+	spki256 := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	cert512 := sha512.Sum512(leaf.Raw)
+
+	tests := []struct {
+		tlsa TLSA
+		want bool
+	}{
+		{TLSA{Selector: TLSASelectorCert, MatchingType: TLSAMatchingFull, Data: leaf.Raw}, true},
+		{TLSA{Selector: TLSASelectorSPKI, MatchingType: TLSAMatchingSHA256, Data: spki256[:]}, true},
+		{TLSA{Selector: TLSASelectorCert, MatchingType: TLSAMatchingSHA512, Data: cert512[:]}, true},
+		{TLSA{Selector: TLSASelectorCert, MatchingType: TLSAMatchingSHA256, Data: spki256[:]}, false},
+		{TLSA{Selector: 7, MatchingType: TLSAMatchingFull, Data: leaf.Raw}, false},
+		{TLSA{Selector: TLSASelectorCert, MatchingType: 7, Data: leaf.Raw}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.tlsa.Match(leaf); got != tt.want {
+			t.Errorf("%s: got %t, want %t", tt.tlsa, got, tt.want)
+		}
+	}
+}
+
+func TestMatchTLSA(t *testing.T) {
+	leaf, ca, cert := testChain(t)
+
+	leafSPKI := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	caSPKI := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+
+	tests := []struct {
+		name  string
+		rrset []TLSA
+		want  bool
+	}{
+		{"dane-ee", []TLSA{{TLSAUsageDANEEE, TLSASelectorSPKI, TLSAMatchingSHA256, leafSPKI[:]}}, true},
+		{"dane-ta", []TLSA{{TLSAUsageDANETA, TLSASelectorSPKI, TLSAMatchingSHA256, caSPKI[:]}}, true},
+		{"ee usage with ca data", []TLSA{{TLSAUsageDANEEE, TLSASelectorSPKI, TLSAMatchingSHA256, caSPKI[:]}}, false},
+		{"ta usage with leaf data", []TLSA{{TLSAUsageDANETA, TLSASelectorSPKI, TLSAMatchingSHA256, leafSPKI[:]}}, false},
+		{"unknown usage", []TLSA{{9, TLSASelectorSPKI, TLSAMatchingSHA256, leafSPKI[:]}}, false},
+		{"second record matches", []TLSA{
+			{TLSAUsageDANEEE, TLSASelectorSPKI, TLSAMatchingSHA256, make([]byte, 32)},
+			{TLSAUsagePKIXEE, TLSASelectorCert, TLSAMatchingFull, leaf.Raw},
+		}, true},
+	}
+	for _, tt := range tests {
+		got, err := MatchTLSA(tt.rrset, cert)
+		if err != nil {
+			t.Errorf("%s: error: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %t, want %t", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := MatchTLSA(nil, tls.Certificate{}); err == nil {
+		t.Error("empty chain: want error")
+	}
+}
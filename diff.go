@@ -0,0 +1,193 @@
+package resolve
+
+import (
+	"sort"
+	"strings"
+)
+
+// A Section identifies one of the record sections of a packet.
+type Section int
+
+const (
+	SectionAnswer Section = iota
+	SectionAuthority
+	SectionAdditional
+)
+
+func (s Section) String() string {
+	switch s {
+	case SectionAnswer:
+		return "answer"
+	case SectionAuthority:
+		return "authority"
+	case SectionAdditional:
+		return "additional"
+	default:
+		return "unknown"
+	}
+}
+
+// A DiffKind describes how a record differs between two packets.
+type DiffKind int
+
+const (
+	// RecordAdded is a record only present in the second packet.
+	RecordAdded DiffKind = iota
+	// RecordRemoved is a record only present in the first packet.
+	RecordRemoved
+	// RecordDataChanged is a record whose data differs, with the same name,
+	// type and class.
+	RecordDataChanged
+	// RecordTTLChanged is a record whose data is the same but whose TTL
+	// differs.
+	RecordTTLChanged
+)
+
+func (k DiffKind) String() string {
+	switch k {
+	case RecordAdded:
+		return "added"
+	case RecordRemoved:
+		return "removed"
+	case RecordDataChanged:
+		return "data changed"
+	case RecordTTLChanged:
+		return "ttl changed"
+	default:
+		return "unknown"
+	}
+}
+
+// RecordDiff is a difference between the records of two packets.
+type RecordDiff struct {
+	Section Section
+	Kind    DiffKind
+	Old     *Record // Nil if Kind is RecordAdded.
+	New     *Record // Nil if Kind is RecordRemoved.
+}
+
+// DiffPackets reports how the records of b differ from those of a.
+//
+// Records are grouped by section, name, type and class, and the order of
+// records within a section is ignored. Within a group, records with equal
+// data but different TTLs are reported as RecordTTLChanged. Remaining
+// records are paired up as RecordDataChanged, and any left over are
+// reported as RecordAdded or RecordRemoved.
+func DiffPackets(a, b *Packet) []RecordDiff {
+	var diffs []RecordDiff
+	diffs = append(diffs, diffSection(SectionAnswer, a.Answers, b.Answers)...)
+	diffs = append(diffs, diffSection(SectionAuthority, a.Authorities, b.Authorities)...)
+	diffs = append(diffs, diffSection(SectionAdditional, a.Additionals, b.Additionals)...)
+	return diffs
+}
+
+// rrsetKey identifies the set of records sharing a name, type and class.
+type rrsetKey struct {
+	name  string
+	typ   Type
+	class Class
+}
+
+func groupRecords(records []Record) map[rrsetKey][]Record {
+	m := make(map[rrsetKey][]Record)
+	for _, r := range records {
+		k := rrsetKey{strings.ToLower(string(r.Name)), r.Type, r.Class}
+		m[k] = append(m[k], r)
+	}
+	for _, rs := range m {
+		sort.SliceStable(rs, func(i, j int) bool {
+			return dataKey(rs[i]) < dataKey(rs[j])
+		})
+	}
+	return m
+}
+
+func diffSection(s Section, a, b []Record) []RecordDiff {
+	ga, gb := groupRecords(a), groupRecords(b)
+
+	keys := make([]rrsetKey, 0, len(ga)+len(gb))
+	for k := range ga {
+		keys = append(keys, k)
+	}
+	for k := range gb {
+		if _, ok := ga[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		if keys[i].typ != keys[j].typ {
+			return keys[i].typ < keys[j].typ
+		}
+		return keys[i].class < keys[j].class
+	})
+
+	var diffs []RecordDiff
+	for _, k := range keys {
+		diffs = append(diffs, diffRRset(s, ga[k], gb[k])...)
+	}
+	return diffs
+}
+
+func diffRRset(s Section, a, b []Record) []RecordDiff {
+	var (
+		diffs   []RecordDiff
+		removed []Record
+		matched = make([]bool, len(b))
+	)
+
+	for i := range a {
+		j := indexData(b, matched, dataKey(a[i]))
+		if j < 0 {
+			removed = append(removed, a[i])
+			continue
+		}
+		matched[j] = true
+		if a[i].TTL != b[j].TTL {
+			diffs = append(diffs, RecordDiff{Section: s, Kind: RecordTTLChanged, Old: &a[i], New: &b[j]})
+		}
+	}
+
+	var added []Record
+	for j := range b {
+		if !matched[j] {
+			added = append(added, b[j])
+		}
+	}
+
+	for len(removed) > 0 && len(added) > 0 {
+		diffs = append(diffs, RecordDiff{Section: s, Kind: RecordDataChanged, Old: &removed[0], New: &added[0]})
+		removed, added = removed[1:], added[1:]
+	}
+	for i := range removed {
+		diffs = append(diffs, RecordDiff{Section: s, Kind: RecordRemoved, Old: &removed[i]})
+	}
+	for i := range added {
+		diffs = append(diffs, RecordDiff{Section: s, Kind: RecordAdded, New: &added[i]})
+	}
+
+	return diffs
+}
+
+// dataKey returns a comparable form of r's data. Parsed data is compared
+// in presentation format, since the wire form of the same data differs
+// between packets when it contains compressed names.
+func dataKey(r Record) string {
+	if r.RData != nil {
+		return r.RData.String()
+	}
+	return string(r.Data)
+}
+
+// indexData returns the index of the first unmatched record in rs with the
+// given data key, or -1.
+func indexData(rs []Record, matched []bool, key string) int {
+	for i, r := range rs {
+		if !matched[i] && dataKey(r) == key {
+			return i
+		}
+	}
+	return -1
+}
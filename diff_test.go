@@ -0,0 +1,62 @@
+package resolve
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiffPackets(t *testing.T) {
+	a := &Packet{
+		Answers: []Record{
+			{Name: []byte("example.com"), Type: TypeA, Class: ClassIN, TTL: 300, Data: []byte{192, 0, 2, 1}},
+			{Name: []byte("example.com"), Type: TypeA, Class: ClassIN, TTL: 300, Data: []byte{192, 0, 2, 2}},
+			{Name: []byte("example.com"), Type: TypeNS, Class: ClassIN, TTL: 3600, Data: []byte("a.iana-servers.net")},
+		},
+	}
+	b := &Packet{
+		Answers: []Record{
+			// Reordered relative to a.
+			{Name: []byte("example.com"), Type: TypeNS, Class: ClassIN, TTL: 3600, Data: []byte("a.iana-servers.net")},
+			{Name: []byte("example.com"), Type: TypeA, Class: ClassIN, TTL: 300, Data: []byte{192, 0, 2, 3}},
+			{Name: []byte("example.com"), Type: TypeA, Class: ClassIN, TTL: 60, Data: []byte{192, 0, 2, 1}},
+		},
+	}
+
+	want := []RecordDiff{
+		{Section: SectionAnswer, Kind: RecordTTLChanged, Old: &a.Answers[0], New: &b.Answers[2]},
+		{Section: SectionAnswer, Kind: RecordDataChanged, Old: &a.Answers[1], New: &b.Answers[1]},
+	}
+
+	got := DiffPackets(a, b)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+}
+
+func TestDiffPackets_AddedRemoved(t *testing.T) {
+	a := &Packet{
+		Authorities: []Record{
+			{Name: []byte("example.com"), Type: TypeNS, Class: ClassIN, TTL: 3600, Data: []byte("a.iana-servers.net")},
+		},
+	}
+	b := &Packet{
+		Additionals: []Record{
+			{Name: []byte("a.iana-servers.net"), Type: TypeA, Class: ClassIN, TTL: 3600, Data: []byte{199, 43, 135, 53}},
+		},
+	}
+
+	want := []RecordDiff{
+		{Section: SectionAuthority, Kind: RecordRemoved, Old: &a.Authorities[0]},
+		{Section: SectionAdditional, Kind: RecordAdded, New: &b.Additionals[0]},
+	}
+
+	got := DiffPackets(a, b)
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+
+	if got := DiffPackets(a, a); len(got) != 0 {
+		t.Errorf("DiffPackets(a, a) = %v, want none", got)
+	}
+}
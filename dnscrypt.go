@@ -0,0 +1,275 @@
+package resolve
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultDNSCryptPort is the port used for ProtocolDNSCrypt when
+// Resolver.Port is 0. DNSCrypt has no assigned port, but servers commonly
+// listen on 443.
+const DefaultDNSCryptPort = 443
+
+// Magic values from the DNSCrypt version 2 protocol.
+var (
+	dnscryptCertMagic     = []byte("DNSC")
+	dnscryptResolverMagic = []byte("r6fnvWj8")
+)
+
+const (
+	// dnscryptMinQueryLen is the smallest padded query sent over UDP.
+	dnscryptMinQueryLen = 256
+
+	// dnscryptMaxResponseLen bounds encrypted responses over UDP.
+	dnscryptMaxResponseLen = 65535
+)
+
+// dnscryptCert is a DNSCrypt resolver certificate, which carries the key
+// used to encrypt queries to the resolver.
+type dnscryptCert struct {
+	cipher      boxCipher
+	resolverKey *ecdh.PublicKey
+	clientMagic [8]byte
+	serial      uint32
+	notBefore   time.Time
+	notAfter    time.Time
+}
+
+// parseDNSCryptCert parses a certificate from the data of a TXT record and
+// checks its signature with the provider's key.
+func parseDNSCryptCert(b []byte, providerKey ed25519.PublicKey) (*dnscryptCert, error) {
+	if len(b) < 124 {
+		return nil, fmt.Errorf("dnscrypt certificate too short: %d bytes", len(b))
+	}
+	if !bytes.Equal(b[:4], dnscryptCertMagic) {
+		return nil, fmt.Errorf("not a dnscrypt certificate")
+	}
+
+	var c dnscryptCert
+	switch esVersion := binary.BigEndian.Uint16(b[4:]); esVersion {
+	case 1:
+		c.cipher = xsalsa20
+	case 2:
+		c.cipher = xchacha20
+	default:
+		return nil, fmt.Errorf("unsupported dnscrypt es-version %d", esVersion)
+	}
+
+	signature, signed := b[8:72], b[72:]
+	if len(providerKey) != ed25519.PublicKeySize || !ed25519.Verify(providerKey, signed, signature) {
+		return nil, fmt.Errorf("invalid dnscrypt certificate signature")
+	}
+
+	key, err := ecdh.X25519().NewPublicKey(signed[:32])
+	if err != nil {
+		return nil, err
+	}
+	c.resolverKey = key
+	copy(c.clientMagic[:], signed[32:40])
+	c.serial = binary.BigEndian.Uint32(signed[40:])
+	c.notBefore = time.Unix(int64(binary.BigEndian.Uint32(signed[44:])), 0)
+	c.notAfter = time.Unix(int64(binary.BigEndian.Uint32(signed[48:])), 0)
+	return &c, nil
+}
+
+// valid reports whether c is valid at time t.
+func (c *dnscryptCert) valid(t time.Time) bool {
+	return !t.Before(c.notBefore) && t.Before(c.notAfter)
+}
+
+// A certFetch is a fetch of the DNSCrypt provider's certificates in
+// progress, which concurrent queries wait for rather than fetching their
+// own.
+type certFetch struct {
+	done     chan struct{} // Closed when the fetch is done.
+	cert     *dnscryptCert
+	err      error
+	canceled bool // The context of the fetch was done.
+}
+
+// currentCert returns the DNSCrypt resolver's current certificate, fetching
+// the provider's certificates if there is no valid one. The fetch is shared
+// by concurrent callers, and r.mu isn't held during it. If the fetch is
+// abandoned because the context of the caller that started it is done, the
+// others start another.
+func (r *Resolver) currentCert(ctx context.Context) (*dnscryptCert, error) {
+	for {
+		r.mu.Lock()
+		if r.cert != nil && r.cert.valid(time.Now()) {
+			cert := r.cert
+			r.mu.Unlock()
+			return cert, nil
+		}
+		f := r.certFetch
+		if f == nil {
+			break // Still holding r.mu.
+		}
+		r.mu.Unlock()
+
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if f.canceled && ctx.Err() == nil {
+			continue
+		}
+		return f.cert, f.err
+	}
+
+	f := &certFetch{done: make(chan struct{})}
+	r.certFetch = f
+	r.mu.Unlock()
+
+	f.cert, f.err = r.fetchCert(ctx)
+	f.canceled = ctx.Err() != nil
+
+	r.mu.Lock()
+	if f.err == nil {
+		r.cert = f.cert
+	}
+	r.certFetch = nil
+	r.mu.Unlock()
+	close(f.done)
+
+	return f.cert, f.err
+}
+
+// fetchCert fetches the DNSCrypt provider's certificates. Of the valid
+// ones, the one with the highest serial is returned, preferring XChaCha20 on
+// ties.
+func (r *Resolver) fetchCert(ctx context.Context) (*dnscryptCert, error) {
+	now := time.Now()
+	query, err := r.newQuery(r.ProviderName, TypeTXT, ClassIN)
+	if err != nil {
+		return nil, err
+	}
+	response, err := exchange(ctx, r.address(), query, r.udpSize(), r.CaseRandomization)
+	if err != nil {
+		return nil, err
+	}
+	if err := response.Err(); err != nil {
+		return nil, err
+	}
+
+	var best *dnscryptCert
+	for _, a := range response.Answers {
+		txt, ok := a.RData.(TXT)
+		if !ok {
+			continue
+		}
+		c, err := parseDNSCryptCert([]byte(strings.Join(txt.Strings, "")), r.ProviderKey)
+		if err != nil || !c.valid(now) {
+			continue
+		}
+		if best == nil || c.serial > best.serial || c.serial == best.serial && c.cipher == xchacha20 {
+			best = c
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("dnscrypt: no valid certificate for %s", r.ProviderName)
+	}
+	return best, nil
+}
+
+// exchangeDNSCrypt sends query encrypted with DNSCrypt to the upstream
+// server over UDP, and again over TCP if the response is truncated. Each
+// query uses a new key pair.
+func (r *Resolver) exchangeDNSCrypt(ctx context.Context, query []byte) (*Packet, error) {
+	cert, err := r.currentCert(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	dh, err := priv.ECDH(cert.resolverKey)
+	if err != nil {
+		return nil, err
+	}
+	key := cert.cipher.sharedKey(dh)
+
+	// The client's half of the nonce; the resolver fills in the rest.
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:12]); err != nil {
+		return nil, err
+	}
+
+	seal := func(minLen int) []byte {
+		b := make([]byte, 0, 8+32+12+boxOverhead+len(query)+64)
+		b = append(b, cert.clientMagic[:]...)
+		b = append(b, priv.PublicKey().Bytes()...)
+		b = append(b, nonce[:12]...)
+		return cert.cipher.seal(b, dnscryptPad(query, minLen), &nonce, &key)
+	}
+	open := func(b []byte) (*Packet, error) {
+		if len(b) < len(dnscryptResolverMagic)+24+boxOverhead || !bytes.Equal(b[:8], dnscryptResolverMagic) {
+			return nil, fmt.Errorf("dnscrypt: malformed response")
+		}
+		var n [24]byte
+		copy(n[:], b[8:32])
+		if !bytes.Equal(n[:12], nonce[:12]) {
+			return nil, fmt.Errorf("dnscrypt: response nonce does not match query")
+		}
+		padded, err := cert.cipher.open(nil, b[32:], &n, &key)
+		if err != nil {
+			return nil, fmt.Errorf("dnscrypt: %w", err)
+		}
+		msg, err := dnscryptUnpad(padded)
+		if err != nil {
+			return nil, err
+		}
+		return ParsePacket(msg)
+	}
+
+	b, err := roundTripUDP(ctx, r.address(), seal(dnscryptMinQueryLen), make([]byte, dnscryptMaxResponseLen), nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := open(b)
+	if err != nil || !response.Header.Flags.TC() {
+		return response, err
+	}
+
+	b, err = roundTripTCP(ctx, r.address(), seal(0))
+	if err != nil {
+		return nil, err
+	}
+	return open(b)
+}
+
+// dnscryptPad pads msg with a 0x80 byte and zeros to a multiple of 64
+// bytes, and to at least minLen bytes.
+func dnscryptPad(msg []byte, minLen int) []byte {
+	n := len(msg) + 1
+	if n < minLen {
+		n = minLen
+	}
+	n = (n + 63) &^ 63
+
+	b := make([]byte, n)
+	copy(b, msg)
+	b[len(msg)] = 0x80
+	return b
+}
+
+// dnscryptUnpad removes the padding added by dnscryptPad.
+func dnscryptUnpad(b []byte) ([]byte, error) {
+	i := len(b) - 1
+	for i >= 0 && b[i] == 0 {
+		i--
+	}
+	if i < 0 || b[i] != 0x80 {
+		return nil, fmt.Errorf("dnscrypt: invalid padding")
+	}
+	return b[:i], nil
+}
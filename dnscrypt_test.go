@@ -0,0 +1,274 @@
+package resolve
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dnscryptServer is a DNSCrypt resolver for tests, which answers queries
+// with answerA.
+type dnscryptServer struct {
+	providerKey ed25519.PrivateKey
+	key         *ecdh.PrivateKey
+	clientMagic [8]byte
+	cipher      boxCipher
+}
+
+func newDNSCryptServer(t *testing.T, cipher boxCipher) *dnscryptServer {
+	t.Helper()
+
+	_, providerKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &dnscryptServer{providerKey: providerKey, key: key, clientMagic: [8]byte{'m', 'a', 'g', 'i', 'c', 0, 0, 1}, cipher: cipher}
+}
+
+// cert returns a certificate for the server, valid from notBefore to
+// notAfter.
+func (s *dnscryptServer) cert(serial uint32, notBefore, notAfter time.Time) []byte {
+	signed := append([]byte(nil), s.key.PublicKey().Bytes()...)
+	signed = append(signed, s.clientMagic[:]...)
+	signed = binary.BigEndian.AppendUint32(signed, serial)
+	signed = binary.BigEndian.AppendUint32(signed, uint32(notBefore.Unix()))
+	signed = binary.BigEndian.AppendUint32(signed, uint32(notAfter.Unix()))
+
+	b := append([]byte("DNSC"), 0, byte(s.cipher), 0, 0)
+	b = append(b, ed25519.Sign(s.providerKey, signed)...)
+	return append(b, signed...)
+}
+
+// handler returns a handler for plain certificate queries and encrypted
+// queries. Over UDP, responses have the TC bit set if truncate is true.
+func (s *dnscryptServer) handler(udp, truncate bool) func([]byte) []byte {
+	return func(b []byte) []byte {
+		if !bytes.HasPrefix(b, s.clientMagic[:]) {
+			return handle(func(q *Packet) *Packet {
+				now := time.Now()
+				cert := s.cert(1, now.Add(-time.Hour), now.Add(time.Hour))
+				return &Packet{Answers: []Record{{Name: q.Questions[0].Name, Type: TypeTXT, Class: ClassIN, RData: TXT{Strings: []string{string(cert)}}}}}
+			})(b)
+		}
+
+		clientKey, err := ecdh.X25519().NewPublicKey(b[8:40])
+		if err != nil {
+			return nil
+		}
+		dh, err := s.key.ECDH(clientKey)
+		if err != nil {
+			return nil
+		}
+		key := s.cipher.sharedKey(dh)
+		var nonce [24]byte
+		copy(nonce[:12], b[40:52])
+		padded, err := s.cipher.open(nil, b[52:], &nonce, &key)
+		if err != nil {
+			return nil
+		}
+		query, err := dnscryptUnpad(padded)
+		if err != nil {
+			return nil
+		}
+
+		response := answerA(query)
+		if udp && truncate {
+			response = handle(func(*Packet) *Packet {
+				p := &Packet{}
+				p.Header.Flags.SetTC(true)
+				return p
+			})(query)
+		}
+
+		if _, err := rand.Read(nonce[12:]); err != nil {
+			return nil
+		}
+		out := append([]byte("r6fnvWj8"), nonce[:]...)
+		return s.cipher.seal(out, dnscryptPad(response, 0), &nonce, &key)
+	}
+}
+
+func TestResolver_DNSCrypt(t *testing.T) {
+	for _, cipher := range []boxCipher{xsalsa20, xchacha20} {
+		s := newDNSCryptServer(t, cipher)
+		r := serveUDP(t, s.handler(true, false))
+		r.Protocol = ProtocolDNSCrypt
+		r.ProviderName = "2.dnscrypt-cert.example.com"
+		r.ProviderKey = s.providerKey.Public().(ed25519.PublicKey)
+
+		for _, want := range []string{"192.0.2.1", "192.0.2.2"} {
+			got, err := r.Lookup(want+".test", TypeA)
+			if err != nil {
+				t.Fatalf("cipher %d: error: %v", cipher, err)
+			}
+			if got != netip.MustParseAddr(want) {
+				t.Errorf("cipher %d: got %s, want %s", cipher, got, want)
+			}
+		}
+	}
+}
+
+func TestResolver_DNSCrypt_IDSource(t *testing.T) {
+	s := newDNSCryptServer(t, xchacha20)
+	r := serveUDP(t, s.handler(true, false))
+	r.Protocol = ProtocolDNSCrypt
+	r.ProviderName = "2.dnscrypt-cert.example.com"
+	r.ProviderKey = s.providerKey.Public().(ed25519.PublicKey)
+	r.IDSource = fixedSource(0x1234)
+
+	// Fetching the certificate and building the query both need an ID.
+	got, err := r.Lookup("192.0.2.1.test", TypeA)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if want := netip.MustParseAddr("192.0.2.1"); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestResolver_DNSCrypt_SharedCertFetch(t *testing.T) {
+	s := newDNSCryptServer(t, xchacha20)
+	var (
+		mu      sync.Mutex
+		fetches int
+		release = make(chan struct{})
+	)
+	handler := s.handler(true, false)
+	r := serveUDP(t, func(b []byte) []byte {
+		if !bytes.HasPrefix(b, s.clientMagic[:]) {
+			mu.Lock()
+			fetches++
+			mu.Unlock()
+			<-release
+		}
+		return handler(b)
+	})
+	r.Protocol = ProtocolDNSCrypt
+	r.ProviderName = "2.dnscrypt-cert.example.com"
+	r.ProviderKey = s.providerKey.Public().(ed25519.PublicKey)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := r.Lookup("192.0.2.1.test", TypeA)
+			errs <- err
+		}()
+	}
+
+	// While the certificate is being fetched, r isn't locked.
+	for {
+		mu.Lock()
+		n := fetches
+		mu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	done := make(chan struct{})
+	go func() {
+		r.UpstreamStats()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("UpstreamStats blocked by the certificate fetch")
+	}
+
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("error: %v", err)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("certificate fetched %d times, want 1", fetches)
+	}
+}
+
+func TestResolver_DNSCrypt_Truncated(t *testing.T) {
+	s := newDNSCryptServer(t, xchacha20)
+	r := serveUDP(t, s.handler(true, true))
+	r.Protocol = ProtocolDNSCrypt
+	serveTCP(t, r, s.handler(false, true))
+	r.ProviderName = "2.dnscrypt-cert.example.com"
+	r.ProviderKey = s.providerKey.Public().(ed25519.PublicKey)
+
+	got, err := r.Lookup("192.0.2.1.test", TypeA)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if want := netip.MustParseAddr("192.0.2.1"); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestResolver_DNSCrypt_WrongProviderKey(t *testing.T) {
+	s := newDNSCryptServer(t, xchacha20)
+	r := serveUDP(t, s.handler(true, false))
+	r.Protocol = ProtocolDNSCrypt
+	r.ProviderName = "2.dnscrypt-cert.example.com"
+	r.ProviderKey, _, _ = ed25519.GenerateKey(rand.Reader)
+
+	if _, err := r.Lookup("192.0.2.1.test", TypeA); err == nil {
+		t.Error("want error")
+	}
+}
+
+func TestParseDNSCryptCert(t *testing.T) {
+	s := newDNSCryptServer(t, xsalsa20)
+	providerKey := s.providerKey.Public().(ed25519.PublicKey)
+	now := time.Now()
+
+	c, err := parseDNSCryptCert(s.cert(7, now, now.Add(time.Hour)), providerKey)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if c.cipher != xsalsa20 || c.serial != 7 || c.clientMagic != s.clientMagic || !c.valid(now) {
+		t.Errorf("got %+v", c)
+	}
+	if c.valid(now.Add(2 * time.Hour)) {
+		t.Error("valid after notAfter")
+	}
+
+	b := s.cert(7, now, now.Add(time.Hour))
+	b[len(b)-1] ^= 1
+	if _, err := parseDNSCryptCert(b, providerKey); err == nil {
+		t.Error("tampered certificate: want error")
+	}
+}
+
+func TestDNSCryptPad(t *testing.T) {
+	for _, tt := range []struct{ n, minLen, want int }{
+		{0, 0, 64},
+		{63, 0, 64},
+		{64, 0, 128},
+		{20, 256, 256},
+		{300, 256, 320},
+	} {
+		b := dnscryptPad(bytes.Repeat([]byte{1}, tt.n), tt.minLen)
+		if len(b) != tt.want {
+			t.Errorf("%d, %d: padded to %d bytes, want %d", tt.n, tt.minLen, len(b), tt.want)
+		}
+		msg, err := dnscryptUnpad(b)
+		if err != nil || len(msg) != tt.n {
+			t.Errorf("%d, %d: unpad: got %d bytes, %v", tt.n, tt.minLen, len(msg), err)
+		}
+	}
+}
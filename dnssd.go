@@ -0,0 +1,143 @@
+package resolve
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// A ServiceInstance is an instance of a service found with DNS-based
+// Service Discovery (RFC 6763).
+type ServiceInstance struct {
+	// Name is the instance's full name, such as
+	// "Office Printer._ipp._tcp.local".
+	Name string
+
+	// Host and Port are where the instance listens, from its SRV record.
+	Host string
+	Port uint16
+
+	// Text holds the key/value pairs of the instance's TXT record, with
+	// keys in lower case. Keys present without a value map to "".
+	Text map[string]string
+}
+
+// Browse returns the instances of the service _service._proto.domain, such
+// as _ipp._tcp.local, by following its PTR records to the SRV and TXT
+// records of each instance. Records included in the PTR response, as
+// multicast DNS responders do, save further queries. Instances whose
+// records can't be found are left out.
+func (r *Resolver) Browse(service, proto, domain string) ([]ServiceInstance, error) {
+	return r.BrowseContext(context.Background(), service, proto, domain)
+}
+
+// BrowseContext is like Browse, but honors ctx.
+func (r *Resolver) BrowseContext(ctx context.Context, service, proto, domain string) ([]ServiceInstance, error) {
+	name := "_" + service + "._" + proto + "." + domain
+	response, err := r.QueryContext(ctx, name, TypePTR)
+	if err != nil {
+		return nil, err
+	}
+	if err := response.Err(); err != nil {
+		return nil, err
+	}
+	known := append(response.Answers[:len(response.Answers):len(response.Answers)], response.Additionals...)
+
+	var instances []ServiceInstance
+	seen := make(map[string]bool)
+	for _, rec := range response.Answers {
+		ptr, ok := rec.RData.(PTR)
+		if !ok || !equalNames(string(rec.Name), name) || seen[strings.ToLower(ptr.Host)] {
+			continue
+		}
+		seen[strings.ToLower(ptr.Host)] = true
+
+		inst, err := r.lookupInstance(ctx, ptr.Host, known)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		instances = append(instances, inst)
+	}
+	return instances, nil
+}
+
+// LookupInstance returns the service instance with the full name name,
+// such as "Office Printer._ipp._tcp.local", from its SRV and TXT records.
+func (r *Resolver) LookupInstance(name string) (ServiceInstance, error) {
+	return r.LookupInstanceContext(context.Background(), name)
+}
+
+// LookupInstanceContext is like LookupInstance, but honors ctx.
+func (r *Resolver) LookupInstanceContext(ctx context.Context, name string) (ServiceInstance, error) {
+	return r.lookupInstance(ctx, name, nil)
+}
+
+// lookupInstance looks up the instance name, using the SRV and TXT records
+// in known if there are any, and querying for them otherwise.
+func (r *Resolver) lookupInstance(ctx context.Context, name string, known []Record) (ServiceInstance, error) {
+	inst := ServiceInstance{Name: name}
+
+	srvs, txts := instanceRecords(name, known)
+	if len(srvs) == 0 {
+		records, err := r.lookupRecords(ctx, name, TypeSRV)
+		if err != nil {
+			return ServiceInstance{}, err
+		}
+		srvs, _ = instanceRecords(name, records)
+		if len(srvs) == 0 {
+			return ServiceInstance{}, fmt.Errorf("no srv record for %s", name)
+		}
+	}
+	if len(txts) == 0 {
+		records, err := r.lookupRecords(ctx, name, TypeTXT)
+		if err != nil {
+			return ServiceInstance{}, err
+		}
+		_, txts = instanceRecords(name, records)
+	}
+
+	// An instance has one SRV record (RFC 6763, section 5).
+	inst.Host = srvs[0].Target
+	inst.Port = srvs[0].Port
+	if len(txts) > 0 {
+		inst.Text = parseServiceText(txts[0].Strings)
+	}
+	return inst, nil
+}
+
+// instanceRecords returns the SRV and TXT records for name in records.
+func instanceRecords(name string, records []Record) (srvs []SRV, txts []TXT) {
+	for _, rec := range records {
+		if !equalNames(string(rec.Name), name) {
+			continue
+		}
+		switch rdata := rec.RData.(type) {
+		case SRV:
+			srvs = append(srvs, rdata)
+		case TXT:
+			txts = append(txts, rdata)
+		}
+	}
+	return srvs, txts
+}
+
+// parseServiceText parses the key/value pairs in the strings of a DNS-SD
+// TXT record (RFC 6763, section 6). Keys are case-insensitive, and only the
+// first occurrence of a key counts.
+func parseServiceText(ss []string) map[string]string {
+	m := make(map[string]string)
+	for _, s := range ss {
+		key, value, _ := strings.Cut(s, "=")
+		key = strings.ToLower(key)
+		if key == "" {
+			continue
+		}
+		if _, ok := m[key]; !ok {
+			m[key] = value
+		}
+	}
+	return m
+}
@@ -0,0 +1,72 @@
+package resolve
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestResolver_Browse(t *testing.T) {
+	const (
+		service = "_ipp._tcp.example.com"
+		office  = "Office Printer._ipp._tcp.example.com"
+		lab     = "Lab._ipp._tcp.example.com"
+		gone    = "Gone._ipp._tcp.example.com"
+	)
+	srv := func(name, host string, port uint16) Record {
+		return Record{Name: []byte(name), Type: TypeSRV, Class: ClassIN, TTL: 120, RData: SRV{Port: port, Target: host}}
+	}
+	txt := func(name string, ss ...string) Record {
+		return Record{Name: []byte(name), Type: TypeTXT, Class: ClassIN, TTL: 120, RData: TXT{Strings: ss}}
+	}
+	ptr := func(host string) Record {
+		return Record{Name: []byte(service), Type: TypePTR, Class: ClassIN, TTL: 120, RData: PTR{Host: host}}
+	}
+
+	var (
+		mu      sync.Mutex
+		queried = make(map[Type]int)
+	)
+	r := serveUDP(t, handle(func(q *Packet) *Packet {
+		mu.Lock()
+		queried[q.Questions[0].Type]++
+		mu.Unlock()
+		p := &Packet{}
+		switch name := string(q.Questions[0].Name); {
+		case name == service:
+			// The office printer's records come along with the PTR record.
+			p.Answers = []Record{ptr(office), ptr(lab), ptr(gone), ptr(office)}
+			p.Additionals = []Record{srv(office, "office.example.com", 631), txt(office, "txtvers=1", "Color=T", "color=F", "duplex")}
+		case name == lab && q.Questions[0].Type == TypeSRV:
+			p.Answers = []Record{srv(lab, "lab.example.com", 8631)}
+		case name == lab && q.Questions[0].Type == TypeTXT:
+			p.Answers = []Record{txt(lab, "")}
+		default:
+			p.Header.Flags.SetRCode(RCodeNameError)
+		}
+		return p
+	}))
+
+	got, err := r.Browse("ipp", "tcp", "example.com")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	want := []ServiceInstance{
+		{Name: office, Host: "office.example.com", Port: 631, Text: map[string]string{"txtvers": "1", "color": "T", "duplex": ""}},
+		{Name: lab, Host: "lab.example.com", Port: 8631, Text: map[string]string{}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+	// The office printer needed no further queries.
+	mu.Lock()
+	if queried[TypeSRV] != 2 || queried[TypeTXT] != 1 {
+		t.Errorf("sent %d SRV and %d TXT queries, want 2 and 1", queried[TypeSRV], queried[TypeTXT])
+	}
+	mu.Unlock()
+
+	if _, err := r.LookupInstance(gone); err == nil {
+		t.Errorf("LookupInstance(%q): want error", gone)
+	}
+}
@@ -0,0 +1,154 @@
+package resolve
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// DefaultDoHURL is the DNS over HTTPS endpoint used when Resolver.URL is
+// empty.
+const DefaultDoHURL = "https://dns.google/dns-query"
+
+// DefaultDoHJSONURL is the DNS over HTTPS JSON API endpoint used when
+// Resolver.URL is empty.
+const DefaultDoHJSONURL = "https://dns.google/resolve"
+
+// dohMediaType is the media type of DNS messages in HTTP (RFC 8484, section
+// 6).
+const dohMediaType = "application/dns-message"
+
+// dohJSONMediaType is the media type of DNS messages in the JSON format.
+const dohJSONMediaType = "application/dns-json"
+
+func (r *Resolver) url() string {
+	if r.URL == "" {
+		if r.Protocol == ProtocolDoHJSON {
+			return DefaultDoHJSONURL
+		}
+		return DefaultDoHURL
+	}
+	return r.URL
+}
+
+func (r *Resolver) httpClient() *http.Client {
+	if r.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return r.HTTPClient
+}
+
+// exchangeDoH sends query to r's DNS over HTTPS endpoint (RFC 8484) and
+// decodes the response. The query ID is set to 0, which makes GET
+// responses cacheable.
+func (r *Resolver) exchangeDoH(ctx context.Context, query []byte) (*Packet, error) {
+	query = append([]byte(nil), query...)
+	query[0], query[1] = 0, 0
+
+	var (
+		req *http.Request
+		err error
+	)
+	switch r.HTTPMethod {
+	case "", http.MethodPost:
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, r.url(), bytes.NewReader(query))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", dohMediaType)
+	case http.MethodGet:
+		u, err := url.Parse(r.url())
+		if err != nil {
+			return nil, err
+		}
+		q := u.Query()
+		q.Set("dns", base64.RawURLEncoding.EncodeToString(query))
+		u.RawQuery = q.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported doh method %q", r.HTTPMethod)
+	}
+	req.Header.Set("Accept", dohMediaType)
+
+	resp, err := r.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh: unexpected status %s", resp.Status)
+	}
+	if mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mt != dohMediaType {
+		return nil, fmt.Errorf("doh: unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+	return ParsePacket(b)
+}
+
+// exchangeDoHJSON sends the question in query to r's DNS over HTTPS JSON
+// API endpoint and decodes the response.
+func (r *Resolver) exchangeDoHJSON(ctx context.Context, query []byte) (*Packet, error) {
+	p, err := ParsePacket(query)
+	if err != nil {
+		return nil, err
+	}
+	if len(p.Questions) != 1 {
+		return nil, fmt.Errorf("doh json: query has %d questions, want 1", len(p.Questions))
+	}
+
+	u, err := url.Parse(r.url())
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("name", string(p.Questions[0].Name))
+	q.Set("type", strconv.Itoa(int(p.Questions[0].Type)))
+	if p.Header.Flags.CD() {
+		q.Set("cd", "1")
+	}
+	if p.EDNS != nil && p.EDNS.DNSSECOK {
+		q.Set("do", "1")
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dohJSONMediaType)
+
+	resp, err := r.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh json: unexpected status %s", resp.Status)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	response := new(Packet)
+	if err := json.Unmarshal(b, response); err != nil {
+		return nil, fmt.Errorf("doh json: %w", err)
+	}
+	return response, nil
+}
@@ -0,0 +1,87 @@
+package resolve
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+// serveDoH starts a DNS over HTTPS server that answers queries with
+// answerA, and returns a Resolver that uses it. It reports the method of
+// each request on methods.
+func serveDoH(t *testing.T, methods chan<- string) *Resolver {
+	t.Helper()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		methods <- req.Method
+
+		var (
+			query []byte
+			err   error
+		)
+		switch req.Method {
+		case http.MethodGet:
+			query, err = base64.RawURLEncoding.DecodeString(req.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if ct := req.Header.Get("Content-Type"); ct != dohMediaType {
+				http.Error(w, "bad content type "+ct, http.StatusUnsupportedMediaType)
+				return
+			}
+			query, err = io.ReadAll(req.Body)
+		}
+		if err != nil || len(query) < 2 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		if query[0] != 0 || query[1] != 0 {
+			http.Error(w, "query id not zero", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", dohMediaType)
+		_, _ = w.Write(answerA(query))
+	}))
+	t.Cleanup(srv.Close)
+
+	return &Resolver{Protocol: ProtocolDoH, URL: srv.URL + "/dns-query", HTTPClient: srv.Client()}
+}
+
+func TestResolver_DoH(t *testing.T) {
+	for _, method := range []string{"", http.MethodPost, http.MethodGet} {
+		methods := make(chan string, 1)
+		r := serveDoH(t, methods)
+		r.HTTPMethod = method
+
+		got, err := r.Lookup("192.0.2.1.test", TypeA)
+		if err != nil {
+			t.Errorf("%q: error: %v", method, err)
+			continue
+		}
+		if want := netip.MustParseAddr("192.0.2.1"); got != want {
+			t.Errorf("%q: got %s, want %s", method, got, want)
+		}
+
+		want := method
+		if want == "" {
+			want = http.MethodPost
+		}
+		if got := <-methods; got != want {
+			t.Errorf("%q: sent %s request, want %s", method, got, want)
+		}
+	}
+}
+
+func TestResolver_DoH_HTTPError(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Error(w, "nope", http.StatusBadGateway)
+	}))
+	t.Cleanup(srv.Close)
+
+	r := &Resolver{Protocol: ProtocolDoH, URL: srv.URL, HTTPClient: srv.Client()}
+	if _, err := r.Lookup("example.com", TypeA); err == nil {
+		t.Error("want error")
+	}
+}
@@ -0,0 +1,123 @@
+package resolve
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// doqALPN is the ALPN token for DNS over QUIC (RFC 9250, section 4.1.1).
+const doqALPN = "doq"
+
+// A QUICConn is a QUIC connection, as needed by ProtocolDoQ. The standard
+// library has no QUIC implementation, so Resolver.DialQUIC must provide one,
+// such as a thin wrapper around a quic-go connection.
+type QUICConn interface {
+	// OpenStream opens a new bidirectional stream, waiting until the peer
+	// allows it or ctx is done.
+	OpenStream(ctx context.Context) (QUICStream, error)
+
+	// Close closes the connection.
+	Close() error
+}
+
+// A QUICStream is a bidirectional QUIC stream.
+type QUICStream interface {
+	io.Reader
+	io.Writer
+
+	// Close closes the sending side of the stream, sending a FIN. The
+	// receiving side stays open.
+	Close() error
+
+	// SetDeadline sets the read and write deadlines of the stream.
+	SetDeadline(t time.Time) error
+}
+
+// quicConn returns r's shared QUIC connection, dialing a new one if there
+// is none. fresh reports whether the connection was just dialed.
+func (r *Resolver) quicConn(ctx context.Context) (conn QUICConn, fresh bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.quic != nil {
+		return r.quic, false, nil
+	}
+	if r.DialQUIC == nil {
+		return nil, false, fmt.Errorf("doq: Resolver.DialQUIC is nil")
+	}
+	c := r.tlsConfig()
+	c.NextProtos = []string{doqALPN}
+	conn, err = r.DialQUIC(ctx, r.address(), c)
+	if err != nil {
+		return nil, false, err
+	}
+	r.quic = conn
+	return conn, true, nil
+}
+
+// dropQUICConn closes and forgets conn if it is still r's shared QUIC
+// connection.
+func (r *Resolver) dropQUICConn(conn QUICConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.quic == conn {
+		r.quic.Close()
+		r.quic = nil
+	}
+}
+
+// exchangeDoQ sends query over DNS over QUIC (RFC 9250) on a new stream of
+// r's shared connection and decodes the response. If a stream can't be
+// opened on a reused connection, the query is retried once on a new one.
+func (r *Resolver) exchangeDoQ(ctx context.Context, query []byte) (*Packet, error) {
+	// The message ID must be 0 (RFC 9250, section 4.2.1).
+	query = append([]byte(nil), query...)
+	query[0], query[1] = 0, 0
+
+	for retried := false; ; retried = true {
+		conn, fresh, err := r.quicConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		stream, err := conn.OpenStream(ctx)
+		if err != nil {
+			r.dropQUICConn(conn)
+			if !fresh && !retried && ctx.Err() == nil {
+				continue
+			}
+			return nil, err
+		}
+		return exchangeQUICStream(ctx, stream, query)
+	}
+}
+
+// exchangeQUICStream sends query on stream, which is used for this query
+// alone, and reads the response.
+func exchangeQUICStream(ctx context.Context, stream QUICStream, query []byte) (*Packet, error) {
+	stop := closeOnDone(ctx, stream)
+	defer stop()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := stream.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := WriteQueryTCP(stream, query); err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	// The client signals the end of the query with a FIN (RFC 9250,
+	// section 4.2).
+	if err := stream.Close(); err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+
+	b, err := ReadMessageTCP(stream)
+	if err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	return ParsePacket(b)
+}
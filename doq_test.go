@@ -0,0 +1,129 @@
+package resolve
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeQUICConn stands in for a QUIC connection by carrying each stream
+// over its own TCP connection, which supports the same half-close.
+type fakeQUICConn struct {
+	address string
+	opened  *int // Number of streams opened, shared by all connections.
+	mu      *sync.Mutex
+	broken  bool // OpenStream fails.
+}
+
+func (c *fakeQUICConn) OpenStream(ctx context.Context) (QUICStream, error) {
+	if c.broken {
+		return nil, errors.New("connection lost")
+	}
+	c.mu.Lock()
+	*c.opened++
+	c.mu.Unlock()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.address)
+	if err != nil {
+		return nil, err
+	}
+	return fakeQUICStream{conn.(*net.TCPConn)}, nil
+}
+
+func (c *fakeQUICConn) Close() error { return nil }
+
+type fakeQUICStream struct{ *net.TCPConn }
+
+func (s fakeQUICStream) Close() error { return s.CloseWrite() }
+
+// serveDoQ starts a DNS over QUIC server that answers queries with answerA
+// over fake QUIC streams, and returns a Resolver that uses it. Each dialed
+// connection is passed to dialed before use.
+func serveDoQ(t *testing.T, dialed func(*fakeQUICConn)) (r *Resolver, streams func() int) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	handler := func(conn net.Conn) {
+		query, err := ReadMessageTCP(conn)
+		if err != nil || query[0] != 0 || query[1] != 0 {
+			return
+		}
+		// The query must be followed by a FIN.
+		if n, err := conn.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+			return
+		}
+		_ = WriteQueryTCP(conn, answerA(query))
+	}
+	r = serveStream(t, ln, ProtocolDoQ, handler)
+
+	var (
+		mu     sync.Mutex
+		opened int
+	)
+	r.DialQUIC = func(ctx context.Context, address string, config *tls.Config) (QUICConn, error) {
+		if len(config.NextProtos) != 1 || config.NextProtos[0] != "doq" {
+			t.Errorf("NextProtos: got %q, want [doq]", config.NextProtos)
+		}
+		c := &fakeQUICConn{address: address, opened: &opened, mu: &mu}
+		if dialed != nil {
+			dialed(c)
+		}
+		return c, nil
+	}
+	return r, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return opened
+	}
+}
+
+func TestResolver_DoQ(t *testing.T) {
+	r, streams := serveDoQ(t, nil)
+
+	for _, want := range []string{"192.0.2.1", "192.0.2.2"} {
+		got, err := r.Lookup(want+".test", TypeA)
+		if err != nil {
+			t.Fatalf("%s: error: %v", want, err)
+		}
+		if got != netip.MustParseAddr(want) {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+	if got := streams(); got != 2 {
+		t.Errorf("opened %d streams, want 2", got)
+	}
+}
+
+func TestResolver_DoQ_Redial(t *testing.T) {
+	dials := 0
+	r, _ := serveDoQ(t, func(c *fakeQUICConn) { dials++ })
+
+	if _, err := r.Lookup("192.0.2.1.test", TypeA); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	r.quic.(*fakeQUICConn).broken = true
+
+	if _, err := r.Lookup("192.0.2.1.test", TypeA); err != nil {
+		t.Fatalf("after connection loss: error: %v", err)
+	}
+	if dials != 2 {
+		t.Errorf("dialed %d times, want 2", dials)
+	}
+}
+
+func TestResolver_DoQ_NoDialer(t *testing.T) {
+	r := &Resolver{Protocol: ProtocolDoQ, Server: "127.0.0.1", Timeout: time.Second}
+	if _, err := r.Lookup("example.com", TypeA); err == nil {
+		t.Error("want error")
+	}
+}
@@ -0,0 +1,317 @@
+package resolve
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+// EDNS is the EDNS(0) information carried by an OPT pseudo-record
+// (RFC 6891).
+type EDNS struct {
+	UDPSize       uint16 // Requestor's UDP payload size.
+	ExtendedRCode uint8  // Upper 8 bits of the extended 12-bit RCODE.
+	Version       uint8
+	DNSSECOK      bool // The DO bit.
+	Options       []EDNSOption
+
+	// ExtendedErrors holds the parsed Extended DNS Error options, if any. The
+	// options themselves are also kept in Options.
+	ExtendedErrors []ExtendedError
+
+	// ClientSubnet holds the parsed Client Subnet option, if any. The option
+	// itself is also kept in Options.
+	ClientSubnet *ClientSubnet
+
+	// Cookie holds the parsed Cookie option, if any. The option itself is
+	// also kept in Options.
+	Cookie *Cookie
+}
+
+// EDNSOption is an option carried in an OPT record.
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+// EDNS option codes.
+const (
+	OptionCodeClientSubnet  uint16 = 8
+	OptionCodeCookie        uint16 = 10
+	OptionCodeExtendedError uint16 = 15
+)
+
+// flagDNSSECOK is the DO bit within the OPT record's TTL field.
+const flagDNSSECOK uint32 = 1 << 15
+
+// ParseEDNS parses an OPT record. An option that is framed correctly but
+// whose data doesn't parse, such as a Client Subnet option with bits set
+// past its prefix, is kept in Options and left out of the typed fields,
+// so that it doesn't cost the message its answers.
+func ParseEDNS(r Record) (*EDNS, error) {
+	if r.Type != TypeOPT {
+		return nil, fmt.Errorf("not an opt record: type %d", r.Type)
+	}
+
+	e := &EDNS{
+		UDPSize:       uint16(r.Class),
+		ExtendedRCode: uint8(r.TTL >> 24),
+		Version:       uint8(r.TTL >> 16),
+		DNSSECOK:      r.TTL&flagDNSSECOK != 0,
+	}
+
+	data := r.Data
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("truncated edns option header")
+		}
+		code := binary.BigEndian.Uint16(data[0:])
+		n := int(binary.BigEndian.Uint16(data[2:]))
+		data = data[4:]
+		if len(data) < n {
+			return nil, fmt.Errorf("edns option %d: truncated data", code)
+		}
+		e.Options = append(e.Options, EDNSOption{Code: code, Data: data[:n]})
+
+		switch code {
+		case OptionCodeExtendedError:
+			if ee, err := parseExtendedError(data[:n]); err == nil {
+				e.ExtendedErrors = append(e.ExtendedErrors, ee)
+			}
+		case OptionCodeClientSubnet:
+			if cs, err := ParseClientSubnet(data[:n]); err == nil {
+				e.ClientSubnet = &cs
+			}
+		case OptionCodeCookie:
+			if c, err := ParseCookie(data[:n]); err == nil {
+				e.Cookie = &c
+			}
+		}
+
+		data = data[n:]
+	}
+
+	return e, nil
+}
+
+// Record returns the OPT record that carries e.
+func (e *EDNS) Record() Record {
+	ttl := uint32(e.ExtendedRCode)<<24 | uint32(e.Version)<<16
+	if e.DNSSECOK {
+		ttl |= flagDNSSECOK
+	}
+
+	var data []byte
+	for _, o := range e.Options {
+		data = binary.BigEndian.AppendUint16(data, o.Code)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(o.Data)))
+		data = append(data, o.Data...)
+	}
+
+	return Record{
+		Name:  []byte{},
+		Type:  TypeOPT,
+		Class: Class(e.UDPSize),
+		TTL:   ttl,
+		Data:  data,
+		RData: Raw{RRType: TypeOPT, Data: data},
+	}
+}
+
+// ExtendedError is an Extended DNS Error (RFC 8914), which explains why a
+// server returned an error or an unexpected answer.
+type ExtendedError struct {
+	InfoCode  uint16
+	ExtraText string
+}
+
+// Extended DNS Error info codes.
+const (
+	EDEOther                      uint16 = 0
+	EDEUnsupportedDNSKEYAlgorithm uint16 = 1
+	EDEUnsupportedDSDigestType    uint16 = 2
+	EDEStaleAnswer                uint16 = 3
+	EDEForgedAnswer               uint16 = 4
+	EDEDNSSECIndeterminate        uint16 = 5
+	EDEDNSSECBogus                uint16 = 6
+	EDESignatureExpired           uint16 = 7
+	EDESignatureNotYetValid       uint16 = 8
+	EDEDNSKEYMissing              uint16 = 9
+	EDERRSIGsMissing              uint16 = 10
+	EDENoZoneKeyBitSet            uint16 = 11
+	EDENSECMissing                uint16 = 12
+	EDECachedError                uint16 = 13
+	EDENotReady                   uint16 = 14
+	EDEBlocked                    uint16 = 15
+	EDECensored                   uint16 = 16
+	EDEFiltered                   uint16 = 17
+	EDEProhibited                 uint16 = 18
+	EDEStaleNXDOMAINAnswer        uint16 = 19
+	EDENotAuthoritative           uint16 = 20
+	EDENotSupported               uint16 = 21
+	EDENoReachableAuthority       uint16 = 22
+	EDENetworkError               uint16 = 23
+	EDEInvalidData                uint16 = 24
+)
+
+var edeNames = map[uint16]string{
+	EDEOther:                      "Other Error",
+	EDEUnsupportedDNSKEYAlgorithm: "Unsupported DNSKEY Algorithm",
+	EDEUnsupportedDSDigestType:    "Unsupported DS Digest Type",
+	EDEStaleAnswer:                "Stale Answer",
+	EDEForgedAnswer:               "Forged Answer",
+	EDEDNSSECIndeterminate:        "DNSSEC Indeterminate",
+	EDEDNSSECBogus:                "DNSSEC Bogus",
+	EDESignatureExpired:           "Signature Expired",
+	EDESignatureNotYetValid:       "Signature Not Yet Valid",
+	EDEDNSKEYMissing:              "DNSKEY Missing",
+	EDERRSIGsMissing:              "RRSIGs Missing",
+	EDENoZoneKeyBitSet:            "No Zone Key Bit Set",
+	EDENSECMissing:                "NSEC Missing",
+	EDECachedError:                "Cached Error",
+	EDENotReady:                   "Not Ready",
+	EDEBlocked:                    "Blocked",
+	EDECensored:                   "Censored",
+	EDEFiltered:                   "Filtered",
+	EDEProhibited:                 "Prohibited",
+	EDEStaleNXDOMAINAnswer:        "Stale NXDOMAIN Answer",
+	EDENotAuthoritative:           "Not Authoritative",
+	EDENotSupported:               "Not Supported",
+	EDENoReachableAuthority:       "No Reachable Authority",
+	EDENetworkError:               "Network Error",
+	EDEInvalidData:                "Invalid Data",
+}
+
+func parseExtendedError(data []byte) (ExtendedError, error) {
+	if len(data) < 2 {
+		return ExtendedError{}, fmt.Errorf("extended dns error too short: %d bytes", len(data))
+	}
+	return ExtendedError{
+		InfoCode:  binary.BigEndian.Uint16(data),
+		ExtraText: string(data[2:]),
+	}, nil
+}
+
+// Option returns the EDNS option that carries e.
+func (e ExtendedError) Option() EDNSOption {
+	data := binary.BigEndian.AppendUint16(nil, e.InfoCode)
+	return EDNSOption{Code: OptionCodeExtendedError, Data: append(data, e.ExtraText...)}
+}
+
+// String returns a human-readable description of e.
+func (e ExtendedError) String() string {
+	name, ok := edeNames[e.InfoCode]
+	if !ok {
+		name = fmt.Sprintf("Info Code %d", e.InfoCode)
+	}
+	if e.ExtraText == "" {
+		return name
+	}
+	return name + ": " + e.ExtraText
+}
+
+// ClientSubnet is the data of an EDNS Client Subnet option (RFC 7871),
+// which tells an authoritative server which network a query came from.
+type ClientSubnet struct {
+	// Source is the client's network. Its bits past the prefix length are
+	// zero.
+	Source netip.Prefix
+
+	// ScopePrefixLen is the prefix length the answer applies to. It is zero
+	// in queries.
+	ScopePrefixLen uint8
+}
+
+// ECS address families.
+const (
+	ecsFamilyIPv4 uint16 = 1
+	ecsFamilyIPv6 uint16 = 2
+)
+
+// ParseClientSubnet parses the data of a Client Subnet option.
+func ParseClientSubnet(data []byte) (ClientSubnet, error) {
+	if len(data) < 4 {
+		return ClientSubnet{}, fmt.Errorf("client subnet too short: %d bytes", len(data))
+	}
+	family := binary.BigEndian.Uint16(data)
+	sourceLen, scopeLen := int(data[2]), data[3]
+	addr := data[4:]
+
+	var ip [16]byte
+	switch family {
+	case ecsFamilyIPv4:
+		if sourceLen > 32 || int(scopeLen) > 32 {
+			return ClientSubnet{}, fmt.Errorf("client subnet prefix too long for ipv4")
+		}
+	case ecsFamilyIPv6:
+		if sourceLen > 128 || int(scopeLen) > 128 {
+			return ClientSubnet{}, fmt.Errorf("client subnet prefix too long for ipv6")
+		}
+	default:
+		return ClientSubnet{}, fmt.Errorf("unknown client subnet family %d", family)
+	}
+	if len(addr) != (sourceLen+7)/8 {
+		return ClientSubnet{}, fmt.Errorf("client subnet address is %d bytes, want %d", len(addr), (sourceLen+7)/8)
+	}
+	copy(ip[:], addr)
+
+	var a netip.Addr
+	if family == ecsFamilyIPv4 {
+		a = netip.AddrFrom4([4]byte(ip[:4]))
+	} else {
+		a = netip.AddrFrom16(ip)
+	}
+	source := netip.PrefixFrom(a, sourceLen)
+	if source.Masked() != source {
+		return ClientSubnet{}, fmt.Errorf("client subnet address has bits set past the prefix")
+	}
+
+	return ClientSubnet{Source: source, ScopePrefixLen: scopeLen}, nil
+}
+
+// Option returns the EDNS option that carries c, which must have a valid
+// Source. The source address is masked to its prefix length.
+func (c ClientSubnet) Option() EDNSOption {
+	source := c.Source.Masked()
+	family, ip := ecsFamilyIPv6, source.Addr().AsSlice()
+	if source.Addr().Is4() {
+		family = ecsFamilyIPv4
+	}
+
+	data := binary.BigEndian.AppendUint16(nil, family)
+	data = append(data, byte(source.Bits()), c.ScopePrefixLen)
+	data = append(data, ip[:(source.Bits()+7)/8]...)
+	return EDNSOption{Code: OptionCodeClientSubnet, Data: data}
+}
+
+// extractEDNS moves the OPT record, if any, out of p.Additionals and into
+// p.EDNS.
+func extractEDNS(p *Packet) error {
+	var (
+		additionals []Record
+		opt         *Record
+	)
+
+	for i, rec := range p.Additionals {
+		if rec.Type != TypeOPT {
+			additionals = append(additionals, rec)
+			continue
+		}
+		if opt != nil {
+			return fmt.Errorf("multiple opt records")
+		}
+		opt = &p.Additionals[i]
+	}
+
+	if opt == nil {
+		return nil
+	}
+
+	e, err := ParseEDNS(*opt)
+	if err != nil {
+		return err
+	}
+	p.EDNS = e
+	p.Additionals = additionals
+	return nil
+}
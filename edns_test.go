@@ -0,0 +1,175 @@
+package resolve
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// ednsPacket is a response to an A query for example.com carrying an OPT
+// record with the DO bit and a client cookie option.
+var ednsPacket = []byte("\x12\x34\x81\xa0\x00\x01\x00\x01\x00\x00\x00\x01" +
+	"\x07example\x03com\x00\x00\x01\x00\x01" +
+	"\xc0\x0c\x00\x01\x00\x01\x00\x00\x0e\x10\x00\x04\x5d\xb8\xd8\x22" +
+	"\x00\x00\x29\x04\xd0\x00\x00\x80\x00\x00\x0c\x00\x0a\x00\x08\x01\x02\x03\x04\x05\x06\x07\x08")
+
+func TestDecodePacket_EDNS(t *testing.T) {
+	want := &EDNS{
+		UDPSize:  1232,
+		DNSSECOK: true,
+		Options: []EDNSOption{
+			{Code: 10, Data: []byte("\x01\x02\x03\x04\x05\x06\x07\x08")},
+		},
+		Cookie: &Cookie{Client: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}},
+	}
+
+	p, err := DecodePacket(bytes.NewReader(ednsPacket))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if diff := cmp.Diff(want, p.EDNS); diff != "" {
+		t.Errorf("EDNS mismatch (-want, +got):\n%s", diff)
+	}
+	if len(p.Additionals) != 0 {
+		t.Errorf("OPT record left in Additionals: %v", p.Additionals)
+	}
+
+	// The OPT record is the last 23 bytes of the packet.
+	opt, err := DecodeRecord(bytes.NewReader(ednsPacket[len(ednsPacket)-23:]))
+	if err != nil {
+		t.Fatalf("DecodeRecord: %v", err)
+	}
+	if diff := cmp.Diff(opt, p.EDNS.Record(), cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("Record mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestDecodePacket_MultipleOPT(t *testing.T) {
+	in := []byte("\x12\x34\x81\x80\x00\x00\x00\x00\x00\x00\x00\x02" +
+		"\x00\x00\x29\x04\xd0\x00\x00\x00\x00\x00\x00" +
+		"\x00\x00\x29\x04\xd0\x00\x00\x00\x00\x00\x00")
+
+	if _, err := DecodePacket(bytes.NewReader(in)); err == nil {
+		t.Errorf("want error")
+	}
+}
+
+func TestParseEDNS_Truncated(t *testing.T) {
+	r := Record{Type: TypeOPT, Class: 512, Data: []byte("\x00\x0a\x00\x08\x01\x02")}
+	if _, err := ParseEDNS(r); err == nil {
+		t.Errorf("want error")
+	}
+}
+
+func TestParsePacket_MalformedEDNSOptions(t *testing.T) {
+	opts := []EDNSOption{
+		{Code: OptionCodeClientSubnet, Data: []byte("\x00\x01\x17\x00\xc0\x00\x03")}, // Bits past the /23.
+		{Code: OptionCodeCookie, Data: []byte("\x01\x02")},                           // Short client cookie.
+		{Code: OptionCodeExtendedError, Data: []byte("\x00")},                        // Short info code.
+	}
+	in := &Packet{Answers: []Record{a("www.example", "192.0.2.1")}, EDNS: &EDNS{UDPSize: 1232, Options: opts}}
+	b, err := in.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+
+	p, err := ParsePacket(b)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if len(p.Answers) != 1 {
+		t.Errorf("got %d answers, want 1", len(p.Answers))
+	}
+	if p.EDNS == nil {
+		t.Fatal("no EDNS")
+	}
+	if diff := cmp.Diff(opts, p.EDNS.Options); diff != "" {
+		t.Errorf("Options (-want, +got):\n%s", diff)
+	}
+	if p.EDNS.ClientSubnet != nil || p.EDNS.Cookie != nil || len(p.EDNS.ExtendedErrors) != 0 {
+		t.Errorf("malformed options parsed: %+v", p.EDNS)
+	}
+}
+
+func TestParseEDNS_ExtendedError(t *testing.T) {
+	// A SERVFAIL response to an A query for dnssec-failed.org, with an
+	// Extended DNS Error explaining the validation failure.
+	in := []byte("\xab\xcd\x81\x82\x00\x01\x00\x00\x00\x00\x00\x01" +
+		"\x0ddnssec-failed\x03org\x00\x00\x01\x00\x01" +
+		"\x00\x00\x29\x04\xd0\x00\x00\x00\x00\x00\x1c" +
+		"\x00\x0f\x00\x18\x00\x06no SEP matching the DS")
+
+	p, err := DecodePacket(bytes.NewReader(in))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if p.EDNS == nil {
+		t.Fatalf("no EDNS")
+	}
+
+	want := []ExtendedError{{InfoCode: EDEDNSSECBogus, ExtraText: "no SEP matching the DS"}}
+	if diff := cmp.Diff(want, p.EDNS.ExtendedErrors); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+
+	if got, want := p.EDNS.ExtendedErrors[0].String(), "DNSSEC Bogus: no SEP matching the DS"; got != want {
+		t.Errorf("String: got %q, want %q", got, want)
+	}
+}
+
+func TestClientSubnet(t *testing.T) {
+	tests := []struct {
+		cs   ClientSubnet
+		data []byte
+	}{
+		{
+			ClientSubnet{Source: netip.MustParsePrefix("192.0.2.0/24")},
+			[]byte{0, 1, 24, 0, 192, 0, 2},
+		},
+		{
+			ClientSubnet{Source: netip.MustParsePrefix("198.51.100.0/22"), ScopePrefixLen: 20},
+			[]byte{0, 1, 22, 20, 198, 51, 100},
+		},
+		{
+			ClientSubnet{Source: netip.MustParsePrefix("2001:db8::/56"), ScopePrefixLen: 48},
+			[]byte{0, 2, 56, 48, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0},
+		},
+		{
+			ClientSubnet{Source: netip.MustParsePrefix("0.0.0.0/0")},
+			[]byte{0, 1, 0, 0},
+		},
+	}
+	for _, tt := range tests {
+		o := tt.cs.Option()
+		if o.Code != OptionCodeClientSubnet || !bytes.Equal(o.Data, tt.data) {
+			t.Errorf("%v: Option: got %d %x, want %d %x", tt.cs.Source, o.Code, o.Data, OptionCodeClientSubnet, tt.data)
+		}
+
+		got, err := ParseClientSubnet(tt.data)
+		if err != nil {
+			t.Errorf("%v: error: %v", tt.cs.Source, err)
+			continue
+		}
+		if got != tt.cs {
+			t.Errorf("%v: got %+v, want %+v", tt.cs.Source, got, tt.cs)
+		}
+	}
+}
+
+func TestParseClientSubnet_Invalid(t *testing.T) {
+	invalid := []string{
+		"\x00\x01\x18",
+		"\x00\x03\x00\x00",             // Unknown family.
+		"\x00\x01\x21\x00",             // Prefix too long for IPv4.
+		"\x00\x01\x18\x00\xc0\x00",     // Address too short.
+		"\x00\x01\x17\x00\xc0\x00\x03", // Bits set past the prefix.
+	}
+	for _, in := range invalid {
+		if _, err := ParseClientSubnet([]byte(in)); err == nil {
+			t.Errorf("%q: want error", in)
+		}
+	}
+}
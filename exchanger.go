@@ -0,0 +1,36 @@
+package resolve
+
+import "context"
+
+// An Exchanger sends a DNS query and returns the response. Set as
+// Resolver.Exchanger, it replaces the Resolver's transport.
+//
+// A Resolver is itself an Exchanger, which sends queries with its Protocol:
+// UDP, TCP, DoT, DoH or any other. Middleware can wrap one to observe or
+// change queries and responses.
+type Exchanger interface {
+	Exchange(ctx context.Context, query *Packet) (*Packet, error)
+}
+
+// ExchangerFunc adapts an ordinary function to the Exchanger interface.
+type ExchangerFunc func(ctx context.Context, query *Packet) (*Packet, error)
+
+// Exchange calls f(ctx, query).
+func (f ExchangerFunc) Exchange(ctx context.Context, query *Packet) (*Packet, error) {
+	return f(ctx, query)
+}
+
+// Exchange sends query to r's upstream server as it is, with r's Exchanger
+// or Protocol, and returns the response. Unlike Query, it doesn't use r's
+// Cache, Upstreams or Routes, but failed attempts are retried. The query
+// is bounded by both ctx and r.Timeout.
+func (r *Resolver) Exchange(ctx context.Context, query *Packet) (*Packet, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout())
+	defer cancel()
+
+	b, err := query.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return r.exchange(ctx, b)
+}
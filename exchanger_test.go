@@ -0,0 +1,50 @@
+package resolve
+
+import (
+	"context"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+)
+
+func TestResolver_Exchanger(t *testing.T) {
+	var queries atomic.Int32
+	r := &Resolver{Exchanger: ExchangerFunc(func(ctx context.Context, query *Packet) (*Packet, error) {
+		queries.Add(1)
+		response := &Packet{Header: query.Header, Questions: query.Questions}
+		response.Header.Flags.SetQR(true)
+		response.Answers = []Record{a(string(query.Questions[0].Name), "192.0.2.1")}
+		return response, nil
+	})}
+
+	got, err := r.Lookup("www.example", TypeA)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if want := netip.MustParseAddr("192.0.2.1"); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("%d queries, want 1", n)
+	}
+}
+
+func TestResolver_Exchange(t *testing.T) {
+	upstream := serveUDP(t, handle(func(q *Packet) *Packet {
+		return &Packet{Answers: []Record{a(string(q.Questions[0].Name), "192.0.2.1")}}
+	}))
+
+	// Middleware that records the names queried.
+	var names []string
+	r := &Resolver{Exchanger: ExchangerFunc(func(ctx context.Context, query *Packet) (*Packet, error) {
+		names = append(names, string(query.Questions[0].Name))
+		return upstream.Exchange(ctx, query)
+	})}
+
+	if _, err := r.Lookup("www.example", TypeA); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if len(names) != 1 || names[0] != "www.example" {
+		t.Errorf("got names %q, want [www.example]", names)
+	}
+}
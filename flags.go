@@ -0,0 +1,135 @@
+package resolve
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Flags is the flags field of a DNS header (RFC 1035, section 4.1.1, with
+// the AD and CD bits from RFC 4035). Its value is the packed form sent on
+// the wire.
+type Flags uint16
+
+// Flag bits.
+const (
+	FlagResponse           Flags = 1 << 15 // QR
+	FlagAuthoritative      Flags = 1 << 10 // AA
+	FlagTruncated          Flags = 1 << 9  // TC
+	FlagRecursionDesired   Flags = 1 << 8  // RD
+	FlagRecursionAvailable Flags = 1 << 7  // RA
+	FlagZ                  Flags = 1 << 6  // Z, reserved
+	FlagAuthenticData      Flags = 1 << 5  // AD
+
+	// FlagCheckingDisabled asks a validating resolver to return data even if
+	// DNSSEC validation fails. This disables the protection DNSSEC offers, so
+	// use it only to inspect bogus responses.
+	FlagCheckingDisabled Flags = 1 << 4 // CD
+)
+
+const (
+	opcodeShift = 11
+	opcodeMask  = 0b1111 << opcodeShift
+	rcodeMask   = 0b1111
+)
+
+// An Opcode is the kind of query in a message.
+type Opcode uint8
+
+// Opcodes.
+const (
+	OpcodeQuery  Opcode = 0
+	OpcodeIQuery Opcode = 1
+	OpcodeStatus Opcode = 2
+	OpcodeNotify Opcode = 4
+	OpcodeUpdate Opcode = 5
+)
+
+func (f Flags) has(bit Flags) bool { return f&bit != 0 }
+
+func (f *Flags) set(bit Flags, v bool) {
+	if v {
+		*f |= bit
+	} else {
+		*f &^= bit
+	}
+}
+
+// QR reports whether the message is a response.
+func (f Flags) QR() bool { return f.has(FlagResponse) }
+
+// AA reports whether the answer is authoritative.
+func (f Flags) AA() bool { return f.has(FlagAuthoritative) }
+
+// TC reports whether the message was truncated.
+func (f Flags) TC() bool { return f.has(FlagTruncated) }
+
+// RD reports whether recursion is desired.
+func (f Flags) RD() bool { return f.has(FlagRecursionDesired) }
+
+// RA reports whether recursion is available.
+func (f Flags) RA() bool { return f.has(FlagRecursionAvailable) }
+
+// Z reports whether the reserved Z bit is set.
+func (f Flags) Z() bool { return f.has(FlagZ) }
+
+// AD reports whether the data is authenticated.
+func (f Flags) AD() bool { return f.has(FlagAuthenticData) }
+
+// CD reports whether checking is disabled.
+func (f Flags) CD() bool { return f.has(FlagCheckingDisabled) }
+
+// Opcode returns the opcode.
+func (f Flags) Opcode() Opcode { return Opcode(f & opcodeMask >> opcodeShift) }
+
+// RCode returns the 4-bit response code. EDNS can extend it; see
+// EDNS.ExtendedRCode.
+func (f Flags) RCode() RCode { return RCode(f & rcodeMask) }
+
+// SetQR sets or clears the QR bit.
+func (f *Flags) SetQR(v bool) { f.set(FlagResponse, v) }
+
+// SetAA sets or clears the AA bit.
+func (f *Flags) SetAA(v bool) { f.set(FlagAuthoritative, v) }
+
+// SetTC sets or clears the TC bit.
+func (f *Flags) SetTC(v bool) { f.set(FlagTruncated, v) }
+
+// SetRD sets or clears the RD bit.
+func (f *Flags) SetRD(v bool) { f.set(FlagRecursionDesired, v) }
+
+// SetRA sets or clears the RA bit.
+func (f *Flags) SetRA(v bool) { f.set(FlagRecursionAvailable, v) }
+
+// SetZ sets or clears the reserved Z bit.
+func (f *Flags) SetZ(v bool) { f.set(FlagZ, v) }
+
+// SetAD sets or clears the AD bit.
+func (f *Flags) SetAD(v bool) { f.set(FlagAuthenticData, v) }
+
+// SetCD sets or clears the CD bit.
+func (f *Flags) SetCD(v bool) { f.set(FlagCheckingDisabled, v) }
+
+// SetOpcode sets the opcode. Only the low 4 bits of op are used.
+func (f *Flags) SetOpcode(op Opcode) {
+	*f = *f&^opcodeMask | Flags(op)<<opcodeShift&opcodeMask
+}
+
+// SetRCode sets the 4-bit response code. Only the low 4 bits of rc are
+// used.
+func (f *Flags) SetRCode(rc RCode) {
+	*f = *f&^rcodeMask | Flags(rc)&rcodeMask
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler for Flags.
+func (f Flags) MarshalBinary() ([]byte, error) {
+	return binary.BigEndian.AppendUint16(nil, uint16(f)), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler for Flags.
+func (f *Flags) UnmarshalBinary(data []byte) error {
+	if len(data) != 2 {
+		return fmt.Errorf("flags must be 2 bytes, got %d", len(data))
+	}
+	*f = Flags(binary.BigEndian.Uint16(data))
+	return nil
+}
@@ -0,0 +1,69 @@
+package resolve
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFlags(t *testing.T) {
+	// The flags of examplePacket: a standard query response with RD and RA.
+	f := Flags(0x8180)
+
+	if !f.QR() || !f.RD() || !f.RA() {
+		t.Errorf("%#04x: want QR, RD and RA set", uint16(f))
+	}
+	if f.AA() || f.TC() || f.Z() || f.AD() || f.CD() {
+		t.Errorf("%#04x: want AA, TC, Z, AD and CD clear", uint16(f))
+	}
+	if f.Opcode() != OpcodeQuery {
+		t.Errorf("Opcode: got %d, want %d", f.Opcode(), OpcodeQuery)
+	}
+	if f.RCode() != 0 {
+		t.Errorf("RCode: got %d, want 0", f.RCode())
+	}
+}
+
+func TestFlags_Set(t *testing.T) {
+	var f Flags
+	f.SetQR(true)
+	f.SetOpcode(OpcodeUpdate)
+	f.SetAA(true)
+	f.SetTC(true)
+	f.SetRD(true)
+	f.SetRA(true)
+	f.SetZ(true)
+	f.SetAD(true)
+	f.SetCD(true)
+	f.SetRCode(5)
+
+	if want := Flags(0xaff5); f != want {
+		t.Errorf("got %#04x, want %#04x", uint16(f), uint16(want))
+	}
+
+	f.SetTC(false)
+	f.SetOpcode(OpcodeStatus)
+	f.SetRCode(0x13) // Only the low 4 bits fit.
+	if want := Flags(0x95f3); f != want {
+		t.Errorf("got %#04x, want %#04x", uint16(f), uint16(want))
+	}
+}
+
+func TestFlags_MarshalBinary(t *testing.T) {
+	f := FlagResponse | FlagRecursionDesired
+
+	b, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if want := []byte{0x81, 0x00}; !bytes.Equal(b, want) {
+		t.Errorf("got %q, want %q", b, want)
+	}
+
+	var got Flags
+	if err := got.UnmarshalBinary(b); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	if got != f {
+		t.Errorf("UnmarshalBinary: got %#04x, want %#04x", uint16(got), uint16(f))
+	}
+}
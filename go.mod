@@ -2,4 +2,9 @@ module github.com/clfs/resolve
 
 go 1.20
 
-require github.com/google/go-cmp v0.5.9
+require (
+	github.com/google/go-cmp v0.5.9
+	golang.org/x/crypto v0.33.0
+)
+
+require golang.org/x/sys v0.30.0 // indirect
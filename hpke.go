@@ -0,0 +1,173 @@
+package resolve
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// This file implements the base mode of HPKE (RFC 9180) for the one cipher
+// suite needed by Oblivious DoH: DHKEM(X25519, HKDF-SHA256), HKDF-SHA256
+// and AES-128-GCM.
+
+// HPKE algorithm identifiers (RFC 9180, section 7).
+const (
+	hpkeKEMX25519     = 0x0020
+	hpkeKDFHKDFSHA256 = 0x0001
+	hpkeAEADAES128GCM = 0x0001
+)
+
+const (
+	hpkeNk = 16 // AES-128-GCM key size.
+	hpkeNn = 12 // AES-128-GCM nonce size.
+	hpkeNh = 32 // HKDF-SHA256 output size.
+)
+
+func hkdfExtract(salt, ikm []byte) []byte {
+	if len(salt) == 0 {
+		salt = make([]byte, sha256.Size)
+	}
+	h := hmac.New(sha256.New, salt)
+	h.Write(ikm)
+	return h.Sum(nil)
+}
+
+func hkdfExpand(prk, info []byte, length int) []byte {
+	var out, t []byte
+	h := hmac.New(sha256.New, prk)
+	for i := byte(1); len(out) < length; i++ {
+		h.Reset()
+		h.Write(t)
+		h.Write(info)
+		h.Write([]byte{i})
+		t = h.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:length]
+}
+
+func labeledExtract(suiteID []byte, salt []byte, label string, ikm []byte) []byte {
+	b := append([]byte("HPKE-v1"), suiteID...)
+	b = append(b, label...)
+	return hkdfExtract(salt, append(b, ikm...))
+}
+
+func labeledExpand(suiteID []byte, prk []byte, label string, info []byte, length int) []byte {
+	b := binary.BigEndian.AppendUint16(nil, uint16(length))
+	b = append(b, "HPKE-v1"...)
+	b = append(b, suiteID...)
+	b = append(b, label...)
+	return hkdfExpand(prk, append(b, info...), length)
+}
+
+// hpkeContext is an HPKE encryption context.
+type hpkeContext struct {
+	aead           cipher.AEAD
+	baseNonce      []byte
+	exporterSecret []byte
+	seq            uint64
+	suiteID        []byte
+}
+
+// hpkeSetupBaseS sets up a context for sending to the holder of pkR, as
+// SetupBaseS in RFC 9180, section 5.1.1, with the ephemeral key skE.
+func hpkeSetupBaseS(skE *ecdh.PrivateKey, pkR *ecdh.PublicKey, info []byte) (enc []byte, c *hpkeContext, err error) {
+	dh, err := skE.ECDH(pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc = skE.PublicKey().Bytes()
+	c, err = hpkeKeySchedule(hpkeSharedSecret(dh, enc, pkR.Bytes()), info)
+	return enc, c, err
+}
+
+// hpkeSetupBaseR sets up a context for receiving from the sender of enc, as
+// SetupBaseR in RFC 9180, section 5.1.1.
+func hpkeSetupBaseR(enc []byte, skR *ecdh.PrivateKey, info []byte) (*hpkeContext, error) {
+	pkE, err := ecdh.X25519().NewPublicKey(enc)
+	if err != nil {
+		return nil, err
+	}
+	dh, err := skR.ECDH(pkE)
+	if err != nil {
+		return nil, err
+	}
+	return hpkeKeySchedule(hpkeSharedSecret(dh, enc, skR.PublicKey().Bytes()), info)
+}
+
+// hpkeSharedSecret is ExtractAndExpand from RFC 9180, section 4.1.
+func hpkeSharedSecret(dh, enc, pkR []byte) []byte {
+	suiteID := binary.BigEndian.AppendUint16([]byte("KEM"), hpkeKEMX25519)
+	prk := labeledExtract(suiteID, nil, "eae_prk", dh)
+	return labeledExpand(suiteID, prk, "shared_secret", append(enc[:len(enc):len(enc)], pkR...), 32)
+}
+
+// hpkeKeySchedule is KeySchedule from RFC 9180, section 5.1, in base mode.
+func hpkeKeySchedule(sharedSecret, info []byte) (*hpkeContext, error) {
+	suiteID := []byte("HPKE")
+	suiteID = binary.BigEndian.AppendUint16(suiteID, hpkeKEMX25519)
+	suiteID = binary.BigEndian.AppendUint16(suiteID, hpkeKDFHKDFSHA256)
+	suiteID = binary.BigEndian.AppendUint16(suiteID, hpkeAEADAES128GCM)
+
+	ksc := []byte{0} // mode_base
+	ksc = append(ksc, labeledExtract(suiteID, nil, "psk_id_hash", nil)...)
+	ksc = append(ksc, labeledExtract(suiteID, nil, "info_hash", info)...)
+	secret := labeledExtract(suiteID, sharedSecret, "secret", nil)
+
+	aead, err := newAESGCM(labeledExpand(suiteID, secret, "key", ksc, hpkeNk))
+	if err != nil {
+		return nil, err
+	}
+	return &hpkeContext{
+		aead:           aead,
+		baseNonce:      labeledExpand(suiteID, secret, "base_nonce", ksc, hpkeNn),
+		exporterSecret: labeledExpand(suiteID, secret, "exp", ksc, hpkeNh),
+		suiteID:        suiteID,
+	}, nil
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// nonce returns the nonce for the next message.
+func (c *hpkeContext) nonce() []byte {
+	nonce := append([]byte(nil), c.baseNonce...)
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], c.seq)
+	for i := range seq {
+		nonce[len(nonce)-8+i] ^= seq[i]
+	}
+	return nonce
+}
+
+func (c *hpkeContext) seal(aad, pt []byte) []byte {
+	ct := c.aead.Seal(nil, c.nonce(), pt, aad)
+	c.seq++
+	return ct
+}
+
+var errHPKEOpen = errors.New("hpke: message authentication failed")
+
+func (c *hpkeContext) open(aad, ct []byte) ([]byte, error) {
+	pt, err := c.aead.Open(nil, c.nonce(), ct, aad)
+	if err != nil {
+		return nil, errHPKEOpen
+	}
+	c.seq++
+	return pt, nil
+}
+
+// export derives a secret from the context, as Export in RFC 9180,
+// section 5.3.
+func (c *hpkeContext) export(exporterContext []byte, length int) []byte {
+	return labeledExpand(c.suiteID, c.exporterSecret, "sec", exporterContext, length)
+}
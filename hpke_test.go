@@ -0,0 +1,48 @@
+package resolve
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"testing"
+)
+
+func TestHPKE(t *testing.T) {
+	// RFC 9180, appendix A.1.1.
+	skE, err := ecdh.X25519().NewPrivateKey(mustHex(t, "52c4a758a802cd8b936eceea314432798d5baf2d7e9235dc084ab1b9cfa2f736"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	skR, err := ecdh.X25519().NewPrivateKey(mustHex(t, "4612c550263fc8ad58375df3f557aac531d26850903e55a9f23f21d8534e8ac8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := []byte("Ode on a Grecian Urn")
+
+	enc, sender, err := hpkeSetupBaseS(skE, skR.PublicKey(), info)
+	if err != nil {
+		t.Fatalf("SetupBaseS: %v", err)
+	}
+	if want := mustHex(t, "37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431"); !bytes.Equal(enc, want) {
+		t.Errorf("enc: got %x, want %x", enc, want)
+	}
+
+	ct := sender.seal([]byte("Count-0"), []byte("Beauty is truth, truth beauty"))
+	want := mustHex(t, "f938558b5d72f1a23810b4be2ab4f84331acc02fc97babc53a52ae8218a355a96d8770ac83d07bea87e13c512a")
+	if !bytes.Equal(ct, want) {
+		t.Errorf("ciphertext: got %x, want %x", ct, want)
+	}
+
+	got := sender.export(nil, 32)
+	if want := mustHex(t, "3853fe2b4035195a573ffc53856e77058e15d9ea064de3e59f4961d0095250ee"); !bytes.Equal(got, want) {
+		t.Errorf("export: got %x, want %x", got, want)
+	}
+
+	receiver, err := hpkeSetupBaseR(enc, skR, info)
+	if err != nil {
+		t.Fatalf("SetupBaseR: %v", err)
+	}
+	pt, err := receiver.open([]byte("Count-0"), ct)
+	if err != nil || string(pt) != "Beauty is truth, truth beauty" {
+		t.Errorf("open: got %q, %v", pt, err)
+	}
+}
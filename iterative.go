@@ -0,0 +1,344 @@
+package resolve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// A Mode is a way of resolving queries.
+type Mode int
+
+const (
+	// ModeRecursive sends queries to the upstream server, which resolves
+	// them.
+	ModeRecursive Mode = iota
+
+	// ModeIterative resolves queries without an upstream server: it starts
+	// at the root name servers and follows referrals down to the servers
+	// that are authoritative for each name. Server and Protocol are not
+	// used; queries go over UDP, and over TCP if a response is truncated.
+	ModeIterative
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeRecursive:
+		return "recursive"
+	case ModeIterative:
+		return "iterative"
+	default:
+		return fmt.Sprintf("Mode(%d)", int(m))
+	}
+}
+
+// RootServers are the IPv4 addresses of the root name servers, a through m.
+var RootServers = []netip.Addr{
+	netip.MustParseAddr("198.41.0.4"),
+	netip.MustParseAddr("170.247.170.2"),
+	netip.MustParseAddr("192.33.4.12"),
+	netip.MustParseAddr("199.7.91.13"),
+	netip.MustParseAddr("192.203.230.10"),
+	netip.MustParseAddr("192.5.5.241"),
+	netip.MustParseAddr("192.112.36.4"),
+	netip.MustParseAddr("198.97.190.53"),
+	netip.MustParseAddr("192.36.148.17"),
+	netip.MustParseAddr("192.58.128.30"),
+	netip.MustParseAddr("193.0.14.129"),
+	netip.MustParseAddr("199.7.83.42"),
+	netip.MustParseAddr("202.12.27.33"),
+}
+
+// ErrTooManyReferrals is returned when iterative resolution would follow
+// more than MaxReferrals referrals, which usually means they loop.
+var ErrTooManyReferrals = errors.New("too many referrals")
+
+// MaxReferrals is the most referrals iterative resolution follows for one
+// name before giving up.
+const MaxReferrals = 16
+
+// maxNSDepth bounds how deeply lookups of name server addresses nest, as
+// when the name server for a zone is in a zone whose name server has no
+// glue either.
+const maxNSDepth = 4
+
+// serverTimeout bounds each query to a single server in ModeIterative, so
+// that an unresponsive server leaves time to try the others.
+const serverTimeout = 2 * time.Second
+
+// roots returns the root servers to start iterative resolution from: those
+// found by priming, if r has been primed.
+func (r *Resolver) roots() []netip.Addr {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.primed != nil {
+		return r.primed
+	}
+	if len(r.Roots) == 0 {
+		return RootServers
+	}
+	return r.Roots
+}
+
+// resolveIterative resolves a query for domain and t by following
+// referrals from the root, and returns the response of the last server
+// asked. Records in it that are outside that server's zone are dropped.
+// depth is the nesting of name server lookups.
+//
+// With r.QNAMEMinimization, each zone's servers are asked only about the
+// name one label below the zone, and then about longer names until one is
+// delegated or the full name is reached (RFC 9156, section 3). If a server
+// fails a minimized query, as some do for names without records, the full
+// name is sent instead.
+func (r *Resolver) resolveIterative(ctx context.Context, domain string, t Type, depth int) (*Packet, error) {
+	zone, servers := ".", r.roots()
+	minimize, steps, labels := r.QNAMEMinimization, 0, 1
+	for referrals := 0; referrals <= MaxReferrals; {
+		qname, qtype, minimized := domain, t, false
+		if minimize && steps < maxMinimizeSteps {
+			if name, ok := childName(domain, zone, labels); ok {
+				// A is the type least likely to trip up servers, and what
+				// a resolver would ask for anyway.
+				qname, qtype, minimized = name, TypeA, true
+				steps++
+			}
+		}
+
+		response, err := r.queryServers(ctx, servers, qname, qtype)
+		var child string
+		var hosts []string
+		if err == nil {
+			child, hosts, err = referral(response, qname, zone)
+		}
+		if minimized && ctx.Err() == nil && (err != nil || child == "" && response.RCode() != RCodeSuccess) {
+			minimize = false
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if child == "" {
+			if minimized {
+				labels++
+				continue
+			}
+			response.Answers = inBailiwick(response.Answers, zone)
+			response.Authorities = inBailiwick(response.Authorities, zone)
+			response.Additionals = inBailiwick(response.Additionals, zone)
+			return response, nil
+		}
+
+		servers, err = r.nameServerAddrs(ctx, response, zone, hosts, depth)
+		if err != nil {
+			return nil, fmt.Errorf("name servers for %s: %w", fqdn(child), err)
+		}
+		zone, labels = child, 1
+		referrals++
+	}
+	return nil, ErrTooManyReferrals
+}
+
+// maxMinimizeSteps is the most minimized queries sent while resolving one
+// name, so that names with many labels, such as those under ip6.arpa, don't
+// take a query per label (RFC 9156, section 2.3).
+const maxMinimizeSteps = 10
+
+// childName returns the name made of zone and the n labels of domain just
+// below it. ok is false if that is domain itself, or domain has fewer
+// labels.
+func childName(domain, zone string, n int) (name string, ok bool) {
+	if !inDomain(domain, zone) || equalNames(domain, zone) {
+		return "", false
+	}
+	rest := strings.TrimSuffix(domain, ".")
+	if zone = strings.TrimSuffix(zone, "."); zone != "" {
+		rest = rest[:len(rest)-len(zone)-1]
+	}
+	labels := strings.Split(rest, ".")
+	if n >= len(labels) {
+		return "", false
+	}
+	name = strings.Join(labels[len(labels)-n:], ".")
+	if zone != "" {
+		name += "." + zone
+	}
+	return name, true
+}
+
+// queryServers sends a non-recursive query for domain and t to each of
+// servers in turn, until one answers with neither SERVFAIL nor REFUSED. If
+// none does, the last such response is returned.
+func (r *Resolver) queryServers(ctx context.Context, servers []netip.Addr, domain string, t Type) (*Packet, error) {
+	qname := domain
+	if r.CaseRandomization {
+		var err error
+		if qname, err = randomizeCase(domain); err != nil {
+			return nil, err
+		}
+	}
+	query := &Packet{
+		Header:    Header{ID: r.id()},
+		Questions: []Question{{Name: []byte(qname), Type: t, Class: ClassIN}},
+		EDNS:      r.edns(nil),
+	}
+	b, err := query.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	port := r.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+
+	var last *Packet
+	err = fmt.Errorf("no name servers")
+	for _, addr := range servers {
+		if r.logQueries {
+			log.Printf("querying %s for %s", addr, domain)
+		}
+		sctx, cancel := context.WithTimeout(ctx, serverTimeout)
+		response, qerr := exchange(sctx, netip.AddrPortFrom(addr, uint16(port)).String(), b, r.udpSize(), r.CaseRandomization)
+		cancel()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if qerr == nil && r.CaseRandomization {
+			if !sameCase(query, response) {
+				qerr = ErrResponseMismatch
+			} else {
+				restoreCase(response, domain)
+			}
+		}
+		if qerr != nil {
+			err = qerr
+			continue
+		}
+		if rc := response.RCode(); rc == RCodeServerFailure || rc == RCodeRefused {
+			last = response
+			continue
+		}
+		return response, nil
+	}
+	if last != nil {
+		return last, nil
+	}
+	return nil, err
+}
+
+// referral returns the zone that response delegates domain to, and the
+// host names of that zone's name servers. The zone is "" if response is
+// not a referral: a successful, non-authoritative response with no answers,
+// and NS records in the Authority section. The server for zone may only
+// delegate zones below it (its bailiwick) that hold domain, so other
+// referrals are errors.
+func referral(response *Packet, domain, zone string) (child string, hosts []string, err error) {
+	if response.RCode() != RCodeSuccess || response.Header.Flags.AA() || len(response.Answers) > 0 {
+		return "", nil, nil
+	}
+	for _, rec := range response.Authorities {
+		ns, ok := rec.RData.(NS)
+		if !ok {
+			continue
+		}
+		owner := string(rec.Name)
+		if child == "" {
+			if !inDomain(domain, owner) || !inDomain(owner, zone) || equalNames(owner, zone) {
+				return "", nil, fmt.Errorf("referral to %s from %s is out of bailiwick", fqdn(owner), fqdn(zone))
+			}
+			child = owner
+		}
+		if !equalNames(owner, child) {
+			return "", nil, fmt.Errorf("referral to both %s and %s", fqdn(child), fqdn(owner))
+		}
+		hosts = append(hosts, ns.Host)
+	}
+	return child, hosts, nil
+}
+
+// nameServerAddrs returns the addresses of the name servers hosts, from
+// the glue records in a referral by the server for zone if there are any,
+// and by resolving the host names from the root otherwise. Glue for hosts
+// outside zone is ignored, since the server isn't authoritative for them.
+// IPv4 addresses come first.
+func (r *Resolver) nameServerAddrs(ctx context.Context, referral *Packet, zone string, hosts []string, depth int) ([]netip.Addr, error) {
+	if addrs := hostAddrs(inBailiwick(referral.Additionals, zone), hosts); len(addrs) > 0 {
+		return addrs, nil
+	}
+	if depth >= maxNSDepth {
+		return nil, fmt.Errorf("name server lookups nested too deeply")
+	}
+
+	err := fmt.Errorf("no name servers")
+	for _, host := range hosts {
+		response, rerr := r.resolveIterative(ctx, host, TypeA, depth+1)
+		if rerr != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			err = rerr
+			continue
+		}
+		if addrs := hostAddrs(response.Answers, []string{host}); len(addrs) > 0 {
+			return addrs, nil
+		}
+		err = fmt.Errorf("no address for %s", fqdn(host))
+	}
+	return nil, err
+}
+
+// inBailiwick returns the records in records owned by zone or names below
+// it. It may modify the underlying array of records.
+func inBailiwick(records []Record, zone string) []Record {
+	kept := records[:0]
+	for _, rec := range records {
+		if inDomain(string(rec.Name), zone) {
+			kept = append(kept, rec)
+		}
+	}
+	return kept
+}
+
+// hostAddrs returns the addresses in the A and AAAA records in records for
+// any of hosts, IPv4 addresses first.
+func hostAddrs(records []Record, hosts []string) []netip.Addr {
+	var v4, v6 []netip.Addr
+	for _, rec := range records {
+		if rec.Type != TypeA && rec.Type != TypeAAAA {
+			continue
+		}
+		for _, host := range hosts {
+			if !equalNames(string(rec.Name), host) {
+				continue
+			}
+			if addr, err := rec.Addr(); err == nil {
+				if addr.Is4() {
+					v4 = append(v4, addr)
+				} else {
+					v6 = append(v6, addr)
+				}
+			}
+			break
+		}
+	}
+	return append(v4, v6...)
+}
+
+// inDomain reports whether name is domain or a name below it, ignoring
+// case and trailing dots.
+func inDomain(name, domain string) bool {
+	name = strings.TrimSuffix(name, ".")
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" {
+		return true
+	}
+	if len(name) == len(domain) {
+		return strings.EqualFold(name, domain)
+	}
+	return len(name) > len(domain) && name[len(name)-len(domain)-1] == '.' &&
+		strings.EqualFold(name[len(name)-len(domain):], domain)
+}
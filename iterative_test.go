@@ -0,0 +1,294 @@
+package resolve
+
+import (
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// zoneServer is a toy authoritative server for iterative resolution tests.
+// It answers from records, following CNAME records in their order, with
+// extra in the Additional section. It refers queries for names below a
+// delegated zone to that zone's name servers, with any glue in glue.
+type zoneServer struct {
+	records     []Record
+	extra       []Record
+	delegations map[string][]string // Name server hosts by zone.
+	glue        []Record
+
+	// nxdomain makes the server answer NXDOMAIN for names without
+	// records, even those with names below them, as some servers do.
+	nxdomain bool
+}
+
+func (z zoneServer) handle(q *Packet) *Packet {
+	name := string(q.Questions[0].Name)
+	p := &Packet{}
+	for zone, hosts := range z.delegations {
+		if !inDomain(name, zone) {
+			continue
+		}
+		for _, host := range hosts {
+			p.Authorities = append(p.Authorities, Record{Name: []byte(zone), Type: TypeNS, Class: ClassIN, TTL: 3600, RData: NS{Host: host}})
+		}
+		p.Additionals = z.glue
+		return p
+	}
+	p.Header.Flags.SetAA(true)
+	for _, rec := range z.records {
+		if !equalNames(string(rec.Name), name) {
+			continue
+		}
+		switch {
+		case rec.Type == q.Questions[0].Type:
+			p.Answers = append(p.Answers, rec)
+		case rec.Type == TypeCNAME:
+			// Include the chain, as servers do even for targets outside
+			// their zones.
+			p.Answers = append(p.Answers, rec)
+			name = rec.RData.(CNAME).Target
+		}
+	}
+	if len(p.Answers) == 0 && z.nxdomain {
+		p.Header.Flags.SetRCode(RCodeNameError)
+	}
+	p.Additionals = z.extra
+	return p
+}
+
+func a(name, addr string) Record {
+	return Record{Name: []byte(name), Type: TypeA, Class: ClassIN, TTL: 300, RData: A{Addr: netip.MustParseAddr(addr)}}
+}
+
+// serveZones serves each zone on its own loopback address, all on the same
+// port, and returns that port.
+func serveZones(t *testing.T, zones map[string]zoneServer, seen func(addr string, q *Packet)) int {
+	t.Helper()
+
+	// Find a free port on 127.0.0.1, and hope it is free on the other
+	// loopback addresses as well.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+
+	for addr, z := range zones {
+		addr, z := addr, z
+		serveUDPAt(t, net.JoinHostPort(addr, strconv.Itoa(port)), handle(func(q *Packet) *Packet {
+			seen(addr, q)
+			return z.handle(q)
+		}))
+	}
+	return port
+}
+
+func TestResolver_Iterative(t *testing.T) {
+	zones := map[string]zoneServer{
+		"127.0.0.1": { // The root.
+			delegations: map[string][]string{
+				"example": {"ns1.example"},
+				"test":    {"ns.example"}, // No glue.
+			},
+			glue: []Record{a("ns1.example", "127.0.0.2")},
+		},
+		"127.0.0.2": {
+			records: []Record{a("www.example", "192.0.2.1"), a("ns.example", "127.0.0.3")},
+		},
+		"127.0.0.3": {
+			records: []Record{a("www.test", "192.0.2.2")},
+		},
+	}
+	var (
+		mu        sync.Mutex
+		recursion bool
+	)
+	port := serveZones(t, zones, func(_ string, q *Packet) {
+		mu.Lock()
+		defer mu.Unlock()
+		recursion = recursion || q.Header.Flags.RD()
+	})
+
+	r := &Resolver{Mode: ModeIterative, Roots: []netip.Addr{netip.MustParseAddr("127.0.0.1")}, Port: port}
+	for domain, want := range map[string]string{"www.example": "192.0.2.1", "www.test": "192.0.2.2"} {
+		got, err := r.Lookup(domain, TypeA)
+		if err != nil {
+			t.Errorf("%s: error: %v", domain, err)
+			continue
+		}
+		if diff := cmp.Diff(want, got.String()); diff != "" {
+			t.Errorf("%s: (-want, +got):\n%s", domain, diff)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if recursion {
+		t.Error("a query asked for recursion")
+	}
+}
+
+func TestResolver_IterativeBailiwick(t *testing.T) {
+	cname := Record{Name: []byte("www.sub.example"), Type: TypeCNAME, Class: ClassIN, TTL: 300, RData: CNAME{Target: "www.test"}}
+	zones := map[string]zoneServer{
+		"127.0.0.1": {
+			delegations: map[string][]string{"example": {"ns1.example"}, "test": {"ns1.example"}},
+			glue:        []Record{a("ns1.example", "127.0.0.2")},
+		},
+		"127.0.0.2": { // Serves both example and test.
+			records:     []Record{a("ns.test", "127.0.0.3"), a("www.test", "192.0.2.4")},
+			delegations: map[string][]string{"sub.example": {"ns.test"}},
+			glue:        []Record{a("ns.test", "127.0.0.66")}, // Out of bailiwick.
+		},
+		"127.0.0.3": {
+			records: []Record{cname, a("www.test", "192.0.2.66")}, // Out of bailiwick.
+		},
+	}
+	port := serveZones(t, zones, func(string, *Packet) {})
+
+	r := &Resolver{Mode: ModeIterative, Roots: []netip.Addr{netip.MustParseAddr("127.0.0.1")}, Port: port}
+	got, err := r.Lookup("www.sub.example", TypeA)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if want := netip.MustParseAddr("192.0.2.4"); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestResolver_IterativeUpwardReferral(t *testing.T) {
+	zones := map[string]zoneServer{
+		"127.0.0.1": {
+			delegations: map[string][]string{"example": {"ns.example"}},
+			glue:        []Record{a("ns.example", "127.0.0.2")},
+		},
+		"127.0.0.2": { // Refers back to the root, which would refer here again.
+			delegations: map[string][]string{"": {"ns.example"}},
+			glue:        []Record{a("ns.example", "127.0.0.1")},
+		},
+	}
+	port := serveZones(t, zones, func(string, *Packet) {})
+
+	r := &Resolver{Mode: ModeIterative, Roots: []netip.Addr{netip.MustParseAddr("127.0.0.1")}, Port: port}
+	if _, err := r.Query("www.example", TypeA); err == nil {
+		t.Error("no error")
+	}
+}
+
+func TestResolver_QNAMEMinimization(t *testing.T) {
+	zones := map[string]zoneServer{
+		"127.0.0.1": {
+			delegations: map[string][]string{"example": {"ns.example"}},
+			glue:        []Record{a("ns.example", "127.0.0.2")},
+		},
+		"127.0.0.2": {
+			delegations: map[string][]string{"c.b.example": {"ns.example"}},
+			glue:        []Record{a("ns.example", "127.0.0.3")},
+		},
+		"127.0.0.3": {
+			records: []Record{a("www.c.b.example", "192.0.2.1")},
+		},
+	}
+	var (
+		mu   sync.Mutex
+		seen []string
+	)
+	port := serveZones(t, zones, func(addr string, q *Packet) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, addr+" "+string(q.Questions[0].Name)+" "+q.Questions[0].Type.String())
+	})
+
+	r := &Resolver{
+		Mode:              ModeIterative,
+		Roots:             []netip.Addr{netip.MustParseAddr("127.0.0.1")},
+		Port:              port,
+		QNAMEMinimization: true,
+	}
+	if _, err := r.Lookup("www.c.b.example", TypeAAAA); err == nil {
+		t.Fatal("found an AAAA record")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{
+		"127.0.0.1 example A",
+		"127.0.0.2 b.example A",
+		"127.0.0.2 c.b.example A",
+		"127.0.0.3 www.c.b.example AAAA",
+	}
+	if diff := cmp.Diff(want, seen); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+}
+
+func TestResolver_QNAMEMinimizationFallback(t *testing.T) {
+	zones := map[string]zoneServer{
+		"127.0.0.1": {
+			delegations: map[string][]string{"example": {"ns.example"}},
+			glue:        []Record{a("ns.example", "127.0.0.2")},
+		},
+		"127.0.0.2": {
+			records:  []Record{a("www.b.example", "192.0.2.1")},
+			nxdomain: true,
+		},
+	}
+	port := serveZones(t, zones, func(string, *Packet) {})
+
+	r := &Resolver{
+		Mode:              ModeIterative,
+		Roots:             []netip.Addr{netip.MustParseAddr("127.0.0.1")},
+		Port:              port,
+		QNAMEMinimization: true,
+	}
+	got, err := r.Lookup("www.b.example", TypeA)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if want := netip.MustParseAddr("192.0.2.1"); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestChildName(t *testing.T) {
+	tests := []struct {
+		domain, zone string
+		n            int
+		want         string
+		ok           bool
+	}{
+		{"www.example.com", ".", 1, "com", true},
+		{"www.example.com.", "com.", 1, "example.com", true},
+		{"www.example.com", "com", 2, "", false},
+		{"www.example.com", "www.example.com", 1, "", false},
+	}
+	for _, tt := range tests {
+		got, ok := childName(tt.domain, tt.zone, tt.n)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("childName(%q, %q, %d) = %q, %t; want %q, %t", tt.domain, tt.zone, tt.n, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestInDomain(t *testing.T) {
+	tests := []struct {
+		name, domain string
+		want         bool
+	}{
+		{"www.example.com", "example.com", true},
+		{"example.com.", "Example.COM", true},
+		{"www.example.com", ".", true},
+		{"badexample.com", "example.com", false},
+		{"com", "example.com", false},
+	}
+	for _, tt := range tests {
+		if got := inDomain(tt.name, tt.domain); got != tt.want {
+			t.Errorf("inDomain(%q, %q) = %t, want %t", tt.name, tt.domain, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package resolve
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// jsonMessage is a DNS message in the JSON format used by the DNS over HTTPS
+// JSON APIs of Google Public DNS and Cloudflare.
+type jsonMessage struct {
+	Status     RCode
+	TC         bool
+	RD         bool
+	RA         bool
+	AD         bool
+	CD         bool
+	Question   []jsonQuestion `json:",omitempty"`
+	Answer     []jsonRecord   `json:",omitempty"`
+	Authority  []jsonRecord   `json:",omitempty"`
+	Additional []jsonRecord   `json:",omitempty"`
+	Comment    string         `json:",omitempty"`
+}
+
+type jsonQuestion struct {
+	Name string `json:"name"`
+	Type Type   `json:"type"`
+}
+
+type jsonRecord struct {
+	Name string `json:"name"`
+	Type Type   `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// MarshalJSON encodes p in the JSON format of the Google Public DNS and
+// Cloudflare JSON APIs. Record data is in presentation format, and the OPT
+// record is left out.
+func (p *Packet) MarshalJSON() ([]byte, error) {
+	f := p.Header.Flags
+	m := jsonMessage{
+		Status: p.RCode(),
+		TC:     f.TC(),
+		RD:     f.RD(),
+		RA:     f.RA(),
+		AD:     f.AD(),
+		CD:     f.CD(),
+	}
+	for _, q := range p.Questions {
+		m.Question = append(m.Question, jsonQuestion{Name: fqdn(string(q.Name)), Type: q.Type})
+	}
+	m.Answer = jsonRecords(p.Answers)
+	m.Authority = jsonRecords(p.Authorities)
+	m.Additional = jsonRecords(p.Additionals)
+	return json.Marshal(m)
+}
+
+func jsonRecords(records []Record) []jsonRecord {
+	var out []jsonRecord
+	for _, r := range records {
+		rdata := r.RData
+		if rdata == nil {
+			rdata = Raw{RRType: r.Type, Data: r.Data}
+		}
+		out = append(out, jsonRecord{Name: fqdn(string(r.Name)), Type: r.Type, TTL: r.TTL, Data: rdata.String()})
+	}
+	return out
+}
+
+// UnmarshalJSON decodes p from the format written by MarshalJSON. All
+// records have class IN. Record data is parsed for the A, AAAA, NS, CNAME,
+// SOA, PTR, MX, TXT, SRV, DNAME and CAA types and for data in the generic
+// format from RFC 3597; other data is an error.
+func (p *Packet) UnmarshalJSON(b []byte) error {
+	var m jsonMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+
+	var out Packet
+	out.Header.Flags.SetQR(true)
+	out.Header.Flags.SetTC(m.TC)
+	out.Header.Flags.SetRD(m.RD)
+	out.Header.Flags.SetRA(m.RA)
+	out.Header.Flags.SetAD(m.AD)
+	out.Header.Flags.SetCD(m.CD)
+	out.Header.Flags.SetRCode(m.Status & 0xf)
+	if m.Status > 0xf {
+		out.EDNS = &EDNS{ExtendedRCode: uint8(m.Status >> 4)}
+	}
+
+	for _, q := range m.Question {
+		out.Questions = append(out.Questions, Question{Name: []byte(trimDot(q.Name)), Type: q.Type, Class: ClassIN})
+	}
+	for _, s := range []struct {
+		in  []jsonRecord
+		out *[]Record
+	}{
+		{m.Answer, &out.Answers},
+		{m.Authority, &out.Authorities},
+		{m.Additional, &out.Additionals},
+	} {
+		for _, jr := range s.in {
+			r, err := jr.record()
+			if err != nil {
+				return err
+			}
+			*s.out = append(*s.out, r)
+		}
+	}
+
+	out.Header.NumQuestions = uint16(len(out.Questions))
+	out.Header.NumAnswers = uint16(len(out.Answers))
+	out.Header.NumAuthorities = uint16(len(out.Authorities))
+	out.Header.NumAdditionals = uint16(len(out.Additionals))
+
+	*p = out
+	return nil
+}
+
+func (jr jsonRecord) record() (Record, error) {
+	rdata, err := parseRDataText(jr.Type, jr.Data)
+	if err != nil {
+		return Record{}, fmt.Errorf("%s record: %w", jr.Type, err)
+	}
+	data, err := rdata.pack(nil, nil)
+	if err != nil {
+		return Record{}, fmt.Errorf("%s record: %w", jr.Type, err)
+	}
+	return Record{Name: []byte(trimDot(jr.Name)), Type: jr.Type, Class: ClassIN, TTL: jr.TTL, Data: data, RData: rdata}, nil
+}
+
+// trimDot returns name without its trailing dot, if any.
+func trimDot(name string) string {
+	return strings.TrimSuffix(name, ".")
+}
+
+// parseRDataText parses record data of type t in presentation format.
+func parseRDataText(t Type, s string) (RData, error) {
+	fields := strings.Fields(s)
+
+	if len(fields) > 0 && fields[0] == `\#` {
+		return parseGenericRData(t, fields[1:])
+	}
+
+	switch t {
+	case TypeA, TypeAAAA:
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, err
+		}
+		if t == TypeA {
+			if !addr.Is4() {
+				return nil, fmt.Errorf("not an ipv4 address: %q", s)
+			}
+			return A{Addr: addr}, nil
+		}
+		if !addr.Is6() {
+			return nil, fmt.Errorf("not an ipv6 address: %q", s)
+		}
+		return AAAA{Addr: addr}, nil
+	case TypeNS, TypeCNAME, TypePTR, TypeDNAME:
+		if len(fields) != 1 {
+			return nil, fmt.Errorf("want a name, got %q", s)
+		}
+		name := trimDot(fields[0])
+		switch t {
+		case TypeNS:
+			return NS{Host: name}, nil
+		case TypeCNAME:
+			return CNAME{Target: name}, nil
+		case TypePTR:
+			return PTR{Host: name}, nil
+		default:
+			return DNAME{Target: name}, nil
+		}
+	case TypeMX:
+		n, err := parseUints(fields, 1, 2, 16)
+		if err != nil {
+			return nil, err
+		}
+		return MX{Preference: uint16(n[0]), Host: trimDot(fields[1])}, nil
+	case TypeSRV:
+		n, err := parseUints(fields, 3, 4, 16)
+		if err != nil {
+			return nil, err
+		}
+		return SRV{Priority: uint16(n[0]), Weight: uint16(n[1]), Port: uint16(n[2]), Target: trimDot(fields[3])}, nil
+	case TypeSOA:
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("soa has %d fields, want 7", len(fields))
+		}
+		n, err := parseUints(fields[2:], 5, 5, 32)
+		if err != nil {
+			return nil, err
+		}
+		return SOA{
+			MName:   trimDot(fields[0]),
+			RName:   trimDot(fields[1]),
+			Serial:  uint32(n[0]),
+			Refresh: uint32(n[1]),
+			Retry:   uint32(n[2]),
+			Expire:  uint32(n[3]),
+			Minimum: uint32(n[4]),
+		}, nil
+	case TypeTXT:
+		// Some servers leave out the quotes around a single string.
+		if !strings.HasPrefix(s, `"`) {
+			return TXT{Strings: []string{s}}, nil
+		}
+		ss, err := parseQuotedStrings(s)
+		if err != nil {
+			return nil, err
+		}
+		return TXT{Strings: ss}, nil
+	case TypeCAA:
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("caa has %d fields, want 3", len(fields))
+		}
+		flags, err := strconv.ParseUint(fields[0], 10, 8)
+		if err != nil {
+			return nil, err
+		}
+		value := strings.TrimSpace(s)
+		value = strings.TrimSpace(value[len(fields[0]):])
+		value = strings.TrimSpace(value[len(fields[1]):])
+		if strings.HasPrefix(value, `"`) {
+			ss, err := parseQuotedStrings(value)
+			if err != nil || len(ss) != 1 {
+				return nil, fmt.Errorf("invalid caa value %q", value)
+			}
+			value = ss[0]
+		}
+		return CAA{Flags: uint8(flags), Tag: fields[1], Value: value}, nil
+	default:
+		return nil, fmt.Errorf("can't parse %s data %q", t, s)
+	}
+}
+
+// parseGenericRData parses the fields after `\#` in the generic format from
+// RFC 3597, section 5.
+func parseGenericRData(t Type, fields []string) (RData, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf(`missing length after \#`)
+	}
+	n, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	data, err := hex.DecodeString(strings.Join(fields[1:], ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != n {
+		return nil, fmt.Errorf(`\# length %d does not match %d bytes of data`, n, len(data))
+	}
+	return Raw{RRType: t, Data: data}, nil
+}
+
+// parseUints parses the first count of fields as unsigned integers of the
+// given bit size, and checks that there are want fields in all.
+func parseUints(fields []string, count, want, bitSize int) ([]uint64, error) {
+	if len(fields) != want {
+		return nil, fmt.Errorf("got %d fields, want %d", len(fields), want)
+	}
+	n := make([]uint64, count)
+	for i := range n {
+		v, err := strconv.ParseUint(fields[i], 10, bitSize)
+		if err != nil {
+			return nil, err
+		}
+		n[i] = v
+	}
+	return n, nil
+}
+
+// parseQuotedStrings parses a sequence of quoted <character-string>s in
+// presentation format, as written by quoteCharacterString.
+func parseQuotedStrings(s string) ([]string, error) {
+	var ss []string
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return ss, nil
+		}
+		if s[0] != '"' {
+			return nil, fmt.Errorf("want quoted string at %q", s)
+		}
+
+		var b strings.Builder
+		i := 1
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] != '\\' {
+				b.WriteByte(s[i])
+				continue
+			}
+			if i+1 >= len(s) {
+				return nil, fmt.Errorf("unterminated escape")
+			}
+			if i+3 < len(s) && isDigits(s[i+1:i+4]) {
+				v, err := strconv.ParseUint(s[i+1:i+4], 10, 8)
+				if err != nil {
+					return nil, fmt.Errorf("invalid escape \\%s", s[i+1:i+4])
+				}
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+			b.WriteByte(s[i+1])
+			i++
+		}
+		if i >= len(s) {
+			return nil, fmt.Errorf("unterminated quoted string")
+		}
+		ss = append(ss, b.String())
+		s = s[i+1:]
+	}
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
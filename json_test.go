@@ -0,0 +1,156 @@
+package resolve
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// googleJSON is a response from the Google Public DNS JSON API, trimmed and
+// with a few records added to cover more types.
+const googleJSON = `{
+  "Status": 0,
+  "TC": false,
+  "RD": true,
+  "RA": true,
+  "AD": false,
+  "CD": false,
+  "Question": [{"name": "www.example.com.", "type": 1}],
+  "Answer": [
+    {"name": "www.example.com.", "type": 5, "TTL": 300, "data": "example.com."},
+    {"name": "example.com.", "type": 1, "TTL": 3600, "data": "93.184.216.34"},
+    {"name": "example.com.", "type": 16, "TTL": 60, "data": "v=spf1 -all"},
+    {"name": "example.com.", "type": 16, "TTL": 60, "data": "\"a\\\"b\" \"c\\010d\""},
+    {"name": "example.com.", "type": 15, "TTL": 60, "data": "10 mail.example.com."},
+    {"name": "example.com.", "type": 257, "TTL": 60, "data": "0 issue \"letsencrypt.org\""},
+    {"name": "example.com.", "type": 99, "TTL": 60, "data": "\\# 2 abcd"}
+  ],
+  "Authority": [
+    {"name": "example.com.", "type": 6, "TTL": 1800, "data": "ns.icann.org. noc.dns.icann.org. 2024010101 7200 3600 1209600 3600"}
+  ],
+  "Comment": "Response from 199.43.135.53."
+}`
+
+func TestPacket_UnmarshalJSON(t *testing.T) {
+	var p Packet
+	if err := json.Unmarshal([]byte(googleJSON), &p); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	if !p.Header.Flags.QR() || !p.Header.Flags.RD() || !p.Header.Flags.RA() {
+		t.Errorf("flags: got %v", p.Header.Flags)
+	}
+	if p.Header.NumAnswers != 7 || p.Header.NumAuthorities != 1 {
+		t.Errorf("counts: got %+v", p.Header)
+	}
+
+	want := []RData{
+		CNAME{Target: "example.com"},
+		A{Addr: netip.MustParseAddr("93.184.216.34")},
+		TXT{Strings: []string{"v=spf1 -all"}},
+		TXT{Strings: []string{`a"b`, "c\nd"}},
+		MX{Preference: 10, Host: "mail.example.com"},
+		CAA{Tag: "issue", Value: "letsencrypt.org"},
+		Raw{RRType: 99, Data: []byte{0xab, 0xcd}},
+		SOA{
+			MName:   "ns.icann.org",
+			RName:   "noc.dns.icann.org",
+			Serial:  2024010101,
+			Refresh: 7200,
+			Retry:   3600,
+			Expire:  1209600,
+			Minimum: 3600,
+		},
+	}
+	var got []RData
+	for _, r := range append(p.Answers, p.Authorities...) {
+		got = append(got, r.RData)
+	}
+	if diff := cmp.Diff(want, got, cmp.Comparer(func(a, b netip.Addr) bool { return a == b })); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+
+	// Data must match the RData, so the records can be packed.
+	for _, r := range p.Answers {
+		data, err := r.RData.pack(nil, nil)
+		if err != nil || !bytes.Equal(data, r.Data) {
+			t.Errorf("%s: Data %x does not match RData", r.Type, r.Data)
+		}
+	}
+}
+
+func TestPacket_JSONRoundTrip(t *testing.T) {
+	p, err := DecodePacket(bytes.NewReader(ednsPacket))
+	if err != nil {
+		t.Fatalf("DecodePacket: %v", err)
+	}
+
+	b, err := json.Marshal(p)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var got Packet
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	// The ID and OPT record are not part of the JSON format.
+	want := *p
+	want.Header.ID = 0
+	want.Header.NumAdditionals = 0
+	want.EDNS = nil
+	if diff := cmp.Diff(want, got, cmpopts.EquateEmpty(), cmp.Comparer(func(a, b netip.Addr) bool { return a == b })); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+}
+
+func TestParseRDataText_Invalid(t *testing.T) {
+	tests := []struct {
+		t Type
+		s string
+	}{
+		{TypeA, "2001:db8::1"},
+		{TypeAAAA, "192.0.2.1"},
+		{TypeMX, "mail.example.com."},
+		{TypeSOA, "ns.example.com. 1 2 3 4 5"},
+		{TypeTXT, `"unterminated`},
+		{TypeSRV, "0 5 70000 example.com."},
+		{99, `\# 3 abcd`},
+		{TypeHTTPS, "1 ."},
+	}
+	for _, tt := range tests {
+		if _, err := parseRDataText(tt.t, tt.s); err == nil {
+			t.Errorf("%s %q: want error", tt.t, tt.s)
+		}
+	}
+}
+
+func TestResolver_DoHJSON(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		if q.Get("name") != "example.com" || q.Get("type") != "1" {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", dohJSONMediaType)
+		_, _ = w.Write([]byte(`{"Status": 0, "RD": true, "RA": true,
+			"Question": [{"name": "example.com.", "type": 1}],
+			"Answer": [{"name": "example.com.", "type": 1, "TTL": 60, "data": "192.0.2.1"}]}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	r := &Resolver{Protocol: ProtocolDoHJSON, URL: srv.URL + "/resolve", HTTPClient: srv.Client()}
+	got, err := r.Lookup("example.com", TypeA)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if want := netip.MustParseAddr("192.0.2.1"); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
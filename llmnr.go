@@ -0,0 +1,66 @@
+package resolve
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// Link-Local Multicast Name Resolution (RFC 4795) group addresses and port.
+var (
+	LLMNRAddrIPv4 = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 252), Port: LLMNRPort}
+	LLMNRAddrIPv6 = &net.UDPAddr{IP: net.ParseIP("ff02::1:3"), Port: LLMNRPort}
+)
+
+// LLMNRPort is the LLMNR port.
+const LLMNRPort = 5355
+
+// llmnrAddrs returns the addresses to send LLMNR queries to: r's server if
+// it is the server for ProtocolLLMNR, and the multicast groups otherwise.
+func (r *Resolver) llmnrAddrs() ([]*net.UDPAddr, error) {
+	if r.Protocol != ProtocolLLMNR || r.Server == "" {
+		return []*net.UDPAddr{LLMNRAddrIPv4, LLMNRAddrIPv6}, nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", r.address())
+	if err != nil {
+		return nil, err
+	}
+	return []*net.UDPAddr{addr}, nil
+}
+
+// exchangeLLMNR sends query with LLMNR and merges the responses that
+// answer it, received within r's multicast window. LLMNR has no
+// recursion, so the RD bit, which is the T bit in LLMNR, is cleared.
+func (r *Resolver) exchangeLLMNR(ctx context.Context, query []byte) (*Packet, error) {
+	q, err := ParsePacket(query)
+	if err != nil {
+		return nil, err
+	}
+	q.Header.Flags.SetRD(false)
+	b, err := q.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := r.llmnrAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	// Responses must carry the query's ID and question (RFC 4795, section
+	// 2.1.1).
+	accept := func(p *Packet) bool {
+		return p.Header.ID == q.Header.ID && len(p.Questions) == 1 &&
+			equalNames(string(p.Questions[0].Name), string(q.Questions[0].Name)) &&
+			p.Questions[0].Type == q.Questions[0].Type
+	}
+	merged := &Packet{Header: Header{ID: q.Header.ID}, Questions: q.Questions}
+	return exchangeMulticast(ctx, b, addrs, r.mdnsWindow(), merged, accept)
+}
+
+// isSingleLabel reports whether domain is a single-label name, such as
+// "printer".
+func isSingleLabel(domain string) bool {
+	domain = strings.TrimSuffix(domain, ".")
+	return domain != "" && !strings.Contains(domain, ".")
+}
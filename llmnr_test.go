@@ -0,0 +1,89 @@
+package resolve
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// answerLLMNR answers LLMNR queries for A records with 192.0.2.7, and
+// reports whether the queries had the T bit set.
+func answerLLMNR(t *testing.T, tBit chan<- bool) *Resolver {
+	t.Helper()
+	return serveUDP(t, handle(func(q *Packet) *Packet {
+		select {
+		case tBit <- q.Header.Flags.RD():
+		default:
+		}
+		return &Packet{Answers: []Record{{
+			Name: q.Questions[0].Name, Type: TypeA, Class: ClassIN, TTL: 30,
+			RData: A{Addr: netip.MustParseAddr("192.0.2.7")},
+		}}}
+	}))
+}
+
+func TestResolver_LLMNR(t *testing.T) {
+	tBit := make(chan bool, 1)
+	r := answerLLMNR(t, tBit)
+	r.Protocol = ProtocolLLMNR
+	r.MDNSWindow = 100 * time.Millisecond
+
+	got, err := r.Lookup("printer", TypeA)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if want := netip.MustParseAddr("192.0.2.7"); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if <-tBit {
+		t.Error("query has the T bit set")
+	}
+}
+
+func TestResolver_LLMNRFallback(t *testing.T) {
+	responder := answerLLMNR(t, nil)
+	addr := &net.UDPAddr{IP: net.ParseIP(responder.Server), Port: responder.Port}
+	v4, v6 := LLMNRAddrIPv4, LLMNRAddrIPv6
+	LLMNRAddrIPv4, LLMNRAddrIPv6 = addr, addr
+	t.Cleanup(func() { LLMNRAddrIPv4, LLMNRAddrIPv6 = v4, v6 })
+
+	queried := make(chan string, 2)
+	r := serveUDP(t, handle(func(q *Packet) *Packet {
+		queried <- string(q.Questions[0].Name)
+		p := &Packet{}
+		p.Header.Flags.SetRCode(RCodeNameError)
+		return p
+	}))
+	r.LLMNRFallback = true
+	r.MDNSWindow = 100 * time.Millisecond
+
+	tests := []struct {
+		domain string
+		want   []string
+	}{
+		{"printer", []string{"192.0.2.7"}},
+		{"printer.example", nil}, // Not a single label.
+	}
+	for _, tt := range tests {
+		p, err := r.Query(tt.domain, TypeA)
+		if err != nil {
+			t.Fatalf("%s: error: %v", tt.domain, err)
+		}
+		if got := <-queried; got != tt.domain {
+			t.Errorf("upstream queried for %q, want %q", got, tt.domain)
+		}
+		var got []string
+		for _, rec := range p.Answers {
+			got = append(got, rec.RData.(A).Addr.String())
+		}
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("%s: (-want, +got):\n%s", tt.domain, diff)
+		}
+		if tt.want == nil && p.RCode() != RCodeNameError {
+			t.Errorf("%s: rcode %v, want %v", tt.domain, p.RCode(), RCodeNameError)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package resolve
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// Multicast DNS (RFC 6762) group addresses and port.
+var (
+	MDNSAddrIPv4 = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: MDNSPort}
+	MDNSAddrIPv6 = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: MDNSPort}
+)
+
+// MDNSPort is the multicast DNS port.
+const MDNSPort = 5353
+
+// DefaultMDNSWindow is how long ProtocolMDNS collects responses when
+// Resolver.MDNSWindow is 0.
+const DefaultMDNSWindow = time.Second
+
+// In multicast DNS, the top bit of the class is the unicast-response (QU)
+// bit in questions, and the cache-flush bit in records (RFC 6762, sections
+// 5.4 and 10.2).
+const (
+	ClassUnicastResponse Class = 1 << 15
+	ClassCacheFlush      Class = 1 << 15
+)
+
+// CacheFlush reports whether r has the multicast DNS cache-flush bit set,
+// meaning that it replaces rather than adds to cached records with the
+// same name, type and class.
+func (r Record) CacheFlush() bool {
+	return r.Class&ClassCacheFlush != 0
+}
+
+func (r *Resolver) mdnsWindow() time.Duration {
+	if r.MDNSWindow == 0 {
+		return DefaultMDNSWindow
+	}
+	return r.MDNSWindow
+}
+
+// mdnsAddrs returns the addresses to send multicast DNS queries to: r's
+// server if set, and the multicast groups otherwise.
+func (r *Resolver) mdnsAddrs() ([]*net.UDPAddr, error) {
+	if r.Server == "" {
+		return []*net.UDPAddr{MDNSAddrIPv4, MDNSAddrIPv6}, nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", r.address())
+	if err != nil {
+		return nil, err
+	}
+	return []*net.UDPAddr{addr}, nil
+}
+
+// exchangeMDNS sends query as a one-shot multicast DNS query (RFC 6762,
+// section 5.1) and collects responses until r's window ends. The answers
+// and additional records of all responses are merged into one response,
+// with the cache-flush bit cleared and duplicates dropped.
+func (r *Resolver) exchangeMDNS(ctx context.Context, query []byte) (*Packet, error) {
+	q, err := ParsePacket(query)
+	if err != nil {
+		return nil, err
+	}
+	// The ID and RD bit should be zero (RFC 6762, section 18).
+	q.Header.ID = 0
+	q.Header.Flags.SetRD(false)
+	if r.MDNSUnicast {
+		for i := range q.Questions {
+			q.Questions[i].Class |= ClassUnicastResponse
+		}
+	}
+	b, err := q.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := r.mdnsAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	merged := &Packet{Questions: q.Questions}
+	for i := range merged.Questions {
+		merged.Questions[i].Class &^= ClassUnicastResponse
+	}
+	return exchangeMulticast(ctx, b, addrs, r.mdnsWindow(), merged, func(*Packet) bool { return true })
+}
+
+// exchangeMulticast sends msg to each of addrs, and merges into merged the
+// responses received until window ends that accept reports true for. It
+// gives up only if msg can't be sent to any address.
+func exchangeMulticast(ctx context.Context, msg []byte, addrs []*net.UDPAddr, window time.Duration, merged *Packet, accept func(*Packet) bool) (*Packet, error) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	sent := false
+	for _, addr := range addrs {
+		if _, werr := conn.WriteTo(msg, addr); werr == nil {
+			sent = true
+		} else {
+			err = werr
+		}
+	}
+	if !sent {
+		return nil, err
+	}
+
+	wctx, cancel := context.WithTimeout(ctx, window)
+	defer cancel()
+	stop := closeOnDone(wctx, conn)
+	defer stop()
+	if deadline, ok := wctx.Deadline(); ok {
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	merged.Header.Flags.SetQR(true)
+	seen := make(map[string]bool)
+
+	bp := getBuf(9000) // The largest mDNS message (RFC 6762, section 17).
+	defer putBuf(bp)
+	buf := *bp
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			var netErr net.Error
+			if wctx.Err() != nil || errors.As(err, &netErr) && netErr.Timeout() {
+				return merged, nil
+			}
+			return nil, err
+		}
+
+		p, err := ParsePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		// Only successful responses to standard queries are merged, as
+		// multicast DNS requires (RFC 6762, section 18).
+		f := p.Header.Flags
+		if !f.QR() || f.Opcode() != OpcodeQuery || f.RCode() != RCodeSuccess || !accept(p) {
+			continue
+		}
+		merged.Answers = mergeMDNSRecords(merged.Answers, p.Answers, seen)
+		merged.Additionals = mergeMDNSRecords(merged.Additionals, p.Additionals, seen)
+	}
+}
+
+// mergeMDNSRecords appends the records of src not yet seen to dst, with
+// the cache-flush bit cleared.
+func mergeMDNSRecords(dst, src []Record, seen map[string]bool) []Record {
+	for _, rec := range src {
+		rec.Class &^= ClassCacheFlush
+		key := strings.ToLower(string(rec.Name)) + "\x00" + rec.Type.String() + "\x00" + rec.Class.String()
+		if rec.RData != nil {
+			key += "\x00" + rec.RData.String()
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		dst = append(dst, rec)
+	}
+	return dst
+}
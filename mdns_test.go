@@ -0,0 +1,92 @@
+package resolve
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestResolver_MDNS(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	queries := make(chan *Packet, 1)
+	go func() {
+		buf := make([]byte, 9000)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		q, err := ParsePacket(buf[:n])
+		if err != nil {
+			return
+		}
+		queries <- q
+
+		name := q.Questions[0].Name
+		a := Record{Name: name, Type: TypeA, Class: ClassIN | ClassCacheFlush, TTL: 120, RData: A{Addr: netip.MustParseAddr("192.0.2.1")}}
+		aaaa := Record{Name: name, Type: TypeAAAA, Class: ClassIN | ClassCacheFlush, TTL: 120, RData: AAAA{Addr: netip.MustParseAddr("2001:db8::1")}}
+		responses := []*Packet{
+			{Answers: []Record{a}},
+			{Questions: []Question{{Name: name, Type: TypeA, Class: ClassIN}}}, // Not a response.
+			{Answers: []Record{a}, Additionals: []Record{aaaa}},
+		}
+		responses[0].Header.Flags.SetQR(true)
+		responses[1].Header.Flags.SetAA(true)
+		responses[2].Header.Flags.SetQR(true)
+		for _, p := range responses {
+			b, err := p.MarshalBinary()
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(b, addr)
+		}
+	}()
+
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	r := &Resolver{
+		Server:      addr.IP.String(),
+		Port:        addr.Port,
+		Protocol:    ProtocolMDNS,
+		MDNSWindow:  200 * time.Millisecond,
+		MDNSUnicast: true,
+	}
+
+	start := time.Now()
+	got, err := r.Query("printer.local", TypeA)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < r.MDNSWindow {
+		t.Errorf("returned after %v, before the window ended", elapsed)
+	}
+
+	q := <-queries
+	if q.Header.ID != 0 || q.Header.Flags.RD() {
+		t.Errorf("query ID %d, RD %t: want 0 and false", q.Header.ID, q.Header.Flags.RD())
+	}
+	if q.Questions[0].Class != ClassIN|ClassUnicastResponse {
+		t.Errorf("question class %#x, want QU bit set", uint16(q.Questions[0].Class))
+	}
+
+	var rdata []RData
+	for _, rec := range append(got.Answers, got.Additionals...) {
+		if rec.CacheFlush() {
+			t.Errorf("%s: cache-flush bit not cleared", rec.Type)
+		}
+		rdata = append(rdata, rec.RData)
+	}
+	want := []RData{
+		A{Addr: netip.MustParseAddr("192.0.2.1")},
+		AAAA{Addr: netip.MustParseAddr("2001:db8::1")},
+	}
+	if diff := cmp.Diff(want, rdata, cmp.Comparer(func(a, b netip.Addr) bool { return a == b })); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,128 @@
+package resolve
+
+// Message is a partially decoded DNS message. The header is decoded
+// eagerly; each section is decoded the first time it is requested.
+//
+// Sections are stored back to back on the wire, so requesting a section
+// also decodes every section before it.
+type Message struct {
+	Header Header
+
+	msg         []byte
+	off         int // where the next undecoded section starts
+	questions   []Question
+	answers     []Record
+	authorities []Record
+	additionals []Record
+	decoded     int // number of sections decoded so far
+	err         error
+}
+
+// DecodeMessage decodes the header of a DNS message and returns a Message
+// that decodes the remaining sections on demand.
+func DecodeMessage(b []byte) (*Message, error) {
+	header, off, err := parseHeader(b, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Header: header, msg: b, off: off}, nil
+}
+
+// Questions returns the question section.
+func (m *Message) Questions() ([]Question, error) {
+	if err := m.decodeThrough(1); err != nil {
+		return nil, err
+	}
+	return m.questions, nil
+}
+
+// Answers returns the answer section.
+func (m *Message) Answers() ([]Record, error) {
+	if err := m.decodeThrough(2); err != nil {
+		return nil, err
+	}
+	return m.answers, nil
+}
+
+// Authorities returns the authority section.
+func (m *Message) Authorities() ([]Record, error) {
+	if err := m.decodeThrough(3); err != nil {
+		return nil, err
+	}
+	return m.authorities, nil
+}
+
+// Additionals returns the additional section, including any OPT record.
+func (m *Message) Additionals() ([]Record, error) {
+	if err := m.decodeThrough(4); err != nil {
+		return nil, err
+	}
+	return m.additionals, nil
+}
+
+// Packet decodes every remaining section and returns the full packet.
+func (m *Message) Packet() (*Packet, error) {
+	if err := m.decodeThrough(4); err != nil {
+		return nil, err
+	}
+	p := &Packet{
+		Header:      m.Header,
+		Questions:   m.questions,
+		Answers:     m.answers,
+		Authorities: m.authorities,
+		Additionals: m.additionals,
+	}
+	if err := extractEDNS(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// decodeThrough decodes sections until n sections have been decoded.
+// A decoding error is sticky.
+func (m *Message) decodeThrough(n int) error {
+	for m.err == nil && m.decoded < n {
+		m.err = m.decodeNext()
+	}
+	return m.err
+}
+
+// decodeNext decodes the next undecoded section.
+func (m *Message) decodeNext() error {
+	if m.decoded == 0 {
+		for i := 0; i < int(m.Header.NumQuestions); i++ {
+			q, off, err := parseQuestion(m.msg, m.off, maxNameLen)
+			if err != nil {
+				return err
+			}
+			m.off = off
+			m.questions = append(m.questions, q)
+		}
+		m.decoded++
+		return nil
+	}
+
+	var (
+		count   uint16
+		section *[]Record
+	)
+	switch m.decoded {
+	case 1:
+		count, section = m.Header.NumAnswers, &m.answers
+	case 2:
+		count, section = m.Header.NumAuthorities, &m.authorities
+	case 3:
+		count, section = m.Header.NumAdditionals, &m.additionals
+	}
+
+	for i := 0; i < int(count); i++ {
+		rec, off, err := parseRecord(m.msg, m.off, DecodeOptions{})
+		if err != nil {
+			return err
+		}
+		m.off = off
+		*section = append(*section, rec)
+	}
+	m.decoded++
+	return nil
+}
@@ -0,0 +1,82 @@
+package resolve
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// examplePacket is a response to an A query for www.example.com.
+var examplePacket = []byte("`V\x81\x80\x00\x01\x00\x01\x00\x00\x00\x00\x03www\x07example\x03com\x00\x00\x01\x00\x01\xc0\x0c\x00\x01\x00\x01\x00\x00R\x9b\x00\x04]\xb8\xd8\"")
+
+func TestDecodeMessage(t *testing.T) {
+	m, err := DecodeMessage(examplePacket)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	wantQuestions := []Question{{
+		Name:  []byte("www.example.com"),
+		Type:  TypeA,
+		Class: ClassIN,
+	}}
+	gotQuestions, err := m.Questions()
+	if err != nil {
+		t.Fatalf("Questions: %v", err)
+	}
+	if diff := cmp.Diff(wantQuestions, gotQuestions); diff != "" {
+		t.Errorf("Questions mismatch (-want, +got):\n%s", diff)
+	}
+
+	want, err := DecodePacket(bytes.NewReader(examplePacket))
+	if err != nil {
+		t.Fatalf("DecodePacket: %v", err)
+	}
+	got, err := m.Packet()
+	if err != nil {
+		t.Fatalf("Packet: %v", err)
+	}
+	if diff := cmp.Diff(want, got, cmpAddr); diff != "" {
+		t.Errorf("Packet mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestDecodeMessage_Truncated(t *testing.T) {
+	// Cut the packet in the middle of the answer section.
+	m, err := DecodeMessage(examplePacket[:len(examplePacket)-4])
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if _, err := m.Questions(); err != nil {
+		t.Errorf("Questions: %v", err)
+	}
+	if _, err := m.Answers(); err == nil {
+		t.Errorf("Answers: want error")
+	}
+	if _, err := m.Packet(); err == nil {
+		t.Errorf("Packet: want error")
+	}
+}
+
+func BenchmarkDecodeMessage_Question(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		m, err := DecodeMessage(examplePacket)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := m.Questions(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodePacket_Question(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		p, err := DecodePacket(bytes.NewReader(examplePacket))
+		if err != nil {
+			b.Fatal(err)
+		}
+		_ = p.Questions
+	}
+}
@@ -0,0 +1,88 @@
+package resolve
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+)
+
+// NetResolver returns a net.Resolver whose lookups go through r, so that
+// code written for the standard library's resolver gets r's transports,
+// cache and routing. It uses Go's own resolver, which still reads
+// /etc/hosts and takes its search domains and attempts from
+// /etc/resolv.conf, but its queries are answered by r rather than by the
+// servers listed there.
+func (r *Resolver) NetResolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			// Go's resolver speaks the stream protocol over any net.Conn
+			// that isn't a net.PacketConn, so there is no UDP size limit
+			// to deal with.
+			client, server := net.Pipe()
+			go r.serveConn(ctx, server)
+			return client, nil
+		},
+	}
+}
+
+// serveConn answers the queries read from conn, length-prefixed as over
+// TCP, until conn is closed.
+func (r *Resolver) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	for {
+		msg, err := ReadMessageTCP(conn)
+		if err != nil {
+			return
+		}
+		if err := WriteQueryTCP(conn, r.answer(ctx, msg)); err != nil {
+			return
+		}
+	}
+}
+
+// answer returns the response to the query msg, as looked up by r. If the
+// lookup fails, the response is a SERVFAIL.
+func (r *Resolver) answer(ctx context.Context, msg []byte) []byte {
+	response := &Packet{}
+	if len(msg) >= 2 {
+		response.Header.ID = binary.BigEndian.Uint16(msg)
+	}
+	response.Header.Flags.SetQR(true)
+	response.Header.Flags.SetRA(true)
+
+	query, err := ParsePacket(msg)
+	switch {
+	case err != nil:
+		response.Header.Flags.SetRCode(RCodeFormatError)
+	case query.Header.Flags.Opcode() != OpcodeQuery:
+		response.Questions = query.Questions
+		response.Header.Flags.SetOpcode(query.Header.Flags.Opcode())
+		response.Header.Flags.SetRCode(RCodeNotImplemented)
+	case len(query.Questions) != 1:
+		response.Questions = query.Questions
+		response.Header.Flags.SetRCode(RCodeFormatError)
+	default:
+		response.Questions = query.Questions
+		response.Header.Flags.SetRD(query.Header.Flags.RD())
+		q := query.Questions[0]
+		p, err := r.QueryContext(ctx, string(q.Name), q.Type)
+		if err != nil {
+			response.Header.Flags.SetRCode(RCodeServerFailure)
+			break
+		}
+		response.Header.Flags.SetRCode(p.Header.Flags.RCode())
+		response.Header.Flags.SetAD(p.Header.Flags.AD())
+		response.Answers = p.Answers
+		response.Authorities = p.Authorities
+		response.Additionals = p.Additionals
+	}
+
+	b, err := response.MarshalBinary()
+	if err != nil {
+		response.Answers, response.Authorities, response.Additionals = nil, nil, nil
+		response.Header.Flags.SetRCode(RCodeServerFailure)
+		b, _ = response.MarshalBinary()
+	}
+	return b
+}
@@ -0,0 +1,49 @@
+package resolve
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestResolver_NetResolver(t *testing.T) {
+	r := serveUDP(t, dualStack(0))
+	nr := r.NetResolver()
+
+	got, err := nr.LookupNetIP(context.Background(), "ip", "www.example")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	want := []netip.Addr{
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("192.0.2.2"),
+		netip.MustParseAddr("2001:db8::1"),
+		netip.MustParseAddr("2001:db8::2"),
+	}
+	sorted := cmpopts.SortSlices(func(a, b netip.Addr) bool { return a.Less(b) })
+	if diff := cmp.Diff(want, got, cmpAddr, sorted); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestResolver_NetResolver_NXDOMAIN(t *testing.T) {
+	r := serveUDP(t, handle(func(*Packet) *Packet {
+		p := &Packet{}
+		p.Header.Flags.SetRCode(RCodeNameError)
+		return p
+	}))
+
+	_, err := r.NetResolver().LookupNetIP(context.Background(), "ip4", "nonexistent.example")
+	if err == nil {
+		t.Fatal("no error")
+	}
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("got %v, want a not found error", err)
+	}
+}
@@ -0,0 +1,272 @@
+package resolve
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+)
+
+// odohMediaType is the media type of Oblivious DoH messages (RFC 9230,
+// section 4.1).
+const odohMediaType = "application/oblivious-dns-message"
+
+// odohVersion is the version of ObliviousDoHConfig this package supports.
+const odohVersion = 0x0001
+
+// Oblivious DoH message types (RFC 9230, section 6.1).
+const (
+	odohQuery    = 0x01
+	odohResponse = 0x02
+)
+
+// odohConfig is a target's Oblivious DoH configuration, which carries its
+// HPKE public key.
+type odohConfig struct {
+	publicKey *ecdh.PublicKey
+	keyID     []byte // Derived from the encoded config contents.
+}
+
+// parseODoHConfigs returns the first configuration with a supported
+// version and cipher suite from an encoded ObliviousDoHConfigs structure
+// (RFC 9230, section 6.1).
+func parseODoHConfigs(b []byte) (*odohConfig, error) {
+	configs, rest, ok := readVector16(b)
+	if !ok || len(rest) != 0 {
+		return nil, fmt.Errorf("odoh: malformed configs")
+	}
+
+	for len(configs) > 0 {
+		if len(configs) < 2 {
+			return nil, fmt.Errorf("odoh: malformed configs")
+		}
+		version := binary.BigEndian.Uint16(configs)
+		contents, next, ok := readVector16(configs[2:])
+		if !ok {
+			return nil, fmt.Errorf("odoh: malformed configs")
+		}
+		configs = next
+
+		if version != odohVersion || len(contents) < 8 {
+			continue
+		}
+		kem := binary.BigEndian.Uint16(contents[0:])
+		kdf := binary.BigEndian.Uint16(contents[2:])
+		aead := binary.BigEndian.Uint16(contents[4:])
+		if kem != hpkeKEMX25519 || kdf != hpkeKDFHKDFSHA256 || aead != hpkeAEADAES128GCM {
+			continue
+		}
+		pk, rest, ok := readVector16(contents[6:])
+		if !ok || len(rest) != 0 {
+			continue
+		}
+		publicKey, err := ecdh.X25519().NewPublicKey(pk)
+		if err != nil {
+			continue
+		}
+		return &odohConfig{
+			publicKey: publicKey,
+			keyID:     hkdfExpand(hkdfExtract(nil, contents), []byte("odoh key id"), hpkeNh),
+		}, nil
+	}
+	return nil, fmt.Errorf("odoh: no supported config")
+}
+
+// readVector16 reads a byte vector with a 2-byte length prefix from b.
+func readVector16(b []byte) (v, rest []byte, ok bool) {
+	if len(b) < 2 {
+		return nil, nil, false
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return nil, nil, false
+	}
+	return b[2 : 2+n], b[2+n:], true
+}
+
+func appendVector16(b, v []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(v)))
+	return append(b, v...)
+}
+
+// targetConfig returns the Oblivious DoH target's configuration, fetching
+// it from the target's well-known URI if needed. This request goes straight
+// to the target, but carries no query.
+func (r *Resolver) targetConfig(ctx context.Context) (*odohConfig, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.odoh != nil {
+		return r.odoh, nil
+	}
+
+	target, err := url.Parse(r.ODoHTarget)
+	if err != nil {
+		return nil, err
+	}
+	u := url.URL{Scheme: "https", Host: target.Host, Path: "/.well-known/odohconfigs"}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("odoh: unexpected status %s fetching config", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := parseODoHConfigs(b)
+	if err != nil {
+		return nil, err
+	}
+	r.odoh = c
+	return c, nil
+}
+
+// dropODoHConfig forgets c if it is still r's target configuration, so the
+// next query fetches it again.
+func (r *Resolver) dropODoHConfig(c *odohConfig) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.odoh == c {
+		r.odoh = nil
+	}
+}
+
+// exchangeODoH sends query encrypted to the Oblivious DoH target through
+// the proxy at r.URL (RFC 9230) and decodes the response.
+func (r *Resolver) exchangeODoH(ctx context.Context, query []byte) (*Packet, error) {
+	if r.URL == "" || r.ODoHTarget == "" {
+		return nil, fmt.Errorf("odoh: Resolver.URL and ODoHTarget must be set")
+	}
+	config, err := r.targetConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	query = append([]byte(nil), query...)
+	query[0], query[1] = 0, 0
+
+	// Pad queries to a multiple of 128 bytes, as RFC 8467 recommends.
+	plain := appendVector16(nil, query)
+	plain = appendVector16(plain, make([]byte, (128-(len(plain)+2)%128)%128))
+
+	skE, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	enc, hc, err := hpkeSetupBaseS(skE, config.publicKey, []byte("odoh query"))
+	if err != nil {
+		return nil, err
+	}
+	aad := appendVector16([]byte{odohQuery}, config.keyID)
+	msg := appendVector16([]byte{odohQuery}, config.keyID)
+	msg = appendVector16(msg, append(enc, hc.seal(aad, plain)...))
+
+	b, err := r.postODoH(ctx, msg)
+	if err != nil {
+		// The target may have rotated its key.
+		r.dropODoHConfig(config)
+		return nil, err
+	}
+
+	response, err := openODoHResponse(hc, plain, b)
+	if err != nil {
+		r.dropODoHConfig(config)
+		return nil, err
+	}
+	return ParsePacket(response)
+}
+
+// postODoH sends msg to the proxy at r.URL for the target, and returns the
+// encrypted response.
+func (r *Resolver) postODoH(ctx context.Context, msg []byte) ([]byte, error) {
+	proxy, err := url.Parse(r.URL)
+	if err != nil {
+		return nil, err
+	}
+	target, err := url.Parse(r.ODoHTarget)
+	if err != nil {
+		return nil, err
+	}
+	q := proxy.Query()
+	q.Set("targethost", target.Host)
+	q.Set("targetpath", target.Path)
+	proxy.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, proxy.String(), bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", odohMediaType)
+	req.Header.Set("Accept", odohMediaType)
+
+	resp, err := r.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("odoh: unexpected status %s", resp.Status)
+	}
+	if mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mt != odohMediaType {
+		return nil, fmt.Errorf("odoh: unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// odohResponseKey derives the key and nonce that encrypt the response to
+// the plaintext query plain (RFC 9230, section 6.4).
+func odohResponseKey(hc *hpkeContext, plain, responseNonce []byte) (key, nonce []byte) {
+	secret := hc.export([]byte("odoh response"), hpkeNk)
+	salt := appendVector16(append([]byte(nil), plain...), responseNonce)
+	prk := hkdfExtract(salt, secret)
+	return hkdfExpand(prk, []byte("odoh key"), hpkeNk), hkdfExpand(prk, []byte("odoh nonce"), hpkeNn)
+}
+
+// openODoHResponse decrypts an Oblivious DoH response message and returns
+// the DNS message in it.
+func openODoHResponse(hc *hpkeContext, plain, b []byte) ([]byte, error) {
+	if len(b) < 1 || b[0] != odohResponse {
+		return nil, fmt.Errorf("odoh: not a response message")
+	}
+	responseNonce, rest, ok := readVector16(b[1:])
+	if !ok {
+		return nil, fmt.Errorf("odoh: malformed response")
+	}
+	ct, rest, ok := readVector16(rest)
+	if !ok || len(rest) != 0 {
+		return nil, fmt.Errorf("odoh: malformed response")
+	}
+
+	key, nonce := odohResponseKey(hc, plain, responseNonce)
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	pt, err := aead.Open(nil, nonce, ct, appendVector16([]byte{odohResponse}, responseNonce))
+	if err != nil {
+		return nil, fmt.Errorf("odoh: response authentication failed")
+	}
+
+	msg, _, ok := readVector16(pt)
+	if !ok {
+		return nil, fmt.Errorf("odoh: malformed response")
+	}
+	return msg, nil
+}
@@ -0,0 +1,134 @@
+package resolve
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+)
+
+// odohConfigs returns an encoded ObliviousDoHConfigs holding a config for
+// pk, after one with an unsupported version.
+func odohConfigs(pk *ecdh.PublicKey) []byte {
+	var contents []byte
+	contents = binary.BigEndian.AppendUint16(contents, hpkeKEMX25519)
+	contents = binary.BigEndian.AppendUint16(contents, hpkeKDFHKDFSHA256)
+	contents = binary.BigEndian.AppendUint16(contents, hpkeAEADAES128GCM)
+	contents = appendVector16(contents, pk.Bytes())
+
+	configs := binary.BigEndian.AppendUint16(nil, 0xff00)
+	configs = appendVector16(configs, []byte("future"))
+	configs = binary.BigEndian.AppendUint16(configs, odohVersion)
+	configs = appendVector16(configs, contents)
+	return appendVector16(nil, configs)
+}
+
+// serveODoH starts a server that acts as both an Oblivious DoH proxy and
+// target, answering queries with answerA, and returns a Resolver that uses
+// it.
+func serveODoH(t *testing.T) *Resolver {
+	t.Helper()
+
+	sk, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configs := odohConfigs(sk.PublicKey())
+
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/.well-known/odohconfigs" {
+			_, _ = w.Write(configs)
+			return
+		}
+
+		target, _ := url.Parse(srv.URL)
+		if q := req.URL.Query(); q.Get("targethost") != target.Host || q.Get("targetpath") != "/dns-query" {
+			http.Error(w, "bad target", http.StatusBadRequest)
+			return
+		}
+		b, err := io.ReadAll(req.Body)
+		if err != nil || len(b) < 1 || b[0] != odohQuery {
+			http.Error(w, "bad message", http.StatusBadRequest)
+			return
+		}
+		keyID, rest, _ := readVector16(b[1:])
+		encrypted, _, ok := readVector16(rest)
+		if !ok || len(encrypted) < 32 {
+			http.Error(w, "bad message", http.StatusBadRequest)
+			return
+		}
+
+		hc, err := hpkeSetupBaseR(encrypted[:32], sk, []byte("odoh query"))
+		if err != nil {
+			http.Error(w, "bad key", http.StatusBadRequest)
+			return
+		}
+		plain, err := hc.open(appendVector16([]byte{odohQuery}, keyID), encrypted[32:])
+		if err != nil {
+			http.Error(w, "decryption failed", http.StatusUnauthorized)
+			return
+		}
+		query, _, _ := readVector16(plain)
+
+		responseNonce := make([]byte, 16)
+		_, _ = rand.Read(responseNonce)
+		key, nonce := odohResponseKey(hc, plain, responseNonce)
+		aead, err := newAESGCM(key)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		pt := appendVector16(appendVector16(nil, answerA(query)), nil)
+		ct := aead.Seal(nil, nonce, pt, appendVector16([]byte{odohResponse}, responseNonce))
+
+		out := appendVector16([]byte{odohResponse}, responseNonce)
+		w.Header().Set("Content-Type", odohMediaType)
+		_, _ = w.Write(appendVector16(out, ct))
+	}))
+	t.Cleanup(srv.Close)
+
+	return &Resolver{
+		Protocol:   ProtocolODoH,
+		URL:        srv.URL + "/proxy",
+		ODoHTarget: srv.URL + "/dns-query",
+		HTTPClient: srv.Client(),
+	}
+}
+
+func TestResolver_ODoH(t *testing.T) {
+	r := serveODoH(t)
+
+	for _, want := range []string{"192.0.2.1", "192.0.2.2"} {
+		got, err := r.Lookup(want+".test", TypeA)
+		if err != nil {
+			t.Fatalf("%s: error: %v", want, err)
+		}
+		if got != netip.MustParseAddr(want) {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+}
+
+func TestResolver_ODoH_NoProxy(t *testing.T) {
+	r := serveODoH(t)
+	r.URL = ""
+	if _, err := r.Lookup("192.0.2.1.test", TypeA); err == nil {
+		t.Error("want error")
+	}
+}
+
+func TestParseODoHConfigs_Unsupported(t *testing.T) {
+	in := appendVector16(nil, appendVector16(binary.BigEndian.AppendUint16(nil, 0xff00), []byte("future")))
+	if _, err := parseODoHConfigs(in); err == nil {
+		t.Error("want error")
+	}
+	if _, err := parseODoHConfigs(in[:len(in)-1]); err == nil {
+		t.Error("truncated: want error")
+	}
+}
@@ -0,0 +1,46 @@
+package resolve
+
+import "sync"
+
+// bufPool holds buffers for receiving and encoding messages, so that busy
+// resolvers don't allocate new ones for every query.
+var bufPool = sync.Pool{New: func() any { return new([]byte) }}
+
+// maxPooledBuf is the capacity of the largest buffer kept in bufPool. Any
+// DNS message fits, but larger buffers are left to the garbage collector.
+const maxPooledBuf = 64 << 10
+
+// getBuf returns a buffer of length n from bufPool. Return it with putBuf
+// once nothing refers to it any more.
+func getBuf(n int) *[]byte {
+	bp := bufPool.Get().(*[]byte)
+	if cap(*bp) < n {
+		*bp = make([]byte, n)
+	}
+	*bp = (*bp)[:n]
+	return bp
+}
+
+// putBuf returns a buffer from getBuf to bufPool.
+func putBuf(bp *[]byte) {
+	if cap(*bp) > maxPooledBuf {
+		return
+	}
+	bufPool.Put(bp)
+}
+
+// compressorPool holds compressors for encoding messages.
+var compressorPool = sync.Pool{New: func() any { return newCompressor() }}
+
+// getCompressor returns an empty compressor from compressorPool.
+func getCompressor() *compressor {
+	return compressorPool.Get().(*compressor)
+}
+
+// putCompressor empties c and returns it to compressorPool.
+func putCompressor(c *compressor) {
+	for name := range c.offsets {
+		delete(c.offsets, name)
+	}
+	compressorPool.Put(c)
+}
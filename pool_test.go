@@ -0,0 +1,87 @@
+package resolve
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestGetBuf(t *testing.T) {
+	for _, n := range []int{0, 512, 100, maxPooledBuf + 1} {
+		bp := getBuf(n)
+		if len(*bp) != n {
+			t.Errorf("getBuf(%d): got length %d", n, len(*bp))
+		}
+		putBuf(bp)
+	}
+}
+
+func TestExchangeUDP_ResponsesOutliveBuffer(t *testing.T) {
+	r := serveUDP(t, handle(func(q *Packet) *Packet {
+		return &Packet{Answers: []Record{a(string(q.Questions[0].Name), "192.0.2.1")}}
+	}))
+	address := net.JoinHostPort(r.Server, strconv.Itoa(r.Port))
+
+	// The second exchange likely reuses the first one's buffer, which must
+	// not change the first response.
+	var responses []*Packet
+	for _, name := range []string{"first.example", "second.example"} {
+		query, err := NewQuery(name, TypeA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := exchangeUDP(context.Background(), address, query, DefaultUDPSize, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		responses = append(responses, p)
+	}
+
+	if got, want := string(responses[0].Answers[0].Name), "first.example"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func BenchmarkExchangeUDP(b *testing.B) {
+	r := serveUDP(b, handle(func(q *Packet) *Packet {
+		return &Packet{Answers: []Record{a(string(q.Questions[0].Name), "192.0.2.1")}}
+	}))
+	address := net.JoinHostPort(r.Server, strconv.Itoa(r.Port))
+	query, err := NewQuery("www.example.com", TypeA)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := exchangeUDP(context.Background(), address, query, DefaultUDPSize, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPacket_MarshalBinary(b *testing.B) {
+	p, err := ParsePacket(examplePacket)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.MarshalBinary(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteQueryTCP(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := WriteQueryTCP(io.Discard, examplePacket); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package resolve
+
+import (
+	"errors"
+	"fmt"
+)
+
+// An RCode is a response code. Without EDNS it has 4 bits; EDNS extends it
+// to 12.
+type RCode uint16
+
+// Response codes.
+const (
+	RCodeSuccess        RCode = 0  // NOERROR
+	RCodeFormatError    RCode = 1  // FORMERR
+	RCodeServerFailure  RCode = 2  // SERVFAIL
+	RCodeNameError      RCode = 3  // NXDOMAIN
+	RCodeNotImplemented RCode = 4  // NOTIMP
+	RCodeRefused        RCode = 5  // REFUSED
+	RCodeYXDomain       RCode = 6  // YXDOMAIN
+	RCodeYXRRSet        RCode = 7  // YXRRSET
+	RCodeNXRRSet        RCode = 8  // NXRRSET
+	RCodeNotAuth        RCode = 9  // NOTAUTH
+	RCodeNotZone        RCode = 10 // NOTZONE
+	RCodeBadVersion     RCode = 16 // BADVERS, only with EDNS
+	RCodeBadCookie      RCode = 23 // BADCOOKIE, only with EDNS
+)
+
+var rcodeNames = map[RCode]string{
+	RCodeSuccess:        "NOERROR",
+	RCodeFormatError:    "FORMERR",
+	RCodeServerFailure:  "SERVFAIL",
+	RCodeNameError:      "NXDOMAIN",
+	RCodeNotImplemented: "NOTIMP",
+	RCodeRefused:        "REFUSED",
+	RCodeYXDomain:       "YXDOMAIN",
+	RCodeYXRRSet:        "YXRRSET",
+	RCodeNXRRSet:        "NXRRSET",
+	RCodeNotAuth:        "NOTAUTH",
+	RCodeNotZone:        "NOTZONE",
+	RCodeBadVersion:     "BADVERS",
+	RCodeBadCookie:      "BADCOOKIE",
+}
+
+func (rc RCode) String() string {
+	if s, ok := rcodeNames[rc]; ok {
+		return s
+	}
+	return fmt.Sprintf("RCODE%d", uint16(rc))
+}
+
+// Errors for common response codes.
+var (
+	ErrFormatError    = errors.New("server could not interpret the query")   // FORMERR
+	ErrServerFailure  = errors.New("server failure")                         // SERVFAIL
+	ErrNameNotFound   = errors.New("name not found")                         // NXDOMAIN
+	ErrNotImplemented = errors.New("server does not support the query kind") // NOTIMP
+	ErrRefused        = errors.New("server refused the query")               // REFUSED
+)
+
+// Err returns nil if rc is RCodeSuccess, one of the errors above for the
+// matching response codes, and a generic error otherwise.
+func (rc RCode) Err() error {
+	switch rc {
+	case RCodeSuccess:
+		return nil
+	case RCodeFormatError:
+		return ErrFormatError
+	case RCodeServerFailure:
+		return ErrServerFailure
+	case RCodeNameError:
+		return ErrNameNotFound
+	case RCodeNotImplemented:
+		return ErrNotImplemented
+	case RCodeRefused:
+		return ErrRefused
+	default:
+		return fmt.Errorf("response code %s", rc)
+	}
+}
+
+// A ResponseError reports a response with an error RCODE, along with any
+// Extended DNS Errors the server gave to explain it. It unwraps to the
+// error returned by RCode.Err, so errors.Is(err, ErrServerFailure) works.
+type ResponseError struct {
+	RCode          RCode
+	ExtendedErrors []ExtendedError
+}
+
+func (e *ResponseError) Error() string {
+	msg := e.RCode.Err().Error()
+	for _, ee := range e.ExtendedErrors {
+		msg += " (" + ee.String() + ")"
+	}
+	return msg
+}
+
+func (e *ResponseError) Unwrap() error { return e.RCode.Err() }
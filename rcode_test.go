@@ -0,0 +1,67 @@
+package resolve
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRCode_Err(t *testing.T) {
+	cases := []struct {
+		in   RCode
+		want error
+	}{
+		{RCodeSuccess, nil},
+		{RCodeFormatError, ErrFormatError},
+		{RCodeServerFailure, ErrServerFailure},
+		{RCodeNameError, ErrNameNotFound},
+		{RCodeNotImplemented, ErrNotImplemented},
+		{RCodeRefused, ErrRefused},
+	}
+
+	for _, tc := range cases {
+		if got := tc.in.Err(); !errors.Is(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.in, got, tc.want)
+		}
+	}
+
+	if err := RCodeNotZone.Err(); err == nil {
+		t.Errorf("%s: want error", RCodeNotZone)
+	}
+}
+
+func TestPacket_RCode(t *testing.T) {
+	var p Packet
+	p.Header.Flags.SetRCode(RCodeNameError)
+	if got := p.RCode(); got != RCodeNameError {
+		t.Errorf("got %s, want %s", got, RCodeNameError)
+	}
+
+	// BADVERS (16) is 0 in the header and 1 in the OPT record.
+	p.Header.Flags.SetRCode(0)
+	p.EDNS = &EDNS{ExtendedRCode: 1}
+	if got := p.RCode(); got != RCodeBadVersion {
+		t.Errorf("got %s, want %s", got, RCodeBadVersion)
+	}
+}
+
+func TestPacket_Err(t *testing.T) {
+	var p Packet
+	if err := p.Err(); err != nil {
+		t.Errorf("NOERROR: got %v, want nil", err)
+	}
+
+	p.Header.Flags.SetRCode(RCodeServerFailure)
+	p.EDNS = &EDNS{ExtendedErrors: []ExtendedError{{InfoCode: EDEDNSSECBogus, ExtraText: "no valid signature"}}}
+
+	err := p.Err()
+	if !errors.Is(err, ErrServerFailure) {
+		t.Errorf("got %v, want %v", err, ErrServerFailure)
+	}
+	var re *ResponseError
+	if !errors.As(err, &re) || len(re.ExtendedErrors) != 1 {
+		t.Fatalf("got %#v, want a *ResponseError with one extended error", err)
+	}
+	if got, want := err.Error(), "server failure (DNSSEC Bogus: no valid signature)"; got != want {
+		t.Errorf("Error: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,1000 @@
+package resolve
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// RData is the parsed data of a record. Its concrete type depends on the
+// record type: for example, the data of a TypeMX record is an MX.
+type RData interface {
+	// Type returns the record type the data belongs to.
+	Type() Type
+
+	// String returns the data in presentation format.
+	String() string
+
+	// pack appends the wire form of the data to b. Types whose names may be
+	// compressed (RFC 3597, section 4) compress them with c.
+	pack(b []byte, c *compressor) ([]byte, error)
+}
+
+// decodeRData decodes record data of type t. data is the raw record data,
+// which starts at off in msg, so that compressed names can be followed.
+// Those names may be at most maxName bytes long in wire form.
+func decodeRData(t Type, data, msg []byte, off, maxName int) (RData, error) {
+	switch t {
+	case TypeA:
+		return parseA(data)
+	case TypeAAAA:
+		return parseAAAA(data)
+	case TypeNS:
+		name, _, err := parseName(msg, off, maxName)
+		return NS{Host: string(name)}, err
+	case TypeCNAME:
+		name, _, err := parseName(msg, off, maxName)
+		return CNAME{Target: string(name)}, err
+	case TypeSOA:
+		return decodeSOA(data, msg, off, maxName)
+	case TypePTR:
+		name, _, err := parseName(msg, off, maxName)
+		return PTR{Host: string(name)}, err
+	case TypeMX:
+		return decodeMX(data, msg, off, maxName)
+	case TypeTXT:
+		return ParseTXT(data)
+	case TypeSRV:
+		return decodeSRV(data, msg, off, maxName)
+	case TypeISDN:
+		return ParseISDN(data)
+	case TypeLOC:
+		if len(data) > 0 && data[0] != 0 {
+			// Other versions are to be treated as unknown (RFC 1876,
+			// section 3).
+			return Raw{RRType: t, Data: data}, nil
+		}
+		return ParseLOC(data)
+	case TypeDNAME:
+		name, _, err := parseName(msg, off, maxName)
+		return DNAME{Target: string(name)}, err
+	case TypeATMA:
+		return ParseATMA(data)
+	case TypeNAPTR:
+		return ParseNAPTR(data)
+	case TypeSSHFP:
+		return ParseSSHFP(data)
+	case TypeRRSIG:
+		return ParseRRSIG(data)
+	case TypeTLSA:
+		return ParseTLSA(data)
+	case TypeSVCB:
+		return ParseSVCB(data)
+	case TypeHTTPS:
+		return ParseHTTPS(data)
+	case TypeCAA:
+		return ParseCAA(data)
+	case TypeAMTRELAY:
+		return ParseAMTRELAY(data)
+	default:
+		return Raw{RRType: t, Data: data}, nil
+	}
+}
+
+// appendCharacterStrings appends ss to b as <character-string>s.
+func appendCharacterStrings(b []byte, ss []string) ([]byte, error) {
+	for _, s := range ss {
+		if len(s) > 255 {
+			return nil, fmt.Errorf("character-string too long: %d bytes", len(s))
+		}
+		b = append(b, byte(len(s)))
+		b = append(b, s...)
+	}
+	return b, nil
+}
+
+// Raw is the data of a record whose type has no specific parsing.
+type Raw struct {
+	RRType Type
+	Data   []byte
+}
+
+func (r Raw) Type() Type { return r.RRType }
+
+func (r Raw) pack(b []byte, c *compressor) ([]byte, error) { return append(b, r.Data...), nil }
+
+// String returns r in the generic presentation format from RFC 3597.
+func (r Raw) String() string {
+	if len(r.Data) == 0 {
+		return `\# 0`
+	}
+	return fmt.Sprintf(`\# %d %x`, len(r.Data), r.Data)
+}
+
+// A is the data of an A record.
+type A struct {
+	Addr netip.Addr
+}
+
+func parseA(data []byte) (A, error) {
+	if len(data) != 4 {
+		return A{}, fmt.Errorf("invalid ip: %q", data)
+	}
+	addr, _ := netip.AddrFromSlice(data)
+	return A{Addr: addr}, nil
+}
+
+func (a A) Type() Type { return TypeA }
+
+func (a A) pack(b []byte, c *compressor) ([]byte, error) {
+	if !a.Addr.Is4() {
+		return nil, fmt.Errorf("a record with non-ipv4 address %s", a.Addr)
+	}
+	ip := a.Addr.As4()
+	return append(b, ip[:]...), nil
+}
+
+func (a A) String() string { return a.Addr.String() }
+
+// AAAA is the data of an AAAA record.
+type AAAA struct {
+	Addr netip.Addr
+}
+
+func parseAAAA(data []byte) (AAAA, error) {
+	if len(data) != 16 {
+		return AAAA{}, fmt.Errorf("invalid ip: %q", data)
+	}
+	addr, _ := netip.AddrFromSlice(data)
+	return AAAA{Addr: addr}, nil
+}
+
+func (a AAAA) Type() Type { return TypeAAAA }
+
+func (a AAAA) pack(b []byte, c *compressor) ([]byte, error) {
+	if !a.Addr.Is6() {
+		return nil, fmt.Errorf("aaaa record with non-ipv6 address %s", a.Addr)
+	}
+	ip := a.Addr.As16()
+	return append(b, ip[:]...), nil
+}
+
+func (a AAAA) String() string { return a.Addr.String() }
+
+// NS is the data of an NS record.
+type NS struct {
+	Host string
+}
+
+func (n NS) Type() Type { return TypeNS }
+
+func (n NS) pack(b []byte, c *compressor) ([]byte, error) { return appendName(b, n.Host, c) }
+
+func (n NS) String() string { return fqdn(n.Host) }
+
+// CNAME is the data of a CNAME record.
+type CNAME struct {
+	Target string
+}
+
+func (cn CNAME) Type() Type { return TypeCNAME }
+
+func (cn CNAME) pack(b []byte, c *compressor) ([]byte, error) {
+	return appendName(b, cn.Target, c)
+}
+
+func (cn CNAME) String() string { return fqdn(cn.Target) }
+
+// DNAME is the data of a DNAME record (RFC 6672).
+type DNAME struct {
+	Target string
+}
+
+func (d DNAME) Type() Type { return TypeDNAME }
+
+// pack doesn't compress the target, since RFC 6672 was published after RFC
+// 3597 restricted compression to the original record types.
+func (d DNAME) pack(b []byte, c *compressor) ([]byte, error) {
+	return appendName(b, d.Target, nil)
+}
+
+func (d DNAME) String() string { return fqdn(d.Target) }
+
+// SOA is the data of an SOA record.
+type SOA struct {
+	MName   string // Primary name server for the zone.
+	RName   string // Mailbox of the person responsible for the zone.
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32
+}
+
+func decodeSOA(data, msg []byte, off, maxName int) (SOA, error) {
+	mname, end, err := parseName(msg, off, maxName)
+	if err != nil {
+		return SOA{}, err
+	}
+	rname, end, err := parseName(msg, end, maxName)
+	if err != nil {
+		return SOA{}, err
+	}
+
+	if n := len(data) - (end - off); n != 20 {
+		return SOA{}, fmt.Errorf("soa has %d bytes after names, want 20", n)
+	}
+	fixed := data[end-off:]
+	return SOA{
+		MName:   string(mname),
+		RName:   string(rname),
+		Serial:  binary.BigEndian.Uint32(fixed[0:]),
+		Refresh: binary.BigEndian.Uint32(fixed[4:]),
+		Retry:   binary.BigEndian.Uint32(fixed[8:]),
+		Expire:  binary.BigEndian.Uint32(fixed[12:]),
+		Minimum: binary.BigEndian.Uint32(fixed[16:]),
+	}, nil
+}
+
+func (s SOA) Type() Type { return TypeSOA }
+
+func (s SOA) pack(b []byte, c *compressor) ([]byte, error) {
+	b, err := appendName(b, s.MName, c)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = appendName(b, s.RName, c); err != nil {
+		return nil, err
+	}
+	for _, v := range []uint32{s.Serial, s.Refresh, s.Retry, s.Expire, s.Minimum} {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b, nil
+}
+
+func (s SOA) String() string {
+	return fmt.Sprintf("%s %s %d %d %d %d %d", fqdn(s.MName), fqdn(s.RName), s.Serial, s.Refresh, s.Retry, s.Expire, s.Minimum)
+}
+
+// PTR is the data of a PTR record.
+type PTR struct {
+	Host string
+}
+
+func (p PTR) Type() Type { return TypePTR }
+
+func (p PTR) pack(b []byte, c *compressor) ([]byte, error) { return appendName(b, p.Host, c) }
+
+func (p PTR) String() string { return fqdn(p.Host) }
+
+// MX is the data of an MX record.
+type MX struct {
+	Preference uint16
+	Host       string
+}
+
+func decodeMX(data, msg []byte, off, maxName int) (MX, error) {
+	if len(data) < 3 {
+		return MX{}, fmt.Errorf("mx too short: %d bytes", len(data))
+	}
+	host, _, err := parseName(msg, off+2, maxName)
+	if err != nil {
+		return MX{}, err
+	}
+	return MX{Preference: binary.BigEndian.Uint16(data), Host: string(host)}, nil
+}
+
+func (m MX) Type() Type { return TypeMX }
+
+func (m MX) pack(b []byte, c *compressor) ([]byte, error) {
+	b = binary.BigEndian.AppendUint16(b, m.Preference)
+	return appendName(b, m.Host, c)
+}
+
+func (m MX) String() string { return fmt.Sprintf("%d %s", m.Preference, fqdn(m.Host)) }
+
+// SRV is the data of an SRV record.
+type SRV struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+func decodeSRV(data, msg []byte, off, maxName int) (SRV, error) {
+	if len(data) < 7 {
+		return SRV{}, fmt.Errorf("srv too short: %d bytes", len(data))
+	}
+	// RFC 2782 forbids compressing the target, but RFC 3597 asks decoders to
+	// accept it anyway.
+	target, _, err := parseName(msg, off+6, maxName)
+	if err != nil {
+		return SRV{}, err
+	}
+	return SRV{
+		Priority: binary.BigEndian.Uint16(data[0:]),
+		Weight:   binary.BigEndian.Uint16(data[2:]),
+		Port:     binary.BigEndian.Uint16(data[4:]),
+		Target:   string(target),
+	}, nil
+}
+
+func (s SRV) Type() Type { return TypeSRV }
+
+func (s SRV) pack(b []byte, c *compressor) ([]byte, error) {
+	b = binary.BigEndian.AppendUint16(b, s.Priority)
+	b = binary.BigEndian.AppendUint16(b, s.Weight)
+	b = binary.BigEndian.AppendUint16(b, s.Port)
+	return appendName(b, s.Target, nil)
+}
+
+func (s SRV) String() string {
+	return fmt.Sprintf("%d %d %d %s", s.Priority, s.Weight, s.Port, fqdn(s.Target))
+}
+
+// TXT is the data of a TXT record.
+type TXT struct {
+	Strings []string
+}
+
+// ParseTXT parses the data of a TXT record.
+func ParseTXT(data []byte) (TXT, error) {
+	ss, err := parseCharacterStrings(data)
+	if err != nil {
+		return TXT{}, err
+	}
+	return TXT{Strings: ss}, nil
+}
+
+func (t TXT) Type() Type { return TypeTXT }
+
+func (t TXT) pack(b []byte, c *compressor) ([]byte, error) {
+	return appendCharacterStrings(b, t.Strings)
+}
+
+func (t TXT) String() string {
+	quoted := make([]string, len(t.Strings))
+	for i, s := range t.Strings {
+		quoted[i] = quoteCharacterString(s)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// fqdn returns name in presentation format, with a trailing dot.
+func fqdn(name string) string {
+	return name + "."
+}
+
+// decodeRDataName decodes an uncompressed domain name that makes up the
+// whole of b.
+func decodeRDataName(b []byte) (string, error) {
+	name, end, err := parseName(b, 0, maxNameLen)
+	if err != nil {
+		return "", err
+	}
+	if end != len(b) {
+		return "", fmt.Errorf("%d trailing bytes after name", len(b)-end)
+	}
+	return string(name), nil
+}
+
+// parseCharacterStrings splits b into its <character-string>s (RFC 1035,
+// section 3.3).
+func parseCharacterStrings(b []byte) ([]string, error) {
+	var ss []string
+	for len(b) > 0 {
+		n := int(b[0])
+		if len(b) < 1+n {
+			return nil, fmt.Errorf("character-string overruns data: need %d bytes, have %d", n, len(b)-1)
+		}
+		ss = append(ss, string(b[1:1+n]))
+		b = b[1+n:]
+	}
+	return ss, nil
+}
+
+// quoteCharacterString returns s as a quoted <character-string> in
+// presentation format.
+func quoteCharacterString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// AMT relay types.
+const (
+	AMTRelayNone uint8 = 0
+	AMTRelayIPv4 uint8 = 1
+	AMTRelayIPv6 uint8 = 2
+	AMTRelayName uint8 = 3
+)
+
+// AMTRELAY is the data of an AMTRELAY record (RFC 8777).
+type AMTRELAY struct {
+	Precedence        uint8
+	DiscoveryOptional bool
+	RelayType         uint8
+	RelayAddr         netip.Addr // Set if RelayType is AMTRelayIPv4 or AMTRelayIPv6.
+	RelayName         string     // Set if RelayType is AMTRelayName.
+}
+
+// ParseAMTRELAY parses the data of an AMTRELAY record.
+func ParseAMTRELAY(data []byte) (AMTRELAY, error) {
+	var a AMTRELAY
+
+	if len(data) < 2 {
+		return a, fmt.Errorf("amtrelay too short: %d bytes", len(data))
+	}
+	a.Precedence = data[0]
+	a.DiscoveryOptional = data[1]&0b1000_0000 != 0
+	a.RelayType = data[1] & 0b0111_1111
+
+	relay := data[2:]
+
+	switch a.RelayType {
+	case AMTRelayNone:
+		if len(relay) != 0 {
+			return a, fmt.Errorf("amtrelay: unexpected relay for type 0")
+		}
+	case AMTRelayIPv4, AMTRelayIPv6:
+		addr, ok := netip.AddrFromSlice(relay)
+		if !ok || addr.Is4() != (a.RelayType == AMTRelayIPv4) {
+			return a, fmt.Errorf("invalid ip: %q", relay)
+		}
+		a.RelayAddr = addr
+	case AMTRelayName:
+		name, err := decodeRDataName(relay)
+		if err != nil {
+			return a, err
+		}
+		a.RelayName = name
+	default:
+		return a, fmt.Errorf("unknown amtrelay relay type %d", a.RelayType)
+	}
+
+	return a, nil
+}
+
+func (a AMTRELAY) Type() Type { return TypeAMTRELAY }
+
+func (a AMTRELAY) pack(b []byte, c *compressor) ([]byte, error) {
+	if a.RelayType > 0b0111_1111 {
+		return nil, fmt.Errorf("amtrelay relay type %d out of range", a.RelayType)
+	}
+	dType := a.RelayType
+	if a.DiscoveryOptional {
+		dType |= 0b1000_0000
+	}
+	b = append(b, a.Precedence, dType)
+
+	switch a.RelayType {
+	case AMTRelayNone:
+		return b, nil
+	case AMTRelayIPv4:
+		if !a.RelayAddr.Is4() {
+			return nil, fmt.Errorf("amtrelay: %s is not an ipv4 address", a.RelayAddr)
+		}
+		ip := a.RelayAddr.As4()
+		return append(b, ip[:]...), nil
+	case AMTRelayIPv6:
+		if !a.RelayAddr.Is6() {
+			return nil, fmt.Errorf("amtrelay: %s is not an ipv6 address", a.RelayAddr)
+		}
+		ip := a.RelayAddr.As16()
+		return append(b, ip[:]...), nil
+	case AMTRelayName:
+		return appendName(b, a.RelayName, nil)
+	default:
+		return nil, fmt.Errorf("unknown amtrelay relay type %d", a.RelayType)
+	}
+}
+
+// String returns a in presentation format.
+func (a AMTRELAY) String() string {
+	d := "0"
+	if a.DiscoveryOptional {
+		d = "1"
+	}
+
+	var relay string
+	switch a.RelayType {
+	case AMTRelayNone:
+		relay = "."
+	case AMTRelayIPv4, AMTRelayIPv6:
+		relay = a.RelayAddr.String()
+	case AMTRelayName:
+		relay = fqdn(a.RelayName)
+	}
+
+	return fmt.Sprintf("%d %s %d %s", a.Precedence, d, a.RelayType, relay)
+}
+
+// RRSIG is the data of an RRSIG record (RFC 4034).
+type RRSIG struct {
+	TypeCovered Type
+	Algorithm   uint8
+	Labels      uint8
+	OriginalTTL uint32
+	Expiration  uint32 // Seconds since the Unix epoch, modulo 2**32.
+	Inception   uint32 // Seconds since the Unix epoch, modulo 2**32.
+	KeyTag      uint16
+	SignerName  string
+	Signature   []byte
+}
+
+// ParseRRSIG parses the data of an RRSIG record.
+func ParseRRSIG(data []byte) (RRSIG, error) {
+	var s RRSIG
+
+	if len(data) < 18 {
+		return s, fmt.Errorf("rrsig too short: %d bytes", len(data))
+	}
+	s.TypeCovered = Type(binary.BigEndian.Uint16(data[0:]))
+	s.Algorithm = data[2]
+	s.Labels = data[3]
+	s.OriginalTTL = binary.BigEndian.Uint32(data[4:])
+	s.Expiration = binary.BigEndian.Uint32(data[8:])
+	s.Inception = binary.BigEndian.Uint32(data[12:])
+	s.KeyTag = binary.BigEndian.Uint16(data[16:])
+
+	name, end, err := parseName(data, 18, maxNameLen)
+	if err != nil {
+		return s, err
+	}
+	s.SignerName = string(name)
+
+	s.Signature = data[end:]
+
+	return s, nil
+}
+
+func (s RRSIG) Type() Type { return TypeRRSIG }
+
+func (s RRSIG) pack(b []byte, c *compressor) ([]byte, error) {
+	b = binary.BigEndian.AppendUint16(b, uint16(s.TypeCovered))
+	b = append(b, s.Algorithm, s.Labels)
+	b = binary.BigEndian.AppendUint32(b, s.OriginalTTL)
+	b = binary.BigEndian.AppendUint32(b, s.Expiration)
+	b = binary.BigEndian.AppendUint32(b, s.Inception)
+	b = binary.BigEndian.AppendUint16(b, s.KeyTag)
+	b, err := appendName(b, s.SignerName, nil)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, s.Signature...), nil
+}
+
+// String returns s in presentation format.
+func (s RRSIG) String() string {
+	return fmt.Sprintf("%s %d %d %d %s %s %d %s %s",
+		s.TypeCovered, s.Algorithm, s.Labels, s.OriginalTTL,
+		formatRRSIGTime(s.Expiration), formatRRSIGTime(s.Inception),
+		s.KeyTag, fqdn(s.SignerName), base64.StdEncoding.EncodeToString(s.Signature))
+}
+
+// formatRRSIGTime formats an RRSIG timestamp as YYYYMMDDHHmmSS.
+func formatRRSIGTime(t uint32) string {
+	return time.Unix(int64(t), 0).UTC().Format("20060102150405")
+}
+
+// ValidAt reports whether t is within the signature validity period.
+//
+// The inception and expiration times are compared to t using serial number
+// arithmetic (RFC 1982), so the period may span the point where the 32-bit
+// timestamps wrap around.
+func (s RRSIG) ValidAt(t time.Time) bool {
+	now := uint32(t.Unix())
+	return serialLTE(s.Inception, now) && serialLTE(now, s.Expiration)
+}
+
+// serialLTE reports whether a <= b in 32-bit serial number arithmetic.
+func serialLTE(a, b uint32) bool {
+	return int32(b-a) >= 0
+}
+
+// ISDN is the data of an ISDN record (RFC 1183).
+type ISDN struct {
+	Address    string
+	SubAddress string // Optional.
+}
+
+// ParseISDN parses the data of an ISDN record.
+func ParseISDN(data []byte) (ISDN, error) {
+	ss, err := parseCharacterStrings(data)
+	if err != nil {
+		return ISDN{}, err
+	}
+
+	switch len(ss) {
+	case 1:
+		return ISDN{Address: ss[0]}, nil
+	case 2:
+		return ISDN{Address: ss[0], SubAddress: ss[1]}, nil
+	default:
+		return ISDN{}, fmt.Errorf("isdn: got %d character-strings, want 1 or 2", len(ss))
+	}
+}
+
+func (i ISDN) Type() Type { return TypeISDN }
+
+func (i ISDN) pack(b []byte, c *compressor) ([]byte, error) {
+	ss := []string{i.Address}
+	if i.SubAddress != "" {
+		ss = append(ss, i.SubAddress)
+	}
+	return appendCharacterStrings(b, ss)
+}
+
+// String returns i in presentation format.
+func (i ISDN) String() string {
+	if i.SubAddress == "" {
+		return quoteCharacterString(i.Address)
+	}
+	return quoteCharacterString(i.Address) + " " + quoteCharacterString(i.SubAddress)
+}
+
+// ATM address formats.
+const (
+	ATMAFormatAESA uint8 = 0
+	ATMAFormatE164 uint8 = 1
+)
+
+// ATMA is the data of an ATMA record, as defined by the ATM Forum's "ATM
+// Name System" specification.
+type ATMA struct {
+	Format  uint8
+	Address []byte // 20 octets for AESA, ASCII digits for E.164, opaque otherwise.
+}
+
+// ParseATMA parses the data of an ATMA record. Addresses in formats other
+// than AESA and E.164 are kept as they are.
+func ParseATMA(data []byte) (ATMA, error) {
+	if len(data) < 2 {
+		return ATMA{}, fmt.Errorf("atma too short: %d bytes", len(data))
+	}
+
+	a := ATMA{Format: data[0], Address: data[1:]}
+
+	switch a.Format {
+	case ATMAFormatAESA:
+		if len(a.Address) != 20 {
+			return ATMA{}, fmt.Errorf("atma: aesa address is %d bytes, want 20", len(a.Address))
+		}
+	case ATMAFormatE164:
+		for _, c := range a.Address {
+			if c < '0' || c > '9' {
+				return ATMA{}, fmt.Errorf("atma: invalid e.164 digit %q", c)
+			}
+		}
+	}
+
+	return a, nil
+}
+
+func (a ATMA) Type() Type { return TypeATMA }
+
+func (a ATMA) pack(b []byte, c *compressor) ([]byte, error) {
+	b = append(b, a.Format)
+	return append(b, a.Address...), nil
+}
+
+// String returns a in presentation format.
+func (a ATMA) String() string {
+	if a.Format == ATMAFormatE164 {
+		return "+" + string(a.Address)
+	}
+	return hex.EncodeToString(a.Address)
+}
+
+// CAA is the data of a CAA record (RFC 8659).
+type CAA struct {
+	Flags uint8 // Bit 7 is the Issuer Critical flag.
+	Tag   string
+	Value string
+}
+
+// CAACritical is the Issuer Critical flag of a CAA record.
+const CAACritical uint8 = 1 << 7
+
+// ParseCAA parses the data of a CAA record.
+func ParseCAA(data []byte) (CAA, error) {
+	if len(data) < 2 {
+		return CAA{}, fmt.Errorf("caa too short: %d bytes", len(data))
+	}
+	n := int(data[1])
+	if len(data) < 2+n {
+		return CAA{}, fmt.Errorf("caa tag overruns data: need %d bytes, have %d", n, len(data)-2)
+	}
+
+	a := CAA{Flags: data[0], Tag: string(data[2 : 2+n]), Value: string(data[2+n:])}
+	if err := checkCAATag(a.Tag); err != nil {
+		return CAA{}, err
+	}
+	return a, nil
+}
+
+// checkCAATag reports whether tag is 1 to 15 ASCII letters and digits.
+func checkCAATag(tag string) error {
+	if len(tag) == 0 || len(tag) > 15 {
+		return fmt.Errorf("caa: tag is %d bytes, want 1 to 15", len(tag))
+	}
+	for _, c := range []byte(tag) {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			return fmt.Errorf("caa: invalid tag character %q", c)
+		}
+	}
+	return nil
+}
+
+func (a CAA) Type() Type { return TypeCAA }
+
+func (a CAA) pack(b []byte, c *compressor) ([]byte, error) {
+	if err := checkCAATag(a.Tag); err != nil {
+		return nil, err
+	}
+	b = append(b, a.Flags, byte(len(a.Tag)))
+	b = append(b, a.Tag...)
+	return append(b, a.Value...), nil
+}
+
+// String returns a in presentation format.
+func (a CAA) String() string {
+	return fmt.Sprintf("%d %s %s", a.Flags, a.Tag, quoteCharacterString(a.Value))
+}
+
+// NAPTR is the data of a NAPTR record (RFC 3403).
+type NAPTR struct {
+	Order       uint16
+	Preference  uint16
+	Flags       string
+	Services    string
+	Regexp      string
+	Replacement string
+}
+
+// ParseNAPTR parses the data of a NAPTR record.
+func ParseNAPTR(data []byte) (NAPTR, error) {
+	var n NAPTR
+
+	if len(data) < 4 {
+		return n, fmt.Errorf("naptr too short: %d bytes", len(data))
+	}
+	n.Order = binary.BigEndian.Uint16(data[0:])
+	n.Preference = binary.BigEndian.Uint16(data[2:])
+
+	rest := data[4:]
+	for _, s := range []*string{&n.Flags, &n.Services, &n.Regexp} {
+		if len(rest) == 0 || len(rest) < 1+int(rest[0]) {
+			return NAPTR{}, fmt.Errorf("naptr: truncated character-string")
+		}
+		*s = string(rest[1 : 1+rest[0]])
+		rest = rest[1+rest[0]:]
+	}
+
+	name, err := decodeRDataName(rest)
+	if err != nil {
+		return NAPTR{}, err
+	}
+	n.Replacement = name
+
+	return n, nil
+}
+
+func (n NAPTR) Type() Type { return TypeNAPTR }
+
+func (n NAPTR) pack(b []byte, c *compressor) ([]byte, error) {
+	b = binary.BigEndian.AppendUint16(b, n.Order)
+	b = binary.BigEndian.AppendUint16(b, n.Preference)
+	b, err := appendCharacterStrings(b, []string{n.Flags, n.Services, n.Regexp})
+	if err != nil {
+		return nil, err
+	}
+	return appendName(b, n.Replacement, nil)
+}
+
+// String returns n in presentation format.
+func (n NAPTR) String() string {
+	return fmt.Sprintf("%d %d %s %s %s %s", n.Order, n.Preference,
+		quoteCharacterString(n.Flags), quoteCharacterString(n.Services),
+		quoteCharacterString(n.Regexp), fqdn(n.Replacement))
+}
+
+// TLSA is the data of a TLSA record (RFC 6698).
+type TLSA struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte // Certificate association data.
+}
+
+// ParseTLSA parses the data of a TLSA record.
+func ParseTLSA(data []byte) (TLSA, error) {
+	if len(data) < 3 {
+		return TLSA{}, fmt.Errorf("tlsa too short: %d bytes", len(data))
+	}
+	return TLSA{Usage: data[0], Selector: data[1], MatchingType: data[2], Data: data[3:]}, nil
+}
+
+func (t TLSA) Type() Type { return TypeTLSA }
+
+func (t TLSA) pack(b []byte, c *compressor) ([]byte, error) {
+	b = append(b, t.Usage, t.Selector, t.MatchingType)
+	return append(b, t.Data...), nil
+}
+
+// String returns t in presentation format.
+func (t TLSA) String() string {
+	return fmt.Sprintf("%d %d %d %x", t.Usage, t.Selector, t.MatchingType, t.Data)
+}
+
+// SSHFP is the data of an SSHFP record (RFC 4255).
+type SSHFP struct {
+	Algorithm   uint8
+	FPType      uint8
+	Fingerprint []byte
+}
+
+// ParseSSHFP parses the data of an SSHFP record.
+func ParseSSHFP(data []byte) (SSHFP, error) {
+	if len(data) < 2 {
+		return SSHFP{}, fmt.Errorf("sshfp too short: %d bytes", len(data))
+	}
+	return SSHFP{Algorithm: data[0], FPType: data[1], Fingerprint: data[2:]}, nil
+}
+
+func (s SSHFP) Type() Type { return TypeSSHFP }
+
+func (s SSHFP) pack(b []byte, c *compressor) ([]byte, error) {
+	b = append(b, s.Algorithm, s.FPType)
+	return append(b, s.Fingerprint...), nil
+}
+
+// String returns s in presentation format.
+func (s SSHFP) String() string {
+	return fmt.Sprintf("%d %d %x", s.Algorithm, s.FPType, s.Fingerprint)
+}
+
+// LOC is the data of a LOC record (RFC 1876). Latitudes are positive north
+// of the equator and longitudes positive east of the prime meridian.
+type LOC struct {
+	Latitude  float64 // Degrees, to 1/1000 of an arcsecond.
+	Longitude float64 // Degrees, to 1/1000 of an arcsecond.
+	Altitude  float64 // Meters above the WGS 84 reference spheroid, to 1 cm.
+	Size      float64 // Diameter of the enclosing sphere in meters.
+	HorizPre  float64 // Horizontal precision in meters.
+	VertPre   float64 // Vertical precision in meters.
+}
+
+const (
+	locEquator   = 1 << 31 // Wire value of latitude 0 and longitude 0.
+	locArcsec    = 1000    // Wire units per arcsecond.
+	locDegree    = 3600 * locArcsec
+	locAltOffset = 10000000 // Wire value of altitude 0, in centimeters.
+)
+
+// ParseLOC parses the data of a LOC record of version 0, the only one
+// defined. It returns an error for other versions; when records are
+// decoded, those are left with Raw data, as RFC 1876 says to treat them
+// as unknown.
+func ParseLOC(data []byte) (LOC, error) {
+	if len(data) != 16 {
+		return LOC{}, fmt.Errorf("loc is %d bytes, want 16", len(data))
+	}
+	if data[0] != 0 {
+		return LOC{}, fmt.Errorf("unsupported loc version %d", data[0])
+	}
+
+	var (
+		l    LOC
+		errs [3]error
+	)
+	l.Size, errs[0] = decodeLOCPrecision(data[1])
+	l.HorizPre, errs[1] = decodeLOCPrecision(data[2])
+	l.VertPre, errs[2] = decodeLOCPrecision(data[3])
+	for _, err := range errs {
+		if err != nil {
+			return LOC{}, err
+		}
+	}
+
+	lat := int64(binary.BigEndian.Uint32(data[4:])) - locEquator
+	long := int64(binary.BigEndian.Uint32(data[8:])) - locEquator
+	if lat < -90*locDegree || lat > 90*locDegree {
+		return LOC{}, fmt.Errorf("loc latitude out of range")
+	}
+	if long < -180*locDegree || long > 180*locDegree {
+		return LOC{}, fmt.Errorf("loc longitude out of range")
+	}
+	l.Latitude = float64(lat) / locDegree
+	l.Longitude = float64(long) / locDegree
+	l.Altitude = float64(int64(binary.BigEndian.Uint32(data[12:]))-locAltOffset) / 100
+
+	return l, nil
+}
+
+// decodeLOCPrecision decodes a size or precision in centimeters, stored as
+// a base in the high nibble and a power of ten in the low nibble, into
+// meters.
+func decodeLOCPrecision(b byte) (float64, error) {
+	base, exp := b>>4, b&0xf
+	if base > 9 || exp > 9 {
+		return 0, fmt.Errorf("invalid loc precision %#02x", b)
+	}
+	return float64(base) * math.Pow10(int(exp)) / 100, nil
+}
+
+// encodeLOCPrecision encodes meters in the form decodeLOCPrecision expects,
+// truncating to one significant digit.
+func encodeLOCPrecision(m float64) (byte, error) {
+	cm := math.Round(m * 100)
+	if cm < 0 || cm > 9e9 {
+		return 0, fmt.Errorf("loc precision out of range: %gm", m)
+	}
+	var exp byte
+	for cm >= 10 {
+		cm /= 10
+		exp++
+	}
+	return byte(cm)<<4 | exp, nil
+}
+
+func (l LOC) Type() Type { return TypeLOC }
+
+func (l LOC) pack(b []byte, c *compressor) ([]byte, error) {
+	if l.Latitude < -90 || l.Latitude > 90 || l.Longitude < -180 || l.Longitude > 180 {
+		return nil, fmt.Errorf("loc coordinates out of range: %g, %g", l.Latitude, l.Longitude)
+	}
+	alt := math.Round(l.Altitude*100) + locAltOffset
+	if alt < 0 || alt > math.MaxUint32 {
+		return nil, fmt.Errorf("loc altitude out of range: %gm", l.Altitude)
+	}
+
+	b = append(b, 0)
+	for _, m := range []float64{l.Size, l.HorizPre, l.VertPre} {
+		p, err := encodeLOCPrecision(m)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, p)
+	}
+	b = binary.BigEndian.AppendUint32(b, uint32(int64(math.Round(l.Latitude*locDegree))+locEquator))
+	b = binary.BigEndian.AppendUint32(b, uint32(int64(math.Round(l.Longitude*locDegree))+locEquator))
+	return binary.BigEndian.AppendUint32(b, uint32(alt)), nil
+}
+
+// String returns l in presentation format.
+func (l LOC) String() string {
+	return fmt.Sprintf("%s %s %.2fm %.2fm %.2fm %.2fm",
+		formatLOCCoord(l.Latitude, 'N', 'S'), formatLOCCoord(l.Longitude, 'E', 'W'),
+		l.Altitude, l.Size, l.HorizPre, l.VertPre)
+}
+
+// formatLOCCoord formats deg as degrees, minutes and seconds, followed by
+// pos or neg for its hemisphere.
+func formatLOCCoord(deg float64, pos, neg byte) string {
+	v := int64(math.Round(deg * locDegree))
+	h := pos
+	if v < 0 {
+		v, h = -v, neg
+	}
+	d, v := v/locDegree, v%locDegree
+	m, v := v/(60*locArcsec), v%(60*locArcsec)
+	return fmt.Sprintf("%d %d %d.%03d %c", d, m, v/locArcsec, v%locArcsec, h)
+}
@@ -0,0 +1,532 @@
+package resolve
+
+import (
+	"bytes"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestParseAMTRELAY(t *testing.T) {
+	cases := []struct {
+		in      []byte
+		want    AMTRELAY
+		wantStr string
+	}{
+		{
+			[]byte("\x0a\x00"),
+			AMTRELAY{Precedence: 10},
+			"10 0 0 .",
+		},
+		{
+			[]byte("\x0a\x81\xcb\x00\x71\x0f"),
+			AMTRELAY{
+				Precedence:        10,
+				DiscoveryOptional: true,
+				RelayType:         AMTRelayIPv4,
+				RelayAddr:         netip.MustParseAddr("203.0.113.15"),
+			},
+			"10 1 1 203.0.113.15",
+		},
+		{
+			[]byte("\x0a\x02\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x15"),
+			AMTRELAY{
+				Precedence: 10,
+				RelayType:  AMTRelayIPv6,
+				RelayAddr:  netip.MustParseAddr("2001:db8::15"),
+			},
+			"10 0 2 2001:db8::15",
+		},
+		{
+			[]byte("\x80\x03\x09amtrelays\x07example\x03com\x00"),
+			AMTRELAY{
+				Precedence: 128,
+				RelayType:  AMTRelayName,
+				RelayName:  "amtrelays.example.com",
+			},
+			"128 0 3 amtrelays.example.com.",
+		},
+	}
+
+	for _, tc := range cases {
+		got, err := ParseAMTRELAY(tc.in)
+		if err != nil {
+			t.Errorf("%q: error: %v", tc.in, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got, cmpAddr); diff != "" {
+			t.Errorf("%q: mismatch (-want, +got):\n%s", tc.in, diff)
+		}
+		if s := got.String(); s != tc.wantStr {
+			t.Errorf("%q: got %q, want %q", tc.in, s, tc.wantStr)
+		}
+	}
+}
+
+func TestParseAMTRELAY_Invalid(t *testing.T) {
+	cases := [][]byte{
+		[]byte("\x0a"),                    // too short
+		[]byte("\x0a\x04\x00"),            // unknown relay type
+		[]byte("\x0a\x01\xcb\x00\x71"),    // short IPv4 address
+		[]byte("\x0a\x00\x01"),            // relay data with type 0
+		[]byte("\x0a\x03\x03com\x00\xff"), // trailing bytes after name
+	}
+
+	for _, in := range cases {
+		if _, err := ParseAMTRELAY(in); err == nil {
+			t.Errorf("%q: want error", in)
+		}
+	}
+}
+
+func TestParseRRSIG(t *testing.T) {
+	var (
+		in   = []byte("\x00\x01\x08\x02\x00\x01\x51\x80\x65\x00\x00\x00\x64\x00\x00\x00\x12\x34\x07example\x03com\x00\xde\xad\xbe\xef")
+		want = RRSIG{
+			TypeCovered: TypeA,
+			Algorithm:   8,
+			Labels:      2,
+			OriginalTTL: 86400,
+			Expiration:  0x65000000,
+			Inception:   0x64000000,
+			KeyTag:      0x1234,
+			SignerName:  "example.com",
+			Signature:   []byte("\xde\xad\xbe\xef"),
+		}
+	)
+
+	got, err := ParseRRSIG(in)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+}
+
+func TestRRSIG_ValidAt(t *testing.T) {
+	cases := []struct {
+		name                  string
+		inception, expiration uint32
+		at                    int64 // Unix time
+		want                  bool
+	}{
+		{"before inception", 1000, 2000, 999, false},
+		{"at inception", 1000, 2000, 1000, true},
+		{"at expiration", 1000, 2000, 2000, true},
+		{"after expiration", 1000, 2000, 2001, false},
+
+		// Crossing 2**31 (2038): naive signed comparison would fail here.
+		{"2038 before", 0x7fff_ff00, 0x8000_0100, 0x7fff_ff80, true},
+		{"2038 after", 0x7fff_ff00, 0x8000_0100, 0x8000_0080, true},
+		{"2038 expired", 0x7fff_ff00, 0x8000_0100, 0x8000_0200, false},
+
+		// Crossing 2**32 (2106): expiration wraps around to a small number.
+		{"2106 before", 0xffff_ff00, 0x0000_0100, 0xffff_ff80, true},
+		{"2106 after", 0xffff_ff00, 0x0000_0100, 1<<32 + 0x80, true},
+		{"2106 expired", 0xffff_ff00, 0x0000_0100, 1<<32 + 0x200, false},
+		{"2106 not yet valid", 0xffff_ff00, 0x0000_0100, 0xffff_fe00, false},
+	}
+
+	for _, tc := range cases {
+		s := RRSIG{Inception: tc.inception, Expiration: tc.expiration}
+		if got := s.ValidAt(time.Unix(tc.at, 0)); got != tc.want {
+			t.Errorf("%s: got %t, want %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParseISDN(t *testing.T) {
+	cases := []struct {
+		in      []byte
+		want    ISDN
+		wantStr string
+	}{
+		{[]byte("\x0f150862028003217"), ISDN{Address: "150862028003217"}, `"150862028003217"`},
+		{
+			[]byte("\x0f150862028003217\x03004"),
+			ISDN{Address: "150862028003217", SubAddress: "004"},
+			`"150862028003217" "004"`,
+		},
+	}
+
+	for _, tc := range cases {
+		got, err := ParseISDN(tc.in)
+		if err != nil {
+			t.Errorf("%q: error: %v", tc.in, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("%q: mismatch (-want, +got):\n%s", tc.in, diff)
+		}
+		if s := got.String(); s != tc.wantStr {
+			t.Errorf("%q: got %q, want %q", tc.in, s, tc.wantStr)
+		}
+	}
+
+	for _, in := range [][]byte{
+		nil,                       // no address
+		[]byte("\x10123"),         // length overruns data
+		[]byte("\x011\x012\x013"), // too many strings
+	} {
+		if _, err := ParseISDN(in); err == nil {
+			t.Errorf("%q: want error", in)
+		}
+	}
+}
+
+func TestParseATMA(t *testing.T) {
+	aesa := []byte("\x47\x00\x05\x80\xff\xe1\x00\x00\x00\xf2\x15\x11\x0b\x00\x20\x48\x1a\x65\x15\x00")
+
+	cases := []struct {
+		in      []byte
+		want    ATMA
+		wantStr string
+	}{
+		{append([]byte{0}, aesa...), ATMA{Format: ATMAFormatAESA, Address: aesa}, "47000580ffe1000000f215110b0020481a651500"},
+		{[]byte("\x0112345678"), ATMA{Format: ATMAFormatE164, Address: []byte("12345678")}, "+12345678"},
+		{[]byte("\x02\x47\x01"), ATMA{Format: 2, Address: []byte{0x47, 0x01}}, "4701"},
+	}
+
+	for _, tc := range cases {
+		got, err := ParseATMA(tc.in)
+		if err != nil {
+			t.Errorf("%q: error: %v", tc.in, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("%q: mismatch (-want, +got):\n%s", tc.in, diff)
+		}
+		if s := got.String(); s != tc.wantStr {
+			t.Errorf("%q: got %q, want %q", tc.in, s, tc.wantStr)
+		}
+	}
+
+	for _, in := range [][]byte{
+		[]byte("\x00"),         // no address
+		[]byte("\x00\x47\x00"), // short AESA address
+		[]byte("\x011234a"),    // non-digit in E.164 address
+	} {
+		if _, err := ParseATMA(in); err == nil {
+			t.Errorf("%q: want error", in)
+		}
+	}
+}
+
+func TestParseCAA(t *testing.T) {
+	got, err := ParseCAA([]byte("\x00\x05issueletsencrypt.org"))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	want := CAA{Tag: "issue", Value: "letsencrypt.org"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+	if s, want := got.String(), `0 issue "letsencrypt.org"`; s != want {
+		t.Errorf("String: got %q, want %q", s, want)
+	}
+}
+
+func TestParseCAA_Invalid(t *testing.T) {
+	invalid := []string{
+		"",
+		"\x00",
+		"\x00\x06issue",                 // Tag overruns data.
+		"\x00\x00value",                 // Empty tag.
+		"\x00\x03a-b",                   // Tag isn't alphanumeric.
+		"\x80\x10" + "abcdefghijklmnop", // Tag too long.
+	}
+	for _, in := range invalid {
+		if _, err := ParseCAA([]byte(in)); err == nil {
+			t.Errorf("%q: want error", in)
+		}
+	}
+}
+
+func TestParseNAPTR(t *testing.T) {
+	in := []byte("\x00\x64\x00\x32\x01s\x07SIP+D2U\x00\x04_sip\x04_udp\x07example\x03com\x00")
+	got, err := ParseNAPTR(in)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	want := NAPTR{Order: 100, Preference: 50, Flags: "s", Services: "SIP+D2U", Replacement: "_sip._udp.example.com"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+	if s, want := got.String(), `100 50 "s" "SIP+D2U" "" _sip._udp.example.com.`; s != want {
+		t.Errorf("String: got %q, want %q", s, want)
+	}
+
+	for _, n := range []int{3, 6, 20, len(in) - 1} {
+		if _, err := ParseNAPTR(in[:n]); err == nil {
+			t.Errorf("truncated to %d bytes: want error", n)
+		}
+	}
+}
+
+func TestParseLOC(t *testing.T) {
+	// The example from RFC 1876, section 4.
+	in := []byte("\x00\x33\x16\x13\x89\x17\x2d\xd0\x70\xbe\x15\xf0\x00\x98\x8d\x20")
+	got, err := ParseLOC(in)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	want := LOC{
+		Latitude:  42 + 21.0/60 + 54.0/3600,
+		Longitude: -(71 + 6.0/60 + 18.0/3600),
+		Altitude:  -24,
+		Size:      30,
+		HorizPre:  10000,
+		VertPre:   10,
+	}
+	if diff := cmp.Diff(want, got, cmpopts.EquateApprox(0, 1e-9)); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+	if s, want := got.String(), "42 21 54.000 N 71 6 18.000 W -24.00m 30.00m 10000.00m 10.00m"; s != want {
+		t.Errorf("String: got %q, want %q", s, want)
+	}
+
+	b, err := got.pack(nil, nil)
+	if err != nil {
+		t.Fatalf("pack: %v", err)
+	}
+	if !bytes.Equal(b, in) {
+		t.Errorf("pack: got %x, want %x", b, in)
+	}
+}
+
+func TestParseLOC_Invalid(t *testing.T) {
+	invalid := []string{
+		"\x00\x33\x16\x13\x89\x17\x2d\xd0\x70\xbe\x15\xf0\x00\x98\x8d",     // Short.
+		"\x01\x33\x16\x13\x89\x17\x2d\xd0\x70\xbe\x15\xf0\x00\x98\x8d\x20", // Version 1.
+		"\x00\xa0\x16\x13\x89\x17\x2d\xd0\x70\xbe\x15\xf0\x00\x98\x8d\x20", // Size base over 9.
+		"\x00\x33\x16\x13\xff\xff\xff\xff\x70\xbe\x15\xf0\x00\x98\x8d\x20", // Latitude past the pole.
+	}
+	for _, in := range invalid {
+		if _, err := ParseLOC([]byte(in)); err == nil {
+			t.Errorf("%q: want error", in)
+		}
+	}
+}
+
+func TestDecodeRecord_LOCVersion(t *testing.T) {
+	data := []byte("\x01\x33\x16\x13\x89\x17\x2d\xd0\x70\xbe\x15\xf0\x00\x98\x8d\x20")
+	in := append([]byte("\x07example\x03com\x00\x00\x1d\x00\x01\x00\x00\x00\x3c\x00\x10"), data...)
+
+	r, err := DecodeRecord(bytes.NewReader(in))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if diff := cmp.Diff(Raw{RRType: TypeLOC, Data: data}, r.RData); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+}
+
+// mixedPacket is a response to an ANY query for example.com with NS, CNAME,
+// MX and TXT answers. The names in the NS, CNAME and MX data are
+// compressed.
+var mixedPacket = []byte("\x00\x01\x81\x80\x00\x01\x00\x04\x00\x00\x00\x00" +
+	"\x07example\x03com\x00\x00\xff\x00\x01" +
+	"\xc0\x0c\x00\x02\x00\x01\x00\x00\x0e\x10\x00\x06\x03ns1\xc0\x0c" +
+	"\x03www\xc0\x0c\x00\x05\x00\x01\x00\x00\x01\x2c\x00\x02\xc0\x0c" +
+	"\xc0\x0c\x00\x0f\x00\x01\x00\x00\x0e\x10\x00\x09\x00\x0a\x04mail\xc0\x0c" +
+	"\xc0\x0c\x00\x10\x00\x01\x00\x00\x0e\x10\x00\x0f\x06v=spf1\x07-all \"x")
+
+func TestDecodePacket_RData(t *testing.T) {
+	p, err := DecodePacket(bytes.NewReader(mixedPacket))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	want := []RData{
+		NS{Host: "ns1.example.com"},
+		CNAME{Target: "example.com"},
+		MX{Preference: 10, Host: "mail.example.com"},
+		TXT{Strings: []string{"v=spf1", `-all "x`}},
+	}
+	var got []RData
+	for _, r := range p.Answers {
+		got = append(got, r.RData)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+
+	wantStrings := []string{
+		"example.com.\t3600\tIN\tNS\tns1.example.com.",
+		"www.example.com.\t300\tIN\tCNAME\texample.com.",
+		"example.com.\t3600\tIN\tMX\t10 mail.example.com.",
+		"example.com.\t3600\tIN\tTXT\t\"v=spf1\" \"-all \\\"x\"",
+	}
+	for i, r := range p.Answers {
+		if s := r.String(); s != wantStrings[i] {
+			t.Errorf("String: got %q, want %q", s, wantStrings[i])
+		}
+	}
+}
+
+func TestDecodePacket_SOA(t *testing.T) {
+	// Marshaling compresses both names in the SOA data against the
+	// question name.
+	soa := SOA{MName: "ns1.example.com", RName: "hostmaster.example.com", Serial: 2023051401, Refresh: 7200, Retry: 3600, Expire: 1209600, Minimum: 300}
+	in := &Packet{
+		Questions:   []Question{{Name: []byte("www.example.com"), Type: TypeA, Class: ClassIN}},
+		Authorities: []Record{{Name: []byte("example.com"), Type: TypeSOA, Class: ClassIN, TTL: 300, RData: soa}},
+	}
+	b, err := in.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+
+	p, err := DecodePacket(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if diff := cmp.Diff(soa, p.Authorities[0].RData); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+	want := "example.com.\t300\tIN\tSOA\tns1.example.com. hostmaster.example.com. 2023051401 7200 3600 1209600 300"
+	if got := p.Authorities[0].String(); got != want {
+		t.Errorf("String: got %q, want %q", got, want)
+	}
+
+	// Two empty names followed by too few fixed fields leave the record
+	// with its raw data.
+	r, err := DecodeRecord(bytes.NewReader([]byte("\x07example\x03com\x00\x00\x06\x00\x01\x00\x00\x00\x3c\x00\x04\x00\x00\x01\x02")))
+	if err != nil {
+		t.Fatalf("short soa: error: %v", err)
+	}
+	if diff := cmp.Diff(Raw{RRType: TypeSOA, Data: []byte{0, 0, 1, 2}}, r.RData); diff != "" {
+		t.Errorf("short soa: (-want, +got):\n%s", diff)
+	}
+}
+
+func TestDecodeRecord_Raw(t *testing.T) {
+	in := []byte("\x07example\x03com\x00\xff\x00\x00\x01\x00\x00\x00\x3c\x00\x03\x01\x02\x03")
+
+	r, err := DecodeRecord(bytes.NewReader(in))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	want := Raw{RRType: 65280, Data: []byte{1, 2, 3}}
+	if diff := cmp.Diff(want, r.RData); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+	if got, want := r.String(), "example.com.\t60\tIN\tTYPE65280\t\\# 3 010203"; got != want {
+		t.Errorf("String: got %q, want %q", got, want)
+	}
+}
+
+func TestParsePacket_MalformedRData(t *testing.T) {
+	// A LOC record one byte too long sits beside a good A record.
+	loc := Record{Name: []byte("www.example"), Type: TypeLOC, Class: ClassIN, TTL: 300, RData: Raw{RRType: TypeLOC, Data: make([]byte, 17)}}
+	in := &Packet{Answers: []Record{loc, a("www.example", "192.0.2.1")}}
+	b, err := in.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+
+	p, err := ParsePacket(b)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if diff := cmp.Diff(loc.RData, p.Answers[0].RData); diff != "" {
+		t.Errorf("LOC (-want, +got):\n%s", diff)
+	}
+	if got, err := p.Answers[1].Addr(); err != nil || got != netip.MustParseAddr("192.0.2.1") {
+		t.Errorf("A: got %v, %v", got, err)
+	}
+
+	// A response like it still answers lookups.
+	r := serveUDP(t, handle(func(q *Packet) *Packet { return &Packet{Answers: in.Answers} }))
+	if got, err := r.Lookup("www.example", TypeA); err != nil || got != netip.MustParseAddr("192.0.2.1") {
+		t.Errorf("Lookup: got %v, %v", got, err)
+	}
+}
+
+func TestRecord_MarshalBinary_RoundTrip(t *testing.T) {
+	rdatas := []RData{
+		A{Addr: netip.MustParseAddr("192.0.2.1")},
+		AAAA{Addr: netip.MustParseAddr("2001:db8::1")},
+		NS{Host: "ns1.example.com"},
+		CNAME{Target: "example.net"},
+		PTR{Host: "host.example.com"},
+		DNAME{Target: "example.net"},
+		MX{Preference: 10, Host: "mail.example.com"},
+		SOA{MName: "ns1.example.com", RName: "hostmaster.example.com", Serial: 2023051401, Refresh: 7200, Retry: 3600, Expire: 1209600, Minimum: 300},
+		TXT{Strings: []string{"v=spf1", "-all"}},
+		SRV{Priority: 10, Weight: 60, Port: 5060, Target: "sip.example.com"},
+		ISDN{Address: "150862028003217", SubAddress: "004"},
+		ATMA{Format: ATMAFormatE164, Address: []byte("12345678")},
+		LOC{Latitude: -33.5, Longitude: 151.25, Altitude: 5.5, Size: 1, HorizPre: 10000, VertPre: 10},
+		NAPTR{Order: 100, Preference: 10, Flags: "u", Services: "E2U+sip", Regexp: "!^.*$!sip:info@example.com!"},
+		RRSIG{TypeCovered: TypeA, Algorithm: 8, Labels: 2, OriginalTTL: 300, KeyTag: 1, SignerName: "example.com", Signature: []byte{1, 2, 3}},
+		SSHFP{Algorithm: SSHFPAlgorithmEd25519, FPType: SSHFPTypeSHA256, Fingerprint: []byte{1, 2, 3}},
+		TLSA{Usage: TLSAUsageDANEEE, Selector: TLSASelectorSPKI, MatchingType: TLSAMatchingSHA256, Data: []byte{1, 2, 3}},
+		CAA{Flags: CAACritical, Tag: "issue", Value: "ca.example.net; account=230123"},
+		AMTRELAY{Precedence: 10, DiscoveryOptional: true, RelayType: AMTRelayName, RelayName: "relay.example.com"},
+		Raw{RRType: 65280, Data: []byte{1, 2, 3}},
+	}
+
+	for _, rd := range rdatas {
+		in := Record{Name: []byte("example.com"), Type: rd.Type(), Class: ClassIN, TTL: 300, RData: rd}
+
+		b, err := in.MarshalBinary()
+		if err != nil {
+			t.Errorf("%s: error: %v", rd.Type(), err)
+			continue
+		}
+
+		got, err := DecodeRecord(bytes.NewReader(b))
+		if err != nil {
+			t.Errorf("%s: DecodeRecord: %v", rd.Type(), err)
+			continue
+		}
+		if diff := cmp.Diff(in, got, cmpAddr, cmpopts.IgnoreFields(Record{}, "Data")); diff != "" {
+			t.Errorf("%s: mismatch (-want, +got):\n%s", rd.Type(), diff)
+		}
+	}
+}
+
+func TestRecord_MarshalBinary_Compressed(t *testing.T) {
+	// Re-encoding a decoded record must expand compressed names in its data
+	// rather than copy pointers into the original message.
+	p, err := DecodePacket(bytes.NewReader(mixedPacket))
+	if err != nil {
+		t.Fatalf("DecodePacket: %v", err)
+	}
+
+	for _, want := range p.Answers {
+		b, err := want.MarshalBinary()
+		if err != nil {
+			t.Errorf("%s: error: %v", want.Type, err)
+			continue
+		}
+		got, err := DecodeRecord(bytes.NewReader(b))
+		if err != nil {
+			t.Errorf("%s: DecodeRecord: %v", want.Type, err)
+			continue
+		}
+		if diff := cmp.Diff(want, got, cmpopts.IgnoreFields(Record{}, "Data")); diff != "" {
+			t.Errorf("%s: mismatch (-want, +got):\n%s", want.Type, diff)
+		}
+	}
+}
+
+func TestRecord_MarshalBinary_Invalid(t *testing.T) {
+	cases := []Record{
+		{Type: TypeA, RData: AAAA{Addr: netip.MustParseAddr("2001:db8::1")}},
+		{Type: TypeA, RData: A{Addr: netip.MustParseAddr("2001:db8::1")}},
+		{Type: TypeTXT, RData: TXT{Strings: []string{strings.Repeat("x", 256)}}},
+	}
+
+	for _, r := range cases {
+		if _, err := r.MarshalBinary(); err == nil {
+			t.Errorf("%v: want error", r)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package resolve
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// ErrRebindingSuspected is returned by lookups with RejectPrivate when an
+// answer holds a private address, as in a DNS rebinding attack, where a
+// public name is made to point at a service on the victim's network.
+var ErrRebindingSuspected = errors.New("private address in answer")
+
+// bogonPrefixes are the ranges, besides those netip.Addr reports as
+// private, loopback, link-local or unspecified, that RejectPrivate rejects
+// by default: none of them is a unicast address of a public host.
+var bogonPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "This network" (RFC 791).
+	netip.MustParsePrefix("100.64.0.0/10"),   // Shared address space (RFC 6598).
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments (RFC 6890).
+	netip.MustParsePrefix("192.0.2.0/24"),    // TEST-NET-1 (RFC 5737).
+	netip.MustParsePrefix("198.18.0.0/15"),   // Benchmarking (RFC 2544).
+	netip.MustParsePrefix("198.51.100.0/24"), // TEST-NET-2 (RFC 5737).
+	netip.MustParsePrefix("203.0.113.0/24"),  // TEST-NET-3 (RFC 5737).
+	netip.MustParsePrefix("224.0.0.0/4"),     // Multicast (RFC 5771).
+	netip.MustParsePrefix("240.0.0.0/4"),     // Reserved, and broadcast (RFC 1112, RFC 919).
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // Local-use IPv4/IPv6 translation (RFC 8215).
+	netip.MustParsePrefix("100::/64"),        // Discard-only (RFC 6666).
+	netip.MustParsePrefix("2001:db8::/32"),   // Documentation (RFC 3849).
+	netip.MustParsePrefix("ff00::/8"),        // Multicast (RFC 4291).
+}
+
+// nat64Prefix is the well-known prefix for IPv4 addresses translated to
+// IPv6 by NAT64 (RFC 6052), whose last 32 bits are the IPv4 address.
+var nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// isPrivate reports whether addr is one RejectPrivate rejects: in
+// r.PrivatePrefixes if set, or in a private or bogon range otherwise.
+// IPv4-mapped addresses are checked as IPv4, and so, by default, are the
+// IPv4 addresses embedded in NAT64 ones.
+func (r *Resolver) isPrivate(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if r.PrivatePrefixes != nil {
+		for _, p := range r.PrivatePrefixes {
+			if p.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+	if nat64Prefix.Contains(addr) {
+		b := addr.As16()
+		addr = netip.AddrFrom4([4]byte{b[12], b[13], b[14], b[15]})
+	}
+	if addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsUnspecified() {
+		return true
+	}
+	for _, p := range bogonPrefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRebinding returns ErrRebindingSuspected if r.RejectPrivate is set
+// and one of the A or AAAA records found for domain holds a private
+// address.
+func (r *Resolver) checkRebinding(domain string, records []Record) error {
+	if !r.RejectPrivate {
+		return nil
+	}
+	for _, rec := range records {
+		if rec.Type != TypeA && rec.Type != TypeAAAA {
+			continue
+		}
+		if addr, err := rec.Addr(); err == nil && r.isPrivate(addr) {
+			return fmt.Errorf("%w: %s has address %s", ErrRebindingSuspected, domain, addr)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package resolve
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+// serveAddrs returns a Resolver for a server that answers A and AAAA
+// queries for any name with v4 and v6.
+func serveAddrs(t *testing.T, v4, v6 string) *Resolver {
+	return serveUDP(t, handle(func(q *Packet) *Packet {
+		name := string(q.Questions[0].Name)
+		if q.Questions[0].Type == TypeAAAA {
+			return &Packet{Answers: []Record{aaaa(name, v6)}}
+		}
+		return &Packet{Answers: []Record{a(name, v4)}}
+	}))
+}
+
+func aaaa(name, addr string) Record {
+	return Record{Name: []byte(name), Type: TypeAAAA, Class: ClassIN, TTL: 300, RData: AAAA{Addr: netip.MustParseAddr(addr)}}
+}
+
+func TestResolver_RejectPrivate(t *testing.T) {
+	r := serveAddrs(t, "127.0.0.1", "2606:4700::1111")
+
+	// Off by default.
+	if _, err := r.Lookup("www.example.com", TypeA); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	r.RejectPrivate = true
+	if _, err := r.Lookup("www.example.com", TypeA); !errors.Is(err, ErrRebindingSuspected) {
+		t.Errorf("Lookup: got %v, want %v", err, ErrRebindingSuspected)
+	}
+	if _, err := r.LookupHost("www.example.com", TypeA); !errors.Is(err, ErrRebindingSuspected) {
+		t.Errorf("LookupHost: got %v, want %v", err, ErrRebindingSuspected)
+	}
+	// The IPv6 address is fine, but the lookup still fails.
+	if _, err := r.LookupIPAddrs("www.example.com"); !errors.Is(err, ErrRebindingSuspected) {
+		t.Errorf("LookupIPAddrs: got %v, want %v", err, ErrRebindingSuspected)
+	}
+	if got, err := r.Lookup("www.example.com", TypeAAAA); err != nil || got != netip.MustParseAddr("2606:4700::1111") {
+		t.Errorf("Lookup AAAA: got %v, %v", got, err)
+	}
+}
+
+func TestResolver_RejectPrivate_Defaults(t *testing.T) {
+	var r Resolver
+	for _, tt := range []struct {
+		addr string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"127.0.0.1", true},
+		{"169.254.169.254", true},
+		{"0.0.0.0", true},
+		{"100.64.0.1", true},
+		{"::1", true},
+		{"fe80::1", true},
+		{"fd00::1", true},
+		{"::ffff:10.0.0.1", true},
+		{"192.0.2.1", true},
+		{"198.18.0.1", true},
+		{"198.19.255.255", true},
+		{"198.51.100.1", true},
+		{"203.0.113.1", true},
+		{"224.0.0.251", true},
+		{"239.255.255.250", true},
+		{"240.0.0.1", true},
+		{"255.255.255.255", true},
+		{"64:ff9b::10.0.0.1", true},
+		{"64:ff9b::127.0.0.1", true},
+		{"64:ff9b:1::1", true},
+		{"100::1", true},
+		{"2001:db8::1", true},
+		{"ff02::fb", true},
+		{"ff0e::1", true},
+		{"::ffff:192.0.2.1", true},
+		{"8.8.8.8", false},
+		{"1.1.1.1", false},
+		{"198.20.0.1", false},
+		{"64:ff9b::8.8.8.8", false},
+		{"2606:4700::1111", false},
+		{"::ffff:8.8.8.8", false},
+	} {
+		if got := r.isPrivate(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("isPrivate(%s) = %t, want %t", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestResolver_PrivatePrefixes(t *testing.T) {
+	r := serveAddrs(t, "192.0.2.1", "2606:4700::1111")
+	r.RejectPrivate = true
+	r.PrivatePrefixes = []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+
+	if _, err := r.Lookup("www.example.com", TypeA); !errors.Is(err, ErrRebindingSuspected) {
+		t.Errorf("got %v, want %v", err, ErrRebindingSuspected)
+	}
+	if _, err := r.Lookup("www.example.com", TypeAAAA); err != nil {
+		t.Errorf("AAAA: error: %v", err)
+	}
+}
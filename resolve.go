@@ -2,21 +2,23 @@
 package resolve
 
 import (
-	"bytes"
+	"context"
+	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"log"
-	"math/rand"
+	"math"
 	"net"
 	"net/netip"
 	"strings"
+	"time"
 )
 
 // Header is a DNS header.
 type Header struct {
 	ID             uint16
-	Flags          uint16
+	Flags          Flags
 	NumQuestions   uint16
 	NumAnswers     uint16
 	NumAuthorities uint16
@@ -32,14 +34,44 @@ func DecodeHeader(r io.Reader) (Header, error) {
 
 // MarshalBinary implements encoding.BinaryMarshaler for Header.
 func (h *Header) MarshalBinary() ([]byte, error) {
-	var buf bytes.Buffer
-	err := binary.Write(&buf, binary.BigEndian, h)
-	return buf.Bytes(), err
+	return appendHeader(nil, *h), nil
+}
+
+// appendHeader appends the wire form of h to b.
+func appendHeader(b []byte, h Header) []byte {
+	b = binary.BigEndian.AppendUint16(b, h.ID)
+	b = binary.BigEndian.AppendUint16(b, uint16(h.Flags))
+	b = binary.BigEndian.AppendUint16(b, h.NumQuestions)
+	b = binary.BigEndian.AppendUint16(b, h.NumAnswers)
+	b = binary.BigEndian.AppendUint16(b, h.NumAuthorities)
+	return binary.BigEndian.AppendUint16(b, h.NumAdditionals)
 }
 
 // UnmarshalBinary implements encoding.BinaryUnmarshaler for Header.
 func (h *Header) UnmarshalBinary(data []byte) error {
-	return binary.Read(bytes.NewReader(data), binary.BigEndian, h)
+	var err error
+	*h, _, err = parseHeader(data, 0)
+	return err
+}
+
+// headerLen is the length of a DNS header.
+const headerLen = 12
+
+// parseHeader parses the header at off in msg, and returns it along with
+// the offset just past it.
+func parseHeader(msg []byte, off int) (Header, int, error) {
+	if len(msg)-off < headerLen {
+		return Header{}, 0, io.ErrUnexpectedEOF
+	}
+	b := msg[off:]
+	return Header{
+		ID:             binary.BigEndian.Uint16(b[0:]),
+		Flags:          Flags(binary.BigEndian.Uint16(b[2:])),
+		NumQuestions:   binary.BigEndian.Uint16(b[4:]),
+		NumAnswers:     binary.BigEndian.Uint16(b[6:]),
+		NumAuthorities: binary.BigEndian.Uint16(b[8:]),
+		NumAdditionals: binary.BigEndian.Uint16(b[10:]),
+	}, off + headerLen, nil
 }
 
 // Question is a DNS question.
@@ -49,145 +81,383 @@ type Question struct {
 	Class Class
 }
 
-// DecodeQuestion decodes a DNS question.
+// DecodeQuestion decodes a DNS question. r must hold the whole message, so
+// that compression pointers can be followed. Like the other Decode
+// functions, it reads all of r on each call; see DecodePacket.
 func DecodeQuestion(r io.ReadSeeker) (Question, error) {
 	var q Question
+	err := decodeAt(r, func(msg []byte, off int) (next int, err error) {
+		q, next, err = parseQuestion(msg, off, maxNameLen)
+		return next, err
+	})
+	return q, err
+}
+
+// parseQuestion parses the question at off in msg, and returns it along
+// with the offset just past it.
+func parseQuestion(msg []byte, off, maxName int) (Question, int, error) {
+	var q Question
 
-	name, err := DecodeName(r)
+	name, off, err := parseName(msg, off, maxName)
 	if err != nil {
-		return q, err
+		return q, 0, err
 	}
 	q.Name = name
 
-	if err := binary.Read(r, binary.BigEndian, &q.Type); err != nil {
-		return q, err
-	}
-	if err := binary.Read(r, binary.BigEndian, &q.Class); err != nil {
-		return q, err
+	if len(msg)-off < 4 {
+		return q, 0, io.ErrUnexpectedEOF
 	}
+	q.Type = Type(binary.BigEndian.Uint16(msg[off:]))
+	q.Class = Class(binary.BigEndian.Uint16(msg[off+2:]))
+
+	return q, off + 4, nil
+}
 
-	return q, nil
+// decodeAt runs parse on the message held by r, at r's current offset, and
+// on success leaves r at the offset parse returns. Decoding works on whole
+// messages in memory; this adapts it to readers for the Decode functions,
+// which are kept for compatibility. It reads all of r every time, so
+// nothing in the package decodes through readers.
+func decodeAt(r io.ReadSeeker, parse func(msg []byte, off int) (int, error)) error {
+	off, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	msg, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	next, err := parse(msg, int(off))
+	if err != nil {
+		return err
+	}
+	_, err = r.Seek(int64(next), io.SeekStart)
+	return err
 }
 
+// MarshalBinary implements encoding.BinaryMarshaler for Question.
 func (q *Question) MarshalBinary() ([]byte, error) {
 	// binary.Write can only serialize types with known sizes.
 	// https://cs.opensource.google/go/go/+/refs/tags/go1.20.4:src/encoding/binary/binary.go;l=450;drc=986b04c0f12efa1c57293f147a9e734ec71f0363
-	var b []byte
-	b = append(b, q.Name...)
+	return appendQuestion(nil, *q, nil)
+}
+
+// appendQuestion appends the wire form of q to b, compressing its name with
+// c if c is non-nil.
+func appendQuestion(b []byte, q Question, c *compressor) ([]byte, error) {
+	b, err := appendName(b, string(q.Name), c)
+	if err != nil {
+		return nil, err
+	}
 	b = binary.BigEndian.AppendUint16(b, uint16(q.Type))
 	b = binary.BigEndian.AppendUint16(b, uint16(q.Class))
 	return b, nil
 }
 
-// EncodeDNSName encodes a domain name for DNS.
-func EncodeDNSName(s string) []byte {
-	var b []byte
-	for _, part := range strings.Split(s, ".") {
-		b = append(b, byte(len(part)))
-		b = append(b, part...)
+// EncodeDNSName encodes a domain name for DNS. A trailing dot is optional,
+// and both "" and "." encode the root name. It returns ErrLabelTooLong or
+// ErrNameTooLong if s doesn't fit the limits of RFC 1035, section 2.3.4.
+func EncodeDNSName(s string) ([]byte, error) {
+	return AppendDNSName(nil, s)
+}
+
+// AppendDNSName is like EncodeDNSName, but appends the encoded name to dst
+// and returns the extended buffer, so that a caller can reuse one.
+func AppendDNSName(dst []byte, s string) ([]byte, error) {
+	return appendName(dst, s, nil)
+}
+
+// ErrLabelTooLong is returned when a label in a name is longer than 63
+// bytes.
+var ErrLabelTooLong = errors.New("label too long")
+
+// ErrNameTooLong is returned when a name is longer than 255 bytes in wire
+// form.
+var ErrNameTooLong = errors.New("name too long")
+
+const (
+	maxLabelLen = 63
+	maxNameLen  = 255
+)
+
+// checkName checks that name, which has no trailing dot, fits the limits
+// of RFC 1035, section 2.3.4.
+func checkName(name string) error {
+	if n := wireLen(name); n > maxNameLen {
+		return fmt.Errorf("%w: %d bytes", ErrNameTooLong, n)
+	}
+	for name != "" {
+		var label string
+		label, name, _ = strings.Cut(name, ".")
+		if len(label) > maxLabelLen {
+			return fmt.Errorf("%w: %q", ErrLabelTooLong, label)
+		}
 	}
-	b = append(b, 0)
-	return b
+	return nil
 }
 
-// DecodeName decodes a DNS name.
+// wireLen returns the length of name, which has no trailing dot, in
+// uncompressed wire form.
+func wireLen(name string) int {
+	if name == "" {
+		return 1
+	}
+	// A length byte for the first label, one in place of each dot, and the
+	// root label.
+	return len(name) + 2
+}
+
+// DecodeName decodes a DNS name. r must hold the whole message, so that
+// compression pointers can be followed. It returns ErrLabelTooLong or
+// ErrNameTooLong if the name doesn't fit the limits of RFC 1035, section
+// 2.3.4. It reads all of r on each call; see DecodePacket.
 func DecodeName(r io.ReadSeeker) ([]byte, error) {
+	var name []byte
+	err := decodeAt(r, func(msg []byte, off int) (next int, err error) {
+		name, next, err = parseName(msg, off, maxNameLen)
+		return next, err
+	})
+	return name, err
+}
+
+// ErrBadPointer is returned when a compression pointer points outside of
+// the message.
+var ErrBadPointer = errors.New("compression pointer out of bounds")
+
+// ErrPointerLoop is returned when a name follows more compression pointers
+// than any valid name needs, as when pointers refer to each other.
+var ErrPointerLoop = errors.New("too many compression pointers")
+
+// maxPointers is the most compression pointers a name may follow. A name is
+// at most 255 bytes long, so it has at most 127 labels, and there is no need
+// for more than one pointer per label.
+const maxPointers = 127
+
+// AppendDecodedName is like DecodeName, but decodes the name at off in
+// msg, and appends it to dst rather than allocating. It returns the
+// extended buffer and the offset just past the name in msg. Compression
+// pointers are followed elsewhere in msg, so msg must be the whole message.
+func AppendDecodedName(dst, msg []byte, off int) ([]byte, int, error) {
+	return appendParsedName(dst, msg, off, maxNameLen)
+}
+
+// parseName parses the name at off in msg, following compression pointers
+// elsewhere in msg, and returns it along with the offset just past it. The
+// name may be at most maxLen bytes long in uncompressed wire form.
+func parseName(msg []byte, off, maxLen int) ([]byte, int, error) {
+	name, next, err := appendParsedName(nil, msg, off, maxLen)
+	if err == nil && name == nil {
+		name = []byte{} // The root name.
+	}
+	return name, next, err
+}
+
+// appendParsedName is parseName, but appends the name to dst.
+func appendParsedName(dst, msg []byte, off, maxLen int) ([]byte, int, error) {
 	var (
-		parts  [][]byte
-		length = make([]byte, 1)
+		name  = dst
+		start = len(dst)
+		next  = -1 // The offset past the name, once a pointer is followed.
+
+		// The offsets of the pointers followed. A pointer followed twice
+		// means a loop.
+		pointers [maxPointers]int
+		jumps    int
 	)
 
-loop:
 	for {
-		_, err := r.Read(length)
-		if err != nil {
-			return nil, err
+		if off >= len(msg) {
+			return nil, 0, io.ErrUnexpectedEOF
 		}
 
-		switch n := int(length[0]); {
+		switch n := int(msg[off]); {
 		case n == 0:
-			break loop
-		case n&0b1100_0000 != 0:
-			part, err := DecodeCompressedName(n, r)
-			if err != nil {
-				return nil, err
+			if next < 0 {
+				next = off + 1
+			}
+			return name, next, nil
+		case n&0b1100_0000 == 0b1100_0000:
+			if off+1 >= len(msg) {
+				return nil, 0, io.ErrUnexpectedEOF
+			}
+			if jumps == maxPointers {
+				return nil, 0, ErrPointerLoop
+			}
+			for _, p := range pointers[:jumps] {
+				if p == off {
+					return nil, 0, ErrPointerLoop
+				}
+			}
+			pointers[jumps] = off
+			jumps++
+
+			ptr := int(binary.BigEndian.Uint16(msg[off:]) & maxPointer)
+			if ptr >= len(msg) {
+				return nil, 0, ErrBadPointer
+			}
+			if next < 0 {
+				next = off + 2
 			}
-			parts = append(parts, part)
-			break loop
+			off = ptr
+		case n > maxLabelLen:
+			// The 0b01 and 0b10 prefixes are reserved for other label
+			// types, none of which are in use.
+			return nil, 0, fmt.Errorf("%w: length byte %#x", ErrLabelTooLong, n)
 		default:
-			part := make([]byte, n)
-			if _, err := r.Read(part); err != nil {
-				return nil, err
+			off++
+			if off+n > len(msg) {
+				return nil, 0, io.ErrUnexpectedEOF
+			}
+			if len(name) > start {
+				name = append(name, '.')
+			}
+			name = append(name, msg[off:off+n]...)
+			off += n
+
+			// Check as the name grows, so a long one stops early.
+			if l := len(name) - start + 2; l > maxLen {
+				return nil, 0, fmt.Errorf("%w: at least %d bytes", ErrNameTooLong, l)
 			}
-			parts = append(parts, part)
 		}
 	}
-
-	return bytes.Join(parts, []byte(".")), nil
 }
 
-// DecodeCompressedName decodes a compressed DNS name.
+// DecodeCompressedName decodes a compressed DNS name. length is the first
+// byte of the compression pointer, which has already been read from r, and
+// r must hold the whole message. It reads all of r on each call; see
+// DecodePacket.
 func DecodeCompressedName(length int, r io.ReadSeeker) ([]byte, error) {
-	pointerBytes := make([]byte, 2)
-	pointerBytes[0] = byte(length & 0b0011_1111)
-	if _, err := r.Read(pointerBytes[1:]); err != nil {
-		return nil, err
-	}
-	pointer := binary.BigEndian.Uint16(pointerBytes)
-
-	restoreOffset, err := r.Seek(0, io.SeekCurrent)
-	if err != nil {
-		return nil, err
-	}
-
-	if _, err := r.Seek(int64(pointer), io.SeekStart); err != nil {
-		return nil, err
-	}
-
-	res, err := DecodeName(r)
-	if err != nil {
-		return nil, err
-	}
-
-	if _, err := r.Seek(restoreOffset, io.SeekStart); err != nil {
-		return nil, err
-	}
-
-	return res, nil
+	var name []byte
+	err := decodeAt(r, func(msg []byte, off int) (int, error) {
+		if off >= len(msg) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		ptr := int(length&0b0011_1111)<<8 | int(msg[off])
+		if ptr >= len(msg) {
+			return 0, ErrBadPointer
+		}
+		var err error
+		name, _, err = parseName(msg, ptr, maxNameLen)
+		return off + 1, err
+	})
+	return name, err
 }
 
 // A Type is a DNS record type.
 type Type uint16
 
 const (
-	TypeA  Type = 1
-	TypeNS Type = 2
+	TypeA        Type = 1
+	TypeNS       Type = 2
+	TypeCNAME    Type = 5
+	TypeSOA      Type = 6
+	TypePTR      Type = 12
+	TypeMX       Type = 15
+	TypeTXT      Type = 16
+	TypeISDN     Type = 20
+	TypeAAAA     Type = 28
+	TypeLOC      Type = 29
+	TypeSRV      Type = 33
+	TypeATMA     Type = 34
+	TypeNAPTR    Type = 35
+	TypeDNAME    Type = 39
+	TypeOPT      Type = 41
+	TypeSSHFP    Type = 44
+	TypeRRSIG    Type = 46
+	TypeTLSA     Type = 52
+	TypeSVCB     Type = 64
+	TypeHTTPS    Type = 65
+	TypeCAA      Type = 257
+	TypeAMTRELAY Type = 260
 )
 
+var typeNames = map[Type]string{
+	TypeA:        "A",
+	TypeNS:       "NS",
+	TypeCNAME:    "CNAME",
+	TypeSOA:      "SOA",
+	TypePTR:      "PTR",
+	TypeMX:       "MX",
+	TypeTXT:      "TXT",
+	TypeISDN:     "ISDN",
+	TypeAAAA:     "AAAA",
+	TypeLOC:      "LOC",
+	TypeSRV:      "SRV",
+	TypeATMA:     "ATMA",
+	TypeNAPTR:    "NAPTR",
+	TypeDNAME:    "DNAME",
+	TypeOPT:      "OPT",
+	TypeSSHFP:    "SSHFP",
+	TypeRRSIG:    "RRSIG",
+	TypeTLSA:     "TLSA",
+	TypeSVCB:     "SVCB",
+	TypeHTTPS:    "HTTPS",
+	TypeCAA:      "CAA",
+	TypeAMTRELAY: "AMTRELAY",
+}
+
+// String returns the mnemonic for t, or the generic TYPEnnn form from
+// RFC 3597 if t has none.
+func (t Type) String() string {
+	if s, ok := typeNames[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("TYPE%d", uint16(t))
+}
+
 // A Class is a DNS record class.
 type Class uint16
 
-const ClassIN Class = 1
-
-// Flag constants.
 const (
-	FlagRecursionDesired uint16 = 1 << 8
+	ClassIN Class = 1
+	ClassCH Class = 3
+	ClassHS Class = 4
 )
 
-// ID returns a random query ID.
+// String returns the mnemonic for c, or the generic CLASSnnn form from
+// RFC 3597 if c has none.
+func (c Class) String() string {
+	switch c {
+	case ClassIN:
+		return "IN"
+	case ClassCH:
+		return "CH"
+	case ClassHS:
+		return "HS"
+	default:
+		return fmt.Sprintf("CLASS%d", uint16(c))
+	}
+}
+
+// ID returns a random query ID. It comes from crypto/rand, since an ID
+// that can be predicted makes it easier to spoof responses (RFC 5452,
+// section 9.2).
 func ID() uint16 {
-	return uint16(rand.Int())
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic("resolve: reading random query ID: " + err.Error())
+	}
+	return binary.BigEndian.Uint16(b[:])
 }
 
 // NewQuery returns a new DNS query for a domain name and record type.
 func NewQuery(domain string, t Type) ([]byte, error) {
+	return NewQueryWithFlags(domain, t, 0)
+}
+
+// NewQueryWithFlags is like NewQuery, but sets flags in the query header.
+func NewQueryWithFlags(domain string, t Type, flags Flags) ([]byte, error) {
 	h := Header{
 		ID:           ID(),
+		Flags:        flags,
 		NumQuestions: 1,
 	}
 
 	q := Question{
-		Name:  EncodeDNSName(domain),
+		Name:  []byte(domain),
 		Type:  t,
 		Class: ClassIN,
 	}
@@ -211,45 +481,175 @@ type Record struct {
 	Type  Type
 	Class Class
 	TTL   uint32
-	Data  []byte
+
+	// Data is the record data as it appears on the wire. Domain names in it
+	// may be compressed, so RData is usually more useful.
+	Data []byte
+
+	// RData is the parsed record data. DecodeRecord sets it to Raw for types
+	// it doesn't know, and for data that isn't valid for the type.
+	RData RData
 }
 
-// DecodeRecord decodes a DNS record.
+// DecodeRecord decodes a DNS record. r must hold the whole message, so that
+// compression pointers can be followed. It reads all of r on each call; see
+// DecodePacket.
 func DecodeRecord(r io.ReadSeeker) (Record, error) {
 	var record Record
+	err := decodeAt(r, func(msg []byte, off int) (next int, err error) {
+		record, next, err = parseRecord(msg, off, DecodeOptions{})
+		return next, err
+	})
+	return record, err
+}
 
-	name, err := DecodeName(r)
+// parseRecord parses the record at off in msg, and returns it along with
+// the offset just past it.
+func parseRecord(msg []byte, off int, opts DecodeOptions) (Record, int, error) {
+	var record Record
+
+	name, off, err := parseName(msg, off, opts.maxNameLen())
 	if err != nil {
-		return record, err
+		return record, 0, err
 	}
 	record.Name = name
 
-	buf := make([]byte, 10)
-	if _, err := r.Read(buf); err != nil {
-		return record, err
+	if len(msg)-off < 10 {
+		return record, 0, io.ErrUnexpectedEOF
+	}
+	record.Type = Type(binary.BigEndian.Uint16(msg[off:]))
+	record.Class = Class(binary.BigEndian.Uint16(msg[off+2:]))
+	record.TTL = binary.BigEndian.Uint32(msg[off+4:])
+	dataLen := int(binary.BigEndian.Uint16(msg[off+8:]))
+	off += 10
+
+	if left := len(msg) - off; dataLen > left {
+		if opts.Strict {
+			return record, 0, fmt.Errorf("%w: %s record has RDLENGTH %d, packet has %d bytes left", ErrDataOverrun, record.Type, dataLen, left)
+		}
+		return record, 0, io.ErrUnexpectedEOF
 	}
+	end := off + dataLen
 
-	record.Type = Type(binary.BigEndian.Uint16(buf[0:]))
-	record.Class = Class(binary.BigEndian.Uint16(buf[2:]))
-	record.TTL = binary.BigEndian.Uint32(buf[4:])
-	dataLen := binary.BigEndian.Uint16(buf[8:])
+	// Copy the data, so the record doesn't keep msg alive or change with it.
+	record.Data = make([]byte, dataLen)
+	copy(record.Data, msg[off:end])
 
-	switch record.Type {
-	case TypeNS:
-		data, err := DecodeName(r)
-		if err != nil {
-			return record, err
-		}
-		record.Data = data
+	// Names in the data may point elsewhere in the message, so decode them
+	// from msg. In strict mode, they may not run past the data.
+	nameMsg := msg
+	if opts.Strict {
+		nameMsg = msg[:end]
+	}
+	rdata, err := decodeRData(record.Type, record.Data, nameMsg, off, opts.maxNameLen())
+	if opts.Strict && errors.Is(err, io.ErrUnexpectedEOF) {
+		return record, 0, fmt.Errorf("%w: %s record data runs past RDLENGTH %d", ErrDataOverrun, record.Type, dataLen)
+	}
+	if err != nil {
+		// RDLENGTH still frames the record, so data that doesn't parse as
+		// its type only costs this record its RData, not the message.
+		rdata = Raw{RRType: record.Type, Data: record.Data}
+	}
+	record.RData = rdata
+
+	return record, end, nil
+}
+
+// String returns r in presentation format.
+func (r Record) String() string {
+	rdata := r.RData
+	if rdata == nil {
+		rdata = Raw{RRType: r.Type, Data: r.Data}
+	}
+	return fmt.Sprintf("%s\t%d\t%s\t%s\t%s", fqdn(string(r.Name)), r.TTL, r.Class, r.Type, rdata)
+}
+
+// Addr returns the IP address held by an A or AAAA record, from RData if it
+// is set and Data otherwise.
+func (r Record) Addr() (netip.Addr, error) {
+	switch rd := r.RData.(type) {
+	case A:
+		return rd.Addr, nil
+	case AAAA:
+		return rd.Addr, nil
+	}
+
+	var size int
+	switch r.Type {
+	case TypeA:
+		size = 4
+	case TypeAAAA:
+		size = 16
 	default:
-		data := make([]byte, dataLen)
-		if _, err := r.Read(data); err != nil {
-			return record, err
+		return netip.Addr{}, fmt.Errorf("not an address record: type %d", r.Type)
+	}
+
+	if len(r.Data) != size {
+		return netip.Addr{}, fmt.Errorf("invalid ip: %q", r.Data)
+	}
+	addr, _ := netip.AddrFromSlice(r.Data)
+	return addr, nil
+}
+
+// ChainTTL returns the effective TTL of a resolution chain: the smallest
+// TTL among records, which are typically a chain of CNAME records followed
+// by the terminal records. An alias can't be cached for longer than any
+// link it depends on. ChainTTL returns 0 if records is empty.
+func ChainTTL(records []Record) uint32 {
+	if len(records) == 0 {
+		return 0
+	}
+	ttl := records[0].TTL
+	for _, r := range records[1:] {
+		if r.TTL < ttl {
+			ttl = r.TTL
 		}
-		record.Data = data
 	}
+	return ttl
+}
 
-	return record, nil
+// MarshalBinary implements encoding.BinaryMarshaler for Record.
+//
+// The record data is encoded from RData if it is set, and copied from Data
+// otherwise. Data may hold compression pointers into the message it was
+// decoded from, so RData is the reliable source for decoded records.
+func (r *Record) MarshalBinary() ([]byte, error) {
+	return appendRecord(nil, *r, nil)
+}
+
+// appendRecord appends the wire form of r to b, compressing names with c if
+// c is non-nil.
+func appendRecord(b []byte, r Record, c *compressor) ([]byte, error) {
+	b, err := appendName(b, string(r.Name), c)
+	if err != nil {
+		return nil, err
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(r.Type))
+	b = binary.BigEndian.AppendUint16(b, uint16(r.Class))
+	b = binary.BigEndian.AppendUint32(b, r.TTL)
+
+	// Reserve space for the data length and fill it in afterwards.
+	lenOffset := len(b)
+	b = append(b, 0, 0)
+
+	if r.RData == nil {
+		b = append(b, r.Data...)
+	} else {
+		if r.RData.Type() != r.Type {
+			return nil, fmt.Errorf("%s record with %s data", r.Type, r.RData.Type())
+		}
+		if b, err = r.RData.pack(b, c); err != nil {
+			return nil, fmt.Errorf("%s record: %w", r.Type, err)
+		}
+	}
+
+	dataLen := len(b) - lenOffset - 2
+	if dataLen > math.MaxUint16 {
+		return nil, fmt.Errorf("%s record data too large: %d bytes", r.Type, dataLen)
+	}
+	binary.BigEndian.PutUint16(b[lenOffset:], uint16(dataLen))
+
+	return b, nil
 }
 
 // Packet represents a DNS packet.
@@ -259,17 +659,90 @@ type Packet struct {
 	Answers     []Record
 	Authorities []Record
 	Additionals []Record
+
+	// EDNS is the OPT record from the Additional section, if any. It is not
+	// included in Additionals.
+	EDNS *EDNS
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler for Packet.
+//
+// The section counts in the encoded header are taken from the lengths of
+// the sections rather than from p.Header, and if p.EDNS is set, its OPT
+// record is appended to the Additional section. Repeated names are
+// compressed.
+func (p *Packet) MarshalBinary() ([]byte, error) {
+	additionals := p.Additionals
+	if p.EDNS != nil {
+		additionals = append(additionals[:len(additionals):len(additionals)], p.EDNS.Record())
+	}
+
+	h := p.Header
+	for _, n := range []int{len(p.Questions), len(p.Answers), len(p.Authorities), len(additionals)} {
+		if n > math.MaxUint16 {
+			return nil, fmt.Errorf("too many records in section: %d", n)
+		}
+	}
+	h.NumQuestions = uint16(len(p.Questions))
+	h.NumAnswers = uint16(len(p.Answers))
+	h.NumAuthorities = uint16(len(p.Authorities))
+	h.NumAdditionals = uint16(len(additionals))
+
+	// Encode into pooled scratch space, and copy out the result, so the
+	// buffer doesn't have to grow from nothing for every message.
+	scratch := getBuf(0)
+	defer putBuf(scratch)
+	c := getCompressor()
+	defer putCompressor(c)
+
+	b := appendHeader((*scratch)[:0], h)
+	var err error
+	for _, q := range p.Questions {
+		if b, err = appendQuestion(b, q, c); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, section := range [][]Record{p.Answers, p.Authorities, additionals} {
+		for _, r := range section {
+			if b, err = appendRecord(b, r, c); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	*scratch = b
+	return append([]byte(nil), b...), nil
+}
+
+// RCode returns the response code of p, including the upper bits carried by
+// its OPT record, if any.
+func (p *Packet) RCode() RCode {
+	rc := p.Header.Flags.RCode()
+	if p.EDNS != nil {
+		rc |= RCode(p.EDNS.ExtendedRCode) << 4
+	}
+	return rc
 }
 
-// Answer returns the IP from the first A record in the Answer section.
+// Err returns a *ResponseError if p has an error RCODE, and nil otherwise.
+func (p *Packet) Err() error {
+	rc := p.RCode()
+	if rc == RCodeSuccess {
+		return nil
+	}
+	e := &ResponseError{RCode: rc}
+	if p.EDNS != nil {
+		e.ExtendedErrors = p.EDNS.ExtendedErrors
+	}
+	return e
+}
+
+// Answer returns the IP from the first A or AAAA record in the Answer section.
 func (p Packet) Answer() (netip.Addr, error) {
 	for _, record := range p.Answers {
-		if record.Type == TypeA {
-			addr, ok := netip.AddrFromSlice(record.Data)
-			if !ok {
-				return netip.Addr{}, fmt.Errorf("invalid ip: %q", record.Data)
-			}
-			return addr, nil
+		if record.Type == TypeA || record.Type == TypeAAAA {
+			return record.Addr()
 		}
 	}
 
@@ -280,11 +753,7 @@ func (p Packet) Answer() (netip.Addr, error) {
 func (p Packet) NameserverIP() (netip.Addr, error) {
 	for _, record := range p.Additionals {
 		if record.Type == TypeA {
-			addr, ok := netip.AddrFromSlice(record.Data)
-			if !ok {
-				return netip.Addr{}, fmt.Errorf("invalid ip: %q", record.Data)
-			}
-			return addr, nil
+			return record.Addr()
 		}
 	}
 
@@ -294,143 +763,449 @@ func (p Packet) NameserverIP() (netip.Addr, error) {
 // Nameserver returns the domain from the first NS record in the Authority section.
 func (p Packet) Nameserver() (string, error) {
 	for _, record := range p.Authorities {
-		if record.Type == TypeNS {
-			return string(record.Data), nil
+		if ns, ok := record.RData.(NS); ok {
+			return ns.Host, nil
 		}
 	}
 
 	return "", fmt.Errorf("no authorities")
 }
 
-// DecodePacket decodes a DNS packet.
+// DecodePacket decodes a DNS packet from r, starting at its current offset.
+//
+// DecodePacket and the other Decode functions are kept for compatibility.
+// Each call seeks r back to the start and reads the whole message, because
+// compression pointers may refer anywhere in it, so decoding a message
+// piece by piece through them takes time quadratic in its size. Use
+// ParsePacket on the message's bytes instead.
 func DecodePacket(r io.ReadSeeker) (*Packet, error) {
+	return DecodePacketWithOptions(r, DecodeOptions{})
+}
+
+// ParsePacket decodes the DNS packet in msg. It is like DecodePacket, but
+// works on the bytes directly rather than through a reader.
+func ParsePacket(msg []byte) (*Packet, error) {
+	return ParsePacketWithOptions(msg, DecodeOptions{})
+}
+
+// DecodeOptions controls how DecodePacketWithOptions and
+// ParsePacketWithOptions decode a packet.
+type DecodeOptions struct {
+	// Strict rejects packets that are malformed in ways DecodePacket
+	// tolerates or reports only as a read error: header counts that promise
+	// more entries than the packet holds (ErrCountMismatch), record data
+	// that runs past its RDLENGTH or the end of the packet
+	// (ErrDataOverrun), and bytes left over after the last section
+	// (ErrTrailingBytes). It is meant for validators and fuzz targets.
+	Strict bool
+
+	// MaxSize is the largest packet to decode, in bytes. If zero, it is
+	// 65535, the most a TCP message can hold.
+	MaxSize int
+
+	// MaxRecords is the most questions and records, counted together, that
+	// a packet may hold according to its header. If zero, the only limit is
+	// what fits in MaxSize.
+	MaxRecords int
+
+	// MaxNameLen is the longest name to decode, in bytes of uncompressed
+	// wire form. If zero, or more than 255, it is 255. Names in the data of
+	// records whose types forbid compression are only limited by the data's
+	// length.
+	MaxNameLen int
+}
+
+func (opts DecodeOptions) maxSize() int {
+	if opts.MaxSize == 0 {
+		return math.MaxUint16
+	}
+	return opts.MaxSize
+}
+
+func (opts DecodeOptions) maxNameLen() int {
+	if opts.MaxNameLen == 0 || opts.MaxNameLen > maxNameLen {
+		return maxNameLen
+	}
+	return opts.MaxNameLen
+}
+
+var (
+	// ErrCountMismatch is returned in strict mode when a section holds
+	// fewer entries than the header says.
+	ErrCountMismatch = errors.New("section count does not match packet")
+
+	// ErrDataOverrun is returned in strict mode when record data runs past
+	// its RDLENGTH or the end of the packet.
+	ErrDataOverrun = errors.New("record data overruns its length")
+
+	// ErrTrailingBytes is returned in strict mode when bytes are left over
+	// after the last section.
+	ErrTrailingBytes = errors.New("trailing bytes after packet")
+
+	// ErrPacketTooLarge is returned when a packet is larger than
+	// DecodeOptions.MaxSize.
+	ErrPacketTooLarge = errors.New("packet too large")
+
+	// ErrTooManyRecords is returned when a packet's header counts more
+	// records than DecodeOptions.MaxRecords.
+	ErrTooManyRecords = errors.New("too many records")
+)
+
+// DecodePacketWithOptions is like DecodePacket, but decodes as opts says.
+func DecodePacketWithOptions(r io.ReadSeeker, opts DecodeOptions) (*Packet, error) {
+	var p *Packet
+	err := decodeAt(r, func(msg []byte, off int) (next int, err error) {
+		p, next, err = parsePacket(msg, off, opts)
+		return next, err
+	})
+	return p, err
+}
+
+// ParsePacketWithOptions is like ParsePacket, but decodes as opts says.
+func ParsePacketWithOptions(msg []byte, opts DecodeOptions) (*Packet, error) {
+	p, _, err := parsePacket(msg, 0, opts)
+	return p, err
+}
+
+// parsePacket parses the packet that starts at off in msg, and returns it
+// along with the offset just past it.
+func parsePacket(msg []byte, off int, opts DecodeOptions) (*Packet, int, error) {
 	var p Packet
 
-	header, err := DecodeHeader(r)
+	if size := len(msg) - off; size > opts.maxSize() {
+		return nil, 0, fmt.Errorf("%w: %d bytes", ErrPacketTooLarge, size)
+	}
+
+	header, off, err := parseHeader(msg, off)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	p.Header = header
 
+	if opts.MaxRecords > 0 {
+		n := int(header.NumQuestions) + int(header.NumAnswers) + int(header.NumAuthorities) + int(header.NumAdditionals)
+		if n > opts.MaxRecords {
+			return nil, 0, fmt.Errorf("%w: header counts %d", ErrTooManyRecords, n)
+		}
+	}
+
 	for i := 0; i < int(p.Header.NumQuestions); i++ {
-		q, err := DecodeQuestion(r)
-		if err != nil {
-			return nil, err
+		if err := opts.checkMore(msg, off, "questions", i, int(p.Header.NumQuestions)); err != nil {
+			return nil, 0, err
+		}
+		var q Question
+		if q, off, err = parseQuestion(msg, off, opts.maxNameLen()); err != nil {
+			return nil, 0, err
 		}
 		p.Questions = append(p.Questions, q)
 	}
 
-	for i := 0; i < int(p.Header.NumAnswers); i++ {
-		rec, err := DecodeRecord(r)
-		if err != nil {
-			return nil, err
+	sections := []struct {
+		name    string
+		n       int
+		records *[]Record
+	}{
+		{"answers", int(p.Header.NumAnswers), &p.Answers},
+		{"authorities", int(p.Header.NumAuthorities), &p.Authorities},
+		{"additionals", int(p.Header.NumAdditionals), &p.Additionals},
+	}
+	for _, s := range sections {
+		for i := 0; i < s.n; i++ {
+			if err := opts.checkMore(msg, off, s.name, i, s.n); err != nil {
+				return nil, 0, err
+			}
+			var rec Record
+			if rec, off, err = parseRecord(msg, off, opts); err != nil {
+				return nil, 0, err
+			}
+			*s.records = append(*s.records, rec)
 		}
-		p.Answers = append(p.Answers, rec)
 	}
 
-	for i := 0; i < int(p.Header.NumAuthorities); i++ {
-		rec, err := DecodeRecord(r)
-		if err != nil {
-			return nil, err
-		}
-		p.Authorities = append(p.Authorities, rec)
+	if left := len(msg) - off; opts.Strict && left > 0 {
+		return nil, 0, fmt.Errorf("%w: %d bytes", ErrTrailingBytes, left)
 	}
 
-	for i := 0; i < int(p.Header.NumAdditionals); i++ {
-		rec, err := DecodeRecord(r)
-		if err != nil {
-			return nil, err
-		}
-		p.Additionals = append(p.Additionals, rec)
+	if err := extractEDNS(&p); err != nil {
+		return nil, 0, err
 	}
 
-	return &p, nil
+	return &p, off, nil
 }
 
-func LookupDomain(name string) (netip.Addr, error) {
-	query, err := NewQuery(name, TypeA)
-	if err != nil {
-		return netip.Addr{}, err
+// checkMore returns ErrCountMismatch in strict mode if off is the end of
+// msg when the header promises the ith of n entries in a section.
+func (opts DecodeOptions) checkMore(msg []byte, off int, section string, i, n int) error {
+	if opts.Strict && off == len(msg) {
+		return fmt.Errorf("%w: header has %d %s, packet has %d", ErrCountMismatch, n, section, i)
 	}
+	return nil
+}
 
-	conn, err := net.Dial("udp", "8.8.8.8:53")
-	if err != nil {
-		return netip.Addr{}, err
-	}
+// LookupDomain returns an IPv4 address for name, using Google Public DNS.
+func LookupDomain(name string) (netip.Addr, error) {
+	return LookupDomainContext(context.Background(), name)
+}
 
-	if _, err := conn.Write(query); err != nil {
-		return netip.Addr{}, err
-	}
+// LookupDomainContext is like LookupDomain, but honors ctx.
+func LookupDomainContext(ctx context.Context, name string) (netip.Addr, error) {
+	var r Resolver
+	return r.LookupContext(ctx, name, TypeA)
+}
 
-	buf := make([]byte, 1024)
-	if _, err := conn.Read(buf); err != nil {
-		return netip.Addr{}, err
-	}
+// LookupMX returns the MX records for name sorted by preference, using
+// Google Public DNS.
+func LookupMX(name string) ([]MX, error) {
+	return LookupMXContext(context.Background(), name)
+}
+
+// LookupMXContext is like LookupMX, but honors ctx.
+func LookupMXContext(ctx context.Context, name string) ([]MX, error) {
+	var r Resolver
+	return r.LookupMXContext(ctx, name)
+}
 
-	response, err := DecodePacket(bytes.NewReader(buf))
+// LookupTXT returns the TXT records for name, using Google Public DNS.
+func LookupTXT(name string) ([]string, error) {
+	return LookupTXTContext(context.Background(), name)
+}
+
+// LookupTXTContext is like LookupTXT, but honors ctx.
+func LookupTXTContext(ctx context.Context, name string) ([]string, error) {
+	var r Resolver
+	return r.LookupTXTContext(ctx, name)
+}
+
+// LookupNS returns the NS records for name, using Google Public DNS.
+func LookupNS(name string) ([]NS, error) {
+	return LookupNSContext(context.Background(), name)
+}
+
+// LookupNSContext is like LookupNS, but honors ctx.
+func LookupNSContext(ctx context.Context, name string) ([]NS, error) {
+	var r Resolver
+	return r.LookupNSContext(ctx, name)
+}
+
+// LookupSRV returns the SRV records for service and proto at name, in the
+// order to try them, using Google Public DNS.
+func LookupSRV(service, proto, name string) ([]SRV, error) {
+	return LookupSRVContext(context.Background(), service, proto, name)
+}
+
+// LookupSRVContext is like LookupSRV, but honors ctx.
+func LookupSRVContext(ctx context.Context, service, proto, name string) ([]SRV, error) {
+	var r Resolver
+	return r.LookupSRVContext(ctx, service, proto, name)
+}
+
+// LookupAddr returns the host names for addr, using Google Public DNS.
+func LookupAddr(addr netip.Addr) ([]string, error) {
+	return LookupAddrContext(context.Background(), addr)
+}
+
+// LookupAddrContext is like LookupAddr, but honors ctx.
+func LookupAddrContext(ctx context.Context, addr netip.Addr) ([]string, error) {
+	var r Resolver
+	return r.LookupAddrContext(ctx, addr)
+}
+
+// SendQuery sends a query for domain and t to the DNS server at address and
+// returns the response. The query does not ask for recursion. Truncated
+// responses are retried over TCP.
+func SendQuery(address, domain string, t Type) (*Packet, error) {
+	return SendQueryContext(context.Background(), address, domain, t)
+}
+
+// SendQueryContext is like SendQuery, but honors ctx.
+func SendQueryContext(ctx context.Context, address, domain string, t Type) (*Packet, error) {
+	query, err := NewQuery(domain, t)
 	if err != nil {
-		return netip.Addr{}, err
+		return nil, err
 	}
 
-	if len(response.Answers) == 0 {
-		return netip.Addr{}, fmt.Errorf("no answers")
-	}
+	return exchange(ctx, net.JoinHostPort(address, "53"), query, maxUDPSize, false)
+}
 
-	ipData := response.Answers[0].Data
-	ip, ok := netip.AddrFromSlice(ipData)
-	if !ok {
-		return netip.Addr{}, fmt.Errorf("invalid ip: %x", ipData)
+// exchange sends query to address over UDP, and again over TCP if the UDP
+// response is truncated. bufSize and checkCase are as for exchangeUDP.
+func exchange(ctx context.Context, address string, query []byte, bufSize int, checkCase bool) (*Packet, error) {
+	response, err := exchangeUDP(ctx, address, query, bufSize, checkCase)
+	if err != nil || !response.Header.Flags.TC() {
+		return response, err
 	}
-	return ip, nil
+	return exchangeTCP(ctx, address, query)
 }
 
-func SendQuery(address, domain string, t Type) (*Packet, error) {
-	query, err := NewQuery(domain, t)
+// maxUDPSize is the largest UDP response to a query without EDNS (RFC 1035,
+// section 2.3.4).
+const maxUDPSize = 512
+
+// exchangeUDP sends query to address over UDP and decodes the response,
+// which may be up to bufSize bytes. Packets that don't answer query, such
+// as spoofed ones with the wrong ID, are ignored (RFC 5452, section 9.1).
+// If checkCase is true, so are packets that don't echo the question's name
+// in the case it was sent, for CaseRandomization.
+func exchangeUDP(ctx context.Context, address string, query []byte, bufSize int, checkCase bool) (*Packet, error) {
+	q, err := ParsePacket(query)
 	if err != nil {
 		return nil, err
 	}
 
-	conn, err := net.Dial("udp", address+":53")
+	// The response is decoded into a Packet that doesn't refer to the
+	// buffer, so the buffer can go back to the pool.
+	buf := getBuf(bufSize)
+	defer putBuf(buf)
+
+	var response *Packet
+	_, err = roundTripUDP(ctx, address, query, *buf, func(b []byte) bool {
+		p, err := ParsePacket(b)
+		if err != nil || matchResponse(q, p, true) != nil || checkCase && !sameCase(q, p) {
+			return false
+		}
+		response = p
+		return true
+	})
 	if err != nil {
 		return nil, err
 	}
+	return response, nil
+}
 
-	if _, err := conn.Write(query); err != nil {
+// roundTripUDP sends msg to address over UDP and returns the response,
+// which is read into buf and may be up to len(buf) bytes. Only packets from
+// address count, and of those, packets that accept reports false for are
+// skipped; if accept is nil, the first packet from address is the response.
+func roundTripUDP(ctx context.Context, address string, msg, buf []byte, accept func([]byte) bool) ([]byte, error) {
+	server, err := resolveUDPAddr(ctx, address)
+	if err != nil {
 		return nil, err
 	}
 
-	buf := make([]byte, 1024)
-	if _, err := conn.Read(buf); err != nil {
+	// The socket isn't connected, so packets from anywhere arrive and
+	// those from elsewhere than the server can be seen and dropped.
+	network := "udp4"
+	if server.Addr().Is6() {
+		network = "udp6"
+	}
+	conn, err := listenUDP(network)
+	if err != nil {
 		return nil, err
 	}
+	defer conn.Close()
 
-	return DecodePacket(bytes.NewReader(buf))
-}
+	stop := closeOnDone(ctx, conn)
+	defer stop()
 
-const RootNSIP = "198.41.0.4"
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
 
-func Resolve(domain string, t Type) (netip.Addr, error) {
-	nameserver := RootNSIP
+	if _, err := conn.WriteToUDPAddrPort(msg, server); err != nil {
+		return nil, ctxErr(ctx, err)
+	}
 
 	for {
-		log.Printf("querying %s for %s", nameserver, domain)
-		response, err := SendQuery(nameserver, domain, t)
+		n, from, err := conn.ReadFromUDPAddrPort(buf)
 		if err != nil {
-			return netip.Addr{}, nil
+			return nil, ctxErr(ctx, err)
+		}
+		if from.Addr().Unmap().WithZone("") != server.Addr().WithZone("") || from.Port() != server.Port() {
+			continue
+		}
+		if accept == nil || accept(buf[:n]) {
+			return buf[:n], nil
 		}
+	}
+}
 
-		if ip, err := response.Answer(); err == nil {
-			return ip, nil // done!
-		} else if nsIP, err := response.NameserverIP(); err == nil {
-			nameserver = nsIP.String() // keep going...
-		} else if nsDomain, err := response.Nameserver(); err == nil {
-			nsIP, err := Resolve(nsDomain, TypeA) // branch off
-			if err != nil {
-				return netip.Addr{}, err
-			}
-			nameserver = nsIP.String()
-		} else {
-			return netip.Addr{}, fmt.Errorf("unable to resolve") // fail :(
+// listenUDP opens a UDP socket for a single query, on a random port. An
+// attacker who wants to spoof the response has to guess the port as well as
+// the query ID (RFC 5452, section 9.2), so the port is picked with
+// crypto/rand rather than left to the system, which may pick predictably.
+// If a few random ports are taken, the system picks after all.
+func listenUDP(network string) (*net.UDPConn, error) {
+	for i := 0; i < 5; i++ {
+		port, err := randomPort()
+		if err != nil {
+			break
 		}
+		conn, err := net.ListenUDP(network, &net.UDPAddr{Port: port})
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return net.ListenUDP(network, nil)
+}
+
+// minRandomPort is the lowest port randomPort returns, leaving out the
+// well-known ports.
+const minRandomPort = 1024
+
+// randomPort returns a random port from minRandomPort up.
+func randomPort() (int, error) {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return minRandomPort + int(binary.BigEndian.Uint16(b[:]))%(65536-minRandomPort), nil
+}
+
+// resolveUDPAddr returns the IP address and port of address, a host and
+// port, looking up the host if it is a name.
+func resolveUDPAddr(ctx context.Context, address string) (netip.AddrPort, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return netip.AddrPort{}, err
 	}
+	p, err := net.DefaultResolver.LookupPort(ctx, "udp", port)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(addrs[0].Unmap(), uint16(p)), nil
+}
+
+// closeOnDone unblocks pending I/O on conn once ctx is done. Calling stop
+// releases the associated goroutine.
+func closeOnDone(ctx context.Context, conn interface{ SetDeadline(time.Time) error }) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// ctxErr returns ctx's error if ctx is done, and err otherwise. It reports
+// why I/O was interrupted by closeOnDone.
+func ctxErr(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// RootNSIP is the IPv4 address of a.root-servers.net.
+const RootNSIP = "198.41.0.4"
+
+// Resolve resolves domain iteratively, starting from the root name servers,
+// and logs each query it sends. It returns the first address in the answer,
+// as Resolver.Lookup does.
+func Resolve(domain string, t Type) (netip.Addr, error) {
+	return ResolveContext(context.Background(), domain, t)
+}
+
+// ResolveContext is like Resolve, but honors ctx.
+func ResolveContext(ctx context.Context, domain string, t Type) (netip.Addr, error) {
+	r := Resolver{Mode: ModeIterative, logQueries: true}
+	return r.LookupContext(ctx, domain, t)
 }
@@ -2,13 +2,21 @@ package resolve
 
 import (
 	"bytes"
+	"errors"
+	"io"
+	"math"
 	"net"
 	"net/netip"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 )
 
+// cmpAddr lets cmp compare netip.Addr values, which have unexported fields.
+var cmpAddr = cmp.Comparer(func(a, b netip.Addr) bool { return a == b })
+
 func TestHeader_MarshalBinary(t *testing.T) {
 	var (
 		in   = Header{ID: 0x1314, NumQuestions: 1}
@@ -60,6 +68,7 @@ func TestDecodePacket(t *testing.T) {
 				Class: ClassIN,
 				TTL:   21147,
 				Data:  []byte("]\xb8\xd8\""),
+				RData: A{Addr: netip.MustParseAddr("93.184.216.34")},
 			}},
 		}
 	)
@@ -68,23 +77,403 @@ func TestDecodePacket(t *testing.T) {
 	if err != nil {
 		t.Errorf("error: %v", err)
 	}
-	if diff := cmp.Diff(want, got); diff != "" {
+	if diff := cmp.Diff(want, got, cmpAddr); diff != "" {
 		t.Errorf("DecodePacket mismatch (-want, +got):\n%s", diff)
 	}
 }
 
+func TestDecodePacketWithOptions_Strict(t *testing.T) {
+	strict := DecodeOptions{Strict: true}
+	if _, err := DecodePacketWithOptions(bytes.NewReader(examplePacket), strict); err != nil {
+		t.Fatalf("well-formed packet: %v", err)
+	}
+
+	withAnswers := func(n byte) []byte {
+		b := bytes.Clone(examplePacket)
+		b[7] = n
+		return b
+	}
+	// The answer is an A record at offset 33, so its RDLENGTH is at 43.
+	withRDLength := func(n byte) []byte {
+		b := bytes.Clone(examplePacket)
+		b[44] = n
+		return b
+	}
+	// A CNAME whose target runs past its 2-byte RDLENGTH.
+	cname := append(bytes.Clone(examplePacket[:35]), "\x00\x05\x00\x01\x00\x00\x00\x3c\x00\x02\x03foo\x00"...)
+
+	cases := []struct {
+		name string
+		in   []byte
+		want error
+	}{
+		{"trailing bytes", append(bytes.Clone(examplePacket), 0), ErrTrailingBytes},
+		{"too few answers", withAnswers(0), ErrTrailingBytes},
+		{"too many answers", withAnswers(2), ErrCountMismatch},
+		{"rdlength past end", withRDLength(5), ErrDataOverrun},
+		{"name past rdlength", cname, ErrDataOverrun},
+	}
+	for _, tc := range cases {
+		if _, err := DecodePacketWithOptions(bytes.NewReader(tc.in), strict); !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+
+	// Without strict mode, trailing bytes are ignored.
+	if _, err := DecodePacket(bytes.NewReader(append(bytes.Clone(examplePacket), 0))); err != nil {
+		t.Errorf("trailing bytes, not strict: %v", err)
+	}
+}
+
+func TestDecodePacketWithOptions_Limits(t *testing.T) {
+	// examplePacket is 49 bytes, with one question and one answer, both for
+	// www.example.com, which is 17 bytes long in wire form.
+	cases := []struct {
+		opts DecodeOptions
+		want error
+	}{
+		{DecodeOptions{MaxSize: 49}, nil},
+		{DecodeOptions{MaxSize: 48}, ErrPacketTooLarge},
+		{DecodeOptions{MaxRecords: 2}, nil},
+		{DecodeOptions{MaxRecords: 1}, ErrTooManyRecords},
+		{DecodeOptions{MaxNameLen: 17}, nil},
+		{DecodeOptions{MaxNameLen: 16}, ErrNameTooLong},
+		{DecodeOptions{MaxNameLen: 1000}, nil},
+	}
+	for _, tc := range cases {
+		if _, err := DecodePacketWithOptions(bytes.NewReader(examplePacket), tc.opts); !errors.Is(err, tc.want) {
+			t.Errorf("%+v: got %v, want %v", tc.opts, err, tc.want)
+		}
+	}
+
+	// By default, packets are limited to what TCP can carry.
+	big := append(bytes.Clone(examplePacket), make([]byte, math.MaxUint16)...)
+	if _, err := DecodePacket(bytes.NewReader(big)); !errors.Is(err, ErrPacketTooLarge) {
+		t.Errorf("%d bytes: got %v, want %v", len(big), err, ErrPacketTooLarge)
+	}
+
+	// An RDLENGTH past the end of the packet fails before the data is read.
+	b := bytes.Clone(examplePacket)
+	b[43], b[44] = 0xff, 0xff
+	if _, err := DecodePacket(bytes.NewReader(b)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("RDLENGTH 65535: got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestParsePacket(t *testing.T) {
+	want, err := DecodePacket(bytes.NewReader(examplePacket))
+	if err != nil {
+		t.Fatalf("DecodePacket: %v", err)
+	}
+	got, err := ParsePacket(examplePacket)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if diff := cmp.Diff(want, got, cmpAddr); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+
+	// Every truncation of the packet fails cleanly.
+	for n := 0; n < len(examplePacket); n++ {
+		if _, err := ParsePacket(examplePacket[:n]); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("%d bytes: got %v, want %v", n, err, io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+func TestPacket_MarshalBinary(t *testing.T) {
+	in := &Packet{
+		Header: Header{ID: 0xbeef, Flags: 0x8180, NumAnswers: 7}, // NumAnswers is recomputed.
+		Questions: []Question{
+			{Name: []byte("example.com"), Type: TypeA, Class: ClassIN},
+		},
+		Answers: []Record{
+			{Name: []byte("example.com"), Type: TypeA, Class: ClassIN, TTL: 300, Data: []byte{192, 0, 2, 1}},
+		},
+		Additionals: []Record{
+			{Name: []byte("ns1.example.com"), Type: TypeA, Class: ClassIN, TTL: 3600, Data: []byte{192, 0, 2, 53}},
+		},
+		EDNS: &EDNS{UDPSize: 1232},
+	}
+
+	b, err := in.MarshalBinary()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	got, err := DecodePacket(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("DecodePacket: %v", err)
+	}
+
+	want := &Packet{
+		Header:    Header{ID: 0xbeef, Flags: 0x8180, NumQuestions: 1, NumAnswers: 1, NumAdditionals: 2},
+		Questions: in.Questions,
+		Answers: []Record{
+			{Name: []byte("example.com"), Type: TypeA, Class: ClassIN, TTL: 300, Data: []byte{192, 0, 2, 1}, RData: A{Addr: netip.MustParseAddr("192.0.2.1")}},
+		},
+		Additionals: []Record{
+			{Name: []byte("ns1.example.com"), Type: TypeA, Class: ClassIN, TTL: 3600, Data: []byte{192, 0, 2, 53}, RData: A{Addr: netip.MustParseAddr("192.0.2.53")}},
+		},
+		EDNS: &EDNS{UDPSize: 1232},
+	}
+	if diff := cmp.Diff(want, got, cmpAddr); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+}
+
+func TestPacket_MarshalBinary_RoundTrip(t *testing.T) {
+	want, err := DecodePacket(bytes.NewReader(examplePacket))
+	if err != nil {
+		t.Fatalf("DecodePacket: %v", err)
+	}
+
+	b, err := want.MarshalBinary()
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	got, err := DecodePacket(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("DecodePacket: %v", err)
+	}
+	if diff := cmp.Diff(want, got, cmpAddr); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+}
+
+func TestDecodeRecord_PointerName(t *testing.T) {
+	// The answer in examplePacket starts at offset 33, and its name is a
+	// single compression pointer (0xc0 0x0c) back to the question name.
+	const answerOffset = 33
+
+	r := bytes.NewReader(examplePacket)
+	if _, err := r.Seek(answerOffset, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	name, err := DecodeName(r)
+	if err != nil {
+		t.Fatalf("DecodeName: %v", err)
+	}
+	if want := []byte("www.example.com"); !bytes.Equal(name, want) {
+		t.Errorf("DecodeName: got %q, want %q", name, want)
+	}
+	if pos, _ := r.Seek(0, io.SeekCurrent); pos != answerOffset+2 {
+		t.Errorf("DecodeName: cursor at %d, want %d", pos, answerOffset+2)
+	}
+
+	if _, err := r.Seek(answerOffset, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	want := Record{
+		Name:  []byte("www.example.com"),
+		Type:  TypeA,
+		Class: ClassIN,
+		TTL:   21147,
+		Data:  []byte("]\xb8\xd8\""),
+		RData: A{Addr: netip.MustParseAddr("93.184.216.34")},
+	}
+	got, err := DecodeRecord(r)
+	if err != nil {
+		t.Fatalf("DecodeRecord: %v", err)
+	}
+	if diff := cmp.Diff(want, got, cmpAddr); diff != "" {
+		t.Errorf("DecodeRecord mismatch (-want, +got):\n%s", diff)
+	}
+	if r.Len() != 0 {
+		t.Errorf("DecodeRecord: %d unread bytes, want 0", r.Len())
+	}
+}
+
+func TestPacket_Answer(t *testing.T) {
+	cases := []struct {
+		answers []Record
+		want    netip.Addr
+	}{
+		{
+			[]Record{{Type: TypeA, Class: ClassIN, Data: []byte{93, 184, 216, 34}}},
+			netip.MustParseAddr("93.184.216.34"),
+		},
+		{
+			[]Record{{Type: TypeAAAA, Class: ClassIN, Data: []byte("\x26\x06\x28\x00\x02\x20\x00\x01\x02\x48\x18\x93\x25\xc8\x19\x46")}},
+			netip.MustParseAddr("2606:2800:220:1:248:1893:25c8:1946"),
+		},
+	}
+
+	for _, tc := range cases {
+		got, err := Packet{Answers: tc.answers}.Answer()
+		if err != nil {
+			t.Errorf("%s: error: %v", tc.want, err)
+		}
+		if got != tc.want {
+			t.Errorf("got %s, want %s", got, tc.want)
+		}
+	}
+}
+
+func TestRecord_Addr_Invalid(t *testing.T) {
+	cases := []Record{
+		{Type: TypeA, Data: []byte{1, 2, 3}},
+		{Type: TypeAAAA, Data: []byte{1, 2, 3, 4}},
+		{Type: TypeNS, Data: []byte("a.iana-servers.net")},
+	}
+
+	for _, r := range cases {
+		if _, err := r.Addr(); err == nil {
+			t.Errorf("%v: want error", r)
+		}
+	}
+}
+
+func TestChainTTL(t *testing.T) {
+	records := []Record{
+		{Name: []byte("www.example.com"), Type: TypeCNAME, Class: ClassIN, TTL: 30},
+		{Name: []byte("example.com"), Type: TypeA, Class: ClassIN, TTL: 3600},
+	}
+	if got := ChainTTL(records); got != 30 {
+		t.Errorf("got %d, want 30", got)
+	}
+	if got := ChainTTL(nil); got != 0 {
+		t.Errorf("ChainTTL(nil): got %d, want 0", got)
+	}
+}
+
 func TestEncodeDNSName(t *testing.T) {
 	var (
 		in   = "google.com"
 		want = []byte("\x06google\x03com\x00")
 	)
 
-	got := EncodeDNSName(in)
+	got, err := EncodeDNSName(in)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if !bytes.Equal(got, want) {
 		t.Errorf("got %q, want %q", got, want)
 	}
 }
 
+func TestEncodeDNSName_Root(t *testing.T) {
+	for _, in := range []string{"", "."} {
+		if got, _ := EncodeDNSName(in); !bytes.Equal(got, []byte{0}) {
+			t.Errorf("%q: got %q, want %q", in, got, []byte{0})
+		}
+	}
+	if got, want := mustEncodeName(t, "google.com."), []byte("\x06google\x03com\x00"); !bytes.Equal(got, want) {
+		t.Errorf("trailing dot: got %q, want %q", got, want)
+	}
+}
+
+func TestEncodeDNSName_Limits(t *testing.T) {
+	var (
+		label63 = strings.Repeat("a", 63)
+		// Three 63-byte labels and one of 61 bytes make a 255-byte name.
+		name255 = strings.Repeat(label63+".", 3) + strings.Repeat("b", 61)
+	)
+
+	for _, in := range []string{label63, name255, name255 + "."} {
+		if _, err := EncodeDNSName(in); err != nil {
+			t.Errorf("%d bytes: %v", len(in), err)
+		}
+	}
+
+	cases := []struct {
+		in   string
+		want error
+	}{
+		{label63 + "a.com", ErrLabelTooLong},
+		{"www." + label63 + "a", ErrLabelTooLong},
+		{name255 + "b", ErrNameTooLong},
+		{"x." + name255, ErrNameTooLong},
+	}
+	for _, tc := range cases {
+		if _, err := EncodeDNSName(tc.in); !errors.Is(err, tc.want) {
+			t.Errorf("%d bytes: got %v, want %v", len(tc.in), err, tc.want)
+		}
+	}
+
+	// Names are checked however they are encoded.
+	p := Packet{Questions: []Question{{Name: []byte(label63 + "a"), Type: TypeA, Class: ClassIN}}}
+	if _, err := p.MarshalBinary(); !errors.Is(err, ErrLabelTooLong) {
+		t.Errorf("packet: got %v, want %v", err, ErrLabelTooLong)
+	}
+}
+
+func TestAppendDNSName(t *testing.T) {
+	got, err := AppendDNSName([]byte("prefix"), "www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "prefix\x03www\x07example\x03com\x00"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	buf := make([]byte, 0, 64)
+	allocs := testing.AllocsPerRun(100, func() {
+		_, _ = AppendDNSName(buf[:0], "www.example.com")
+	})
+	if allocs != 0 {
+		t.Errorf("got %v allocs, want 0", allocs)
+	}
+}
+
+func TestAppendDecodedName(t *testing.T) {
+	// The answer's name in examplePacket, at offset 33, points back to the
+	// question's.
+	got, next, err := AppendDecodedName([]byte("prefix "), examplePacket, 33)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "prefix www.example.com"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if next != 35 {
+		t.Errorf("got next offset %d, want 35", next)
+	}
+
+	// The root name appends nothing.
+	if got, _, err := AppendDecodedName([]byte("prefix"), []byte{0}, 0); err != nil || string(got) != "prefix" {
+		t.Errorf("root: got %q, %v", got, err)
+	}
+
+	buf := make([]byte, 0, 64)
+	allocs := testing.AllocsPerRun(100, func() {
+		_, _, _ = AppendDecodedName(buf[:0], examplePacket, 33)
+	})
+	if allocs != 0 {
+		t.Errorf("got %v allocs, want 0", allocs)
+	}
+}
+
+func mustEncodeName(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := EncodeDNSName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestNewQueryWithFlags(t *testing.T) {
+	query, err := NewQueryWithFlags("example.com", TypeA, FlagCheckingDisabled)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	var h Header
+	if err := h.UnmarshalBinary(query[:12]); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	if h.Flags&FlagCheckingDisabled == 0 {
+		t.Errorf("CD bit not set: flags %#04x", h.Flags)
+	}
+	if h.Flags&FlagRecursionDesired != 0 {
+		t.Errorf("RD bit set: flags %#04x", h.Flags)
+	}
+}
+
 func TestGoogleDNS(t *testing.T) {
 	t.Skip("makes network calls")
 
@@ -146,10 +535,165 @@ func TestLookupDomain(t *testing.T) {
 	}
 }
 
+func TestDecodeName_BadPointer(t *testing.T) {
+	cases := [][]byte{
+		[]byte("\xc0\x02"),                            // just past the end
+		[]byte("\xc0\xff"),                            // far past the end
+		[]byte("\x03www\xff\xff"),                     // maximum pointer after a label
+		[]byte("\x03www\xc0\x09\x00\x00\x00\xc0\x40"), // pointer to a pointer past the end
+	}
+
+	for _, in := range cases {
+		_, err := DecodeName(bytes.NewReader(in))
+		if !errors.Is(err, ErrBadPointer) {
+			t.Errorf("%q: got %v, want %v", in, err, ErrBadPointer)
+		}
+	}
+}
+
+func TestDecodeName_Truncated(t *testing.T) {
+	for _, in := range []string{"", "\x03ww", "\x03www", "\x03www\xc0"} {
+		if _, err := DecodeName(bytes.NewReader([]byte(in))); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("%q: got %v, want %v", in, err, io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+func TestDecodeName_Offset(t *testing.T) {
+	// The answer's name in examplePacket, at offset 33, points back to the
+	// question's.
+	r := bytes.NewReader(examplePacket)
+	if _, err := r.Seek(33, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := DecodeName(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "www.example.com"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if off, _ := r.Seek(0, io.SeekCurrent); off != 35 {
+		t.Errorf("reader left at offset %d, want 35", off)
+	}
+}
+
+func TestDecodeName_Limits(t *testing.T) {
+	label63 := "\x3f" + strings.Repeat("a", 63)
+
+	// Three 63-byte labels and one of 61 bytes make a 255-byte name.
+	name255 := strings.Repeat(label63, 3) + "\x3d" + strings.Repeat("b", 61) + "\x00"
+	if _, err := DecodeName(bytes.NewReader([]byte(name255))); err != nil {
+		t.Errorf("255 bytes: %v", err)
+	}
+
+	cases := []struct {
+		in   string
+		want error
+	}{
+		{"\x40" + strings.Repeat("a", 64) + "\x00", ErrLabelTooLong},
+		{"\x80\x00", ErrLabelTooLong},
+		{"\x01x" + name255, ErrNameTooLong},
+	}
+	for _, tc := range cases {
+		if _, err := DecodeName(bytes.NewReader([]byte(tc.in))); !errors.Is(err, tc.want) {
+			t.Errorf("%q: got %v, want %v", tc.in, err, tc.want)
+		}
+	}
+
+	// A name can also grow too long through a pointer.
+	r := bytes.NewReader([]byte(name255 + "\x01x\xc0\x00"))
+	if _, err := r.Seek(int64(len(name255)), io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodeName(r); !errors.Is(err, ErrNameTooLong) {
+		t.Errorf("through a pointer: got %v, want %v", err, ErrNameTooLong)
+	}
+}
+
+func TestDecodeName_PointerLoop(t *testing.T) {
+	cases := [][]byte{
+		[]byte("\xc0\x00"),                   // points to itself
+		[]byte("\x03www\xc0\x00"),            // points back to its own start
+		[]byte("\xc0\x02\xc0\x00"),           // two pointers to each other
+		[]byte("\x01a\xc0\x04\x01b\xc0\x00"), // a loop through labels
+	}
+
+	for _, in := range cases {
+		_, err := DecodeName(bytes.NewReader(in))
+		if !errors.Is(err, ErrPointerLoop) {
+			t.Errorf("%q: got %v, want %v", in, err, ErrPointerLoop)
+		}
+	}
+}
+
+func TestDecodeName_PointerChain(t *testing.T) {
+	// A long but finite chain of pointers is not a loop.
+	var b []byte
+	for i := 0; i < 10; i++ {
+		b = append(b, 0xc0, byte(len(b)+2))
+	}
+	b = append(b, "\x03com\x00"...)
+
+	got, err := DecodeName(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "com" {
+		t.Errorf("got %q, want %q", got, "com")
+	}
+}
+
 func FuzzDecodeName(f *testing.F) {
+	f.Add([]byte("\x03www\x07example\x03com\x00"))
+	f.Add([]byte("\xc0\xff"))
+	f.Add([]byte("\xc0\x00"))
+	f.Add([]byte("\xc0\x02\xc0\x00"))
+
 	// DecodeName calls DecodeCompressedName and vice versa, so ensure no panic
 	// or hang can occur.
 	f.Fuzz(func(t *testing.T, b []byte) {
-		_, _ = DecodeName(bytes.NewReader(b))
+		done := make(chan error, 1)
+		go func() {
+			_, err := DecodeName(bytes.NewReader(b))
+			done <- err
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("DecodeName(%q) did not return", b)
+		}
+	})
+}
+
+func FuzzDecodePacket(f *testing.F) {
+	f.Add(examplePacket)
+	f.Add(append(bytes.Clone(examplePacket), 0))
+
+	// Strict mode only rejects more packets, never fewer.
+	f.Fuzz(func(t *testing.T, b []byte) {
+		_, lenientErr := DecodePacket(bytes.NewReader(b))
+		_, strictErr := DecodePacketWithOptions(bytes.NewReader(b), DecodeOptions{Strict: true})
+		if strictErr == nil && lenientErr != nil {
+			t.Errorf("strict mode accepted %q, which failed with %v", b, lenientErr)
+		}
+
+		// Decoding from a reader and from bytes agree.
+		if _, err := ParsePacket(b); (err == nil) != (lenientErr == nil) {
+			t.Errorf("%q: ParsePacket error %v, DecodePacket error %v", b, err, lenientErr)
+		}
 	})
 }
+
+func TestID(t *testing.T) {
+	seen := make(map[uint16]bool)
+	for i := 0; i < 100; i++ {
+		seen[ID()] = true
+	}
+	// 100 random IDs out of 65536 almost never collide much.
+	if len(seen) < 90 {
+		t.Errorf("got %d distinct IDs out of 100", len(seen))
+	}
+}
@@ -0,0 +1,1064 @@
+package resolve
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Resolver defaults.
+const (
+	DefaultServer   = "8.8.8.8"
+	DefaultPort     = 53
+	DefaultDoTPort  = 853
+	DefaultTimeout  = 5 * time.Second
+	DefaultAttempts = 2
+	DefaultBackoff  = 100 * time.Millisecond
+	DefaultUDPSize  = 1232 // Recommended by DNS Flag Day 2020.
+
+	DefaultBatchConcurrency = 16
+)
+
+// A Resolver looks up records by asking a recursive DNS server.
+//
+// The zero value is ready to use and queries Google Public DNS.
+type Resolver struct {
+	// Server is the IP address or host name of the upstream server. If
+	// empty, DefaultServer is used.
+	Server string
+
+	// Upstreams, if set, are the resolvers that queries are sent to, in
+	// order: if one fails or answers SERVFAIL, the next is tried. They
+	// take the place of Server, Protocol and the settings for them, but r's
+	// Cache and the like still apply.
+	Upstreams []*Resolver
+
+	// Rotate spreads queries over Upstreams by starting each query at the
+	// next upstream in turn, rather than always at the first.
+	Rotate bool
+
+	// PreferFastest tries the healthiest and fastest of Upstreams first,
+	// going by their UpstreamStats, instead of going in order.
+	PreferFastest bool
+
+	// Routes sends queries for some names to other resolvers, as in split
+	// DNS. Each key is a domain, and queries for it and names below it go
+	// to its resolver instead of r's upstream; for example, a route for
+	// "corp.example" could send internal names to the company's server.
+	// The route for the longest matching domain wins, so a route for "."
+	// catches the names no other route does.
+	Routes map[string]*Resolver
+
+	// Port is the upstream server's port. If zero, DefaultDoTPort is used
+	// for ProtocolDoT, and DefaultPort otherwise. In ModeIterative, it is
+	// the port of every name server queried.
+	Port int
+
+	// Timeout bounds each query. If zero, DefaultTimeout is used.
+	Timeout time.Duration
+
+	// Attempts is how many times a query is sent to the upstream server
+	// before giving up, if it doesn't answer or can't be reached. If zero,
+	// DefaultAttempts is used.
+	Attempts int
+
+	// AttemptTimeout bounds each attempt. If zero, Timeout is split evenly
+	// between the attempts.
+	AttemptTimeout time.Duration
+
+	// Backoff is the delay before the second attempt, which doubles for
+	// each attempt after that and is randomly shortened by up to half. If
+	// zero, DefaultBackoff is used.
+	Backoff time.Duration
+
+	// BatchConcurrency is how many lookups LookupAddrs runs at once. If
+	// zero, DefaultBatchConcurrency is used.
+	BatchConcurrency int
+
+	// BatchRetryBudget, if positive, caps the attempts after the first that
+	// the lookups of one LookupAddrs call make between them. Once it is
+	// spent, failed attempts aren't retried, so that an upstream failing
+	// for every name doesn't get several times the batch's queries.
+	BatchRetryBudget int
+
+	// OnRetransmit, if set, is called before each attempt after the first,
+	// with the number of the attempt, counting from 1, and the address of
+	// the server, which is empty with an Exchanger. It lets tests observe
+	// retries.
+	OnRetransmit func(attempt int, server string)
+
+	// EDNS holds the settings for the OPT record sent with each query. If
+	// nil, the defaults are used. Its UDPSize is ignored in favor of
+	// r.UDPSize.
+	EDNS *EDNS
+
+	// UDPSize is the UDP payload size advertised in queries, and the size of
+	// the buffer for responses. If zero, DefaultUDPSize is used.
+	UDPSize uint16
+
+	// DNSSECUDPSize is the least UDP payload size advertised when EDNS
+	// asks for DNSSEC records with the DO bit. Signed responses are
+	// larger, so a smaller UDPSize would get them truncated and retried
+	// over TCP; it is raised to this instead. If zero, DefaultUDPSize is
+	// used.
+	DNSSECUDPSize uint16
+
+	// ClientSubnet, if valid, is sent in a Client Subnet option with each
+	// query.
+	ClientSubnet netip.Prefix
+
+	// CheckingDisabled sets the CD bit in queries, asking a validating
+	// upstream server to return data even if it fails DNSSEC validation,
+	// rather than SERVFAIL. This turns off the protection validation
+	// gives, so it is meant for inspecting broken signatures, not for
+	// everyday use.
+	CheckingDisabled bool
+
+	// ServFailAsEmpty makes LookupIPAddrs take SERVFAIL for one address
+	// family as an answer with no addresses of that family, as long as
+	// the query for the other family succeeds. Some broken servers fail
+	// AAAA queries while answering A queries. By default, SERVFAIL for
+	// either family fails the lookup, so that it isn't hidden.
+	ServFailAsEmpty bool
+
+	// RejectPrivate guards against DNS rebinding. The lookups for
+	// addresses, such as Lookup and LookupIPAddrs, fail with
+	// ErrRebindingSuspected if an answer holds a private, loopback,
+	// link-local or other non-public address, which a public name has no
+	// business pointing at. Names that really do have such addresses then
+	// can't be looked up. Query returns responses as they are.
+	RejectPrivate bool
+
+	// PrivatePrefixes, if non-nil, are the ranges of addresses that
+	// RejectPrivate rejects, in place of the default ones.
+	PrivatePrefixes []netip.Prefix
+
+	// Cookies enables DNS Cookies (RFC 7873). Each query carries a client
+	// cookie and the last server cookie received from the server. Responses
+	// that don't echo the client cookie are rejected with
+	// ErrCookieMismatch.
+	Cookies bool
+
+	// Cache, if set, holds responses to answer repeated queries from,
+	// until their TTLs run out. NXDOMAIN and NODATA responses are cached
+	// too, as RFC 2308 describes. A MemoryCache may be shared by Resolvers
+	// with the same settings.
+	Cache Cache
+
+	// MaxStale, if nonzero, enables serve-stale (RFC 8767): if the
+	// upstream server can't be reached or fails, a response in r.Cache
+	// that expired less than MaxStale ago is returned instead; see
+	// Packet.Stale.
+	MaxStale time.Duration
+
+	// Prefetch refreshes popular entries in r.Cache in the background
+	// shortly before they expire, when a query finds less than a tenth of
+	// their TTL left, so that queries for them keep being answered from the
+	// cache.
+	Prefetch bool
+
+	// Mode selects how queries are resolved: by the upstream server, or
+	// iteratively from the root name servers.
+	Mode Mode
+
+	// QNAMEMinimization, in ModeIterative, sends each zone's servers only
+	// as much of the query name as they need to see to refer the query
+	// onward (RFC 9156), rather than the full name.
+	QNAMEMinimization bool
+
+	// Roots are the addresses of the root name servers for ModeIterative,
+	// such as those from ParseRootHints. If empty, RootServers is used.
+	// After Prime, the root servers it found are used instead.
+	Roots []netip.Addr
+
+	// Protocol is the transport used to reach the server.
+	Protocol Protocol
+
+	// IdleTimeout, if positive, closes the connection that queries over
+	// ProtocolTCP and ProtocolDoT share once it has gone unused for that
+	// long, so that a long-running process doesn't keep it open for
+	// nothing. The next query opens a new one.
+	IdleTimeout time.Duration
+
+	// CaseRandomization sends query names with the case of each letter
+	// chosen at random, and rejects responses that don't echo it exactly
+	// (draft-vixie-dnsext-dns0x20). This makes spoofed responses harder to
+	// get accepted, but fails with the few servers that change the case of
+	// names. Names in responses are given back as they were asked for.
+	CaseRandomization bool
+
+	// IDSource, if set, is the source of query IDs in place of ID, so that
+	// tests can send the same queries every time. A Source that always
+	// returns the same number fixes the ID. IDs from a math/rand Source
+	// can be predicted, so it shouldn't be set otherwise.
+	IDSource rand.Source
+
+	// Exchanger, if set, sends queries in place of Protocol, to whatever
+	// it likes: a custom transport, or middleware around another Resolver.
+	// Retries and everything above the transport still apply.
+	Exchanger Exchanger
+
+	// ServerName is the name to verify the server's TLS certificate
+	// against. If empty, Server is used.
+	ServerName string
+
+	// SPKIPins, if set, are SHA-256 hashes of SubjectPublicKeyInfo
+	// structures. The server's TLS certificate chain is then accepted if
+	// and only if one of its certificates matches a pin.
+	SPKIPins [][]byte
+
+	// TLSConfig, if set, is the base TLS configuration. Its ServerName
+	// takes precedence over r.ServerName.
+	TLSConfig *tls.Config
+
+	// URL is the endpoint for ProtocolDoH, such as
+	// "https://cloudflare-dns.com/dns-query", or for ProtocolDoHJSON.
+	// Server and Port are not used with these protocols. If empty,
+	// DefaultDoHURL or DefaultDoHJSONURL is used. For ProtocolODoH, URL
+	// is the proxy and must be set.
+	URL string
+
+	// ODoHTarget is the URL of the target for ProtocolODoH, such as
+	// "https://odoh.cloudflare-dns.com/dns-query". Its configuration is
+	// fetched from /.well-known/odohconfigs on the same host.
+	ODoHTarget string
+
+	// HTTPMethod is the method for ProtocolDoH: http.MethodPost or
+	// http.MethodGet. If empty, POST is used.
+	HTTPMethod string
+
+	// HTTPClient sends requests for the HTTPS-based protocols. If nil,
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// DialQUIC dials a QUIC connection to address for ProtocolDoQ, using
+	// config for the TLS handshake. DoQ queries are safe to send as 0-RTT
+	// data (RFC 9250, section 4.5), so it may return before the handshake
+	// completes.
+	DialQUIC func(ctx context.Context, address string, config *tls.Config) (QUICConn, error)
+
+	// ProviderName is the DNSCrypt provider name for ProtocolDNSCrypt,
+	// such as "2.dnscrypt-cert.example.com".
+	ProviderName string
+
+	// ProviderKey is the Ed25519 public key of the DNSCrypt provider,
+	// which signs the resolver's certificates.
+	ProviderKey ed25519.PublicKey
+
+	// MDNSWindow is how long ProtocolMDNS and LLMNR queries wait for
+	// responses. If 0, DefaultMDNSWindow is used.
+	MDNSWindow time.Duration
+
+	// MDNSUnicast sets the unicast-response (QU) bit in ProtocolMDNS
+	// questions, asking responders to reply directly rather than to the
+	// multicast group.
+	MDNSUnicast bool
+
+	// LLMNRFallback enables LLMNR (RFC 4795) for single-label names, such
+	// as "printer", that the upstream server can't resolve: queries for
+	// them that fail or get NXDOMAIN are sent again with LLMNR.
+	LLMNRFallback bool
+
+	logQueries bool             // Log each query in ModeIterative, for Resolve.
+	clock      func() time.Time // If nil, time.Now.
+
+	// idMu guards IDSource, which isn't safe for concurrent use. It is
+	// separate from mu, which may be held while queries are built.
+	idMu sync.Mutex
+
+	mu        sync.Mutex
+	cookies   map[string]Cookie            // By server address.
+	conn      *streamConn                  // Shared by queries over stream protocols.
+	connDial  *connDial                    // A dial of conn in progress.
+	quic      QUICConn                     // Shared by queries over ProtocolDoQ.
+	cert      *dnscryptCert                // The current ProtocolDNSCrypt certificate.
+	certFetch *certFetch                   // A fetch of cert in progress.
+	odoh      *odohConfig                  // The ProtocolODoH target's configuration.
+	primed    []netip.Addr                 // Root servers found by Prime.
+	fetches   map[CacheKey]*prefetchRun    // Prefetches in progress.
+	flights   map[CacheKey]*flight         // Queries in progress, shared by callers.
+	stats     map[*Resolver]*UpstreamStats // By upstream.
+
+	rotation atomic.Uint32 // The next upstream to start at, with Rotate.
+}
+
+func (r *Resolver) server() string {
+	if r.Server == "" {
+		return DefaultServer
+	}
+	return r.Server
+}
+
+func (r *Resolver) address() string {
+	port := r.Port
+	if port == 0 {
+		port = r.Protocol.defaultPort()
+	}
+	return net.JoinHostPort(r.server(), strconv.Itoa(port))
+}
+
+// id returns a query ID from r.IDSource, or ID if it is nil.
+func (r *Resolver) id() uint16 {
+	if r.IDSource == nil {
+		return ID()
+	}
+	r.idMu.Lock()
+	defer r.idMu.Unlock()
+	return uint16(r.IDSource.Int63())
+}
+
+func (r *Resolver) udpSize() int {
+	size := int(r.UDPSize)
+	if size == 0 {
+		size = DefaultUDPSize
+	}
+	if r.EDNS != nil && r.EDNS.DNSSECOK {
+		floor := int(r.DNSSECUDPSize)
+		if floor == 0 {
+			floor = DefaultUDPSize
+		}
+		if size < floor {
+			size = floor
+		}
+	}
+	return size
+}
+
+func (r *Resolver) batchConcurrency() int {
+	if r.BatchConcurrency <= 0 {
+		return DefaultBatchConcurrency
+	}
+	return r.BatchConcurrency
+}
+
+func (r *Resolver) timeout() time.Duration {
+	if r.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return r.Timeout
+}
+
+// Query asks the upstream server for records of type t for domain, and
+// returns its response. If the UDP response is truncated, the query is
+// retried over TCP. A response with an error RCODE is not an error; see
+// Packet.Err. If r has a Cache, a cached response is returned if there is
+// one.
+func (r *Resolver) Query(domain string, t Type) (*Packet, error) {
+	return r.QueryContext(context.Background(), domain, t)
+}
+
+// QueryContext is like Query, but honors ctx. The query is bounded by both
+// ctx and r.Timeout. Concurrent queries for the same name and type share
+// one query to the server.
+func (r *Resolver) QueryContext(ctx context.Context, domain string, t Type) (*Packet, error) {
+	return r.QueryClassContext(ctx, domain, t, ClassIN)
+}
+
+// QueryClass is like Query, but asks for records of class rather than
+// ClassIN, such as ClassCH for the TXT records that describe a server
+// (RFC 4892). ModeIterative only supports ClassIN.
+func (r *Resolver) QueryClass(domain string, t Type, class Class) (*Packet, error) {
+	return r.QueryClassContext(context.Background(), domain, t, class)
+}
+
+// QueryClassContext is like QueryClass, but honors ctx.
+func (r *Resolver) QueryClassContext(ctx context.Context, domain string, t Type, class Class) (*Packet, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout())
+	defer cancel()
+
+	response, err := r.cachedQuery(ctx, domain, t, class)
+	if r.LLMNRFallback && r.Protocol != ProtocolLLMNR && class == ClassIN && isSingleLabel(domain) &&
+		(err != nil || response.RCode() == RCodeNameError) {
+		if fallback, ferr := r.queryLLMNR(ctx, domain, t); ferr == nil && len(fallback.Answers) > 0 {
+			return fallback, nil
+		}
+	}
+	return response, err
+}
+
+// cachedQuery answers a query for domain, t and class from r's cache, if it
+// can, and queries the upstream server otherwise, caching the response.
+func (r *Resolver) cachedQuery(ctx context.Context, domain string, t Type, class Class) (*Packet, error) {
+	if r.Cache == nil {
+		return r.sharedQuery(ctx, domain, t, class)
+	}
+	key := newCacheKey(domain, t, class)
+	e, cached := r.Cache.Get(key)
+	now := r.now()
+	if cached && now.Before(e.Expires) {
+		if r.Prefetch && e.Hits >= prefetchMinHits && e.Expires.Sub(now)*10 < e.Expires.Sub(e.Stored) {
+			r.prefetch(key)
+		}
+		// Reduce the TTLs by the time the response spent in the cache.
+		return agePacket(e.Response, now.Sub(e.Stored)), nil
+	}
+
+	response, err := r.sharedQuery(ctx, domain, t, class)
+	if err == nil {
+		r.store(key, response)
+	}
+	if r.MaxStale > 0 && (err != nil || response.RCode() == RCodeServerFailure) &&
+		cached && now.Before(e.Expires.Add(r.MaxStale)) {
+		return stalePacket(e.Response), nil
+	}
+	return response, err
+}
+
+// queryLLMNR sends a query for domain and t with LLMNR.
+func (r *Resolver) queryLLMNR(ctx context.Context, domain string, t Type) (*Packet, error) {
+	query, err := r.newQuery(domain, t, ClassIN)
+	if err != nil {
+		return nil, err
+	}
+	return r.exchangeLLMNR(ctx, query)
+}
+
+// query sends a query for domain, t and class to the upstream server, or
+// resolves it iteratively.
+func (r *Resolver) query(ctx context.Context, domain string, t Type, class Class) (*Packet, error) {
+	if u := r.route(domain); u != nil {
+		return u.query(ctx, domain, t, class)
+	}
+	if len(r.Upstreams) > 0 {
+		return r.queryUpstreams(ctx, domain, t, class)
+	}
+	if r.Mode == ModeIterative {
+		if class != ClassIN {
+			return nil, fmt.Errorf("iterative resolution of class %s", class)
+		}
+		return r.resolveIterative(ctx, domain, t, 0)
+	}
+
+	var (
+		response *Packet
+		err      error
+	)
+	if r.Cookies {
+		response, err = r.exchangeWithCookie(ctx, domain, t, class)
+	} else {
+		var query []byte
+		if query, err = r.newQuery(domain, t, class); err != nil {
+			return nil, err
+		}
+		response, err = r.exchange(ctx, query)
+	}
+	if err == nil && r.CaseRandomization {
+		restoreCase(response, domain)
+	}
+	return response, err
+}
+
+// newQuery returns a recursive query for domain, t and class, with EDNS
+// options from r and any extra options.
+func (r *Resolver) newQuery(domain string, t Type, class Class, extra ...EDNSOption) ([]byte, error) {
+	if r.CaseRandomization {
+		var err error
+		if domain, err = randomizeCase(domain); err != nil {
+			return nil, err
+		}
+	}
+	query := &Packet{
+		Header:    Header{ID: r.id(), Flags: FlagRecursionDesired},
+		Questions: []Question{{Name: []byte(domain), Type: t, Class: class}},
+		EDNS:      r.edns(extra),
+	}
+	query.Header.Flags.SetCD(r.CheckingDisabled)
+	return query.MarshalBinary()
+}
+
+// edns returns the EDNS settings to send with a query, including extra
+// options.
+func (r *Resolver) edns(extra []EDNSOption) *EDNS {
+	var e EDNS
+	if r.EDNS != nil {
+		e = *r.EDNS
+	}
+	e.UDPSize = uint16(r.udpSize())
+
+	if r.ClientSubnet.IsValid() {
+		extra = append(extra, ClientSubnet{Source: r.ClientSubnet}.Option())
+	}
+	e.Options = append(e.Options[:len(e.Options):len(e.Options)], extra...)
+	return &e
+}
+
+// Lookup returns the first address in the answer to a query for domain and
+// t, which should be TypeA or TypeAAAA. CNAME records are followed, with
+// further queries if the response doesn't include the whole chain.
+func (r *Resolver) Lookup(domain string, t Type) (netip.Addr, error) {
+	return r.LookupContext(context.Background(), domain, t)
+}
+
+// LookupContext is like Lookup, but honors ctx.
+func (r *Resolver) LookupContext(ctx context.Context, domain string, t Type) (netip.Addr, error) {
+	records, err := r.lookupRecords(ctx, domain, t)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return records[0].Addr()
+}
+
+// A HostAddr is an address of a host, found by LookupHost.
+type HostAddr struct {
+	Addr netip.Addr
+
+	// TTL is how long, in seconds, the address may be cached: the smallest
+	// TTL of its record and of the aliases that led to it.
+	TTL uint32
+}
+
+// LookupHost is like Lookup, but returns every address in the answer, in
+// the order the server gave them, with their TTLs.
+func (r *Resolver) LookupHost(domain string, t Type) ([]HostAddr, error) {
+	return r.LookupHostContext(context.Background(), domain, t)
+}
+
+// LookupHostContext is like LookupHost, but honors ctx.
+func (r *Resolver) LookupHostContext(ctx context.Context, domain string, t Type) ([]HostAddr, error) {
+	records, aliases, _, err := r.lookupChain(ctx, domain, t)
+	if err != nil {
+		return nil, err
+	}
+	chain := ChainTTL(aliases)
+
+	addrs := make([]HostAddr, 0, len(records))
+	for _, rec := range records {
+		addr, err := rec.Addr()
+		if err != nil {
+			return nil, err
+		}
+		ttl := rec.TTL
+		if len(aliases) > 0 && chain < ttl {
+			ttl = chain
+		}
+		addrs = append(addrs, HostAddr{Addr: addr, TTL: ttl})
+	}
+	return addrs, nil
+}
+
+// LookupIPAddrs returns the IPv6 and IPv4 addresses of domain, sorted by
+// the rules of RFC 6724 so that the best one to connect to comes first, as
+// a Happy Eyeballs client (RFC 8305) wants them. The AAAA and A queries
+// are sent at once. If the A query is answered first, the AAAA query gets a
+// short while longer before it is given up on, so that a slow IPv6 lookup
+// doesn't hold up the connection. An error is returned if neither query
+// finds an address, if either gets SERVFAIL and r.ServFailAsEmpty is
+// false, or if RejectPrivate rejects either answer.
+func (r *Resolver) LookupIPAddrs(domain string) ([]netip.Addr, error) {
+	return r.LookupIPAddrsContext(context.Background(), domain)
+}
+
+// LookupIPAddrsContext is like LookupIPAddrs, but honors ctx.
+func (r *Resolver) LookupIPAddrsContext(ctx context.Context, domain string) ([]netip.Addr, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		addrs []netip.Addr
+		err   error
+	}
+	lookup := func(t Type, c chan<- result) {
+		addrs, err := r.lookupAddrs(ctx, domain, t)
+		c <- result{addrs, err}
+	}
+	v6, v4 := make(chan result, 1), make(chan result, 1)
+	go lookup(TypeAAAA, v6)
+	go lookup(TypeA, v4)
+
+	var res6, res4 result
+	select {
+	case res6 = <-v6:
+		res4 = <-v4
+	case res4 = <-v4:
+		if res4.err != nil {
+			res6 = <-v6
+			break
+		}
+		timer := time.NewTimer(resolutionDelay)
+		defer timer.Stop()
+		select {
+		case res6 = <-v6:
+		case <-timer.C:
+		}
+	}
+
+	// A suspected rebinding or a server failure fails the lookup, even if
+	// the other family's addresses are fine.
+	for _, err := range []error{res6.err, res4.err} {
+		if errors.Is(err, ErrRebindingSuspected) || !r.ServFailAsEmpty && errors.Is(err, ErrServerFailure) {
+			return nil, err
+		}
+	}
+	addrs := append(res6.addrs, res4.addrs...)
+	if len(addrs) == 0 {
+		return nil, res4.err
+	}
+	sortAddrs(addrs)
+	return addrs, nil
+}
+
+// LookupIP returns the addresses of host for network, which is "ip" for
+// both IPv4 and IPv6 addresses, "ip4" for IPv4 addresses, or "ip6" for IPv6
+// addresses, like net.Resolver.LookupNetIP. For "ip", the addresses are
+// found as by LookupIPAddrs. If host is an IP address, it is returned
+// as is. The addresses are sorted by the rules of RFC 6724.
+func (r *Resolver) LookupIP(network, host string) ([]netip.Addr, error) {
+	return r.LookupIPContext(context.Background(), network, host)
+}
+
+// LookupIPContext is like LookupIP, but honors ctx.
+func (r *Resolver) LookupIPContext(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	var t Type
+	switch network {
+	case "ip":
+	case "ip4":
+		t = TypeA
+	case "ip6":
+		t = TypeAAAA
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if t == TypeA && !addr.Unmap().Is4() || t == TypeAAAA && !addr.Is6() {
+			return nil, &net.AddrError{Err: "no suitable address", Addr: host}
+		}
+		return []netip.Addr{addr}, nil
+	}
+
+	if t == 0 {
+		return r.LookupIPAddrsContext(ctx, host)
+	}
+	addrs, err := r.lookupAddrs(ctx, host, t)
+	if err != nil {
+		return nil, err
+	}
+	sortAddrs(addrs)
+	return addrs, nil
+}
+
+// resolutionDelay is how long LookupIPAddrs waits for the AAAA query once
+// the A query is answered (RFC 8305, section 3).
+const resolutionDelay = 50 * time.Millisecond
+
+// lookupAddrs returns the addresses in the records of type t for domain,
+// which should be TypeA or TypeAAAA.
+func (r *Resolver) lookupAddrs(ctx context.Context, domain string, t Type) ([]netip.Addr, error) {
+	records, err := r.lookupRecords(ctx, domain, t)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]netip.Addr, 0, len(records))
+	for _, rec := range records {
+		addr, err := rec.Addr()
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// LookupMX returns the MX records for domain, sorted by preference.
+func (r *Resolver) LookupMX(domain string) ([]MX, error) {
+	return r.LookupMXContext(context.Background(), domain)
+}
+
+// LookupMXContext is like LookupMX, but honors ctx.
+func (r *Resolver) LookupMXContext(ctx context.Context, domain string) ([]MX, error) {
+	records, err := r.lookupRecords(ctx, domain, TypeMX)
+	if err != nil {
+		return nil, err
+	}
+
+	mxs := make([]MX, 0, len(records))
+	for _, rec := range records {
+		if mx, ok := rec.RData.(MX); ok {
+			mxs = append(mxs, mx)
+		}
+	}
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Preference < mxs[j].Preference
+	})
+	return mxs, nil
+}
+
+// LookupTXT returns the TXT records for domain. The character-strings of
+// each record are joined into one string.
+func (r *Resolver) LookupTXT(domain string) ([]string, error) {
+	return r.LookupTXTContext(context.Background(), domain)
+}
+
+// LookupTXTContext is like LookupTXT, but honors ctx.
+func (r *Resolver) LookupTXTContext(ctx context.Context, domain string) ([]string, error) {
+	records, err := r.lookupRecords(ctx, domain, TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+
+	var txts []string
+	for _, rec := range records {
+		if txt, ok := rec.RData.(TXT); ok {
+			txts = append(txts, strings.Join(txt.Strings, ""))
+		}
+	}
+	return txts, nil
+}
+
+// LookupNS returns the NS records for domain.
+func (r *Resolver) LookupNS(domain string) ([]NS, error) {
+	return r.LookupNSContext(context.Background(), domain)
+}
+
+// LookupNSContext is like LookupNS, but honors ctx.
+func (r *Resolver) LookupNSContext(ctx context.Context, domain string) ([]NS, error) {
+	records, err := r.lookupRecords(ctx, domain, TypeNS)
+	if err != nil {
+		return nil, err
+	}
+
+	var nss []NS
+	for _, rec := range records {
+		if ns, ok := rec.RData.(NS); ok {
+			nss = append(nss, ns)
+		}
+	}
+	return nss, nil
+}
+
+// LookupSRV returns the SRV records for _service._proto.name, in the order
+// to try them: by priority, and randomly by weight within a priority (RFC
+// 2782). If service and proto are both empty, name is looked up directly.
+func (r *Resolver) LookupSRV(service, proto, name string) ([]SRV, error) {
+	return r.LookupSRVContext(context.Background(), service, proto, name)
+}
+
+// LookupSRVContext is like LookupSRV, but honors ctx.
+func (r *Resolver) LookupSRVContext(ctx context.Context, service, proto, name string) ([]SRV, error) {
+	srvs, _, err := r.lookupSRV(ctx, service, proto, name)
+	return srvs, err
+}
+
+// lookupSRV is like LookupSRVContext, but also returns the Additional
+// section of the response, where servers may put the targets' addresses.
+func (r *Resolver) lookupSRV(ctx context.Context, service, proto, name string) ([]SRV, []Record, error) {
+	if service != "" || proto != "" {
+		name = "_" + service + "._" + proto + "." + name
+	}
+	records, _, extra, err := r.lookupChain(ctx, name, TypeSRV)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var srvs []SRV
+	for _, rec := range records {
+		if srv, ok := rec.RData.(SRV); ok {
+			srvs = append(srvs, srv)
+		}
+	}
+	orderSRV(srvs, rand.Intn)
+	return srvs, extra, nil
+}
+
+// An Endpoint is a server for a service, found by LookupService.
+type Endpoint struct {
+	Host     string
+	Port     uint16
+	Priority uint16
+	Weight   uint16
+
+	// Addrs are the addresses of Host, sorted as by LookupIPAddrs.
+	Addrs []netip.Addr
+}
+
+// LookupService returns the endpoints for _service._proto.name: the
+// targets of its SRV records, in the order from LookupSRV, with their
+// addresses. Addresses the server put in the Additional section of the SRV
+// response are used as they are, and the other targets are looked up with
+// LookupIPAddrs. Targets whose addresses can't be found are left out; if
+// none can be, the first error is returned. A lone target of "." means the
+// service isn't available (RFC 2782), and no endpoints are returned.
+func (r *Resolver) LookupService(service, proto, name string) ([]Endpoint, error) {
+	return r.LookupServiceContext(context.Background(), service, proto, name)
+}
+
+// LookupServiceContext is like LookupService, but honors ctx.
+func (r *Resolver) LookupServiceContext(ctx context.Context, service, proto, name string) ([]Endpoint, error) {
+	srvs, extra, err := r.lookupSRV(ctx, service, proto, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints []Endpoint
+	var firstErr error
+	for _, srv := range srvs {
+		if srv.Target == "." || srv.Target == "" {
+			continue
+		}
+		addrs, err := r.glueAddrs(srv.Target, extra)
+		if err == nil && len(addrs) == 0 {
+			addrs, err = r.LookupIPAddrsContext(ctx, srv.Target)
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		endpoints = append(endpoints, Endpoint{
+			Host:     srv.Target,
+			Port:     srv.Port,
+			Priority: srv.Priority,
+			Weight:   srv.Weight,
+			Addrs:    addrs,
+		})
+	}
+	if len(endpoints) == 0 && firstErr != nil {
+		return nil, firstErr
+	}
+	return endpoints, nil
+}
+
+// glueAddrs returns the addresses of host in the A and AAAA records in
+// extra, sorted as by LookupIPAddrs.
+func (r *Resolver) glueAddrs(host string, extra []Record) ([]netip.Addr, error) {
+	var glue []Record
+	for _, rec := range extra {
+		if (rec.Type == TypeA || rec.Type == TypeAAAA) && equalNames(string(rec.Name), host) {
+			glue = append(glue, rec)
+		}
+	}
+	if err := r.checkRebinding(host, glue); err != nil {
+		return nil, err
+	}
+
+	addrs := make([]netip.Addr, 0, len(glue))
+	for _, rec := range glue {
+		if addr, err := rec.Addr(); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	sortAddrs(addrs)
+	return addrs, nil
+}
+
+// orderSRV sorts srvs by priority, then orders each run of equal priority
+// with the weighted random selection from RFC 2782. intn returns a random
+// int in [0, n).
+func orderSRV(srvs []SRV, intn func(n int) int) {
+	sort.SliceStable(srvs, func(i, j int) bool {
+		return srvs[i].Priority < srvs[j].Priority
+	})
+
+	for i := 0; i < len(srvs); {
+		j := i + 1
+		for j < len(srvs) && srvs[j].Priority == srvs[i].Priority {
+			j++
+		}
+		shuffleByWeight(srvs[i:j], intn)
+		i = j
+	}
+}
+
+// shuffleByWeight orders srvs so that each position is filled by a record
+// chosen with probability proportional to its weight among those left.
+// Zero-weight records go first so that they keep a small chance of being
+// picked, as RFC 2782 suggests.
+func shuffleByWeight(srvs []SRV, intn func(n int) int) {
+	sort.SliceStable(srvs, func(i, j int) bool {
+		return srvs[i].Weight == 0 && srvs[j].Weight != 0
+	})
+
+	sum := 0
+	for _, srv := range srvs {
+		sum += int(srv.Weight)
+	}
+	for len(srvs) > 1 && sum > 0 {
+		n := intn(sum + 1)
+		i, running := 0, int(srvs[0].Weight)
+		for running < n {
+			i++
+			running += int(srvs[i].Weight)
+		}
+		srvs[0], srvs[i] = srvs[i], srvs[0]
+		sum -= int(srvs[0].Weight)
+		srvs = srvs[1:]
+	}
+}
+
+// LookupAddr returns the host names for addr, found with a PTR query for
+// its in-addr.arpa or ip6.arpa name.
+func (r *Resolver) LookupAddr(addr netip.Addr) ([]string, error) {
+	return r.LookupAddrContext(context.Background(), addr)
+}
+
+// LookupAddrContext is like LookupAddr, but honors ctx.
+func (r *Resolver) LookupAddrContext(ctx context.Context, addr netip.Addr) ([]string, error) {
+	name, err := reverseName(addr)
+	if err != nil {
+		return nil, err
+	}
+	records, err := r.lookupRecords(ctx, name, TypePTR)
+	if err != nil {
+		return nil, err
+	}
+
+	var hosts []string
+	for _, rec := range records {
+		if ptr, ok := rec.RData.(PTR); ok {
+			hosts = append(hosts, ptr.Host)
+		}
+	}
+	return hosts, nil
+}
+
+// LookupAddrs looks up the host names for each of addrs, as LookupAddr
+// does, running up to r.BatchConcurrency lookups at once. It is meant for
+// annotating many addresses, such as those in a connection log. The host
+// names are returned by address, and so are the errors of the lookups that
+// failed; an address is in one map or the other.
+func (r *Resolver) LookupAddrs(ctx context.Context, addrs []netip.Addr) (map[netip.Addr][]string, map[netip.Addr]error) {
+	if r.BatchRetryBudget > 0 {
+		ctx = withRetryBudget(ctx, r.BatchRetryBudget)
+	}
+	hosts := make(map[netip.Addr][]string)
+	errs := make(map[netip.Addr]error)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, r.batchConcurrency())
+	seen := make(map[netip.Addr]bool)
+	for _, addr := range addrs {
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(addr netip.Addr) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			names, err := r.LookupAddrContext(ctx, addr)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[addr] = err
+			} else {
+				hosts[addr] = names
+			}
+		}(addr)
+	}
+	wg.Wait()
+	return hosts, errs
+}
+
+// retryBudgetKey is the context key for the retry budget of a batch.
+type retryBudgetKey struct{}
+
+// withRetryBudget returns a copy of ctx with a budget of n retries, shared
+// by the exchanges made with it.
+func withRetryBudget(ctx context.Context, n int) context.Context {
+	budget := new(atomic.Int64)
+	budget.Store(int64(n))
+	return context.WithValue(ctx, retryBudgetKey{}, budget)
+}
+
+// takeRetry reports whether an exchange made with ctx may retry, spending
+// one retry of its budget if it has one.
+func takeRetry(ctx context.Context) bool {
+	budget, ok := ctx.Value(retryBudgetKey{}).(*atomic.Int64)
+	return !ok || budget.Add(-1) >= 0
+}
+
+// reverseName returns the name used to look up PTR records for addr: its
+// octets in reverse under in-addr.arpa for IPv4 (RFC 1035, section 3.5),
+// or its nibbles in reverse under ip6.arpa for IPv6 (RFC 3596, section
+// 2.5). IPv4-mapped IPv6 addresses are treated as IPv4.
+func reverseName(addr netip.Addr) (string, error) {
+	if !addr.IsValid() {
+		return "", fmt.Errorf("invalid address")
+	}
+	addr = addr.Unmap()
+
+	var b strings.Builder
+	if addr.Is4() {
+		ip := addr.As4()
+		for i := len(ip) - 1; i >= 0; i-- {
+			b.WriteString(strconv.Itoa(int(ip[i])))
+			b.WriteByte('.')
+		}
+		b.WriteString("in-addr.arpa")
+		return b.String(), nil
+	}
+
+	const hexDigits = "0123456789abcdef"
+	ip := addr.As16()
+	for i := len(ip) - 1; i >= 0; i-- {
+		b.WriteByte(hexDigits[ip[i]&0xf])
+		b.WriteByte('.')
+		b.WriteByte(hexDigits[ip[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString("ip6.arpa")
+	return b.String(), nil
+}
+
+// lookupRecords returns the records of type t for domain, following CNAME
+// records with further queries if needed. It returns an error if there are
+// no such records.
+func (r *Resolver) lookupRecords(ctx context.Context, domain string, t Type) ([]Record, error) {
+	records, _, _, err := r.lookupChain(ctx, domain, t)
+	return records, err
+}
+
+// lookupChain is like lookupRecords, but also returns the CNAME and DNAME
+// records in the responses, which normally are the chain that was
+// followed, and the Additional section of the response the records came
+// from.
+func (r *Resolver) lookupChain(ctx context.Context, domain string, t Type) (records, aliases, extra []Record, err error) {
+	name, hops := domain, 0
+
+	for {
+		response, err := r.QueryContext(ctx, name, t)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if err := response.Err(); err != nil {
+			return nil, nil, nil, err
+		}
+		for _, rec := range response.Answers {
+			if rec.Type == TypeCNAME || rec.Type == TypeDNAME {
+				aliases = append(aliases, rec)
+			}
+		}
+
+		target, n, records := followCNAMEs(response.Answers, name, t)
+		if hops += n; hops > MaxCNAMEChain {
+			return nil, nil, nil, ErrCNAMEChainTooLong
+		}
+		if len(records) > 0 {
+			if err := r.checkRebinding(domain, records); err != nil {
+				return nil, nil, nil, err
+			}
+			return records, aliases, response.Additionals, nil
+		}
+		if n == 0 {
+			return nil, nil, nil, fmt.Errorf("no answers")
+		}
+		name = target
+	}
+}
@@ -0,0 +1,872 @@
+package resolve
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// serveUDP starts a DNS server on localhost that replies to each query with
+// handler's response, and returns a Resolver that uses it. Returning nil
+// from handler drops the query.
+func serveUDP(t testing.TB, handler func(query []byte) []byte) *Resolver {
+	t.Helper()
+	return serveUDPAt(t, "127.0.0.1:0", handler)
+}
+
+// serveUDPAt is like serveUDP, but listens on address.
+func serveUDPAt(t testing.TB, address string, handler func(query []byte) []byte) *Resolver {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if response := handler(append([]byte(nil), buf[:n]...)); response != nil {
+				_, _ = conn.WriteTo(response, addr)
+			}
+		}
+	}()
+
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	return &Resolver{Server: addr.IP.String(), Port: addr.Port, Timeout: time.Second}
+}
+
+// replyWith returns a handler that answers every query with response,
+// rewritten to carry the query's ID.
+func replyWith(response []byte) func([]byte) []byte {
+	return func(query []byte) []byte {
+		b := append([]byte(nil), response...)
+		copy(b[:2], query[:2])
+		return b
+	}
+}
+
+// handle returns a handler that decodes each query and replies with f's
+// response. The response's ID and questions are copied from the query.
+func handle(f func(query *Packet) *Packet) func([]byte) []byte {
+	return func(b []byte) []byte {
+		query, err := ParsePacket(b)
+		if err != nil {
+			return nil
+		}
+		response := f(query)
+		if response == nil {
+			return nil
+		}
+		response.Header.ID = query.Header.ID
+		response.Header.Flags.SetQR(true)
+		response.Questions = query.Questions
+		out, err := response.MarshalBinary()
+		if err != nil {
+			return nil
+		}
+		return out
+	}
+}
+
+func TestResolver_Lookup(t *testing.T) {
+	flags := make(chan Flags, 1)
+	r := serveUDP(t, func(query []byte) []byte {
+		var h Header
+		if err := h.UnmarshalBinary(query[:12]); err == nil {
+			flags <- h.Flags
+		}
+		return replyWith(examplePacket)(query)
+	})
+
+	got, err := r.Lookup("www.example.com", TypeA)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if want := netip.MustParseAddr("93.184.216.34"); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if f := <-flags; !f.RD() {
+		t.Errorf("query flags %#04x: RD bit not set", f)
+	}
+}
+
+func TestResolver_Timeout(t *testing.T) {
+	r := serveUDP(t, func([]byte) []byte { return nil })
+	r.Timeout = 50 * time.Millisecond
+
+	_, err := r.Lookup("www.example.com", TypeA)
+	if err == nil {
+		t.Fatal("want error")
+	}
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("got %v, want a timeout", err)
+	}
+}
+
+func TestResolver_LookupContext_Canceled(t *testing.T) {
+	r := serveUDP(t, func([]byte) []byte { return nil })
+	r.Timeout = time.Minute
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	_, err := r.LookupContext(ctx, "www.example.com", TypeA)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestResolver_Lookup_NXDOMAIN(t *testing.T) {
+	r := serveUDP(t, handle(func(*Packet) *Packet {
+		p := &Packet{}
+		p.Header.Flags.SetRCode(RCodeNameError)
+		return p
+	}))
+
+	_, err := r.Lookup("nonexistent.example.com", TypeA)
+	if !errors.Is(err, ErrNameNotFound) {
+		t.Errorf("got %v, want %v", err, ErrNameNotFound)
+	}
+}
+
+func TestResolver_Lookup_CNAME(t *testing.T) {
+	// The first response only has the first link of the chain, so the
+	// resolver has to query for the target.
+	r := serveUDP(t, handle(func(query *Packet) *Packet {
+		p := &Packet{}
+		switch string(query.Questions[0].Name) {
+		case "www.example.com":
+			p.Answers = []Record{cnameRecord("www.example.com", "cdn.example.net")}
+		case "cdn.example.net":
+			p.Answers = []Record{
+				cnameRecord("cdn.example.net", "edge.example.net"),
+				{Name: []byte("edge.example.net"), Type: TypeA, Class: ClassIN, TTL: 60, RData: A{Addr: netip.MustParseAddr("192.0.2.1")}},
+			}
+		}
+		return p
+	}))
+
+	got, err := r.Lookup("www.example.com", TypeA)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if want := netip.MustParseAddr("192.0.2.1"); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestResolver_Lookup_CNAMELoop(t *testing.T) {
+	r := serveUDP(t, handle(func(query *Packet) *Packet {
+		name := string(query.Questions[0].Name)
+		target := "a.example.com"
+		if name == target {
+			target = "b.example.com"
+		}
+		return &Packet{Answers: []Record{cnameRecord(name, target)}}
+	}))
+
+	_, err := r.Lookup("a.example.com", TypeA)
+	if !errors.Is(err, ErrCNAMEChainTooLong) {
+		t.Errorf("got %v, want %v", err, ErrCNAMEChainTooLong)
+	}
+}
+
+func TestResolver_LookupHost(t *testing.T) {
+	// The chain continues in a second response, with a shorter CNAME TTL.
+	r := serveUDP(t, handle(func(query *Packet) *Packet {
+		p := &Packet{}
+		switch string(query.Questions[0].Name) {
+		case "www.example.com":
+			cname := cnameRecord("www.example.com", "cdn.example.net")
+			cname.TTL = 120
+			p.Answers = []Record{cname}
+		case "cdn.example.net":
+			edge := cnameRecord("cdn.example.net", "edge.example.net")
+			edge.TTL = 90
+			first, second, third := a("edge.example.net", "192.0.2.3"), a("edge.example.net", "192.0.2.1"), a("edge.example.net", "192.0.2.2")
+			third.TTL = 30
+			p.Answers = []Record{edge, first, second, third}
+		}
+		return p
+	}))
+
+	got, err := r.LookupHost("www.example.com", TypeA)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	want := []HostAddr{
+		{Addr: netip.MustParseAddr("192.0.2.3"), TTL: 90},
+		{Addr: netip.MustParseAddr("192.0.2.1"), TTL: 90},
+		{Addr: netip.MustParseAddr("192.0.2.2"), TTL: 30},
+	}
+	if diff := cmp.Diff(want, got, cmpAddr); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+// dualStack returns a handler for www.example with two A and two AAAA
+// records. A query of type drop is dropped.
+func dualStack(drop Type) func([]byte) []byte {
+	return handle(func(query *Packet) *Packet {
+		name := query.Questions[0].Name
+		switch query.Questions[0].Type {
+		case drop:
+			return nil
+		case TypeA:
+			return &Packet{Answers: []Record{a(string(name), "192.0.2.1"), a(string(name), "192.0.2.2")}}
+		case TypeAAAA:
+			return &Packet{Answers: []Record{
+				{Name: name, Type: TypeAAAA, Class: ClassIN, TTL: 300, RData: AAAA{Addr: netip.MustParseAddr("2001:db8::1")}},
+				{Name: name, Type: TypeAAAA, Class: ClassIN, TTL: 300, RData: AAAA{Addr: netip.MustParseAddr("2001:db8::2")}},
+			}}
+		}
+		return &Packet{}
+	})
+}
+
+func TestResolver_LookupIPAddrs(t *testing.T) {
+	r := serveUDP(t, dualStack(0))
+
+	got, err := r.LookupIPAddrs("www.example")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	want := []netip.Addr{
+		netip.MustParseAddr("2001:db8::1"),
+		netip.MustParseAddr("2001:db8::2"),
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("192.0.2.2"),
+	}
+	// The order depends on the routes of the machine the test runs on.
+	sorted := cmpopts.SortSlices(func(a, b netip.Addr) bool { return a.Less(b) })
+	if diff := cmp.Diff(want, got, cmpAddr, sorted); diff != "" {
+		t.Errorf("mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestResolver_LookupIPAddrs_SlowAAAA(t *testing.T) {
+	// The AAAA query would be retried well after the A query is answered.
+	r := serveUDP(t, dualStack(TypeAAAA))
+
+	start := time.Now()
+	got, err := r.LookupIPAddrs("www.example")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > r.attemptTimeout() {
+		t.Errorf("took %v, want it not to wait for the AAAA query", elapsed)
+	}
+	if len(got) != 2 || !got[0].Is4() || !got[1].Is4() {
+		t.Errorf("got %v, want the IPv4 addresses", got)
+	}
+}
+
+func TestResolver_LookupIPAddrs_NoA(t *testing.T) {
+	r := serveUDP(t, dualStack(TypeA))
+	r.Attempts = 1
+
+	got, err := r.LookupIPAddrs("www.example")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if len(got) != 2 || !got[0].Is6() || !got[1].Is6() {
+		t.Errorf("got %v, want the IPv6 addresses", got)
+	}
+}
+
+func TestResolver_LookupIPAddrs_ServFail(t *testing.T) {
+	// The server fails AAAA queries and answers A queries, a little later
+	// so that the failure isn't missed.
+	r := serveUDP(t, handle(func(query *Packet) *Packet {
+		p := &Packet{}
+		if query.Questions[0].Type == TypeAAAA {
+			p.Header.Flags.SetRCode(RCodeServerFailure)
+			return p
+		}
+		time.Sleep(20 * time.Millisecond)
+		p.Answers = []Record{a(string(query.Questions[0].Name), "192.0.2.1")}
+		return p
+	}))
+	r.Attempts = 1
+
+	if _, err := r.LookupIPAddrs("www.example"); !errors.Is(err, ErrServerFailure) {
+		t.Errorf("got %v, want %v", err, ErrServerFailure)
+	}
+
+	r.ServFailAsEmpty = true
+	got, err := r.LookupIPAddrs("www.example")
+	if err != nil {
+		t.Fatalf("ServFailAsEmpty: error: %v", err)
+	}
+	if want := []netip.Addr{netip.MustParseAddr("192.0.2.1")}; !cmp.Equal(want, got, cmpAddr) {
+		t.Errorf("ServFailAsEmpty: got %v, want %v", got, want)
+	}
+}
+
+func TestResolver_LookupIP(t *testing.T) {
+	r := serveUDP(t, dualStack(0))
+
+	tests := []struct {
+		network, host string
+		want          []string
+	}{
+		{"ip4", "www.example", []string{"192.0.2.1", "192.0.2.2"}},
+		{"ip6", "www.example", []string{"2001:db8::1", "2001:db8::2"}},
+		{"ip", "www.example", []string{"192.0.2.1", "192.0.2.2", "2001:db8::1", "2001:db8::2"}},
+		{"ip", "192.0.2.9", []string{"192.0.2.9"}},
+		{"ip6", "2001:db8::9", []string{"2001:db8::9"}},
+	}
+	sorted := cmpopts.SortSlices(func(a, b netip.Addr) bool { return a.Less(b) })
+	for _, tt := range tests {
+		got, err := r.LookupIP(tt.network, tt.host)
+		if err != nil {
+			t.Errorf("%s %s: error: %v", tt.network, tt.host, err)
+			continue
+		}
+		var want []netip.Addr
+		for _, s := range tt.want {
+			want = append(want, netip.MustParseAddr(s))
+		}
+		if diff := cmp.Diff(want, got, cmpAddr, sorted); diff != "" {
+			t.Errorf("%s %s: mismatch (-want +got):\n%s", tt.network, tt.host, diff)
+		}
+	}
+
+	if _, err := r.LookupIP("ip4", "2001:db8::9"); err == nil {
+		t.Error("ip4 with IPv6 literal: no error")
+	}
+	var unknown net.UnknownNetworkError
+	if _, err := r.LookupIP("tcp", "www.example"); !errors.As(err, &unknown) {
+		t.Errorf("tcp: got %v, want %T", err, unknown)
+	}
+}
+
+func TestResolver_LookupIPAddrs_NXDOMAIN(t *testing.T) {
+	r := serveUDP(t, handle(func(*Packet) *Packet {
+		p := &Packet{}
+		p.Header.Flags.SetRCode(RCodeNameError)
+		return p
+	}))
+
+	_, err := r.LookupIPAddrs("nonexistent.example.com")
+	if !errors.Is(err, ErrNameNotFound) {
+		t.Errorf("got %v, want %v", err, ErrNameNotFound)
+	}
+}
+
+func TestResolver_LookupMX(t *testing.T) {
+	r := serveUDP(t, handle(func(*Packet) *Packet {
+		mx := func(pref uint16, host string) Record {
+			return Record{Name: []byte("example.com"), Type: TypeMX, Class: ClassIN, TTL: 300, RData: MX{Preference: pref, Host: host}}
+		}
+		return &Packet{Answers: []Record{
+			mx(20, "mx2.example.com"),
+			mx(10, "mx1.example.com"),
+			mx(20, "mx3.example.com"),
+		}}
+	}))
+
+	got, err := r.LookupMX("example.com")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	want := []MX{
+		{Preference: 10, Host: "mx1.example.com"},
+		{Preference: 20, Host: "mx2.example.com"},
+		{Preference: 20, Host: "mx3.example.com"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestResolver_LookupTXT(t *testing.T) {
+	r := serveUDP(t, handle(func(*Packet) *Packet {
+		txt := func(s ...string) Record {
+			return Record{Name: []byte("example.com"), Type: TypeTXT, Class: ClassIN, TTL: 300, RData: TXT{Strings: s}}
+		}
+		return &Packet{Answers: []Record{
+			txt("v=spf1 -all"),
+			txt("v=DKIM1; k=rsa; ", "p=MIGfMA0"),
+		}}
+	}))
+
+	got, err := r.LookupTXT("example.com")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	want := []string{"v=spf1 -all", "v=DKIM1; k=rsa; p=MIGfMA0"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestResolver_LookupNS(t *testing.T) {
+	r := serveUDP(t, handle(func(*Packet) *Packet {
+		ns := func(host string) Record {
+			return Record{Name: []byte("example.com"), Type: TypeNS, Class: ClassIN, TTL: 300, RData: NS{Host: host}}
+		}
+		return &Packet{Answers: []Record{ns("a.iana-servers.net"), ns("b.iana-servers.net")}}
+	}))
+
+	got, err := r.LookupNS("example.com")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	want := []NS{{Host: "a.iana-servers.net"}, {Host: "b.iana-servers.net"}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"192.0.2.1", "1.2.0.192.in-addr.arpa"},
+		{"::ffff:192.0.2.1", "1.2.0.192.in-addr.arpa"},
+		{"2001:db8::567:89ab", "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"},
+	}
+	for _, tt := range tests {
+		got, err := reverseName(netip.MustParseAddr(tt.addr))
+		if err != nil {
+			t.Errorf("%s: error: %v", tt.addr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+
+	if _, err := reverseName(netip.Addr{}); err == nil {
+		t.Error("zero Addr: want error")
+	}
+}
+
+func TestResolver_LookupAddr(t *testing.T) {
+	r := serveUDP(t, handle(func(query *Packet) *Packet {
+		q := query.Questions[0]
+		if q.Type != TypePTR || string(q.Name) != "1.2.0.192.in-addr.arpa" {
+			return &Packet{}
+		}
+		return &Packet{Answers: []Record{{Name: q.Name, Type: TypePTR, Class: ClassIN, TTL: 300, RData: PTR{Host: "host.example.com"}}}}
+	}))
+
+	got, err := r.LookupAddr(netip.MustParseAddr("192.0.2.1"))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"host.example.com"}, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestResolver_LookupAddrs(t *testing.T) {
+	var inFlight, most atomic.Int32
+	r := &Resolver{BatchConcurrency: 2, Exchanger: ExchangerFunc(func(ctx context.Context, query *Packet) (*Packet, error) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		q := query.Questions[0]
+		response := &Packet{Header: query.Header, Questions: query.Questions}
+		response.Header.Flags.SetQR(true)
+		if string(q.Name) == "5.2.0.192.in-addr.arpa" {
+			response.Header.Flags.SetRCode(RCodeNameError)
+			return response, nil
+		}
+		host := strings.TrimSuffix(string(q.Name), ".2.0.192.in-addr.arpa") + ".example.com"
+		response.Answers = []Record{{Name: q.Name, Type: TypePTR, Class: ClassIN, TTL: 300, RData: PTR{Host: host}}}
+		return response, nil
+	})}
+
+	var addrs []netip.Addr
+	for i := 1; i <= 8; i++ {
+		addrs = append(addrs, netip.AddrFrom4([4]byte{192, 0, 2, byte(i)}))
+	}
+	addrs = append(addrs, addrs[0]) // Looked up once.
+
+	hosts, errs := r.LookupAddrs(context.Background(), addrs)
+	if len(hosts) != 7 {
+		t.Errorf("got %d addresses with hosts, want 7", len(hosts))
+	}
+	for addr, got := range hosts {
+		want := []string{fmt.Sprintf("%d.example.com", addr.As4()[3])}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("%s: mismatch (-want, +got):\n%s", addr, diff)
+		}
+	}
+	bad := netip.MustParseAddr("192.0.2.5")
+	if len(errs) != 1 || !errors.Is(errs[bad], ErrNameNotFound) {
+		t.Errorf("got errors %v, want %v for %s only", errs, ErrNameNotFound, bad)
+	}
+	if m := most.Load(); m > 2 {
+		t.Errorf("%d lookups at once, want at most 2", m)
+	}
+}
+
+func TestResolver_LookupAddrs_RetryBudget(t *testing.T) {
+	var queries atomic.Int32
+	r := &Resolver{
+		Attempts:         3,
+		Backoff:          time.Millisecond,
+		BatchRetryBudget: 4,
+		Exchanger: ExchangerFunc(func(ctx context.Context, query *Packet) (*Packet, error) {
+			queries.Add(1)
+			return nil, errors.New("upstream down")
+		}),
+	}
+
+	var addrs []netip.Addr
+	for i := 1; i <= 10; i++ {
+		addrs = append(addrs, netip.AddrFrom4([4]byte{192, 0, 2, byte(i)}))
+	}
+	hosts, errs := r.LookupAddrs(context.Background(), addrs)
+	if len(hosts) != 0 || len(errs) != len(addrs) {
+		t.Errorf("got %d hosts and %d errors, want 0 and %d", len(hosts), len(errs), len(addrs))
+	}
+	// One attempt for each address, and the budget's retries.
+	if n, want := queries.Load(), int32(len(addrs)+4); n != want {
+		t.Errorf("%d queries, want %d", n, want)
+	}
+}
+
+func TestOrderSRV(t *testing.T) {
+	srvs := []SRV{
+		{Priority: 20, Weight: 0, Target: "backup.example.com"},
+		{Priority: 10, Weight: 10, Target: "a.example.com"},
+		{Priority: 10, Weight: 0, Target: "b.example.com"},
+		{Priority: 10, Weight: 30, Target: "c.example.com"},
+	}
+	// Always pick the largest number, which selects the last record in the
+	// running sum.
+	var sums []int
+	orderSRV(srvs, func(n int) int {
+		sums = append(sums, n-1)
+		return n - 1
+	})
+
+	var got []string
+	for _, srv := range srvs {
+		got = append(got, srv.Target)
+	}
+	want := []string{"c.example.com", "a.example.com", "b.example.com", "backup.example.com"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("order mismatch (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]int{40, 10}, sums); diff != "" {
+		t.Errorf("weight sums mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestResolver_LookupSRV(t *testing.T) {
+	r := serveUDP(t, handle(func(query *Packet) *Packet {
+		q := query.Questions[0]
+		if string(q.Name) != "_sip._udp.example.com" {
+			return &Packet{}
+		}
+		return &Packet{Answers: []Record{{Name: q.Name, Type: TypeSRV, Class: ClassIN, TTL: 300, RData: SRV{Priority: 10, Weight: 5, Port: 5060, Target: "sip.example.com"}}}}
+	}))
+
+	got, err := r.LookupSRV("sip", "udp", "example.com")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	want := []SRV{{Priority: 10, Weight: 5, Port: 5060, Target: "sip.example.com"}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestResolver_LookupService(t *testing.T) {
+	queried := make(chan string, 10)
+	r := serveUDP(t, handle(func(query *Packet) *Packet {
+		q := query.Questions[0]
+		queried <- string(q.Name)
+		switch {
+		case string(q.Name) == "_xmpp._tcp.example.com" && q.Type == TypeSRV:
+			return &Packet{
+				Answers: []Record{
+					{Name: q.Name, Type: TypeSRV, Class: ClassIN, TTL: 300, RData: SRV{Priority: 20, Weight: 0, Port: 5222, Target: "backup.example.com"}},
+					{Name: q.Name, Type: TypeSRV, Class: ClassIN, TTL: 300, RData: SRV{Priority: 10, Weight: 5, Port: 5222, Target: "xmpp.example.com"}},
+				},
+				Additionals: []Record{
+					a("xmpp.example.com", "192.0.2.1"),
+					aaaa("xmpp.example.com", "2001:db8::1"),
+				},
+			}
+		case string(q.Name) == "backup.example.com" && q.Type == TypeA:
+			return &Packet{Answers: []Record{a("backup.example.com", "192.0.2.2")}}
+		}
+		return &Packet{}
+	}))
+
+	got, err := r.LookupService("xmpp", "tcp", "example.com")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	want := []Endpoint{
+		{Host: "xmpp.example.com", Port: 5222, Priority: 10, Weight: 5, Addrs: []netip.Addr{
+			netip.MustParseAddr("192.0.2.1"),
+			netip.MustParseAddr("2001:db8::1"),
+		}},
+		{Host: "backup.example.com", Port: 5222, Priority: 20, Addrs: []netip.Addr{
+			netip.MustParseAddr("192.0.2.2"),
+		}},
+	}
+	// The order of the addresses depends on the host's, as with
+	// LookupIPAddrs.
+	opts := cmp.Options{
+		cmp.Comparer(func(a, b netip.Addr) bool { return a == b }),
+		cmpopts.SortSlices(func(a, b netip.Addr) bool { return a.Less(b) }),
+	}
+	if diff := cmp.Diff(want, got, opts); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+
+	// The target with glue isn't looked up.
+	for len(queried) > 0 {
+		if name := <-queried; name == "xmpp.example.com" {
+			t.Errorf("queried %s despite glue", name)
+		}
+	}
+}
+
+func TestResolver_LookupService_Unavailable(t *testing.T) {
+	r := serveUDP(t, handle(func(query *Packet) *Packet {
+		q := query.Questions[0]
+		return &Packet{Answers: []Record{{Name: q.Name, Type: TypeSRV, Class: ClassIN, TTL: 300, RData: SRV{Target: "."}}}}
+	}))
+
+	got, err := r.LookupService("xmpp", "tcp", "example.com")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("got %v, want no endpoints", got)
+	}
+}
+
+func TestResolver_Query_EDNS(t *testing.T) {
+	queries := make(chan *Packet, 1)
+	r := serveUDP(t, handle(func(query *Packet) *Packet {
+		queries <- query
+		return &Packet{}
+	}))
+	r.EDNS = &EDNS{UDPSize: 1232, DNSSECOK: true}
+
+	if _, err := r.Query("example.com", TypeA); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	got := (<-queries).EDNS
+	if diff := cmp.Diff(r.EDNS, got, cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("query EDNS mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestResolver_Query_DNSSECUDPSize(t *testing.T) {
+	tests := []struct {
+		name          string
+		udpSize       uint16
+		dnssecUDPSize uint16
+		do            bool
+		want          uint16
+	}{
+		{"no do", 512, 0, false, 512},
+		{"default floor", 512, 0, true, DefaultUDPSize},
+		{"floor", 512, 4096, true, 4096},
+		{"above floor", 4096, 0, true, 4096},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queries := make(chan *Packet, 1)
+			r := serveUDP(t, handle(func(query *Packet) *Packet {
+				queries <- query
+				return &Packet{}
+			}))
+			r.UDPSize = tt.udpSize
+			r.DNSSECUDPSize = tt.dnssecUDPSize
+			r.EDNS = &EDNS{DNSSECOK: tt.do}
+
+			if _, err := r.Query("example.com", TypeA); err != nil {
+				t.Fatalf("error: %v", err)
+			}
+			if got := (<-queries).EDNS.UDPSize; got != tt.want {
+				t.Errorf("got UDP size %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolver_Lookup_ExtendedError(t *testing.T) {
+	r := serveUDP(t, handle(func(*Packet) *Packet {
+		p := &Packet{EDNS: &EDNS{UDPSize: 1232, Options: []EDNSOption{
+			{Code: OptionCodeExtendedError, Data: []byte("\x00\x0fblocked by policy")},
+		}}}
+		p.Header.Flags.SetRCode(RCodeRefused)
+		return p
+	}))
+
+	_, err := r.Lookup("ads.example.com", TypeA)
+	if !errors.Is(err, ErrRefused) {
+		t.Errorf("got %v, want %v", err, ErrRefused)
+	}
+	var re *ResponseError
+	if !errors.As(err, &re) {
+		t.Fatalf("got %T, want *ResponseError", err)
+	}
+	want := []ExtendedError{{InfoCode: EDEBlocked, ExtraText: "blocked by policy"}}
+	if diff := cmp.Diff(want, re.ExtendedErrors); diff != "" {
+		t.Errorf("mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestResolver_Query_ClientSubnet(t *testing.T) {
+	queries := make(chan *Packet, 1)
+	r := serveUDP(t, handle(func(query *Packet) *Packet {
+		queries <- query
+		p := &Packet{EDNS: &EDNS{UDPSize: 1232}}
+		if cs := query.EDNS.ClientSubnet; cs != nil {
+			cs.ScopePrefixLen = 16
+			p.EDNS.Options = []EDNSOption{cs.Option()}
+		}
+		return p
+	}))
+	r.ClientSubnet = netip.MustParsePrefix("198.51.100.0/24")
+
+	response, err := r.Query("example.com", TypeA)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	query := <-queries
+	if cs := query.EDNS.ClientSubnet; cs == nil || cs.Source != r.ClientSubnet {
+		t.Errorf("query ClientSubnet: got %+v, want source %v", cs, r.ClientSubnet)
+	}
+	if cs := response.EDNS.ClientSubnet; cs == nil || cs.ScopePrefixLen != 16 {
+		t.Errorf("response ClientSubnet: got %+v, want scope 16", cs)
+	}
+}
+
+func TestResolver_CheckingDisabled(t *testing.T) {
+	flags := make(chan byte, 1)
+	reply := handle(func(*Packet) *Packet { return &Packet{} })
+	r := serveUDP(t, func(query []byte) []byte {
+		// CD is bit 4 of the header's fourth byte.
+		flags <- query[3]
+		return reply(query)
+	})
+
+	if _, err := r.Query("example.com", TypeA); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if got := <-flags; got&0x10 != 0 {
+		t.Errorf("CD set by default: flags byte %#02x", got)
+	}
+
+	r.CheckingDisabled = true
+	if _, err := r.Query("example.com", TypeA); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if got := <-flags; got&0x10 == 0 {
+		t.Errorf("CD not set: flags byte %#02x", got)
+	}
+}
+
+func TestResolver_UDPSize(t *testing.T) {
+	// Each TXT record is about 220 bytes, so the response is over 1024 bytes
+	// but under the default UDP size.
+	sizes := make(chan uint16, 2)
+	r := serveUDP(t, handle(func(query *Packet) *Packet {
+		sizes <- query.EDNS.UDPSize
+		p := &Packet{}
+		for i := 0; i < 5; i++ {
+			s := string(bytes.Repeat([]byte{'a' + byte(i)}, 200))
+			p.Answers = append(p.Answers, Record{Name: []byte("example.com"), Type: TypeTXT, Class: ClassIN, TTL: 300, RData: TXT{Strings: []string{s}}})
+		}
+		return p
+	}))
+
+	txts, err := r.LookupTXT("example.com")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if len(txts) != 5 {
+		t.Errorf("got %d records, want 5", len(txts))
+	}
+	if got := <-sizes; got != DefaultUDPSize {
+		t.Errorf("advertised %d, want %d", got, DefaultUDPSize)
+	}
+
+	r.UDPSize = 4096
+	if _, err := r.LookupTXT("example.com"); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if got := <-sizes; got != 4096 {
+		t.Errorf("advertised %d, want 4096", got)
+	}
+}
+
+func TestResolver_IDSource(t *testing.T) {
+	// Each resolver records the queries it sends.
+	send := func(r *Resolver) [][]byte {
+		var queries [][]byte
+		r.Exchanger = ExchangerFunc(func(ctx context.Context, query *Packet) (*Packet, error) {
+			b, err := query.MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+			queries = append(queries, b)
+			response := &Packet{Header: query.Header, Questions: query.Questions}
+			response.Header.Flags.SetQR(true)
+			return response, nil
+		})
+		for _, name := range []string{"a.example", "b.example"} {
+			if _, err := r.Query(name, TypeA); err != nil {
+				t.Fatalf("error: %v", err)
+			}
+		}
+		return queries
+	}
+
+	first := send(&Resolver{IDSource: rand.NewSource(1)})
+	second := send(&Resolver{IDSource: rand.NewSource(1)})
+	if diff := cmp.Diff(first, second); diff != "" {
+		t.Errorf("queries differ with the same source (-first +second):\n%s", diff)
+	}
+
+	fixed := send(&Resolver{IDSource: fixedSource(0x1234)})
+	for _, q := range fixed {
+		if id := binary.BigEndian.Uint16(q); id != 0x1234 {
+			t.Errorf("got ID %#04x, want 0x1234", id)
+		}
+	}
+}
+
+// fixedSource is a rand.Source that always returns the same number.
+type fixedSource int64
+
+func (s fixedSource) Int63() int64 { return int64(s) }
+
+func (fixedSource) Seed(int64) {}
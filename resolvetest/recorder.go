@@ -0,0 +1,186 @@
+package resolvetest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/clfs/resolve"
+)
+
+// recordingMagic starts every recording file.
+const recordingMagic = "resolve recording 1\n"
+
+// A Recorder is a resolve.Exchanger that records queries and their
+// responses to a file, to be replayed later. This lets tests run against
+// real-world responses without network access: record them once, check
+// the file in, and replay it from then on.
+//
+// A file holds each query and its response in wire format, with the
+// 2-byte length prefix used over TCP.
+type Recorder struct {
+	next resolve.Exchanger // Nil when replaying.
+
+	mu        sync.Mutex
+	file      *os.File
+	w         *bufio.Writer
+	responses map[recordKey][]*resolve.Packet
+}
+
+type recordKey struct {
+	name  string
+	t     resolve.Type
+	class resolve.Class
+}
+
+// Record returns a Recorder that sends queries to next and records them
+// and their responses in a new file at path. Close must be called to
+// finish the file.
+func Record(path string, next resolve.Exchanger) (*Recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	if _, err := w.WriteString(recordingMagic); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Recorder{next: next, file: f, w: w}, nil
+}
+
+// Replay returns a Recorder that answers queries with the responses
+// recorded in the file at path. The response to a query is the one
+// recorded for the same name, type and class; if a question was recorded
+// more than once, the responses are replayed in order, and the last is
+// repeated.
+func Replay(path string) (*Recorder, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	magic := make([]byte, len(recordingMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != recordingMagic {
+		return nil, fmt.Errorf("%s: not a recording", path)
+	}
+
+	rec := &Recorder{responses: make(map[recordKey][]*resolve.Packet)}
+	for {
+		query, err := readPacket(br)
+		if errors.Is(err, io.EOF) {
+			return rec, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		response, err := readPacket(br)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if len(query.Questions) != 1 {
+			return nil, fmt.Errorf("%s: query has %d questions, want 1", path, len(query.Questions))
+		}
+		k := questionKey(query.Questions[0])
+		rec.responses[k] = append(rec.responses[k], response)
+	}
+}
+
+func questionKey(q resolve.Question) recordKey {
+	return recordKey{strings.ToLower(strings.TrimSuffix(string(q.Name), ".")), q.Type, q.Class}
+}
+
+func readPacket(r io.Reader) (*resolve.Packet, error) {
+	b, err := resolve.ReadMessageTCP(r)
+	if err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("truncated recording")
+		}
+		return nil, err
+	}
+	return resolve.ParsePacket(b)
+}
+
+// Exchange implements resolve.Exchanger.
+func (rec *Recorder) Exchange(ctx context.Context, query *resolve.Packet) (*resolve.Packet, error) {
+	if rec.next == nil {
+		return rec.replay(query)
+	}
+
+	response, err := rec.next.Exchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := query.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	b, err := response.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if err := resolve.WriteQueryTCP(rec.w, q); err != nil {
+		return nil, err
+	}
+	if err := resolve.WriteQueryTCP(rec.w, b); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (rec *Recorder) replay(query *resolve.Packet) (*resolve.Packet, error) {
+	if len(query.Questions) != 1 {
+		return nil, fmt.Errorf("query has %d questions, want 1", len(query.Questions))
+	}
+	q := query.Questions[0]
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	k := questionKey(q)
+	responses := rec.responses[k]
+	if len(responses) == 0 {
+		return nil, fmt.Errorf("no recorded response for %s %s", q.Name, q.Type)
+	}
+	response := responses[0]
+	if len(responses) > 1 {
+		rec.responses[k] = responses[1:]
+	}
+
+	// Each replay gets its own copy, since the caller may change it.
+	b, err := response.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	p, err := resolve.ParsePacket(b)
+	if err != nil {
+		return nil, err
+	}
+	p.Header.ID = query.Header.ID
+	return p, nil
+}
+
+// Close finishes the file being recorded. It does nothing when replaying.
+func (rec *Recorder) Close() error {
+	if rec.file == nil {
+		return nil
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	err := rec.w.Flush()
+	if cerr := rec.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
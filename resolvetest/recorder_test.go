@@ -0,0 +1,62 @@
+package resolvetest
+
+import (
+	"net/netip"
+	"path/filepath"
+	"testing"
+
+	"github.com/clfs/resolve"
+)
+
+func TestRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "www.example.rec")
+
+	var stub Stub
+	stub.Answer("www.example", resolve.TypeA, a("www.example", "192.0.2.1"))
+	stub.SetRCode("nonexistent.example", resolve.TypeA, resolve.RCodeNameError)
+
+	rec, err := Record(path, &stub)
+	if err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+	r := &resolve.Resolver{Exchanger: rec}
+	if _, err := r.Lookup("www.example", resolve.TypeA); err != nil {
+		t.Fatalf("recording: error: %v", err)
+	}
+	if _, err := r.Lookup("nonexistent.example", resolve.TypeA); err == nil {
+		t.Fatal("recording: no error for nonexistent.example")
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	rec, err = Replay(path)
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	r = &resolve.Resolver{Exchanger: rec}
+	for i := 0; i < 2; i++ {
+		got, err := r.Lookup("WWW.example", resolve.TypeA)
+		if err != nil {
+			t.Fatalf("replay %d: error: %v", i, err)
+		}
+		if want := netip.MustParseAddr("192.0.2.1"); got != want {
+			t.Errorf("replay %d: got %s, want %s", i, got, want)
+		}
+	}
+	if _, err := r.Lookup("nonexistent.example", resolve.TypeA); err == nil {
+		t.Error("replay: no error for nonexistent.example")
+	}
+	if _, err := r.Lookup("www.example", resolve.TypeAAAA); err == nil {
+		t.Error("replay: no error for a question not recorded")
+	}
+	if n := len(stub.Queries()); n != 2 {
+		t.Errorf("stub got %d queries, want 2 from recording only", n)
+	}
+}
+
+func TestReplay_NotRecording(t *testing.T) {
+	if _, err := Replay("recorder.go"); err == nil {
+		t.Error("no error")
+	}
+}
@@ -0,0 +1,185 @@
+package resolvetest
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/clfs/resolve"
+)
+
+// A Server is a DNS server on 127.0.0.1 for tests, serving over UDP and TCP
+// on the same port. It answers queries with its Stub, so its records are
+// set with the Stub's methods:
+//
+//	s := resolvetest.NewServer(t)
+//	s.Answer("www.example", resolve.TypeA, record)
+//	r := s.Resolver()
+//
+// UDP responses larger than a query allows are truncated, so that clients
+// retry over TCP.
+type Server struct {
+	Stub
+
+	// Addr is the address the server listens on, as host:port.
+	Addr string
+
+	udp net.PacketConn
+	tcp net.Listener
+
+	mu     sync.Mutex
+	conns  map[net.Conn]bool // Open TCP connections.
+	closed bool              // Close was called.
+	wg     sync.WaitGroup
+}
+
+// NewServer starts a Server on a free port, which is closed when the test
+// and its subtests finish.
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+
+	// Find a port that is free for both UDP and TCP.
+	var s *Server
+	for tries := 0; s == nil; tries++ {
+		udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("resolvetest: %v", err)
+		}
+		tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+		if err != nil {
+			udp.Close()
+			if tries < 10 {
+				continue
+			}
+			t.Fatalf("resolvetest: %v", err)
+		}
+		s = &Server{Addr: udp.LocalAddr().String(), udp: udp, tcp: tcp, conns: make(map[net.Conn]bool)}
+	}
+	t.Cleanup(s.Close)
+
+	s.wg.Add(2)
+	go s.serveUDP()
+	go s.serveTCP()
+	return s
+}
+
+// Resolver returns a Resolver that sends queries to s over UDP.
+func (s *Server) Resolver() *resolve.Resolver {
+	host, port, _ := net.SplitHostPort(s.Addr)
+	p, _ := strconv.Atoi(port)
+	return &resolve.Resolver{Server: host, Port: p, Timeout: time.Second}
+}
+
+// Close shuts s down and waits for its goroutines to finish.
+func (s *Server) Close() {
+	s.udp.Close()
+	s.tcp.Close()
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// track adds conn to the open TCP connections, unless s is closed, in
+// which case conn is closed and track reports false. A connection accepted
+// just as s is closed would otherwise miss being closed by Close.
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		conn.Close()
+		return false
+	}
+	s.conns[conn] = true
+	return true
+}
+
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if response := s.respond(buf[:n], true); response != nil {
+			_, _ = s.udp.WriteTo(response, addr)
+		}
+	}
+}
+
+func (s *Server) serveTCP() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		if !s.track(conn) {
+			return
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				conn.Close()
+			}()
+			for {
+				query, err := resolve.ReadMessageTCP(conn)
+				if err != nil {
+					return
+				}
+				response := s.respond(query, false)
+				if response == nil {
+					return
+				}
+				if err := resolve.WriteQueryTCP(conn, response); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// respond returns the wire form of the response to query, or nil if query
+// is malformed. Over UDP, a response too large for the query's UDP payload
+// size is cut down to its header and question, with the TC bit set.
+func (s *Server) respond(msg []byte, udp bool) []byte {
+	query, err := resolve.ParsePacket(msg)
+	if err != nil {
+		return nil
+	}
+	response, err := s.Exchange(context.Background(), query)
+	if err != nil {
+		return nil
+	}
+	b, err := response.MarshalBinary()
+	if err != nil {
+		return nil
+	}
+
+	size := 512
+	if query.EDNS != nil && query.EDNS.UDPSize > 512 {
+		size = int(query.EDNS.UDPSize)
+	}
+	if udp && len(b) > size {
+		truncated := &resolve.Packet{Header: response.Header, Questions: response.Questions}
+		truncated.Header.Flags.SetTC(true)
+		if b, err = truncated.MarshalBinary(); err != nil {
+			return nil
+		}
+	}
+	return b
+}
@@ -0,0 +1,64 @@
+package resolvetest
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/clfs/resolve"
+)
+
+func TestServer(t *testing.T) {
+	s := NewServer(t)
+	s.Answer("www.example", resolve.TypeA, a("www.example", "192.0.2.1"))
+
+	for _, p := range []resolve.Protocol{resolve.ProtocolUDP, resolve.ProtocolTCP} {
+		r := s.Resolver()
+		r.Protocol = p
+		got, err := r.Lookup("www.example", resolve.TypeA)
+		if err != nil {
+			t.Errorf("%s: error: %v", p, err)
+			continue
+		}
+		if want := netip.MustParseAddr("192.0.2.1"); got != want {
+			t.Errorf("%s: got %s, want %s", p, got, want)
+		}
+		r.Close()
+	}
+}
+
+func TestServer_Truncated(t *testing.T) {
+	s := NewServer(t)
+	var records []resolve.Record
+	for i := 0; i < 100; i++ {
+		records = append(records, a("big.example", fmt.Sprintf("192.0.2.%d", i)))
+	}
+	s.Answer("big.example", resolve.TypeA, records...)
+
+	r := s.Resolver()
+	r.UDPSize = 512
+	p, err := r.Query("big.example", resolve.TypeA)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if p.Header.Flags.TC() || len(p.Answers) != len(records) {
+		t.Errorf("got %d answers, TC=%t; want %d answers from TCP", len(p.Answers), p.Header.Flags.TC(), len(records))
+	}
+}
+
+func TestServer_CloseRacingAccept(t *testing.T) {
+	s := NewServer(t)
+	s.Close()
+
+	// A connection accepted after Close took its snapshot of the open ones
+	// is closed rather than served.
+	client, server := net.Pipe()
+	defer client.Close()
+	if s.track(server) {
+		t.Error("connection tracked after Close")
+	}
+	if _, err := server.Write([]byte{0}); err == nil {
+		t.Error("connection left open")
+	}
+}
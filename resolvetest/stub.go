@@ -0,0 +1,109 @@
+// Package resolvetest provides utilities for testing code that uses package
+// resolve, without network access.
+package resolvetest
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/clfs/resolve"
+)
+
+// A Stub is a resolve.Exchanger that answers queries with canned
+// responses, set per name and type. Use it as a Resolver's Exchanger:
+//
+//	var stub resolvetest.Stub
+//	stub.Answer("www.example", resolve.TypeA, record)
+//	r := &resolve.Resolver{Exchanger: &stub}
+//
+// Queries for names with no responses set get NXDOMAIN, and queries for
+// other types of names that have some get an empty answer. The zero value
+// is ready to use, and a Stub is safe for concurrent use.
+type Stub struct {
+	mu        sync.Mutex
+	responses map[key]*resolve.Packet
+	names     map[string]bool
+	queries   []resolve.Question
+}
+
+type key struct {
+	name string
+	t    resolve.Type
+}
+
+func newKey(name string, t resolve.Type) key {
+	return key{strings.ToLower(strings.TrimSuffix(name, ".")), t}
+}
+
+// Set makes response the answer to queries for name and t. Its ID and
+// questions are replaced by those of each query, and the QR bit is set.
+func (s *Stub) Set(name string, t resolve.Type, response *resolve.Packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.responses == nil {
+		s.responses = make(map[key]*resolve.Packet)
+		s.names = make(map[string]bool)
+	}
+	k := newKey(name, t)
+	s.responses[k] = response
+	s.names[k.name] = true
+}
+
+// Answer makes a successful response with records in the Answer section
+// the answer to queries for name and t.
+func (s *Stub) Answer(name string, t resolve.Type, records ...resolve.Record) {
+	s.Set(name, t, &resolve.Packet{Answers: records})
+}
+
+// SetRCode makes an empty response with rcode the answer to queries for
+// name and t, such as to have them fail with resolve.RCodeServerFailure.
+func (s *Stub) SetRCode(name string, t resolve.Type, rcode resolve.RCode) {
+	p := &resolve.Packet{}
+	p.Header.Flags.SetRCode(rcode)
+	s.Set(name, t, p)
+}
+
+// Queries returns the questions of the queries received so far, in order.
+func (s *Stub) Queries() []resolve.Question {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]resolve.Question(nil), s.queries...)
+}
+
+// Exchange implements resolve.Exchanger.
+func (s *Stub) Exchange(ctx context.Context, query *resolve.Packet) (*resolve.Packet, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.queries = append(s.queries, query.Questions...)
+
+	response := &resolve.Packet{}
+	if len(query.Questions) == 1 {
+		q := query.Questions[0]
+		k := newKey(string(q.Name), q.Type)
+		if p := s.responses[k]; p != nil {
+			// Copy the sections, so the caller can't change the stored ones.
+			*response = *p
+			response.Answers = append([]resolve.Record(nil), p.Answers...)
+			response.Authorities = append([]resolve.Record(nil), p.Authorities...)
+			response.Additionals = append([]resolve.Record(nil), p.Additionals...)
+		} else if !s.names[k.name] {
+			response.Header.Flags.SetRCode(resolve.RCodeNameError)
+		}
+	} else {
+		response.Header.Flags.SetRCode(resolve.RCodeFormatError)
+	}
+
+	response.Header.ID = query.Header.ID
+	response.Header.Flags.SetQR(true)
+	response.Header.Flags.SetRD(query.Header.Flags.RD())
+	response.Header.Flags.SetRA(true)
+	response.Questions = query.Questions
+	return response, nil
+}
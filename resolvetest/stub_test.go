@@ -0,0 +1,58 @@
+package resolvetest
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/clfs/resolve"
+	"github.com/google/go-cmp/cmp"
+)
+
+func a(name, addr string) resolve.Record {
+	return resolve.Record{Name: []byte(name), Type: resolve.TypeA, Class: resolve.ClassIN, TTL: 300, RData: resolve.A{Addr: netip.MustParseAddr(addr)}}
+}
+
+func TestStub(t *testing.T) {
+	var stub Stub
+	stub.Answer("www.example", resolve.TypeA, a("www.example", "192.0.2.1"))
+	stub.SetRCode("broken.example", resolve.TypeA, resolve.RCodeServerFailure)
+	r := &resolve.Resolver{Exchanger: &stub}
+
+	got, err := r.Lookup("WWW.example.", resolve.TypeA)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if want := netip.MustParseAddr("192.0.2.1"); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	if _, err := r.Lookup("nonexistent.example", resolve.TypeA); !errors.Is(err, resolve.ErrNameNotFound) {
+		t.Errorf("unknown name: got %v, want %v", err, resolve.ErrNameNotFound)
+	}
+
+	p, err := r.Query("www.example", resolve.TypeAAAA)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if rc := p.RCode(); rc != resolve.RCodeSuccess || len(p.Answers) != 0 {
+		t.Errorf("other type: got %v with %d answers, want an empty success", rc, len(p.Answers))
+	}
+
+	p, err = r.Query("broken.example", resolve.TypeA)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if rc := p.RCode(); rc != resolve.RCodeServerFailure {
+		t.Errorf("got %v, want %v", rc, resolve.RCodeServerFailure)
+	}
+
+	var names []string
+	for _, q := range stub.Queries() {
+		names = append(names, string(q.Name)+" "+q.Type.String())
+	}
+	want := []string{"WWW.example A", "nonexistent.example A", "www.example AAAA", "broken.example A"}
+	if diff := cmp.Diff(want, names); diff != "" {
+		t.Errorf("queries mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,71 @@
+package resolve_test
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/clfs/resolve"
+	"github.com/clfs/resolve/resolvetest"
+)
+
+func TestResolver_CacheWithServer(t *testing.T) {
+	s := resolvetest.NewServer(t)
+	s.Answer("www.example", resolve.TypeA, resolve.Record{
+		Name:  []byte("www.example"),
+		Type:  resolve.TypeA,
+		Class: resolve.ClassIN,
+		TTL:   300,
+		RData: resolve.A{Addr: netip.MustParseAddr("192.0.2.1")},
+	})
+
+	r := s.Resolver()
+	r.Cache = &resolve.MemoryCache{}
+	for i := 0; i < 3; i++ {
+		got, err := r.Lookup("www.example", resolve.TypeA)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		if want := netip.MustParseAddr("192.0.2.1"); got != want {
+			t.Errorf("got %s, want %s", got, want)
+		}
+	}
+	if n := len(s.Queries()); n != 1 {
+		t.Errorf("server got %d queries, want 1", n)
+	}
+}
+
+func TestResolver_QueryClassWithServer(t *testing.T) {
+	s := resolvetest.NewServer(t)
+	s.Answer("version.bind", resolve.TypeTXT, resolve.Record{
+		Name:  []byte("version.bind"),
+		Type:  resolve.TypeTXT,
+		Class: resolve.ClassCH,
+		RData: resolve.TXT{Strings: []string{"9.18.0"}},
+	})
+
+	r := s.Resolver()
+	r.Cache = &resolve.MemoryCache{}
+	p, err := r.QueryClass("version.bind", resolve.TypeTXT, resolve.ClassCH)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if got := p.Questions[0].Class; got != resolve.ClassCH {
+		t.Errorf("response question class %s, want CH", got)
+	}
+	if len(p.Answers) != 1 || p.Answers[0].Class != resolve.ClassCH {
+		t.Errorf("got answers %+v, want one CH record", p.Answers)
+	}
+
+	// The IN query for the same name and type isn't answered from the
+	// cached CH response.
+	if _, err := r.Query("version.bind", resolve.TypeTXT); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	queries := s.Queries()
+	if len(queries) != 2 {
+		t.Fatalf("server got %d queries, want 2", len(queries))
+	}
+	if queries[0].Class != resolve.ClassCH || queries[1].Class != resolve.ClassIN {
+		t.Errorf("query classes %s, %s, want CH, IN", queries[0].Class, queries[1].Class)
+	}
+}
@@ -0,0 +1,111 @@
+package resolve
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+)
+
+// ParseRootHints parses a root hints file in the format of named.root, as
+// published by IANA, and returns the addresses of the root name servers it
+// lists, in the order they appear. Only addresses of hosts named by NS
+// records for the root are returned.
+func ParseRootHints(r io.Reader) ([]netip.Addr, error) {
+	var (
+		hosts []string
+		addrs = make(map[string][]netip.Addr) // By lowercase host name.
+	)
+
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text, _, _ := strings.Cut(sc.Text(), ";")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		// The TTL and class between the name and type are optional.
+		i := 1
+		for i < len(fields)-1 && (isDigits(fields[i]) || strings.EqualFold(fields[i], "IN")) {
+			i++
+		}
+		if len(fields) != i+2 {
+			return nil, fmt.Errorf("root hints: line %d: malformed record", line)
+		}
+		name, typ, value := fields[0], strings.ToUpper(fields[i]), fields[i+1]
+
+		switch typ {
+		case "NS":
+			if equalNames(name, ".") {
+				hosts = append(hosts, strings.ToLower(trimDot(value)))
+			}
+		case "A", "AAAA":
+			addr, err := netip.ParseAddr(value)
+			if err != nil || addr.Is4() != (typ == "A") {
+				return nil, fmt.Errorf("root hints: line %d: invalid address %q", line, value)
+			}
+			key := strings.ToLower(trimDot(name))
+			addrs[key] = append(addrs[key], addr)
+		default:
+			return nil, fmt.Errorf("root hints: line %d: unexpected type %s", line, typ)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	var roots []netip.Addr
+	for _, host := range hosts {
+		roots = append(roots, addrs[host]...)
+	}
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("root hints: no root server addresses")
+	}
+	return roots, nil
+}
+
+// Prime sends a priming query (RFC 8109) for the root's NS records to the
+// root servers in r.Roots, or RootServers if it is empty, and from then on
+// uses the root servers in the response for ModeIterative. This keeps
+// iterative resolution working when the hints are out of date.
+func (r *Resolver) Prime() error {
+	return r.PrimeContext(context.Background())
+}
+
+// PrimeContext is like Prime, but honors ctx. The query is bounded by both
+// ctx and r.Timeout.
+func (r *Resolver) PrimeContext(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout())
+	defer cancel()
+
+	hints := r.Roots
+	if len(hints) == 0 {
+		hints = RootServers
+	}
+	response, err := r.queryServers(ctx, hints, ".", TypeNS)
+	if err != nil {
+		return err
+	}
+	if err := response.Err(); err != nil {
+		return err
+	}
+
+	var hosts []string
+	for _, rec := range response.Answers {
+		if ns, ok := rec.RData.(NS); ok && equalNames(string(rec.Name), ".") {
+			hosts = append(hosts, ns.Host)
+		}
+	}
+	roots := hostAddrs(response.Additionals, hosts)
+	if len(roots) == 0 {
+		return fmt.Errorf("priming response has no root server addresses")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.primed = roots
+	return nil
+}
@@ -0,0 +1,83 @@
+package resolve
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const testRootHints = `;       This file holds the information on root name servers needed to
+;       initialize cache of Internet domain name servers
+;
+; FORMERLY NS.INTERNIC.NET
+;
+.                        3600000      NS    A.ROOT-SERVERS.NET.
+A.ROOT-SERVERS.NET.      3600000      A     198.41.0.4
+A.ROOT-SERVERS.NET.      3600000      AAAA  2001:503:ba3e::2:30
+;
+; FORMERLY NS1.ISI.EDU
+;
+.                        3600000      NS    B.ROOT-SERVERS.NET.
+B.ROOT-SERVERS.NET.      3600000      A     170.247.170.2
+b.root-servers.net.      IN           AAAA  2801:1b8:10::b
+OTHER.EXAMPLE.           3600000      A     192.0.2.1
+; End of file`
+
+func TestParseRootHints(t *testing.T) {
+	got, err := ParseRootHints(strings.NewReader(testRootHints))
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	want := []netip.Addr{
+		netip.MustParseAddr("198.41.0.4"),
+		netip.MustParseAddr("2001:503:ba3e::2:30"),
+		netip.MustParseAddr("170.247.170.2"),
+		netip.MustParseAddr("2801:1b8:10::b"),
+	}
+	if diff := cmp.Diff(want, got, cmp.Comparer(func(a, b netip.Addr) bool { return a == b })); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+}
+
+func TestParseRootHints_Invalid(t *testing.T) {
+	for _, hints := range []string{
+		"",
+		"; Only comments.",
+		".  3600000  NS  A.ROOT-SERVERS.NET.\nA.ROOT-SERVERS.NET.  3600000  A  2001:db8::1",
+		".  3600000  NS  A.ROOT-SERVERS.NET.\nA.ROOT-SERVERS.NET.  3600000  A",
+		".  3600000  SOA  a.root-servers.net.",
+	} {
+		if _, err := ParseRootHints(strings.NewReader(hints)); err == nil {
+			t.Errorf("%q: no error", hints)
+		}
+	}
+}
+
+func TestResolver_Prime(t *testing.T) {
+	zones := map[string]zoneServer{
+		"127.0.0.1": { // Out of date: no longer a root server.
+			records: []Record{
+				{Name: []byte(""), Type: TypeNS, Class: ClassIN, TTL: 518400, RData: NS{Host: "a.root.test"}},
+			},
+			extra: []Record{a("a.root.test", "127.0.0.2")},
+		},
+		"127.0.0.2": {
+			records: []Record{a("www.example", "192.0.2.1")},
+		},
+	}
+	port := serveZones(t, zones, func(string, *Packet) {})
+
+	r := &Resolver{Mode: ModeIterative, Roots: []netip.Addr{netip.MustParseAddr("127.0.0.1")}, Port: port}
+	if err := r.Prime(); err != nil {
+		t.Fatalf("Prime: %v", err)
+	}
+	got, err := r.Lookup("www.example", TypeA)
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	if want := netip.MustParseAddr("192.0.2.1"); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
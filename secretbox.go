@@ -0,0 +1,96 @@
+package resolve
+
+import (
+	"crypto/subtle"
+	"errors"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/poly1305"
+	"golang.org/x/crypto/salsa20/salsa"
+)
+
+// This file implements the NaCl box construction with the XSalsa20 and
+// XChaCha20 stream ciphers, as used by DNSCrypt. The standard library has
+// neither.
+
+// boxOverhead is the number of bytes a sealed box adds to its message.
+const boxOverhead = secretbox.Overhead
+
+var errBoxOpen = errors.New("message authentication failed")
+
+// A boxCipher is a stream cipher with a 32-byte key and a 24-byte nonce.
+type boxCipher int
+
+const (
+	xsalsa20 boxCipher = iota + 1
+	xchacha20
+)
+
+// sharedKey derives the shared key of a box from the result of the X25519
+// key exchange, as NaCl's crypto_box_beforenm does.
+func (c boxCipher) sharedKey(dh []byte) [32]byte {
+	var key, out [32]byte
+	copy(key[:], dh)
+	var nonce [16]byte
+	if c == xsalsa20 {
+		salsa.HSalsa20(&out, &nonce, &key, &salsa.Sigma)
+		return out
+	}
+	// HChaCha20 only fails on bad key or nonce lengths.
+	k, _ := chacha20.HChaCha20(key[:], nonce[:])
+	copy(out[:], k)
+	return out
+}
+
+// xchacha20Stream returns the XChaCha20 key stream for key and nonce,
+// after taking the Poly1305 key from its first 32 bytes.
+func xchacha20Stream(key *[32]byte, nonce *[24]byte) (*chacha20.Cipher, [32]byte) {
+	// NewUnauthenticatedCipher only fails on bad key or nonce lengths.
+	s, _ := chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+	var polyKey [32]byte
+	s.XORKeyStream(polyKey[:], polyKey[:])
+	return s, polyKey
+}
+
+// seal appends the box of message to out. The box is the Poly1305 tag of
+// the ciphertext followed by the ciphertext. The first 32 bytes of the key
+// stream are the Poly1305 key, and the rest encrypt the message.
+func (c boxCipher) seal(out, message []byte, nonce *[24]byte, key *[32]byte) []byte {
+	if c == xsalsa20 {
+		return secretbox.Seal(out, message, nonce, key)
+	}
+	s, polyKey := xchacha20Stream(key, nonce)
+	ciphertext := make([]byte, len(message))
+	s.XORKeyStream(ciphertext, message)
+
+	var tag [poly1305.TagSize]byte
+	poly1305.Sum(&tag, ciphertext, &polyKey)
+	out = append(out, tag[:]...)
+	return append(out, ciphertext...)
+}
+
+// open authenticates and decrypts box, appending the message to out.
+func (c boxCipher) open(out, box []byte, nonce *[24]byte, key *[32]byte) ([]byte, error) {
+	if len(box) < boxOverhead {
+		return nil, errBoxOpen
+	}
+	if c == xsalsa20 {
+		out, ok := secretbox.Open(out, box, nonce, key)
+		if !ok {
+			return nil, errBoxOpen
+		}
+		return out, nil
+	}
+	ciphertext := box[boxOverhead:]
+
+	s, polyKey := xchacha20Stream(key, nonce)
+	var tag [poly1305.TagSize]byte
+	poly1305.Sum(&tag, ciphertext, &polyKey)
+	if subtle.ConstantTimeCompare(tag[:], box[:boxOverhead]) != 1 {
+		return nil, errBoxOpen
+	}
+	message := make([]byte, len(ciphertext))
+	s.XORKeyStream(message, ciphertext)
+	return append(out, message...), nil
+}
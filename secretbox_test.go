@@ -0,0 +1,88 @@
+package resolve
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestBoxCipher_SharedKey(t *testing.T) {
+	// The shared secret and the first key derived from it in "Cryptography
+	// in NaCl", section 7.
+	dh := mustHex(t, "4a5d9d5ba4ce2de1728e3bf480350f25e07e21c947d19e3376f09b3c1e161742")
+
+	got := xsalsa20.sharedKey(dh)
+	want := mustHex(t, "1b27556473e985d462cd51197a9a46c76009549eac6474f206c4ee0844f68389")
+	if !bytes.Equal(got[:], want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
+
+func TestBoxCipher_NaClBox(t *testing.T) {
+	// An XSalsa20 box is a NaCl crypto_box.
+	alice, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dh, err := alice.ECDH(bob.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		t.Fatal(err)
+	}
+	msg := bytes.Repeat([]byte("secret"), 30)
+
+	var alicePriv, bobPub [32]byte
+	copy(alicePriv[:], alice.Bytes())
+	copy(bobPub[:], bob.PublicKey().Bytes())
+	want := box.Seal(nil, msg, &nonce, &bobPub, &alicePriv)
+
+	key := xsalsa20.sharedKey(dh)
+	if got := xsalsa20.seal(nil, msg, &nonce, &key); !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
+
+func TestBox(t *testing.T) {
+	var key [32]byte
+	var nonce [24]byte
+	for i := range key {
+		key[i] = byte(i)
+	}
+	msg := bytes.Repeat([]byte("secret"), 30)
+
+	for _, c := range []boxCipher{xsalsa20, xchacha20} {
+		box := c.seal(nil, msg, &nonce, &key)
+		if len(box) != len(msg)+boxOverhead {
+			t.Errorf("cipher %d: box is %d bytes, want %d", c, len(box), len(msg)+boxOverhead)
+		}
+		got, err := c.open(nil, box, &nonce, &key)
+		if err != nil || !bytes.Equal(got, msg) {
+			t.Errorf("cipher %d: open: got %q, %v", c, got, err)
+		}
+
+		box[len(box)-1] ^= 1
+		if _, err := c.open(nil, box, &nonce, &key); err == nil {
+			t.Errorf("cipher %d: tampered box: want error", c)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package resolve
+
+import (
+	"context"
+	"time"
+)
+
+// A flight is a query to the upstream server in progress, which concurrent
+// queries with the same question wait for rather than sending their own.
+type flight struct {
+	done     chan struct{} // Closed when the query is done.
+	response *Packet
+	err      error
+	canceled bool // The context of the query was done.
+}
+
+// sharedQuery is like query, but shares a query in progress for the same
+// question if there is one. Each caller gets its own copy of the response.
+// If the shared query is abandoned because the context of the caller that
+// sent it is done, the others send the query again.
+func (r *Resolver) sharedQuery(ctx context.Context, domain string, t Type, class Class) (*Packet, error) {
+	key := newCacheKey(domain, t, class)
+	for {
+		r.mu.Lock()
+		f, ok := r.flights[key]
+		if !ok {
+			break // Still holding r.mu.
+		}
+		r.mu.Unlock()
+
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if f.canceled && ctx.Err() == nil {
+			continue
+		}
+		if f.err != nil {
+			return nil, f.err
+		}
+		return agePacket(f.response, 0), nil
+	}
+
+	f := &flight{done: make(chan struct{})}
+	if r.flights == nil {
+		r.flights = make(map[CacheKey]*flight)
+	}
+	r.flights[key] = f
+	r.mu.Unlock()
+
+	f.response, f.err = r.query(ctx, domain, t, class)
+	// I/O deadlines taken from ctx can pass just before ctx is done.
+	deadline, ok := ctx.Deadline()
+	f.canceled = ctx.Err() != nil || ok && !time.Now().Before(deadline)
+
+	r.mu.Lock()
+	delete(r.flights, key)
+	r.mu.Unlock()
+	close(f.done)
+
+	if f.err != nil {
+		return nil, f.err
+	}
+	return agePacket(f.response, 0), nil
+}
@@ -0,0 +1,107 @@
+package resolve
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResolver_SharedQuery(t *testing.T) {
+	var queries atomic.Int32
+	r := serveUDP(t, handle(func(q *Packet) *Packet {
+		queries.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		return &Packet{Answers: []Record{a("www.example", "192.0.2.1")}}
+	}))
+
+	var wg sync.WaitGroup
+	responses := make([]*Packet, 10)
+	for i := range responses {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p, err := r.Query("www.example", TypeA)
+			if err != nil {
+				t.Errorf("error: %v", err)
+				return
+			}
+			responses[i] = p
+		}()
+	}
+	wg.Wait()
+
+	if n := queries.Load(); n != 1 {
+		t.Errorf("%d queries upstream, want 1", n)
+	}
+	for i, p := range responses {
+		for _, q := range responses[:i] {
+			if p != nil && q != nil && &p.Answers[0] == &q.Answers[0] {
+				t.Fatal("callers share a response")
+			}
+		}
+	}
+}
+
+func TestResolver_SharedQuery_Class(t *testing.T) {
+	// Queries for the same name and type in different classes aren't
+	// shared.
+	var queries atomic.Int32
+	r := serveUDP(t, handle(func(q *Packet) *Packet {
+		queries.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		return &Packet{}
+	}))
+
+	var wg sync.WaitGroup
+	for _, class := range []Class{ClassIN, ClassCH} {
+		class := class
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p, err := r.QueryClass("version.bind", TypeTXT, class)
+			if err != nil {
+				t.Errorf("%s: error: %v", class, err)
+				return
+			}
+			if got := p.Questions[0].Class; got != class {
+				t.Errorf("%s: response for class %s", class, got)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := queries.Load(); n != 2 {
+		t.Errorf("%d queries upstream, want 2", n)
+	}
+}
+
+func TestResolver_SharedQueryCanceled(t *testing.T) {
+	var queries atomic.Int32
+	r := serveUDP(t, handle(func(q *Packet) *Packet {
+		queries.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		return &Packet{Answers: []Record{a("www.example", "192.0.2.1")}}
+	}))
+
+	// The first caller gives up, but the second still gets an answer.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := r.QueryContext(ctx, "www.example", TypeA)
+		errc <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if _, err := r.Query("www.example", TypeA); err != nil {
+		t.Errorf("second caller: error: %v", err)
+	}
+	if err := <-errc; err == nil {
+		t.Error("first caller: no error")
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("%d queries upstream, want 2", n)
+	}
+}
@@ -0,0 +1,82 @@
+package resolve
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"strings"
+)
+
+// SSHFP algorithms (RFC 4255, RFC 6594, RFC 7479, RFC 8709).
+const (
+	SSHFPAlgorithmRSA     uint8 = 1
+	SSHFPAlgorithmDSA     uint8 = 2
+	SSHFPAlgorithmECDSA   uint8 = 3
+	SSHFPAlgorithmEd25519 uint8 = 4
+	SSHFPAlgorithmEd448   uint8 = 6
+)
+
+// SSHFP fingerprint types (RFC 4255, RFC 6594).
+const (
+	SSHFPTypeSHA1   uint8 = 1
+	SSHFPTypeSHA256 uint8 = 2
+)
+
+// Match reports whether key matches s. key is an SSH public key in wire
+// format (RFC 4253, section 6.6), such as the output of
+// golang.org/x/crypto/ssh.PublicKey.Marshal.
+func (s SSHFP) Match(key []byte) bool {
+	if alg, ok := sshKeyAlgorithm(key); !ok || alg != s.Algorithm {
+		return false
+	}
+
+	switch s.FPType {
+	case SSHFPTypeSHA1:
+		sum := sha1.Sum(key)
+		return bytes.Equal(sum[:], s.Fingerprint)
+	case SSHFPTypeSHA256:
+		sum := sha256.Sum256(key)
+		return bytes.Equal(sum[:], s.Fingerprint)
+	default:
+		return false
+	}
+}
+
+// MatchSSHFP reports whether key matches any of the records in rrset. See
+// SSHFP.Match for the format of key.
+func MatchSSHFP(rrset []SSHFP, key []byte) bool {
+	for _, s := range rrset {
+		if s.Match(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// sshKeyAlgorithm returns the SSHFP algorithm for the key type named at the
+// start of key.
+func sshKeyAlgorithm(key []byte) (uint8, bool) {
+	if len(key) < 4 {
+		return 0, false
+	}
+	n := binary.BigEndian.Uint32(key)
+	if uint32(len(key)-4) < n {
+		return 0, false
+	}
+
+	switch name := string(key[4 : 4+n]); {
+	case name == "ssh-rsa":
+		return SSHFPAlgorithmRSA, true
+	case name == "ssh-dss":
+		return SSHFPAlgorithmDSA, true
+	case strings.HasPrefix(name, "ecdsa-sha2-"):
+		return SSHFPAlgorithmECDSA, true
+	case name == "ssh-ed25519":
+		return SSHFPAlgorithmEd25519, true
+	case name == "ssh-ed448":
+		return SSHFPAlgorithmEd448, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,47 @@
+package resolve
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"testing"
+)
+
+// ed25519Key is an ssh-ed25519 public key in wire format.
+var ed25519Key = append([]byte("\x00\x00\x00\x0bssh-ed25519\x00\x00\x00\x20"), make([]byte, 32)...)
+
+func TestSSHFP_Match(t *testing.T) {
+	sha1Sum := sha1.Sum(ed25519Key)
+	sha256Sum := sha256.Sum256(ed25519Key)
+
+	tests := []struct {
+		sshfp SSHFP
+		key   []byte
+		want  bool
+	}{
+		{SSHFP{SSHFPAlgorithmEd25519, SSHFPTypeSHA256, sha256Sum[:]}, ed25519Key, true},
+		{SSHFP{SSHFPAlgorithmEd25519, SSHFPTypeSHA1, sha1Sum[:]}, ed25519Key, true},
+		{SSHFP{SSHFPAlgorithmRSA, SSHFPTypeSHA256, sha256Sum[:]}, ed25519Key, false},
+		{SSHFP{SSHFPAlgorithmEd25519, SSHFPTypeSHA1, sha256Sum[:]}, ed25519Key, false},
+		{SSHFP{SSHFPAlgorithmEd25519, 9, sha256Sum[:]}, ed25519Key, false},
+		{SSHFP{SSHFPAlgorithmEd25519, SSHFPTypeSHA256, sha256Sum[:]}, ed25519Key[:10], false},
+	}
+	for _, tt := range tests {
+		if got := tt.sshfp.Match(tt.key); got != tt.want {
+			t.Errorf("%s: got %t, want %t", tt.sshfp, got, tt.want)
+		}
+	}
+}
+
+func TestMatchSSHFP(t *testing.T) {
+	sum := sha256.Sum256(ed25519Key)
+	rrset := []SSHFP{
+		{SSHFPAlgorithmRSA, SSHFPTypeSHA256, make([]byte, 32)},
+		{SSHFPAlgorithmEd25519, SSHFPTypeSHA256, sum[:]},
+	}
+	if !MatchSSHFP(rrset, ed25519Key) {
+		t.Error("got false, want true")
+	}
+	if MatchSSHFP(rrset[:1], ed25519Key) {
+		t.Error("got true, want false")
+	}
+}
@@ -0,0 +1,320 @@
+package resolve
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// StampProps are the informal properties a DNS stamp declares about a
+// server.
+type StampProps uint64
+
+// Stamp properties.
+const (
+	StampDNSSEC   StampProps = 1 << 0 // The server validates DNSSEC.
+	StampNoLog    StampProps = 1 << 1 // The server doesn't keep logs.
+	StampNoFilter StampProps = 1 << 2 // The server doesn't filter answers.
+)
+
+// Protocol identifiers in DNS stamps.
+const (
+	stampPlain    = 0x00
+	stampDNSCrypt = 0x01
+	stampDoH      = 0x02
+	stampDoT      = 0x03
+	stampDoQ      = 0x04
+	stampODoH     = 0x05
+)
+
+// A Stamp is a DNS stamp, which describes a DNS server and how to reach it
+// in one "sdns://" string. See https://dnscrypt.info/stamps-specifications.
+type Stamp struct {
+	// Protocol is one of ProtocolUDP, ProtocolDNSCrypt, ProtocolDoH,
+	// ProtocolDoT, ProtocolDoQ and ProtocolODoH.
+	Protocol Protocol
+	Props    StampProps
+
+	// Addr is the server's IP address, with an optional port. It may be
+	// empty for DoH, DoT and DoQ, in which case Host is resolved instead.
+	Addr string
+
+	// ProviderKey and ProviderName identify a DNSCrypt provider.
+	ProviderKey  ed25519.PublicKey
+	ProviderName string
+
+	// Host is the server's TLS host name, and Path the URL path for DoH
+	// and ODoH.
+	Host string
+	Path string
+
+	// Hashes are SHA-256 hashes of the TBSCertificate of certificates in
+	// the server's chain, for DoH, DoT and DoQ.
+	Hashes [][]byte
+
+	// Bootstrap are IP addresses of resolvers to use to resolve Host.
+	Bootstrap []string
+}
+
+// ParseStamp parses a DNS stamp. Relay stamps are not supported.
+func ParseStamp(s string) (Stamp, error) {
+	rest, ok := strings.CutPrefix(s, "sdns://")
+	if !ok {
+		return Stamp{}, fmt.Errorf("stamp does not start with sdns://")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(rest)
+	if err != nil {
+		return Stamp{}, fmt.Errorf("stamp: %w", err)
+	}
+	if len(b) < 1 {
+		return Stamp{}, fmt.Errorf("empty stamp")
+	}
+
+	d := stampDecoder{b: b[1:]}
+	var st Stamp
+	switch b[0] {
+	case stampPlain:
+		st.Protocol = ProtocolUDP
+		st.Props = d.props()
+		st.Addr = d.string()
+	case stampDNSCrypt:
+		st.Protocol = ProtocolDNSCrypt
+		st.Props = d.props()
+		st.Addr = d.string()
+		st.ProviderKey = d.bytes()
+		st.ProviderName = d.string()
+		if d.err == nil && len(st.ProviderKey) != ed25519.PublicKeySize {
+			return Stamp{}, fmt.Errorf("stamp: provider key is %d bytes, want %d", len(st.ProviderKey), ed25519.PublicKeySize)
+		}
+	case stampDoH, stampDoT, stampDoQ:
+		st.Protocol = map[byte]Protocol{stampDoH: ProtocolDoH, stampDoT: ProtocolDoT, stampDoQ: ProtocolDoQ}[b[0]]
+		st.Props = d.props()
+		st.Addr = d.string()
+		st.Hashes = d.vector()
+		st.Host = d.string()
+		if b[0] == stampDoH {
+			st.Path = d.string()
+		}
+		st.Bootstrap = d.bootstrap()
+	case stampODoH:
+		st.Protocol = ProtocolODoH
+		st.Props = d.props()
+		st.Host = d.string()
+		st.Path = d.string()
+		st.Bootstrap = d.bootstrap()
+	default:
+		return Stamp{}, fmt.Errorf("unsupported stamp protocol 0x%02x", b[0])
+	}
+	if d.err != nil {
+		return Stamp{}, d.err
+	}
+	if len(d.b) != 0 {
+		return Stamp{}, fmt.Errorf("stamp: %d trailing bytes", len(d.b))
+	}
+	return st, nil
+}
+
+// String returns st encoded as a DNS stamp.
+func (st Stamp) String() string {
+	var b []byte
+	lp := func(s []byte) { b = append(append(b, byte(len(s))), s...) }
+	vlp := func(ss [][]byte) {
+		if len(ss) == 0 {
+			b = append(b, 0)
+			return
+		}
+		for i, s := range ss {
+			n := byte(len(s))
+			if i < len(ss)-1 {
+				n |= 0x80
+			}
+			b = append(append(b, n), s...)
+		}
+	}
+	props := func() { b = binary.LittleEndian.AppendUint64(b, uint64(st.Props)) }
+	var bootstrap [][]byte
+	for _, s := range st.Bootstrap {
+		bootstrap = append(bootstrap, []byte(s))
+	}
+
+	switch st.Protocol {
+	case ProtocolUDP:
+		b = append(b, stampPlain)
+		props()
+		lp([]byte(st.Addr))
+	case ProtocolDNSCrypt:
+		b = append(b, stampDNSCrypt)
+		props()
+		lp([]byte(st.Addr))
+		lp(st.ProviderKey)
+		lp([]byte(st.ProviderName))
+	case ProtocolDoH, ProtocolDoT, ProtocolDoQ:
+		b = append(b, map[Protocol]byte{ProtocolDoH: stampDoH, ProtocolDoT: stampDoT, ProtocolDoQ: stampDoQ}[st.Protocol])
+		props()
+		lp([]byte(st.Addr))
+		vlp(st.Hashes)
+		lp([]byte(st.Host))
+		if st.Protocol == ProtocolDoH {
+			lp([]byte(st.Path))
+		}
+		if len(bootstrap) > 0 {
+			vlp(bootstrap)
+		}
+	case ProtocolODoH:
+		b = append(b, stampODoH)
+		props()
+		lp([]byte(st.Host))
+		lp([]byte(st.Path))
+		if len(bootstrap) > 0 {
+			vlp(bootstrap)
+		}
+	default:
+		return fmt.Sprintf("Stamp(%s)", st.Protocol)
+	}
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Resolver returns a Resolver that uses the server described by st. The
+// stamp's certificate hashes and bootstrap resolvers are not used: TLS
+// certificates are verified as usual. An ODoH stamp describes only the
+// target, so the Resolver's URL must be set to a proxy before use, and a
+// DoQ Resolver needs DialQUIC.
+func (st Stamp) Resolver() (*Resolver, error) {
+	r := &Resolver{Protocol: st.Protocol}
+
+	var addr netip.AddrPort
+	if st.Addr != "" {
+		var err error
+		addr, err = parseStampAddr(st.Addr, st.Protocol.defaultPort())
+		if err != nil {
+			return nil, err
+		}
+		r.Server = addr.Addr().String()
+		r.Port = int(addr.Port())
+	}
+
+	switch st.Protocol {
+	case ProtocolUDP:
+	case ProtocolDNSCrypt:
+		r.ProviderName = st.ProviderName
+		r.ProviderKey = st.ProviderKey
+	case ProtocolDoT, ProtocolDoQ:
+		r.ServerName = st.Host
+		if st.Addr == "" {
+			r.Server = st.Host
+		}
+	case ProtocolDoH:
+		r.URL = "https://" + st.Host + st.Path
+		if st.Addr != "" {
+			// Connect to the stamp's address rather than resolving Host.
+			t := http.DefaultTransport.(*http.Transport).Clone()
+			t.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, net.JoinHostPort(addr.Addr().String(), strconv.Itoa(int(addr.Port()))))
+			}
+			r.HTTPClient = &http.Client{Transport: t}
+			r.Server, r.Port = "", 0
+		}
+	case ProtocolODoH:
+		r.ODoHTarget = "https://" + st.Host + st.Path
+	default:
+		return nil, fmt.Errorf("unsupported stamp protocol %s", st.Protocol)
+	}
+	return r, nil
+}
+
+// parseStampAddr parses an IP address with an optional port, as found in
+// stamps. IPv6 addresses are in brackets.
+func parseStampAddr(s string, defaultPort int) (netip.AddrPort, error) {
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap, nil
+	}
+	a, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("stamp: invalid address %q", s)
+	}
+	return netip.AddrPortFrom(a, uint16(defaultPort)), nil
+}
+
+// stampDecoder reads the fields of a stamp, remembering the first error.
+type stampDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *stampDecoder) fail() {
+	if d.err == nil {
+		d.err = fmt.Errorf("stamp: truncated")
+	}
+	d.b = nil
+}
+
+func (d *stampDecoder) props() StampProps {
+	if len(d.b) < 8 {
+		d.fail()
+		return 0
+	}
+	p := StampProps(binary.LittleEndian.Uint64(d.b))
+	d.b = d.b[8:]
+	return p
+}
+
+func (d *stampDecoder) bytes() []byte {
+	if len(d.b) < 1 || len(d.b) < 1+int(d.b[0]) {
+		d.fail()
+		return nil
+	}
+	n := int(d.b[0])
+	v := d.b[1 : 1+n]
+	d.b = d.b[1+n:]
+	if n == 0 {
+		return nil
+	}
+	return append([]byte(nil), v...)
+}
+
+func (d *stampDecoder) string() string { return string(d.bytes()) }
+
+// vector reads a VLP-encoded set of byte strings, in which each length but
+// the last has its high bit set.
+func (d *stampDecoder) vector() [][]byte {
+	var out [][]byte
+	for {
+		if len(d.b) < 1 {
+			d.fail()
+			return nil
+		}
+		more := d.b[0]&0x80 != 0
+		n := int(d.b[0] &^ 0x80)
+		if len(d.b) < 1+n {
+			d.fail()
+			return nil
+		}
+		if n > 0 {
+			out = append(out, append([]byte(nil), d.b[1:1+n]...))
+		}
+		d.b = d.b[1+n:]
+		if !more {
+			return out
+		}
+	}
+}
+
+// bootstrap reads the optional trailing set of bootstrap resolvers.
+func (d *stampDecoder) bootstrap() []string {
+	if len(d.b) == 0 {
+		return nil
+	}
+	var out []string
+	for _, v := range d.vector() {
+		out = append(out, string(v))
+	}
+	return out
+}
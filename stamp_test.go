@@ -0,0 +1,117 @@
+package resolve
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestParseStamp(t *testing.T) {
+	// Cloudflare's DoH stamp from the public resolvers list.
+	got, err := ParseStamp("sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJlLmNvbQovZG5zLXF1ZXJ5")
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	want := Stamp{
+		Protocol: ProtocolDoH,
+		Props:    StampDNSSEC | StampNoLog | StampNoFilter,
+		Addr:     "1.0.0.1",
+		Host:     "dns.cloudflare.com",
+		Path:     "/dns-query",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+}
+
+func TestStamp_RoundTrip(t *testing.T) {
+	key := ed25519.PublicKey(bytes.Repeat([]byte{0xab}, ed25519.PublicKeySize))
+	stamps := []Stamp{
+		{Protocol: ProtocolUDP, Addr: "192.0.2.53"},
+		{Protocol: ProtocolDNSCrypt, Props: StampDNSSEC, Addr: "192.0.2.53:8443", ProviderKey: key, ProviderName: "2.dnscrypt-cert.example.com"},
+		{Protocol: ProtocolDoH, Addr: "[2001:db8::53]", Hashes: [][]byte{bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)}, Host: "doh.example.com", Path: "/dns-query", Bootstrap: []string{"192.0.2.1", "192.0.2.2"}},
+		{Protocol: ProtocolDoT, Host: "dot.example.com"},
+		{Protocol: ProtocolDoQ, Addr: "192.0.2.53", Host: "doq.example.com"},
+		{Protocol: ProtocolODoH, Props: StampNoLog, Host: "odoh.example.com", Path: "/dns-query"},
+	}
+	for _, want := range stamps {
+		s := want.String()
+		got, err := ParseStamp(s)
+		if err != nil {
+			t.Errorf("%s: error: %v", want.Protocol, err)
+			continue
+		}
+		if diff := cmp.Diff(want, got, cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("%s: (-want, +got):\n%s", want.Protocol, diff)
+		}
+	}
+}
+
+func TestParseStamp_Invalid(t *testing.T) {
+	invalid := []string{
+		"https://example.com",
+		"sdns://",
+		"sdns://not base64!",
+		"sdns://AA",                      // Truncated props.
+		"sdns://gQAAAAAAAAAAAA",          // Relay.
+		"sdns://AAAAAAAAAAAACjE5Mi4wLjI", // Truncated address.
+	}
+	for _, s := range invalid {
+		if _, err := ParseStamp(s); err == nil {
+			t.Errorf("%q: want error", s)
+		}
+	}
+}
+
+func TestStamp_Resolver(t *testing.T) {
+	tests := []struct {
+		stamp Stamp
+		check func(r *Resolver) bool
+	}{
+		{
+			Stamp{Protocol: ProtocolUDP, Addr: "192.0.2.53"},
+			func(r *Resolver) bool { return r.address() == "192.0.2.53:53" },
+		},
+		{
+			Stamp{Protocol: ProtocolDoT, Addr: "[2001:db8::53]:8853", Host: "dot.example.com"},
+			func(r *Resolver) bool {
+				return r.address() == "[2001:db8::53]:8853" && r.ServerName == "dot.example.com"
+			},
+		},
+		{
+			Stamp{Protocol: ProtocolDoT, Host: "dot.example.com"},
+			func(r *Resolver) bool { return r.address() == "dot.example.com:853" },
+		},
+		{
+			Stamp{Protocol: ProtocolDoH, Host: "doh.example.com", Path: "/dns-query"},
+			func(r *Resolver) bool { return r.url() == "https://doh.example.com/dns-query" && r.HTTPClient == nil },
+		},
+		{
+			Stamp{Protocol: ProtocolDoH, Addr: "192.0.2.53", Host: "doh.example.com", Path: "/q"},
+			func(r *Resolver) bool { return r.url() == "https://doh.example.com/q" && r.HTTPClient != nil },
+		},
+		{
+			Stamp{Protocol: ProtocolDNSCrypt, Addr: "192.0.2.53", ProviderName: "2.dnscrypt-cert.example.com"},
+			func(r *Resolver) bool {
+				return r.address() == "192.0.2.53:443" && r.ProviderName == "2.dnscrypt-cert.example.com"
+			},
+		},
+	}
+	for _, tt := range tests {
+		r, err := tt.stamp.Resolver()
+		if err != nil {
+			t.Errorf("%v: error: %v", tt.stamp, err)
+			continue
+		}
+		if !tt.check(r) {
+			t.Errorf("%v: got %+v", tt.stamp, r)
+		}
+	}
+
+	if _, err := (Stamp{Protocol: ProtocolUDP, Addr: "not an address"}).Resolver(); err == nil {
+		t.Error("invalid address: want error")
+	}
+}
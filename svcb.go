@@ -0,0 +1,270 @@
+package resolve
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// A SvcParamKey identifies a service parameter of an SVCB or HTTPS record.
+type SvcParamKey uint16
+
+// Service parameter keys (RFC 9460, section 14.3.2).
+const (
+	SvcParamMandatory     SvcParamKey = 0
+	SvcParamALPN          SvcParamKey = 1
+	SvcParamNoDefaultALPN SvcParamKey = 2
+	SvcParamPort          SvcParamKey = 3
+	SvcParamIPv4Hint      SvcParamKey = 4
+	SvcParamECH           SvcParamKey = 5
+	SvcParamIPv6Hint      SvcParamKey = 6
+)
+
+var svcParamKeyNames = map[SvcParamKey]string{
+	SvcParamMandatory:     "mandatory",
+	SvcParamALPN:          "alpn",
+	SvcParamNoDefaultALPN: "no-default-alpn",
+	SvcParamPort:          "port",
+	SvcParamIPv4Hint:      "ipv4hint",
+	SvcParamECH:           "ech",
+	SvcParamIPv6Hint:      "ipv6hint",
+}
+
+// String returns the presentation name of k, or the generic keyNNNNN form
+// if it has none.
+func (k SvcParamKey) String() string {
+	if s, ok := svcParamKeyNames[k]; ok {
+		return s
+	}
+	return fmt.Sprintf("key%d", uint16(k))
+}
+
+// SvcParam is a service parameter of an SVCB or HTTPS record. Value is in
+// wire format.
+type SvcParam struct {
+	Key   SvcParamKey
+	Value []byte
+}
+
+// SVCB is the data of an SVCB record (RFC 9460). A Priority of 0 makes the
+// record an alias for Target, and such records have no parameters.
+type SVCB struct {
+	Priority uint16
+	Target   string     // "" is the root name, which has a special meaning here (RFC 9460, section 2.5).
+	Params   []SvcParam // In increasing order of key.
+}
+
+// ParseSVCB parses the data of an SVCB record.
+func ParseSVCB(data []byte) (SVCB, error) {
+	var s SVCB
+
+	if len(data) < 3 {
+		return s, fmt.Errorf("svcb too short: %d bytes", len(data))
+	}
+	s.Priority = binary.BigEndian.Uint16(data)
+
+	name, end, err := parseName(data, 2, maxNameLen)
+	if err != nil {
+		return s, err
+	}
+	s.Target = string(name)
+
+	params := data[end:]
+	for len(params) > 0 {
+		if len(params) < 4 {
+			return s, fmt.Errorf("svcb: truncated parameter")
+		}
+		key := SvcParamKey(binary.BigEndian.Uint16(params))
+		n := int(binary.BigEndian.Uint16(params[2:]))
+		if len(params) < 4+n {
+			return s, fmt.Errorf("svcb: %s value overruns data: need %d bytes, have %d", key, n, len(params)-4)
+		}
+		s.Params = append(s.Params, SvcParam{Key: key, Value: params[4 : 4+n]})
+		params = params[4+n:]
+	}
+
+	if err := s.check(); err != nil {
+		return SVCB{}, err
+	}
+	return s, nil
+}
+
+// check reports whether the parameters are in strictly increasing order of
+// key and have well-formed values.
+func (s SVCB) check() error {
+	for i, p := range s.Params {
+		if i > 0 && p.Key <= s.Params[i-1].Key {
+			return fmt.Errorf("svcb: parameter %s out of order", p.Key)
+		}
+		if len(p.Value) > 65535 {
+			return fmt.Errorf("svcb: %s value too long: %d bytes", p.Key, len(p.Value))
+		}
+		if !wellFormed(p) {
+			return fmt.Errorf("svcb: malformed %s value", p.Key)
+		}
+	}
+	return nil
+}
+
+// wellFormed reports whether p's value has the format required by its key.
+// Values of unknown keys are always well-formed.
+func wellFormed(p SvcParam) bool {
+	switch p.Key {
+	case SvcParamMandatory:
+		return len(p.Value) > 0 && len(p.Value)%2 == 0
+	case SvcParamALPN:
+		ss, err := parseCharacterStrings(p.Value)
+		return err == nil && len(ss) > 0
+	case SvcParamNoDefaultALPN:
+		return len(p.Value) == 0
+	case SvcParamPort:
+		return len(p.Value) == 2
+	case SvcParamIPv4Hint:
+		return len(p.Value) > 0 && len(p.Value)%4 == 0
+	case SvcParamIPv6Hint:
+		return len(p.Value) > 0 && len(p.Value)%16 == 0
+	default:
+		return true
+	}
+}
+
+// Param returns the value of the parameter with key k.
+func (s SVCB) Param(k SvcParamKey) ([]byte, bool) {
+	for _, p := range s.Params {
+		if p.Key == k {
+			return p.Value, true
+		}
+	}
+	return nil, false
+}
+
+// ALPN returns the protocol IDs in the alpn parameter.
+func (s SVCB) ALPN() []string {
+	v, _ := s.Param(SvcParamALPN)
+	ss, _ := parseCharacterStrings(v)
+	return ss
+}
+
+// Port returns the value of the port parameter.
+func (s SVCB) Port() (uint16, bool) {
+	v, ok := s.Param(SvcParamPort)
+	if !ok || len(v) != 2 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(v), true
+}
+
+// IPv4Hint returns the addresses in the ipv4hint parameter.
+func (s SVCB) IPv4Hint() []netip.Addr {
+	v, _ := s.Param(SvcParamIPv4Hint)
+	return splitAddrs(v, 4)
+}
+
+// IPv6Hint returns the addresses in the ipv6hint parameter.
+func (s SVCB) IPv6Hint() []netip.Addr {
+	v, _ := s.Param(SvcParamIPv6Hint)
+	return splitAddrs(v, 16)
+}
+
+// ECH returns the ECHConfigList in the ech parameter.
+func (s SVCB) ECH() []byte {
+	v, _ := s.Param(SvcParamECH)
+	return v
+}
+
+// splitAddrs splits b into addresses of size bytes each, ignoring any
+// remainder.
+func splitAddrs(b []byte, size int) []netip.Addr {
+	var addrs []netip.Addr
+	for ; len(b) >= size; b = b[size:] {
+		addr, _ := netip.AddrFromSlice(b[:size])
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+func (s SVCB) Type() Type { return TypeSVCB }
+
+func (s SVCB) pack(b []byte, c *compressor) ([]byte, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	b = binary.BigEndian.AppendUint16(b, s.Priority)
+	b, err := appendName(b, s.Target, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range s.Params {
+		b = binary.BigEndian.AppendUint16(b, uint16(p.Key))
+		b = binary.BigEndian.AppendUint16(b, uint16(len(p.Value)))
+		b = append(b, p.Value...)
+	}
+	return b, nil
+}
+
+// String returns s in presentation format.
+func (s SVCB) String() string {
+	parts := []string{strconv.Itoa(int(s.Priority)), fqdn(s.Target)}
+	for _, p := range s.Params {
+		parts = append(parts, formatSvcParam(p))
+	}
+	return strings.Join(parts, " ")
+}
+
+// formatSvcParam returns p in presentation format. Malformed values are
+// shown in the generic form used for unknown keys.
+func formatSvcParam(p SvcParam) string {
+	key := p.Key
+	if !wellFormed(p) {
+		key = 0xffff // Reserved, so never given a specific format.
+	}
+
+	var value string
+	switch key {
+	case SvcParamMandatory:
+		var keys []string
+		for v := p.Value; len(v) >= 2; v = v[2:] {
+			keys = append(keys, SvcParamKey(binary.BigEndian.Uint16(v)).String())
+		}
+		value = strings.Join(keys, ",")
+	case SvcParamALPN:
+		ss, _ := parseCharacterStrings(p.Value)
+		value = strings.Join(ss, ",")
+	case SvcParamNoDefaultALPN:
+		return p.Key.String()
+	case SvcParamPort:
+		value = strconv.Itoa(int(binary.BigEndian.Uint16(p.Value)))
+	case SvcParamIPv4Hint, SvcParamIPv6Hint:
+		size := 4
+		if p.Key == SvcParamIPv6Hint {
+			size = 16
+		}
+		var addrs []string
+		for _, addr := range splitAddrs(p.Value, size) {
+			addrs = append(addrs, addr.String())
+		}
+		value = strings.Join(addrs, ",")
+	case SvcParamECH:
+		value = base64.StdEncoding.EncodeToString(p.Value)
+	default:
+		value = quoteCharacterString(string(p.Value))
+	}
+	return p.Key.String() + "=" + value
+}
+
+// HTTPS is the data of an HTTPS record, which has the same format as an
+// SVCB record (RFC 9460, section 9).
+type HTTPS struct {
+	SVCB
+}
+
+// ParseHTTPS parses the data of an HTTPS record.
+func ParseHTTPS(data []byte) (HTTPS, error) {
+	s, err := ParseSVCB(data)
+	return HTTPS{s}, err
+}
+
+func (h HTTPS) Type() Type { return TypeHTTPS }
@@ -0,0 +1,111 @@
+package resolve
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+// httpsData is the data of an HTTPS record for example.com, with alpn,
+// port, ipv4hint and ipv6hint parameters.
+var httpsData = []byte("\x00\x01\x00" +
+	"\x00\x01\x00\x06\x02h2\x02h3" +
+	"\x00\x03\x00\x02\x01\xbb" +
+	"\x00\x04\x00\x04\xc0\x00\x02\x01" +
+	"\x00\x06\x00\x10\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01")
+
+func TestParseHTTPS(t *testing.T) {
+	got, err := ParseHTTPS(httpsData)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	want := HTTPS{SVCB{
+		Priority: 1,
+		Params: []SvcParam{
+			{Key: SvcParamALPN, Value: []byte("\x02h2\x02h3")},
+			{Key: SvcParamPort, Value: []byte{0x01, 0xbb}},
+			{Key: SvcParamIPv4Hint, Value: []byte{192, 0, 2, 1}},
+			{Key: SvcParamIPv6Hint, Value: netip.MustParseAddr("2001:db8::1").AsSlice()},
+		},
+	}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("(-want, +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff([]string{"h2", "h3"}, got.ALPN()); diff != "" {
+		t.Errorf("ALPN (-want, +got):\n%s", diff)
+	}
+	if port, ok := got.Port(); !ok || port != 443 {
+		t.Errorf("Port: got %d, %t, want 443, true", port, ok)
+	}
+	if diff := cmp.Diff([]netip.Addr{netip.MustParseAddr("192.0.2.1")}, got.IPv4Hint(), cmpAddr); diff != "" {
+		t.Errorf("IPv4Hint (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]netip.Addr{netip.MustParseAddr("2001:db8::1")}, got.IPv6Hint(), cmpAddr); diff != "" {
+		t.Errorf("IPv6Hint (-want, +got):\n%s", diff)
+	}
+	if ech := got.ECH(); ech != nil {
+		t.Errorf("ECH: got %x, want nil", ech)
+	}
+
+	wantString := "1 . alpn=h2,h3 port=443 ipv4hint=192.0.2.1 ipv6hint=2001:db8::1"
+	if s := got.String(); s != wantString {
+		t.Errorf("String: got %q, want %q", s, wantString)
+	}
+}
+
+func TestParseSVCB_Invalid(t *testing.T) {
+	invalid := []string{
+		"\x00\x01",
+		"\x00\x01\x00\x00\x03",                 // Truncated parameter.
+		"\x00\x01\x00\x00\x03\x00\x03\x01\xbb", // Value overruns data.
+		"\x00\x01\x00\x00\x03\x00\x01\x01",     // Short port.
+		"\x00\x01\x00\x00\x03\x00\x02\x01\xbb\x00\x01\x00\x03\x02h2", // Keys out of order.
+		"\x00\x01\x00\x00\x02\x00\x01\x00",                           // no-default-alpn with a value.
+	}
+	for _, in := range invalid {
+		if _, err := ParseSVCB([]byte(in)); err == nil {
+			t.Errorf("%q: want error", in)
+		}
+	}
+}
+
+func TestSVCB_MarshalBinary_RoundTrip(t *testing.T) {
+	rdatas := []RData{
+		SVCB{Priority: 0, Target: "svc.example.net"},
+		SVCB{Priority: 16, Target: "foo.example.org", Params: []SvcParam{
+			{Key: SvcParamMandatory, Value: []byte{0x00, 0x01}},
+			{Key: SvcParamALPN, Value: []byte("\x02h3")},
+			{Key: SvcParamNoDefaultALPN},
+			{Key: SvcParamECH, Value: []byte{1, 2, 3}},
+			{Key: 667, Value: []byte("hello")},
+		}},
+		HTTPS{SVCB{Priority: 1}},
+	}
+
+	for _, rd := range rdatas {
+		in := Record{Name: []byte("example.com"), Type: rd.Type(), Class: ClassIN, TTL: 300, RData: rd}
+		b, err := in.MarshalBinary()
+		if err != nil {
+			t.Errorf("%s: error: %v", rd, err)
+			continue
+		}
+		got, err := DecodeRecord(bytes.NewReader(b))
+		if err != nil {
+			t.Errorf("%s: DecodeRecord: %v", rd, err)
+			continue
+		}
+		if diff := cmp.Diff(rd, got.RData, cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("%s: mismatch (-want, +got):\n%s", rd, diff)
+		}
+	}
+
+	want := `16 foo.example.org. mandatory=alpn alpn=h3 no-default-alpn ech=AQID key667="hello"`
+	if s := rdatas[1].String(); s != want {
+		t.Errorf("String: got %q, want %q", s, want)
+	}
+}
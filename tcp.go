@@ -0,0 +1,95 @@
+package resolve
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+)
+
+// WriteQueryTCP writes a DNS message to w with the 2-byte length prefix used
+// by stream transports such as TCP (RFC 1035, section 4.2.2).
+func WriteQueryTCP(w io.Writer, query []byte) error {
+	if len(query) > math.MaxUint16 {
+		return fmt.Errorf("message too large for tcp: %d bytes", len(query))
+	}
+
+	// Write the prefix and message together so they can share a segment.
+	bp := getBuf(2 + len(query))
+	defer putBuf(bp)
+	b := *bp
+	binary.BigEndian.PutUint16(b, uint16(len(query)))
+	copy(b[2:], query)
+
+	_, err := w.Write(b)
+	return err
+}
+
+// ReadMessageTCP reads a DNS message written by WriteQueryTCP, stripping the
+// length prefix.
+func ReadMessageTCP(r io.Reader) ([]byte, error) {
+	var prefix [2]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, binary.BigEndian.Uint16(prefix[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// exchangeTCP sends query to address over TCP and decodes the response,
+// which must answer query.
+func exchangeTCP(ctx context.Context, address string, query []byte) (*Packet, error) {
+	q, err := ParsePacket(query)
+	if err != nil {
+		return nil, err
+	}
+	b, err := roundTripTCP(ctx, address, query)
+	if err != nil {
+		return nil, err
+	}
+	response, err := ParsePacket(b)
+	if err != nil {
+		return nil, err
+	}
+	if err := matchResponse(q, response, true); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// roundTripTCP sends msg to address over TCP and returns the response.
+func roundTripTCP(ctx context.Context, address string, msg []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	stop := closeOnDone(ctx, conn)
+	defer stop()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := WriteQueryTCP(conn, msg); err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+
+	b, err := ReadMessageTCP(conn)
+	if err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+
+	return b, nil
+}
@@ -0,0 +1,103 @@
+package resolve
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestWriteQueryTCP(t *testing.T) {
+	query, err := NewQuery("example.com", TypeA)
+	if err != nil {
+		t.Fatalf("NewQuery: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteQueryTCP(&buf, query); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	b := buf.Bytes()
+	if want := []byte{0x00, 0x1d}; !bytes.Equal(b[:2], want) {
+		t.Errorf("prefix: got %q, want %q", b[:2], want)
+	}
+	if !bytes.Equal(b[2:], query) {
+		t.Errorf("message: got %q, want %q", b[2:], query)
+	}
+
+	got, err := ReadMessageTCP(&buf)
+	if err != nil {
+		t.Fatalf("ReadMessageTCP: %v", err)
+	}
+	if !bytes.Equal(got, query) {
+		t.Errorf("ReadMessageTCP: got %q, want %q", got, query)
+	}
+}
+
+func TestWriteQueryTCP_TooLarge(t *testing.T) {
+	if err := WriteQueryTCP(io.Discard, make([]byte, 65536)); err == nil {
+		t.Errorf("want error")
+	}
+}
+
+func TestReadMessageTCP_Short(t *testing.T) {
+	if _, err := ReadMessageTCP(bytes.NewReader([]byte("\x00\x05abc"))); err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+// serveTCP starts a DNS server on r's address over TCP, which answers each
+// query with handler's response.
+func serveTCP(t *testing.T, r *Resolver, handler func(query []byte) []byte) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", r.address())
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					query, err := ReadMessageTCP(conn)
+					if err != nil {
+						return
+					}
+					if response := handler(query); response != nil {
+						_ = WriteQueryTCP(conn, response)
+					}
+				}
+			}()
+		}
+	}()
+}
+
+func TestResolver_Lookup_TruncatedFallsBackToTCP(t *testing.T) {
+	addr := netip.MustParseAddr("192.0.2.1")
+	r := serveUDP(t, handle(func(*Packet) *Packet {
+		p := &Packet{}
+		p.Header.Flags.SetTC(true)
+		return p
+	}))
+	serveTCP(t, r, handle(func(query *Packet) *Packet {
+		q := query.Questions[0]
+		return &Packet{Answers: []Record{{Name: q.Name, Type: TypeA, Class: ClassIN, TTL: 60, RData: A{Addr: addr}}}}
+	}))
+
+	got, err := r.Lookup("example.com", TypeA)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if got != addr {
+		t.Errorf("got %s, want %s", got, addr)
+	}
+}
@@ -0,0 +1,653 @@
+package resolve
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// A Protocol is a transport for DNS messages.
+type Protocol int
+
+const (
+	// ProtocolUDP sends queries over UDP, retrying over TCP if a response is
+	// truncated.
+	ProtocolUDP Protocol = iota
+
+	// ProtocolTCP sends queries over a TCP connection, which is kept open
+	// and shared by concurrent queries.
+	ProtocolTCP
+
+	// ProtocolDoT sends queries over TLS (RFC 7858), sharing a connection
+	// like ProtocolTCP.
+	ProtocolDoT
+
+	// ProtocolDoH sends queries over HTTPS (RFC 8484) to Resolver.URL.
+	ProtocolDoH
+
+	// ProtocolDoHJSON sends queries to the JSON API of a DNS over HTTPS
+	// service, such as those of Google Public DNS and Cloudflare, at
+	// Resolver.URL. Only the name, type and the CD and DO bits of a query
+	// are sent.
+	ProtocolDoHJSON
+
+	// ProtocolDoQ sends queries over QUIC (RFC 9250), one stream per
+	// query on a shared connection dialed with Resolver.DialQUIC.
+	ProtocolDoQ
+
+	// ProtocolDNSCrypt sends queries encrypted with DNSCrypt version 2,
+	// over UDP and over TCP if a response is truncated. The resolver's
+	// certificate is fetched from the server and checked against
+	// Resolver.ProviderName and ProviderKey.
+	ProtocolDNSCrypt
+
+	// ProtocolODoH sends queries with Oblivious DoH (RFC 9230): they are
+	// encrypted to the target at Resolver.ODoHTarget and relayed by the
+	// proxy at Resolver.URL, so the proxy can't read them and the target
+	// doesn't learn the client's address.
+	ProtocolODoH
+
+	// ProtocolMDNS sends queries with multicast DNS (RFC 6762) and merges
+	// the responses received within Resolver.MDNSWindow. If Resolver.Server
+	// is set, queries go to it rather than to the multicast groups.
+	ProtocolMDNS
+
+	// ProtocolLLMNR sends queries with Link-Local Multicast Name
+	// Resolution (RFC 4795) and merges the responses received within
+	// Resolver.MDNSWindow. If Resolver.Server is set, queries go to it
+	// rather than to the multicast groups.
+	ProtocolLLMNR
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolUDP:
+		return "udp"
+	case ProtocolTCP:
+		return "tcp"
+	case ProtocolDoT:
+		return "dot"
+	case ProtocolDoH:
+		return "doh"
+	case ProtocolDoHJSON:
+		return "doh-json"
+	case ProtocolDoQ:
+		return "doq"
+	case ProtocolDNSCrypt:
+		return "dnscrypt"
+	case ProtocolODoH:
+		return "odoh"
+	case ProtocolMDNS:
+		return "mdns"
+	case ProtocolLLMNR:
+		return "llmnr"
+	default:
+		return fmt.Sprintf("Protocol(%d)", int(p))
+	}
+}
+
+// exchange sends query to the upstream server using r.Protocol and decodes
+// the response, which must answer query. If an attempt fails, such as when a
+// UDP packet is lost, the query is sent again after a backoff, up to
+// r.Attempts times in all, unless the retry budget of a batch in ctx is
+// spent. The multicast protocols, which collect responses for a while and
+// check them themselves, make only one attempt.
+func (r *Resolver) exchange(ctx context.Context, query []byte) (*Packet, error) {
+	if r.Exchanger == nil && (r.Protocol == ProtocolMDNS || r.Protocol == ProtocolLLMNR) {
+		return r.exchangeOnce(ctx, query)
+	}
+	q, err := ParsePacket(query)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < r.attempts(); i++ {
+		if i > 0 {
+			if !takeRetry(ctx) {
+				return nil, err
+			}
+			t := time.NewTimer(r.backoff(i))
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return nil, ctx.Err()
+			}
+			if r.OnRetransmit != nil {
+				server := ""
+				if r.Exchanger == nil {
+					server = r.address()
+				}
+				r.OnRetransmit(i+1, server)
+			}
+		}
+
+		actx, cancel := context.WithTimeout(ctx, r.attemptTimeout())
+		var response *Packet
+		response, err = r.exchangeOnce(actx, query)
+		cancel()
+		if err == nil {
+			if err = r.checkResponse(q, response); err != nil {
+				response = nil
+			}
+		}
+		if err == nil || ctx.Err() != nil {
+			return response, err
+		}
+	}
+	return nil, err
+}
+
+// ErrResponseMismatch is returned when a response doesn't answer the query
+// that was sent: it isn't a response, or its ID or question differs.
+var ErrResponseMismatch = errors.New("response does not match query")
+
+// checkResponse checks that response answers query, as sent with r's
+// Exchanger or Protocol. The protocols over HTTPS and QUIC send queries
+// with ID 0, so the ID isn't compared for them. With CaseRandomization, the
+// question's name must be echoed in the same case.
+func (r *Resolver) checkResponse(query, response *Packet) error {
+	checkID := true
+	if r.Exchanger == nil {
+		switch r.Protocol {
+		case ProtocolDoH, ProtocolDoHJSON, ProtocolDoQ, ProtocolODoH:
+			checkID = false
+		}
+	}
+	if err := matchResponse(query, response, checkID); err != nil {
+		return err
+	}
+	if r.CaseRandomization && !sameCase(query, response) {
+		return ErrResponseMismatch
+	}
+	return nil
+}
+
+// matchResponse returns ErrResponseMismatch unless response answers query:
+// it has the QR bit set, the query's ID if checkID is true, and the same
+// question. A response that reports an error may leave out the question,
+// as some servers do for queries they can't parse.
+func matchResponse(query, response *Packet, checkID bool) error {
+	if !response.Header.Flags.QR() || checkID && response.Header.ID != query.Header.ID {
+		return ErrResponseMismatch
+	}
+	if len(response.Questions) == 0 && response.RCode() != RCodeSuccess {
+		return nil
+	}
+	if len(response.Questions) != len(query.Questions) {
+		return ErrResponseMismatch
+	}
+	for i, q := range query.Questions {
+		rq := response.Questions[i]
+		if rq.Type != q.Type || rq.Class != q.Class || !equalNames(string(rq.Name), string(q.Name)) {
+			return ErrResponseMismatch
+		}
+	}
+	return nil
+}
+
+func (r *Resolver) attempts() int {
+	if r.Attempts <= 0 {
+		return DefaultAttempts
+	}
+	return r.Attempts
+}
+
+func (r *Resolver) attemptTimeout() time.Duration {
+	if r.AttemptTimeout == 0 {
+		return r.timeout() / time.Duration(r.attempts())
+	}
+	return r.AttemptTimeout
+}
+
+// maxBackoff caps the delay between attempts.
+const maxBackoff = 2 * time.Second
+
+// backoff returns how long to wait before attempt i, counting from 0: r's
+// Backoff, doubled for each attempt after the second and capped at
+// maxBackoff, less a random jitter of up to half of it so that clients that
+// failed together don't retry together.
+func (r *Resolver) backoff(i int) time.Duration {
+	d := r.Backoff
+	if d == 0 {
+		d = DefaultBackoff
+	}
+	for ; i > 1 && d < maxBackoff; i-- {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d - time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// exchangeOnce sends query to the upstream server using r.Exchanger or
+// r.Protocol and decodes the response.
+func (r *Resolver) exchangeOnce(ctx context.Context, query []byte) (*Packet, error) {
+	if r.Exchanger != nil {
+		q, err := ParsePacket(query)
+		if err != nil {
+			return nil, err
+		}
+		return r.Exchanger.Exchange(ctx, q)
+	}
+
+	switch r.Protocol {
+	case ProtocolUDP:
+		return exchange(ctx, r.address(), query, r.udpSize(), r.CaseRandomization)
+	case ProtocolTCP:
+		return r.exchangeStream(ctx, query, func(ctx context.Context) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", r.address())
+		})
+	case ProtocolDoT:
+		return r.exchangeStream(ctx, query, func(ctx context.Context) (net.Conn, error) {
+			d := tls.Dialer{Config: r.tlsConfig()}
+			return d.DialContext(ctx, "tcp", r.address())
+		})
+	case ProtocolDoH:
+		return r.exchangeDoH(ctx, query)
+	case ProtocolDoHJSON:
+		return r.exchangeDoHJSON(ctx, query)
+	case ProtocolDoQ:
+		return r.exchangeDoQ(ctx, query)
+	case ProtocolDNSCrypt:
+		return r.exchangeDNSCrypt(ctx, query)
+	case ProtocolODoH:
+		return r.exchangeODoH(ctx, query)
+	case ProtocolMDNS:
+		return r.exchangeMDNS(ctx, query)
+	case ProtocolLLMNR:
+		return r.exchangeLLMNR(ctx, query)
+	default:
+		return nil, fmt.Errorf("unknown protocol %s", r.Protocol)
+	}
+}
+
+// defaultPort returns the port servers listen on for p.
+func (p Protocol) defaultPort() int {
+	switch p {
+	case ProtocolDoT, ProtocolDoQ:
+		return DefaultDoTPort
+	case ProtocolDNSCrypt:
+		return DefaultDNSCryptPort
+	case ProtocolMDNS:
+		return MDNSPort
+	case ProtocolLLMNR:
+		return LLMNRPort
+	default:
+		return DefaultPort
+	}
+}
+
+// tlsConfig returns the TLS configuration for connections to the upstream
+// server.
+func (r *Resolver) tlsConfig() *tls.Config {
+	c := &tls.Config{}
+	if r.TLSConfig != nil {
+		c = r.TLSConfig.Clone()
+	}
+	if c.ServerName == "" {
+		c.ServerName = r.ServerName
+	}
+	if c.ServerName == "" {
+		c.ServerName = r.server()
+	}
+
+	if len(r.SPKIPins) > 0 {
+		// The pins replace the usual verification against trusted roots.
+		c.InsecureSkipVerify = true
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifySPKIPins(cs.PeerCertificates, r.SPKIPins)
+		}
+	}
+	return c
+}
+
+// verifySPKIPins checks that a certificate in chain has the SHA-256 hash of
+// its SubjectPublicKeyInfo in pins (RFC 7858, section 4.2).
+func verifySPKIPins(chain []*x509.Certificate, pins [][]byte) error {
+	for _, cert := range chain {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(sum[:], pin) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no certificate matches the spki pins")
+}
+
+// exchangeStream sends query over r's shared stream connection, dialing a
+// new one with dial if there is none or the old one has failed. If a reused
+// connection fails, the query is retried once on a new connection, since
+// servers may close idle connections at any time.
+func (r *Resolver) exchangeStream(ctx context.Context, query []byte, dial func(context.Context) (net.Conn, error)) (*Packet, error) {
+	for retried := false; ; retried = true {
+		sc, fresh, err := r.streamConn(ctx, dial)
+		if err != nil {
+			return nil, err
+		}
+		response, err := sc.exchange(ctx, query)
+		sc.touch(r.now())
+		if err != nil {
+			if !fresh && !retried && ctx.Err() == nil && sc.failed() {
+				continue
+			}
+			return nil, err
+		}
+		return response, nil
+	}
+}
+
+// A connDial is a dial of r's shared stream connection in progress, which
+// concurrent queries wait for rather than dialing their own.
+type connDial struct {
+	done     chan struct{} // Closed when the dial is done.
+	conn     *streamConn
+	err      error
+	canceled bool // The context of the dial was done.
+	closed   bool // r was closed during the dial.
+}
+
+// streamConn returns r's shared stream connection, dialing a new one if
+// needed. fresh reports whether the connection was just dialed by this
+// call. The dial is shared by concurrent callers, and r.mu isn't held
+// during it, so a slow handshake doesn't hold up the rest of r. If the dial
+// is abandoned because the context of the caller that started it is done,
+// the others start another.
+func (r *Resolver) streamConn(ctx context.Context, dial func(context.Context) (net.Conn, error)) (sc *streamConn, fresh bool, err error) {
+	for {
+		r.mu.Lock()
+		if r.conn != nil && !r.conn.failed() {
+			sc = r.conn
+			r.mu.Unlock()
+			return sc, false, nil
+		}
+		d := r.connDial
+		if d == nil {
+			break // Still holding r.mu.
+		}
+		r.mu.Unlock()
+
+		select {
+		case <-d.done:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+		if d.canceled && ctx.Err() == nil {
+			continue
+		}
+		return d.conn, false, d.err
+	}
+
+	d := &connDial{done: make(chan struct{})}
+	r.connDial = d
+	r.mu.Unlock()
+
+	conn, err := dial(ctx)
+	d.canceled = ctx.Err() != nil
+
+	r.mu.Lock()
+	switch {
+	case err != nil:
+		d.err = err
+	case d.closed:
+		conn.Close()
+		d.err = net.ErrClosed
+	default:
+		if r.conn != nil && r.conn.idle != nil {
+			r.conn.idle.Stop()
+		}
+		d.conn = newStreamConn(conn)
+		r.conn = d.conn
+		if r.IdleTimeout > 0 {
+			c := d.conn
+			c.touch(r.now())
+			c.idle = time.AfterFunc(r.IdleTimeout, func() { r.reapIdle(c) })
+		}
+	}
+	r.connDial = nil
+	r.mu.Unlock()
+	close(d.done)
+
+	return d.conn, d.err == nil, d.err
+}
+
+// reapIdle closes sc if it is still r's shared stream connection and has
+// gone unused for r.IdleTimeout, and otherwise checks again once it could
+// have.
+func (r *Resolver) reapIdle(sc *streamConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.conn != sc {
+		return
+	}
+	wait := r.IdleTimeout
+	if used, busy := sc.lastUsed(); !busy {
+		idle := r.now().Sub(used)
+		if idle >= r.IdleTimeout {
+			sc.close()
+			r.conn = nil
+			return
+		}
+		wait -= idle
+	}
+	sc.idle.Reset(wait)
+}
+
+// Close closes the connection kept open by a stream-based Protocol or
+// ProtocolDoQ, if any, and those of r's Upstreams and Routes. It also stops
+// the Prefetch queries in progress, and returns once they are done. The
+// Resolver stays usable and opens a new connection when needed, and
+// closing it again does nothing more.
+func (r *Resolver) Close() error {
+	r.stopPrefetches()
+
+	var err error
+	for _, u := range r.Upstreams {
+		if uerr := u.Close(); err == nil {
+			err = uerr
+		}
+	}
+	for _, u := range r.Routes {
+		if uerr := u.Close(); err == nil {
+			err = uerr
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.connDial != nil {
+		r.connDial.closed = true
+	}
+	if r.conn != nil {
+		if r.conn.idle != nil {
+			r.conn.idle.Stop()
+		}
+		if cerr := r.conn.close(); err == nil {
+			err = cerr
+		}
+		r.conn = nil
+	}
+	if r.quic != nil {
+		if qerr := r.quic.Close(); err == nil {
+			err = qerr
+		}
+		r.quic = nil
+	}
+	return err
+}
+
+// streamConn carries DNS messages over a TCP or TLS connection. Queries may
+// be pipelined: responses are matched to queries by ID, so they can arrive
+// in any order (RFC 7766, section 6.2.1.1).
+type streamConn struct {
+	conn net.Conn
+
+	writeMu sync.Mutex
+
+	// idle closes the connection once it goes unused for the Resolver's
+	// IdleTimeout. It is guarded by the Resolver's mu.
+	idle *time.Timer
+
+	mu      sync.Mutex
+	pending map[uint16]chan []byte // By query ID.
+	err     error                  // Set once the connection fails.
+	used    time.Time              // When a query last finished.
+}
+
+func newStreamConn(conn net.Conn) *streamConn {
+	sc := &streamConn{conn: conn, pending: make(map[uint16]chan []byte)}
+	go sc.readLoop()
+	return sc
+}
+
+// readLoop delivers responses to waiting queries until the connection
+// fails.
+func (sc *streamConn) readLoop() {
+	for {
+		b, err := ReadMessageTCP(sc.conn)
+		if err == nil && len(b) < 2 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			sc.fail(err)
+			return
+		}
+
+		sc.mu.Lock()
+		ch, ok := sc.pending[binary.BigEndian.Uint16(b)]
+		delete(sc.pending, binary.BigEndian.Uint16(b))
+		sc.mu.Unlock()
+		if ok {
+			ch <- b
+		}
+	}
+}
+
+// fail marks the connection as failed with err, closes it, and wakes all
+// waiting queries.
+func (sc *streamConn) fail(err error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.err == nil {
+		sc.err = err
+	}
+	sc.conn.Close()
+	for id, ch := range sc.pending {
+		close(ch)
+		delete(sc.pending, id)
+	}
+}
+
+// touch records that a query finished at now.
+func (sc *streamConn) touch(now time.Time) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.used = now
+}
+
+// lastUsed returns when a query last finished, and whether any are in
+// flight.
+func (sc *streamConn) lastUsed() (used time.Time, busy bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.used, len(sc.pending) > 0
+}
+
+func (sc *streamConn) failed() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.err != nil
+}
+
+func (sc *streamConn) close() error {
+	sc.fail(net.ErrClosed)
+	return nil
+}
+
+// exchange sends query and waits for the response with the same ID.
+func (sc *streamConn) exchange(ctx context.Context, query []byte) (*Packet, error) {
+	if len(query) < 2 {
+		return nil, fmt.Errorf("query too short: %d bytes", len(query))
+	}
+	id := binary.BigEndian.Uint16(query)
+	ch := make(chan []byte, 1)
+
+	sc.mu.Lock()
+	if sc.err != nil {
+		err := sc.err
+		sc.mu.Unlock()
+		return nil, err
+	}
+	if _, ok := sc.pending[id]; ok {
+		sc.mu.Unlock()
+		return nil, fmt.Errorf("query id %d already in flight", id)
+	}
+	sc.pending[id] = ch
+	sc.mu.Unlock()
+
+	defer func() {
+		sc.mu.Lock()
+		if sc.pending[id] == ch {
+			delete(sc.pending, id)
+		}
+		sc.mu.Unlock()
+	}()
+
+	if err := sc.write(ctx, query); err != nil {
+		sc.fail(err)
+		return nil, ctxErr(ctx, err)
+	}
+
+	select {
+	case b, ok := <-ch:
+		if !ok {
+			sc.mu.Lock()
+			err := sc.err
+			sc.mu.Unlock()
+			return nil, err
+		}
+		return ParsePacket(b)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// write writes query to the connection, giving up when ctx is done. Only
+// the write deadline is touched, since other queries may be reading.
+func (sc *streamConn) write(ctx context.Context, query []byte) error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+
+	deadline, _ := ctx.Deadline() // The zero time if none, clearing any old deadline.
+	if err := sc.conn.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = sc.conn.SetWriteDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	return WriteQueryTCP(sc.conn, query)
+}
@@ -0,0 +1,710 @@
+package resolve
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// serveTCPOnly starts a TCP server on localhost that passes each accepted
+// connection to handler, and returns a Resolver that uses it over TCP.
+func serveTCPOnly(t *testing.T, handler func(conn net.Conn)) *Resolver {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	return serveStream(t, ln, ProtocolTCP, handler)
+}
+
+// serveStream serves connections accepted by ln with handler, and returns a
+// Resolver that uses it with protocol p.
+func serveStream(t *testing.T, ln net.Listener, p Protocol, handler func(conn net.Conn)) *Resolver {
+	t.Helper()
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handler(conn)
+			}()
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	r := &Resolver{Server: addr.IP.String(), Port: addr.Port, Timeout: time.Second, Protocol: p}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// answerA returns the response to query with an A record holding the
+// address in the query's name, such as 192.0.2.1 for "192.0.2.1.test".
+func answerA(query []byte) []byte {
+	return handle(func(q *Packet) *Packet {
+		name := q.Questions[0].Name
+		addr := netip.MustParseAddr(string(bytes.TrimSuffix(name, []byte(".test"))))
+		return &Packet{Answers: []Record{{Name: name, Type: TypeA, Class: ClassIN, TTL: 60, RData: A{Addr: addr}}}}
+	})(query)
+}
+
+func TestResolver_TCP_Pipelined(t *testing.T) {
+	// The server reads two queries before answering them in reverse order,
+	// so both must be sent on the same connection.
+	var (
+		mu    sync.Mutex
+		conns int
+	)
+	r := serveTCPOnly(t, func(conn net.Conn) {
+		mu.Lock()
+		conns++
+		mu.Unlock()
+
+		for {
+			var queries [][]byte
+			for i := 0; i < 2; i++ {
+				q, err := ReadMessageTCP(conn)
+				if err != nil {
+					return
+				}
+				queries = append(queries, q)
+			}
+			for i := len(queries) - 1; i >= 0; i-- {
+				if err := WriteQueryTCP(conn, answerA(queries[i])); err != nil {
+					return
+				}
+			}
+		}
+	})
+
+	var wg sync.WaitGroup
+	for _, s := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"} {
+		s := s
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := r.Lookup(s+".test", TypeA)
+			if err != nil {
+				t.Errorf("%s: error: %v", s, err)
+				return
+			}
+			if got.String() != s {
+				t.Errorf("got %s, want %s", got, s)
+			}
+		}()
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if conns != 1 {
+		t.Errorf("got %d connections, want 1", conns)
+	}
+}
+
+func TestResolver_TCP_Reconnect(t *testing.T) {
+	// The server answers one query per connection, then closes it.
+	r := serveTCPOnly(t, func(conn net.Conn) {
+		q, err := ReadMessageTCP(conn)
+		if err != nil {
+			return
+		}
+		_ = WriteQueryTCP(conn, answerA(q))
+	})
+
+	for _, s := range []string{"192.0.2.1", "192.0.2.2"} {
+		got, err := r.Lookup(s+".test", TypeA)
+		if err != nil {
+			t.Fatalf("%s: error: %v", s, err)
+		}
+		if got.String() != s {
+			t.Errorf("got %s, want %s", got, s)
+		}
+	}
+}
+
+func TestResolver_Close(t *testing.T) {
+	r := serveTCPOnly(t, func(conn net.Conn) {
+		for {
+			q, err := ReadMessageTCP(conn)
+			if err != nil {
+				return
+			}
+			if err := WriteQueryTCP(conn, answerA(q)); err != nil {
+				return
+			}
+		}
+	})
+	if _, err := r.Lookup("192.0.2.1.test", TypeA); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+
+	// Closing again, with no connection left, is fine.
+	for i := 0; i < 2; i++ {
+		if err := r.Close(); err != nil {
+			t.Fatalf("Close %d: %v", i+1, err)
+		}
+		r.mu.Lock()
+		conn := r.conn
+		r.mu.Unlock()
+		if conn != nil {
+			t.Errorf("Close %d: connection kept", i+1)
+		}
+	}
+
+	// The resolver stays usable.
+	if _, err := r.Lookup("192.0.2.2.test", TypeA); err != nil {
+		t.Errorf("after Close: error: %v", err)
+	}
+}
+
+func TestResolver_IdleTimeout(t *testing.T) {
+	r := serveTCPOnly(t, func(conn net.Conn) {
+		for {
+			q, err := ReadMessageTCP(conn)
+			if err != nil {
+				return
+			}
+			if err := WriteQueryTCP(conn, answerA(q)); err != nil {
+				return
+			}
+		}
+	})
+	clock := newFakeClock()
+	r.clock = clock.Now
+	r.IdleTimeout = 10 * time.Millisecond
+
+	conn := func() *streamConn {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.conn
+	}
+
+	if _, err := r.Lookup("192.0.2.1.test", TypeA); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	sc := conn()
+	if sc == nil {
+		t.Fatal("no connection")
+	}
+
+	// Until the clock says the connection has been idle long enough, it
+	// stays open.
+	time.Sleep(5 * r.IdleTimeout)
+	if conn() != sc || sc.failed() {
+		t.Fatal("connection closed before the idle timeout")
+	}
+
+	clock.Advance(r.IdleTimeout)
+	deadline := time.Now().Add(5 * time.Second)
+	for conn() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("idle connection not closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !sc.failed() {
+		t.Error("idle connection cleared but not closed")
+	}
+
+	// The next query opens a new connection.
+	if _, err := r.Lookup("192.0.2.2.test", TypeA); err != nil {
+		t.Fatalf("after idle timeout: error: %v", err)
+	}
+	if c := conn(); c == nil || c == sc {
+		t.Error("no new connection")
+	}
+	r.Close()
+}
+
+func TestResolver_IdleTimeout_Close(t *testing.T) {
+	r := serveTCPOnly(t, func(conn net.Conn) {
+		for {
+			q, err := ReadMessageTCP(conn)
+			if err != nil {
+				return
+			}
+			if err := WriteQueryTCP(conn, answerA(q)); err != nil {
+				return
+			}
+		}
+	})
+	r.IdleTimeout = time.Hour
+
+	if _, err := r.Lookup("192.0.2.1.test", TypeA); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	r.mu.Lock()
+	sc := r.conn
+	r.mu.Unlock()
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if sc.idle.Stop() {
+		t.Error("idle timer still running after Close")
+	}
+}
+
+func TestResolver_StreamConnDial(t *testing.T) {
+	r := new(Resolver)
+	var dials atomic.Int32
+	dialing := make(chan struct{})
+	release := make(chan struct{})
+	client, server := net.Pipe()
+	defer server.Close()
+	dial := func(context.Context) (net.Conn, error) {
+		if dials.Add(1) == 1 {
+			close(dialing)
+		}
+		<-release
+		return client, nil
+	}
+
+	type result struct {
+		sc  *streamConn
+		err error
+	}
+	done := make(chan result, 2)
+	go func() {
+		sc, _, err := r.streamConn(context.Background(), dial)
+		done <- result{sc, err}
+	}()
+	<-dialing
+	go func() {
+		sc, _, err := r.streamConn(context.Background(), dial)
+		done <- result{sc, err}
+	}()
+
+	// A slow dial doesn't hold the resolver's lock.
+	locked := make(chan struct{})
+	go func() {
+		r.mu.Lock()
+		r.mu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("resolver locked while dialing")
+	}
+
+	close(release)
+	r1, r2 := <-done, <-done
+	if r1.err != nil || r2.err != nil {
+		t.Fatalf("errors: %v, %v", r1.err, r2.err)
+	}
+	if r1.sc != r2.sc {
+		t.Error("concurrent callers got different connections")
+	}
+	if n := dials.Load(); n != 1 {
+		t.Errorf("dialed %d times, want 1", n)
+	}
+	r1.sc.close()
+}
+
+func TestResolver_StreamConnDial_Close(t *testing.T) {
+	r := new(Resolver)
+	dialing := make(chan struct{})
+	release := make(chan struct{})
+	client, server := net.Pipe()
+	defer server.Close()
+
+	errc := make(chan error)
+	go func() {
+		_, _, err := r.streamConn(context.Background(), func(context.Context) (net.Conn, error) {
+			close(dialing)
+			<-release
+			return client, nil
+		})
+		errc <- err
+	}()
+	<-dialing
+
+	// Close doesn't wait for the dial, and the connection it makes is
+	// closed rather than kept.
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	close(release)
+	if err := <-errc; !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got error %v, want %v", err, net.ErrClosed)
+	}
+	if _, err := client.Write([]byte{0}); err == nil {
+		t.Error("connection not closed")
+	}
+	r.mu.Lock()
+	conn := r.conn
+	r.mu.Unlock()
+	if conn != nil {
+		t.Error("connection kept")
+	}
+}
+
+// serveDoT starts a DNS-over-TLS server on localhost with a certificate for
+// www.example.com, and returns a Resolver that uses it with no TLS settings,
+// along with the certificates.
+func serveDoT(t *testing.T) (r *Resolver, leaf, ca *x509.Certificate) {
+	t.Helper()
+
+	leaf, ca, cert := testChain(t)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	r = serveStream(t, ln, ProtocolDoT, func(conn net.Conn) {
+		for {
+			q, err := ReadMessageTCP(conn)
+			if err != nil {
+				return
+			}
+			if err := WriteQueryTCP(conn, answerA(q)); err != nil {
+				return
+			}
+		}
+	})
+	return r, leaf, ca
+}
+
+func TestResolver_DoT(t *testing.T) {
+	r, _, ca := serveDoT(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	r.TLSConfig = &tls.Config{RootCAs: roots}
+	r.ServerName = "www.example.com"
+
+	got, err := r.Lookup("192.0.2.1.test", TypeA)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if want := netip.MustParseAddr("192.0.2.1"); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestResolver_DoT_WrongServerName(t *testing.T) {
+	r, _, ca := serveDoT(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	r.TLSConfig = &tls.Config{RootCAs: roots}
+	r.ServerName = "dns.example.net"
+
+	var certErr x509.HostnameError
+	if _, err := r.Lookup("192.0.2.1.test", TypeA); !errors.As(err, &certErr) {
+		t.Errorf("got %v, want a hostname error", err)
+	}
+}
+
+func TestResolver_DoT_SPKIPins(t *testing.T) {
+	r, leaf, ca := serveDoT(t)
+	caPin := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+	leafPin := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+
+	// Pinning either certificate is enough, without trusting the CA or
+	// matching the name.
+	for _, pin := range [][32]byte{caPin, leafPin} {
+		r.Close()
+		r.SPKIPins = [][]byte{pin[:]}
+		if _, err := r.Lookup("192.0.2.1.test", TypeA); err != nil {
+			t.Errorf("pin %x: error: %v", pin, err)
+		}
+	}
+
+	r.Close()
+	r.SPKIPins = [][]byte{make([]byte, 32)}
+	if _, err := r.Lookup("192.0.2.1.test", TypeA); err == nil {
+		t.Error("wrong pin: want error")
+	}
+}
+
+func TestResolver_Retry(t *testing.T) {
+	var queries atomic.Int32
+	r := serveUDP(t, handle(func(q *Packet) *Packet {
+		if queries.Add(1) == 1 {
+			return nil // Lost.
+		}
+		return &Packet{Answers: []Record{a("www.example", "192.0.2.1")}}
+	}))
+	r.Attempts = 3
+	r.AttemptTimeout = 100 * time.Millisecond
+	r.Backoff = 10 * time.Millisecond
+
+	if _, err := r.Lookup("www.example", TypeA); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("%d attempts, want 2", n)
+	}
+
+	r.Attempts = 1
+	queries.Store(0)
+	if _, err := r.Lookup("www.example", TypeA); err == nil {
+		t.Error("no error with one attempt")
+	}
+}
+
+func TestResolver_Backoff(t *testing.T) {
+	r := &Resolver{Backoff: 100 * time.Millisecond}
+	for i, max := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, 1600 * time.Millisecond, maxBackoff, maxBackoff} {
+		for n := 0; n < 100; n++ {
+			if d := r.backoff(i + 1); d < max/2 || d > max {
+				t.Fatalf("backoff(%d) = %v, want within [%v, %v]", i+1, d, max/2, max)
+			}
+		}
+	}
+}
+
+func TestResolver_Exchange_CanceledDuringBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := &Resolver{
+		Attempts: 2,
+		Backoff:  time.Hour,
+		Exchanger: ExchangerFunc(func(context.Context, *Packet) (*Packet, error) {
+			time.AfterFunc(10*time.Millisecond, cancel)
+			return nil, errors.New("attempt failed")
+		}),
+	}
+
+	query, err := r.newQuery("www.example", TypeA, ClassIN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.exchange(ctx, query); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestResolver_OnRetransmit(t *testing.T) {
+	// The first two queries are lost.
+	var sent atomic.Int32
+	var retransmits []int
+	r := &Resolver{
+		Attempts:       4,
+		AttemptTimeout: 20 * time.Millisecond,
+		Backoff:        time.Millisecond,
+		Exchanger: ExchangerFunc(func(ctx context.Context, query *Packet) (*Packet, error) {
+			if sent.Add(1) <= 2 {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			p := &Packet{Header: query.Header, Questions: query.Questions, Answers: []Record{a("www.example", "192.0.2.1")}}
+			p.Header.Flags.SetQR(true)
+			return p, nil
+		}),
+		OnRetransmit: func(attempt int, server string) {
+			if server != "" {
+				t.Errorf("attempt %d: server %q with an Exchanger", attempt, server)
+			}
+			retransmits = append(retransmits, attempt)
+		},
+	}
+
+	if _, err := r.Lookup("www.example", TypeA); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if n := sent.Load(); n != 3 {
+		t.Errorf("%d attempts, want 3", n)
+	}
+	if want := []int{2, 3}; !cmp.Equal(want, retransmits) {
+		t.Errorf("retransmits %v, want %v", retransmits, want)
+	}
+}
+
+func TestResolver_OnRetransmit_Server(t *testing.T) {
+	var queries atomic.Int32
+	r := serveUDP(t, handle(func(q *Packet) *Packet {
+		if queries.Add(1) == 1 {
+			return nil // Lost.
+		}
+		return &Packet{Answers: []Record{a("www.example", "192.0.2.1")}}
+	}))
+	r.AttemptTimeout = 100 * time.Millisecond
+	r.Backoff = time.Millisecond
+	var servers []string
+	r.OnRetransmit = func(attempt int, server string) { servers = append(servers, server) }
+
+	if _, err := r.Lookup("www.example", TypeA); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if want := []string{r.address()}; !cmp.Equal(want, servers) {
+		t.Errorf("servers %v, want %v", servers, want)
+	}
+}
+
+func TestResolver_SpoofedResponsesIgnored(t *testing.T) {
+	// Before the real response, the server sends one with the wrong ID and
+	// one for another name, as an off-path attacker might.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query, err := ParsePacket(buf[:n])
+			if err != nil {
+				continue
+			}
+			send := func(id uint16, name, answer string) {
+				p := &Packet{Header: Header{ID: id}, Questions: []Question{{Name: []byte(name), Type: TypeA, Class: ClassIN}}}
+				p.Header.Flags.SetQR(true)
+				p.Answers = []Record{a(name, answer)}
+				b, _ := p.MarshalBinary()
+				_, _ = conn.WriteTo(b, addr)
+			}
+			send(query.Header.ID+1, "www.example", "203.0.113.1")
+			send(query.Header.ID, "evil.example", "203.0.113.2")
+			send(query.Header.ID, "www.example", "192.0.2.1")
+		}
+	}()
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	r := &Resolver{Server: addr.IP.String(), Port: addr.Port, Timeout: time.Second}
+
+	got, err := r.Lookup("www.example", TypeA)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if want := netip.MustParseAddr("192.0.2.1"); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestResolver_ResponseMismatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(p *Packet)
+	}{
+		{"not a response", func(p *Packet) { p.Header.Flags.SetQR(false) }},
+		{"wrong ID", func(p *Packet) { p.Header.ID++ }},
+		{"wrong name", func(p *Packet) { p.Questions[0].Name = []byte("evil.example") }},
+		{"wrong type", func(p *Packet) { p.Questions[0].Type = TypeAAAA }},
+		{"no question", func(p *Packet) { p.Questions = nil }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Resolver{Attempts: 1, Exchanger: ExchangerFunc(func(ctx context.Context, query *Packet) (*Packet, error) {
+				p := &Packet{Header: query.Header, Questions: append([]Question(nil), query.Questions...)}
+				p.Header.Flags.SetQR(true)
+				tt.change(p)
+				return p, nil
+			})}
+			if _, err := r.Query("www.example", TypeA); !errors.Is(err, ErrResponseMismatch) {
+				t.Errorf("got %v, want %v", err, ErrResponseMismatch)
+			}
+		})
+	}
+}
+
+func TestResolver_ResponseFromOtherAddressIgnored(t *testing.T) {
+	// A second socket answers first, with a response that is right in all
+	// but where it comes from.
+	listen := func() net.PacketConn {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("ListenPacket: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	server, spoofer := listen(), listen()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, client, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query, err := ParsePacket(buf[:n])
+			if err != nil {
+				continue
+			}
+			respond := func(conn net.PacketConn, addr string) {
+				p := &Packet{Header: Header{ID: query.Header.ID}, Questions: query.Questions, Answers: []Record{a("www.example", addr)}}
+				p.Header.Flags.SetQR(true)
+				b, _ := p.MarshalBinary()
+				_, _ = conn.WriteTo(b, client)
+			}
+			respond(spoofer, "203.0.113.1")
+			time.Sleep(10 * time.Millisecond)
+			respond(server, "192.0.2.1")
+		}
+	}()
+	addr := server.LocalAddr().(*net.UDPAddr)
+	r := &Resolver{Server: addr.IP.String(), Port: addr.Port, Timeout: time.Second}
+
+	got, err := r.Lookup("www.example", TypeA)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if want := netip.MustParseAddr("192.0.2.1"); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestResolver_RandomSourcePorts(t *testing.T) {
+	ports := make(map[int]bool)
+	var mu sync.Mutex
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, client, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			ports[client.(*net.UDPAddr).Port] = true
+			mu.Unlock()
+			if response := handle(func(*Packet) *Packet {
+				return &Packet{Answers: []Record{a("www.example", "192.0.2.1")}}
+			})(buf[:n]); response != nil {
+				_, _ = conn.WriteTo(response, client)
+			}
+		}
+	}()
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	r := &Resolver{Server: addr.IP.String(), Port: addr.Port, Timeout: time.Second}
+
+	const queries = 10
+	for i := 0; i < queries; i++ {
+		if _, err := r.Lookup("www.example", TypeA); err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ports) < queries-1 {
+		t.Errorf("%d queries came from only %d ports", queries, len(ports))
+	}
+	for port := range ports {
+		if port < minRandomPort {
+			t.Errorf("query from port %d, below %d", port, minRandomPort)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package resolve
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+)
+
+// UpstreamStats describes how an upstream in Resolver.Upstreams has been
+// doing.
+type UpstreamStats struct {
+	Queries int // Queries sent to the upstream.
+	Errors  int // Queries that failed or were answered with SERVFAIL.
+
+	// RTT is the smoothed round-trip time of the successful queries, and
+	// ErrorRate the smoothed fraction of queries that failed, from 0 to 1.
+	// Recent queries count for more.
+	RTT       time.Duration
+	ErrorRate float64
+
+	LastUsed time.Time // When the upstream was last sent a query.
+}
+
+// healthy reports whether the upstream's queries mostly succeed.
+func (s *UpstreamStats) healthy() bool {
+	return s.ErrorRate < maxErrorRate
+}
+
+// record adds the outcome of a query that took rtt to s.
+func (s *UpstreamStats) record(rtt time.Duration, failed bool) {
+	sample := 0.0
+	if failed {
+		s.Errors++
+		sample = 1
+	}
+	s.Queries++
+	if s.Queries == 1 {
+		s.ErrorRate = sample
+	} else {
+		s.ErrorRate += (sample - s.ErrorRate) / smoothing
+	}
+	if failed {
+		return
+	}
+	if s.RTT == 0 {
+		s.RTT = rtt
+	} else {
+		s.RTT += (rtt - s.RTT) / smoothing
+	}
+}
+
+const (
+	// smoothing is how many samples it takes for UpstreamStats to mostly
+	// reflect a change, as in TCP's RTT estimate (RFC 6298).
+	smoothing = 8
+
+	// maxErrorRate is the ErrorRate at which an upstream is no longer
+	// preferred by PreferFastest.
+	maxErrorRate = 0.5
+
+	// probeInterval is how long PreferFastest goes without sending a query
+	// to an upstream before it sends one anyway, to see if it got faster
+	// or recovered.
+	probeInterval = 30 * time.Second
+)
+
+// UpstreamStats returns statistics for each of r.Upstreams, in order.
+func (r *Resolver) UpstreamStats() []UpstreamStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats := make([]UpstreamStats, len(r.Upstreams))
+	for i, u := range r.Upstreams {
+		if s := r.stats[u]; s != nil {
+			stats[i] = *s
+		}
+	}
+	return stats
+}
+
+// upstreamStats returns the statistics for u. r.mu must be held.
+func (r *Resolver) upstreamStats(u *Resolver) *UpstreamStats {
+	if r.stats == nil {
+		r.stats = make(map[*Resolver]*UpstreamStats)
+	}
+	s := r.stats[u]
+	if s == nil {
+		s = &UpstreamStats{}
+		r.stats[u] = s
+	}
+	return s
+}
+
+// upstreamOrder returns r.Upstreams in the order to try them: as they are,
+// or starting at the next one with r.Rotate. With r.PreferFastest, healthy
+// upstreams come first, fastest first, and ones not yet tried count as
+// fastest. Except that the upstream least recently tried comes first if it
+// hasn't been tried in probeInterval, so that a slow or failing upstream is
+// noticed when it gets better.
+func (r *Resolver) upstreamOrder() []*Resolver {
+	n := len(r.Upstreams)
+	start := 0
+	if r.Rotate {
+		start = int((r.rotation.Add(1) - 1) % uint32(n))
+	}
+	order := make([]*Resolver, n)
+	for i := range order {
+		order[i] = r.Upstreams[(start+i)%n]
+	}
+	if !r.PreferFastest {
+		return order
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := r.upstreamStats(order[i]), r.upstreamStats(order[j])
+		if a.healthy() != b.healthy() {
+			return a.healthy()
+		}
+		return a.RTT < b.RTT
+	})
+
+	now := r.now()
+	probe := 0
+	for i, u := range order[1:] {
+		s := r.upstreamStats(u)
+		if now.Sub(s.LastUsed) < probeInterval {
+			continue
+		}
+		if probe == 0 || s.LastUsed.Before(r.upstreamStats(order[probe]).LastUsed) {
+			probe = i + 1
+		}
+	}
+	if probe > 0 {
+		u := order[probe]
+		copy(order[1:probe+1], order[:probe])
+		order[0] = u
+		// Other queries shouldn't probe it too.
+		r.upstreamStats(u).LastUsed = now
+	}
+	return order
+}
+
+// queryUpstreams sends a query for domain, t and class to r.Upstreams in
+// turn, until one answers without SERVFAIL. Each upstream gets an even
+// share of the time left, so that one that doesn't answer leaves time for
+// the others. If none answers, the last response or error is returned.
+func (r *Resolver) queryUpstreams(ctx context.Context, domain string, t Type, class Class) (*Packet, error) {
+	order := r.upstreamOrder()
+
+	var (
+		response *Packet
+		err      error
+	)
+	for i, u := range order {
+		uctx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok && i < len(order)-1 {
+			uctx, cancel = context.WithTimeout(ctx, time.Until(deadline)/time.Duration(len(order)-i))
+		}
+		start := time.Now()
+		response, err = u.query(uctx, domain, t, class)
+		rtt := time.Since(start)
+		cancel()
+
+		failed := err != nil || response.RCode() == RCodeServerFailure
+		if ctx.Err() != nil {
+			// The upstream isn't to blame.
+			break
+		}
+		r.mu.Lock()
+		s := r.upstreamStats(u)
+		s.record(rtt, failed)
+		s.LastUsed = r.now()
+		r.mu.Unlock()
+
+		if !failed {
+			return response, nil
+		}
+	}
+	return response, err
+}
+
+// route returns the resolver in r.Routes for the longest domain that holds
+// domain, or nil if there is none.
+func (r *Resolver) route(domain string) *Resolver {
+	var (
+		best    *Resolver
+		longest = -1
+	)
+	for suffix, u := range r.Routes {
+		suffix = strings.TrimSuffix(suffix, ".")
+		if len(suffix) > longest && inDomain(domain, suffix) {
+			best, longest = u, len(suffix)
+		}
+	}
+	return best
+}
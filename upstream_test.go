@@ -0,0 +1,206 @@
+package resolve
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResolver_UpstreamFailover(t *testing.T) {
+	failing := serveUDP(t, handle(func(q *Packet) *Packet {
+		p := &Packet{}
+		p.Header.Flags.SetRCode(RCodeServerFailure)
+		return p
+	}))
+	silent := serveUDP(t, handle(func(q *Packet) *Packet { return nil }))
+	silent.Attempts = 1
+	working := serveUDP(t, handle(func(q *Packet) *Packet {
+		return &Packet{Answers: []Record{a("www.example", "192.0.2.1")}}
+	}))
+
+	r := &Resolver{Upstreams: []*Resolver{failing, silent, working}, Timeout: 3 * time.Second}
+	p, err := r.Query("www.example", TypeA)
+	if err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if len(p.Answers) != 1 {
+		t.Errorf("got %d answers, want 1", len(p.Answers))
+	}
+
+	r.Upstreams = []*Resolver{working, failing}
+	if _, err := r.Query("www.example", TypeA); err != nil {
+		t.Errorf("error with first upstream working: %v", err)
+	}
+
+	r.Upstreams = []*Resolver{failing}
+	p, err = r.Query("www.example", TypeA)
+	if err != nil {
+		t.Fatalf("error with only failing upstream: %v", err)
+	}
+	if rc := p.RCode(); rc != RCodeServerFailure {
+		t.Errorf("got %v, want %v", rc, RCodeServerFailure)
+	}
+}
+
+func TestResolver_UpstreamRotate(t *testing.T) {
+	var upstreams []*Resolver
+	for _, addr := range []string{"192.0.2.1", "192.0.2.2"} {
+		addr := addr
+		upstreams = append(upstreams, serveUDP(t, handle(func(q *Packet) *Packet {
+			return &Packet{Answers: []Record{a("www.example", addr)}}
+		})))
+	}
+
+	first := func(r *Resolver) string {
+		t.Helper()
+		p, err := r.Query("www.example", TypeA)
+		if err != nil {
+			t.Fatalf("error: %v", err)
+		}
+		return p.Answers[0].RData.String()
+	}
+
+	r := &Resolver{Upstreams: upstreams}
+	for i := 0; i < 3; i++ {
+		if got := first(r); got != "192.0.2.1" {
+			t.Errorf("without Rotate, query %d answered by %s", i, got)
+		}
+	}
+
+	r.Rotate = true
+	for i, want := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.1"} {
+		if got := first(r); got != want {
+			t.Errorf("with Rotate, query %d answered by %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestResolver_PreferFastest(t *testing.T) {
+	var slowQueries, fastQueries atomic.Int32
+	slow := serveUDP(t, handle(func(q *Packet) *Packet {
+		slowQueries.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		return &Packet{Answers: []Record{a("www.example", "192.0.2.1")}}
+	}))
+	fast := serveUDP(t, handle(func(q *Packet) *Packet {
+		fastQueries.Add(1)
+		return &Packet{Answers: []Record{a("www.example", "192.0.2.2")}}
+	}))
+	clock := newFakeClock()
+	r := &Resolver{Upstreams: []*Resolver{slow, fast}, PreferFastest: true, clock: clock.Now}
+
+	// Both are tried once before the fastest is settled on.
+	for i := 0; i < 5; i++ {
+		if _, err := r.Query("www.example", TypeA); err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	}
+	if s, f := slowQueries.Load(), fastQueries.Load(); s != 1 || f != 4 {
+		t.Errorf("slow got %d queries, fast got %d; want 1 and 4", s, f)
+	}
+
+	// Slow is probed again after a while.
+	clock.Advance(probeInterval)
+	if _, err := r.Query("www.example", TypeA); err != nil {
+		t.Fatalf("error: %v", err)
+	}
+	if s := slowQueries.Load(); s != 2 {
+		t.Errorf("slow got %d queries after probe interval, want 2", s)
+	}
+
+	stats := r.UpstreamStats()
+	if len(stats) != 2 {
+		t.Fatalf("got stats for %d upstreams, want 2", len(stats))
+	}
+	if stats[0].Queries != 2 || stats[1].Queries != 4 {
+		t.Errorf("got %d and %d queries, want 2 and 4", stats[0].Queries, stats[1].Queries)
+	}
+	if stats[0].RTT <= stats[1].RTT {
+		t.Errorf("slow RTT %v not above fast RTT %v", stats[0].RTT, stats[1].RTT)
+	}
+	if !stats[0].LastUsed.Equal(clock.Now()) {
+		t.Errorf("slow last used at %v, want %v", stats[0].LastUsed, clock.Now())
+	}
+}
+
+func TestResolver_PreferFastestAvoidsFailing(t *testing.T) {
+	failing := serveUDP(t, handle(func(q *Packet) *Packet {
+		p := &Packet{}
+		p.Header.Flags.SetRCode(RCodeServerFailure)
+		return p
+	}))
+	working := serveUDP(t, handle(func(q *Packet) *Packet {
+		time.Sleep(10 * time.Millisecond)
+		return &Packet{Answers: []Record{a("www.example", "192.0.2.1")}}
+	}))
+	r := &Resolver{Upstreams: []*Resolver{failing, working}, PreferFastest: true, clock: newFakeClock().Now}
+
+	for i := 0; i < 3; i++ {
+		if _, err := r.Query("www.example", TypeA); err != nil {
+			t.Fatalf("error: %v", err)
+		}
+	}
+	stats := r.UpstreamStats()
+	if stats[0].Queries != 1 || stats[0].Errors != 1 || stats[0].ErrorRate != 1 {
+		t.Errorf("failing upstream stats = %+v, want 1 query that failed", stats[0])
+	}
+	if stats[1].Queries != 3 || stats[1].Errors != 0 {
+		t.Errorf("working upstream stats = %+v, want 3 queries that succeeded", stats[1])
+	}
+}
+
+func TestUpstreamStats_record(t *testing.T) {
+	var s UpstreamStats
+	s.record(80*time.Millisecond, false)
+	s.record(0, true)
+	s.record(160*time.Millisecond, false)
+
+	want := UpstreamStats{
+		Queries:   3,
+		Errors:    1,
+		RTT:       90 * time.Millisecond,
+		ErrorRate: 0.109375, // 1/8, then 7/8 of that.
+	}
+	if s != want {
+		t.Errorf("got %+v, want %+v", s, want)
+	}
+}
+
+func TestResolver_Routes(t *testing.T) {
+	server := func(addr string) *Resolver {
+		return serveUDP(t, handle(func(q *Packet) *Packet {
+			return &Packet{Answers: []Record{a(string(q.Questions[0].Name), addr)}}
+		}))
+	}
+	r := server("192.0.2.1")
+	r.Routes = map[string]*Resolver{
+		"corp.example":      server("192.0.2.2"),
+		"lab.corp.example.": server("192.0.2.3"),
+		"ARPA":              server("192.0.2.4"),
+	}
+
+	for _, tt := range []struct {
+		domain, want string
+	}{
+		{"www.example", "192.0.2.1"},
+		{"corp.example", "192.0.2.2"},
+		{"www.corp.example.", "192.0.2.2"},
+		{"www.lab.corp.example", "192.0.2.3"},
+		{"notcorp.example", "192.0.2.1"},
+		{"1.2.0.192.in-addr.arpa", "192.0.2.4"},
+	} {
+		got, err := r.Lookup(tt.domain, TypeA)
+		if err != nil {
+			t.Errorf("%s: error: %v", tt.domain, err)
+			continue
+		}
+		if got.String() != tt.want {
+			t.Errorf("%s: got %v, want %s", tt.domain, got, tt.want)
+		}
+	}
+
+	r.Routes["."] = server("192.0.2.5")
+	if got, err := r.Lookup("www.example", TypeA); err != nil || got.String() != "192.0.2.5" {
+		t.Errorf("with default route: got %v, %v; want 192.0.2.5", got, err)
+	}
+}